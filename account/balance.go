@@ -18,6 +18,7 @@ import (
 	"bufio"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -47,18 +48,23 @@ var (
 
 func init() {
 	balance = cmap.New[float64]()
-	if tmpNum, err := strconv.ParseFloat(config.Config.Gasfee, 64); err == nil {
+	logger.Debug().Int("a", A).Msg("In balance init() !")
+}
+
+// Initializes the account package with the given configuration, from which it takes the gas fee charged per transaction.
+// Cannot be part of the init() function, as the configuration file is not yet loaded when init() is executed.
+func Init(c *config.Configuration) {
+	if tmpNum, err := strconv.ParseFloat(c.Gasfee, 64); err == nil {
 		logger.Debug().Float64("Gasfee", tmpNum).Msg("Gas Fee.")
 		gasFee = tmpNum
 	}
-	logger.Debug().Int("a", A).Msg("In balance init() !")
 }
 
-func LoadData() {
+// Loads the initial account balances from the balance.csv file in the directory dataDir.
+func LoadData(dataDir string) {
 	cnt := 0
 
-	homedir, _ := os.UserHomeDir()
-	file, err := os.Open(homedir + "/balance.csv")
+	file, err := os.Open(filepath.Join(dataDir, "balance.csv"))
 
 	if err != nil {
 		panic(err)
@@ -0,0 +1,142 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The admin package serves the Admin gRPC service (see protobufs/admin.proto) of a peer.
+// It reports a snapshot of the internal state of the running peer (epoch and segments, ordering instances, buckets,
+// log, stable checkpoint and peer connections) and allows changing the logging level without restarting the peer.
+// The service is neither authenticated nor encrypted and is only meant for debugging.
+package admin
+
+import (
+	"context"
+	"net"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/log"
+	"github.com/Hanzheng2021/Orthrus/manager"
+	"github.com/Hanzheng2021/Orthrus/membership"
+	"github.com/Hanzheng2021/Orthrus/messenger"
+	"github.com/Hanzheng2021/Orthrus/orderer"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	"github.com/Hanzheng2021/Orthrus/request"
+	"github.com/rs/zerolog"
+	logger "github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+)
+
+// Implemented by managers that report their epoch and segments (currently only the MirManager).
+type segmentReporter interface {
+	Status() (int32, []*pb.SegmentStatus)
+}
+
+// Maximal number of missing sequence numbers of the log reported in the status.
+const maxMissingSNs = 1024
+
+// Implemented by orderers that report the state of their instances.
+// Only the PbftOrderer does, as the reported view, last proposed sequence number and first uncommitted sequence
+// numbers (pb.InstanceStatus) are specific to PBFT instances.
+type instanceReporter interface {
+	InstanceStatus() []*pb.InstanceStatus
+}
+
+type adminServer struct {
+	mngr manager.Manager
+	ord  orderer.Orderer
+}
+
+// Starts serving the admin service at addr (host:port), reporting the state of mngr and ord.
+// Must only be called after connecting to all peers (messenger.Connect()).
+// Returns an error if the listening socket cannot be created. Serving itself happens in a separate goroutine.
+func Start(addr string, mngr manager.Manager, ord orderer.Orderer) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterAdminServer(grpcServer, &adminServer{mngr: mngr, ord: ord})
+
+	go func() {
+		if err := grpcServer.Serve(listener); err != nil {
+			logger.Error().Err(err).Str("addr", addr).Msg("Admin service stopped.")
+		}
+	}()
+	logger.Info().Str("addr", listener.Addr().String()).Msg("Serving admin service.")
+	return nil
+}
+
+func (as *adminServer) Status(ctx context.Context, req *pb.StatusRequest) (*pb.PeerStatus, error) {
+	status := &pb.PeerStatus{
+		PeerId:           membership.OwnID,
+		Epoch:            -1,
+		Buckets:          bucketStatus(),
+		Log:              logStatus(),
+		StableCheckpoint: log.GetCheckpoint(),
+		Connections:      messenger.PeerConnectionStatus(),
+		LogLevel:         levelName(zerolog.GlobalLevel()),
+	}
+	if sr, ok := as.mngr.(segmentReporter); ok {
+		status.Epoch, status.Segments = sr.Status()
+	}
+	if ir, ok := as.ord.(instanceReporter); ok {
+		status.Instances = ir.InstanceStatus()
+	}
+	return status, nil
+}
+
+// Sets the global logging level. Accepts the level names of the configuration file (see config.ParseLoggingLevel).
+func (as *adminServer) SetLogLevel(ctx context.Context, req *pb.LogLevelRequest) (*pb.LogLevelResponse, error) {
+	level, err := config.ParseLoggingLevel(req.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(level)
+	// Logged at warning level, so the change is visible in most configurations.
+	logger.Warn().
+		Str("previous", levelName(previous)).
+		Str("level", levelName(level)).
+		Msg("Logging level changed through admin service.")
+
+	return &pb.LogLevelResponse{PreviousLevel: levelName(previous), Level: levelName(level)}, nil
+}
+
+// Returns the number of requests in each bucket.
+func bucketStatus() []*pb.BucketStatus {
+	status := make([]*pb.BucketStatus, len(request.Buckets))
+	for i, b := range request.Buckets {
+		b.Lock()
+		status[i] = &pb.BucketStatus{Id: int32(b.GetId()), Requests: int32(b.Len())}
+		b.Unlock()
+	}
+	return status
+}
+
+func logStatus() *pb.LogStatus {
+	firstEmpty, highest := log.FirstEmptyAndHighestSN()
+	return &pb.LogStatus{
+		FirstEmptySn:       firstEmpty,
+		HighestCommittedSn: highest,
+		MissingSns:         log.Missing(highest, maxMissingSNs),
+	}
+}
+
+// Returns the name of a logging level as used in the configuration file.
+func levelName(level zerolog.Level) string {
+	if level == zerolog.WarnLevel {
+		return "warning"
+	}
+	return level.String()
+}
@@ -18,6 +18,7 @@ import (
 	"sync"
 
 	logger "github.com/rs/zerolog/log"
+	"github.com/Hanzheng2021/Orthrus/config"
 	"github.com/Hanzheng2021/Orthrus/crypto"
 	"github.com/Hanzheng2021/Orthrus/log"
 	"github.com/Hanzheng2021/Orthrus/manager"
@@ -45,14 +46,18 @@ type SigningCheckpointer struct {
 	pendingCheckpoints map[int32]map[int32]*pb.CheckpointMsg
 
 	// All incoming checkpoint messages are funneled through this channel and processed sequentially.
+	// Up to CheckpointMsgBufferSize unprocessed checkpoint messages can be stored before the message receiver thread
+	// blocks. This can happen if the peer is a straggler and gets stuck waiting for the local log to reach a
+	// checkpoint, while already having received enough checkpoint messages for a stable checkpoint.
+	// In the current implementation no further checkpoint messages can be processed until the local log advances.
 	messageSerializer chan *receivedMessage
 }
 
 // Returns a new initialized SimpleCheckpointer.
-func NewSigningCheckpointer() *SigningCheckpointer {
+func NewSigningCheckpointer(cfg *config.Configuration) *SigningCheckpointer {
 	return &SigningCheckpointer{
 		pendingCheckpoints: make(map[int32]map[int32]*pb.CheckpointMsg),
-		messageSerializer:  make(chan *receivedMessage, messageSerializerBuffer),
+		messageSerializer:  make(chan *receivedMessage, cfg.CheckpointMsgBufferSize),
 	}
 }
 
@@ -431,7 +431,7 @@ func runServer(wg *sync.WaitGroup) (*grpc.Server, *grpc.Server, *grpc.Server) {
 	var grpcServer1 *grpc.Server
 	var grpcControlServer *grpc.Server
 	if useTLS {
-		tlsConfig := messenger.ConfigureTLS(config.Config.CertFile, config.Config.KeyFile)
+		tlsConfig := messenger.ConfigureTLS(config.Config.CertFile, config.Config.KeyFile, config.Config.CACertFile)
 		grpcServer0 = grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
 		grpcServer1 = grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
 		grpcControlServer = grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
@@ -555,7 +555,7 @@ func newClientConnection(addr string) *grpc.ClientConn {
 
 	// Add TLS-specific gRPC dial options, depending on configuration
 	if useTLS {
-		tlsConfig := messenger.ConfigureTLS(config.Config.CertFile, config.Config.KeyFile)
+		tlsConfig := messenger.ConfigureTLS(config.Config.CertFile, config.Config.KeyFile, config.Config.CACertFile)
 		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
 	} else {
 		dialOpts = append(dialOpts, grpc.WithInsecure())
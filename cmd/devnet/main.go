@@ -0,0 +1,302 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The devnet command runs a complete ISS deployment on the local machine.
+// It generates the keys (static membership, no discovery server) and the configuration for N peers,
+// builds the peer and client binaries (unless given), starts N peers and M client processes,
+// streams their output prefixed by the process name, and shuts everything down
+// when all clients finished or when interrupted.
+//
+// Usage: devnet [flags], e.g., devnet -peers 4 -clients 2 -config config/config.yml
+// Must be run from the repository root (or with -workdir pointing to it),
+// since the configuration may reference files (e.g. TLS keys) by relative paths.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/discovery"
+	"github.com/rs/zerolog"
+	logger "github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	numPeers          = flag.Int("peers", 4, "Number of peers.")
+	numClients        = flag.Int("clients", 1, "Number of client processes.")
+	clientsPerProcess = flag.Int("clients-per-process", 0, "Overrides ClientsPerProcess of the configuration if not 0.")
+	baseConfig        = flag.String("config", "config/config.yml", "Configuration file the generated configuration is based on.")
+	logLevel          = flag.String("log-level", "", "Overrides the Logging level of the configuration if not empty.")
+	outDir            = flag.String("dir", "", "Output directory for keys, configuration, logs and traces. A fresh temporary directory if empty.")
+	workDir           = flag.String("workdir", ".", "Working directory of the peers and clients.")
+	dataDir           = flag.String("data-dir", "deployment/scripts/cloud-deploy/TxFile", "Directory containing the initial account balances (balance.csv), relative to the working directory unless absolute.")
+	binDir            = flag.String("bin", "", "Directory containing the orderingpeer and orderingclient binaries. Built from source into the output directory if empty.")
+	trace             = flag.Bool("trace", false, "Write event traces of the peers to the output directory.")
+	duration          = flag.Duration("duration", 0, "Stop the cluster after this time, even if the clients did not finish. 0 for no limit.")
+	grace             = flag.Duration("grace", 5*time.Second, "Time processes are given to exit on shutdown before being killed.")
+)
+
+func main() {
+	flag.Parse()
+
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	logger.Logger = logger.Output(zerolog.ConsoleWriter{
+		Out:        os.Stderr,
+		NoColor:    true,
+		TimeFormat: "15:04:05.000"})
+
+	if *numPeers < 1 || *numClients < 0 {
+		logger.Fatal().Int("peers", *numPeers).Int("clients", *numClients).Msg("Invalid number of peers or clients.")
+	}
+
+	// Create output directory.
+	dir := *outDir
+	var err error
+	if dir == "" {
+		if dir, err = ioutil.TempDir("", "orthrus-devnet-"); err != nil {
+			logger.Fatal().Err(err).Msg("Could not create output directory.")
+		}
+	} else if err = os.MkdirAll(dir, 0755); err != nil {
+		logger.Fatal().Err(err).Str("dir", dir).Msg("Could not create output directory.")
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		logger.Fatal().Err(err).Msg("Could not resolve output directory.")
+	}
+	logger.Info().Str("dir", dir).Msg("Output directory.")
+
+	data := *dataDir
+	if !filepath.IsAbs(data) {
+		data = filepath.Join(*workDir, data)
+	}
+	if data, err = filepath.Abs(data); err != nil {
+		logger.Fatal().Err(err).Msg("Could not resolve data directory.")
+	}
+	if info, err := os.Stat(data); err != nil || !info.IsDir() {
+		logger.Fatal().Str("dataDir", data).Msg("Data directory does not exist.")
+	}
+
+	peerBinary, clientBinary := binaries(dir)
+	configFile, perProcess := writeConfig(dir)
+	clusterFile := writeKeys(dir)
+
+	// Shut down on INT or TERM signal.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	// Start peers.
+	peers := make([]*process, 0, *numPeers)
+	for i := 0; i < *numPeers; i++ {
+		args := []string{"static",
+			"-config", configFile,
+			"-cluster", clusterFile,
+			"-key", filepath.Join(dir, fmt.Sprintf(discovery.KeyFileNameFormat, i)),
+			"-data-dir", data}
+		if *trace {
+			args = append(args,
+				"-trace", filepath.Join(dir, fmt.Sprintf("peer-%d.trc", i)),
+				"-trace2", filepath.Join(dir, fmt.Sprintf("peer-%d.trc2", i)))
+		}
+		p, err := startProcess(fmt.Sprintf("peer-%d", i), *workDir, dir, peerBinary, args...)
+		if err != nil {
+			stopAll(peers)
+			logger.Fatal().Err(err).Int("peer", i).Msg("Could not start peer.")
+		}
+		peers = append(peers, p)
+	}
+
+	// Start clients.
+	// Client process j uses the client IDs from j*perProcess to (j+1)*perProcess-1.
+	clients := make([]*process, 0, *numClients)
+	for j := 0; j < *numClients; j++ {
+		c, err := startProcess(fmt.Sprintf("client-%d", j), *workDir, dir, clientBinary, "run",
+			"-config", configFile,
+			"-cluster", clusterFile,
+			"-first-client-id", strconv.Itoa(j*perProcess),
+			"-data-dir", data,
+			"-out", filepath.Join(dir, fmt.Sprintf("client-%d", j)))
+		if err != nil {
+			stopAll(append(clients, peers...))
+			logger.Fatal().Err(err).Int("client", j).Msg("Could not start client.")
+		}
+		clients = append(clients, c)
+	}
+
+	// Wait until all clients finish, a peer fails, the time is up, or we are interrupted.
+	clientsDone := make(chan struct{})
+	go func() {
+		for _, c := range clients {
+			<-c.done
+		}
+		close(clientsDone)
+	}()
+	peerFailed := make(chan *process, len(peers))
+	for _, p := range peers {
+		go func(p *process) {
+			<-p.done
+			peerFailed <- p
+		}(p)
+	}
+	var timeout <-chan time.Time
+	if *duration > 0 {
+		timeout = time.After(*duration)
+	}
+	exitCode := 0
+	select {
+	case <-clientsDone:
+		logger.Info().Msg("All clients finished.")
+	case p := <-peerFailed:
+		logger.Error().Err(p.err).Str("name", p.name).Msg("Peer exited unexpectedly.")
+		exitCode = 1
+	case <-timeout:
+		logger.Info().Dur("duration", *duration).Msg("Time is up.")
+	case s := <-signals:
+		logger.Info().Str("signal", s.String()).Msg("Interrupted.")
+	}
+
+	// Clients first, so they do not report errors about peers going away.
+	logger.Info().Msg("Shutting down.")
+	stopAll(clients)
+	stopAll(peers)
+	for _, c := range clients {
+		if c.err != nil {
+			logger.Warn().Err(c.err).Str("name", c.name).Msg("Client exited with error.")
+		}
+	}
+	logger.Info().Str("dir", dir).Msg("Done. Logs and traces are in the output directory.")
+	os.Exit(exitCode)
+}
+
+// Stops all processes in parallel and waits until they exit.
+func stopAll(processes []*process) {
+	for _, p := range processes {
+		go p.stop(*grace)
+	}
+	for _, p := range processes {
+		<-p.done
+	}
+}
+
+// Returns the paths to the peer and client binaries, building them if no binary directory is given.
+func binaries(dir string) (string, string) {
+	if *binDir != "" {
+		return filepath.Join(*binDir, "orderingpeer"), filepath.Join(*binDir, "orderingclient")
+	}
+
+	binaries := make([]string, 0, 2)
+	for _, name := range []string{"orderingpeer", "orderingclient"} {
+		binary := filepath.Join(dir, "bin", name)
+		logger.Info().Str("binary", binary).Msg("Building.")
+		cmd := exec.Command("go", "build", "-o", binary, "./cmd/"+name)
+		cmd.Dir = *workDir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			logger.Fatal().Err(err).Str("binary", name).Msg("Build failed.")
+		}
+		binaries = append(binaries, binary)
+	}
+	return binaries[0], binaries[1]
+}
+
+// Writes the configuration used by all peers and clients to the output directory.
+// The configuration is the base configuration with the following entries replaced:
+// TotalClients (the number of clients in all client processes), ClientsPerProcess and Logging (if overridden),
+// NetFaultControl (disabled, as there is no discovery server),
+// and PrecomputeRequests (disabled, as the precomputed transactions (ethtx.csv) are not part of the repository).
+// Returns the path to the configuration file and the number of clients per process.
+func writeConfig(dir string) (string, int) {
+	data, err := ioutil.ReadFile(*baseConfig)
+	if err != nil {
+		logger.Fatal().Err(err).Str("config", *baseConfig).Msg("Could not read configuration.")
+	}
+	// Keep the order of the entries, so the generated file can be compared to the base configuration.
+	var cfg yaml.MapSlice
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		logger.Fatal().Err(err).Str("config", *baseConfig).Msg("Could not parse configuration.")
+	}
+
+	perProcess := *clientsPerProcess
+	if perProcess == 0 {
+		if v, ok := lookup(cfg, "ClientsPerProcess").(int); ok {
+			perProcess = v
+		}
+	}
+	if perProcess < 1 {
+		logger.Fatal().Int("clientsPerProcess", perProcess).Msg("Need at least one client per process.")
+	}
+
+	cfg = set(cfg, "ClientsPerProcess", perProcess)
+	cfg = set(cfg, "TotalClients", perProcess**numClients)
+	cfg = set(cfg, "NetFaultControl", false)
+	cfg = set(cfg, "PrecomputeRequests", false)
+	if *logLevel != "" {
+		cfg = set(cfg, "Logging", *logLevel)
+	}
+
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Could not serialize configuration.")
+	}
+	configFile := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(configFile, out, 0644); err != nil {
+		logger.Fatal().Err(err).Str("config", configFile).Msg("Could not write configuration.")
+	}
+	return configFile, perProcess
+}
+
+// Generates the keys of all peers and writes them, with the cluster file, to the output directory.
+// Returns the path to the cluster file.
+func writeKeys(dir string) string {
+	addrs := make([]string, *numPeers)
+	for i := range addrs {
+		addrs[i] = "127.0.0.1"
+	}
+	cluster, keys, err := discovery.GenerateStaticCluster(addrs, addrs)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Could not generate keys.")
+	}
+	if err := discovery.WriteStaticCluster(dir, cluster, keys); err != nil {
+		logger.Fatal().Err(err).Msg("Could not write keys.")
+	}
+	return filepath.Join(dir, discovery.ClusterFileName)
+}
+
+func lookup(cfg yaml.MapSlice, key string) interface{} {
+	for _, item := range cfg {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+	return nil
+}
+
+// Sets the value of a configuration entry, appending the entry if not present.
+func set(cfg yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for i := range cfg {
+		if cfg[i].Key == key {
+			cfg[i].Value = value
+			return cfg
+		}
+	}
+	return append(cfg, yaml.MapItem{Key: key, Value: value})
+}
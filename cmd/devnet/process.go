@@ -0,0 +1,120 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	logger "github.com/rs/zerolog/log"
+)
+
+// A process of the local cluster (a peer or a client process).
+type process struct {
+	name string    // Used as prefix of the streamed output lines and as name of the log file.
+	cmd  *exec.Cmd // The running command.
+	done chan struct{}
+	err  error // Exit error of the process. Only valid after done is closed.
+}
+
+// Serializes the output lines of all processes.
+var outputLock sync.Mutex
+
+// Starts a process with the given binary and arguments in the working directory.
+// Every line the process writes to its stdout or stderr is printed prefixed with the process name
+// and appended to <logDir>/<name>.log.
+func startProcess(name string, workDir string, logDir string, binary string, args ...string) (*process, error) {
+	logFile, err := os.Create(filepath.Join(logDir, name+".log"))
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(binary, args...)
+	cmd.Dir = workDir
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return nil, err
+	}
+	logger.Info().Str("name", name).Int("pid", cmd.Process.Pid).Strs("args", args).Msg("Started process.")
+
+	p := &process{name: name, cmd: cmd, done: make(chan struct{})}
+
+	// Stream output.
+	var streams sync.WaitGroup
+	streams.Add(2)
+	go p.stream(stdout, logFile, &streams)
+	go p.stream(stderr, logFile, &streams)
+
+	// Wait for the process to exit. The output must be fully read before calling Wait.
+	go func() {
+		streams.Wait()
+		p.err = cmd.Wait()
+		logFile.Close()
+		close(p.done)
+	}()
+
+	return p, nil
+}
+
+func (p *process) stream(r io.Reader, logFile *os.File, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		outputLock.Lock()
+		fmt.Printf("[%s] %s\n", p.name, scanner.Text())
+		logFile.Write(append(scanner.Bytes(), '\n'))
+		outputLock.Unlock()
+	}
+}
+
+// Asks the process to terminate (with an INT signal, so peers flush their traces)
+// and kills it if it does not exit within the grace period.
+func (p *process) stop(grace time.Duration) {
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+
+	if err := p.cmd.Process.Signal(os.Interrupt); err != nil {
+		logger.Warn().Err(err).Str("name", p.name).Msg("Could not interrupt process.")
+	}
+	select {
+	case <-p.done:
+	case <-time.After(grace):
+		logger.Warn().Str("name", p.name).Msg("Process did not exit in time. Killing.")
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+}
@@ -128,7 +128,7 @@ func runServer(wg *sync.WaitGroup) *grpc.Server {
 	// Depending on configuration, create a plain or TLS-enabled gRPC server
 	var grpcServer *grpc.Server
 	if useTLS {
-		tlsConfig := messenger.ConfigureTLS(config.Config.CertFile, config.Config.KeyFile)
+		tlsConfig := messenger.ConfigureTLS(config.Config.CertFile, config.Config.KeyFile, config.Config.CACertFile)
 		grpcServer = grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
 	} else {
 		grpcServer = grpc.NewServer()
@@ -173,7 +173,7 @@ func runClient(clID int, serverAddr string, wg *sync.WaitGroup) {
 
 	// Add TLS-specific gRPC dial options, depending on configuration
 	if useTLS {
-		tlsConfig := messenger.ConfigureTLS(config.Config.CertFile, config.Config.KeyFile)
+		tlsConfig := messenger.ConfigureTLS(config.Config.CertFile, config.Config.KeyFile, config.Config.CACertFile)
 		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
 	} else {
 		dialOpts = append(dialOpts, grpc.WithInsecure())
@@ -0,0 +1,162 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/discovery"
+)
+
+const usage = `Usage: orderingclient <command> [flags]
+
+Commands:
+  run      Run ClientsPerProcess clients, each submitting RequestsPerClient requests.
+  version  Print the build information and the protocol configuration.
+
+Run "orderingclient <command> -help" for the flags of a command.
+`
+
+// Options of the run command.
+type clientOptions struct {
+	configFile string
+
+	// Membership source. Either discoveryAddr or clusterFile is set.
+	discoveryAddr string
+	clusterFile   string
+	firstClientID int
+
+	outFilePrefix string // Prefix of the log and trace files of the clients, to which the client ID is appended.
+	profilePrefix string // Prefix of the profiler output files. Profiling is disabled if empty.
+	dataDir       string // Directory containing the precomputed transactions (ethtx.csv) and balances (balance.csv).
+}
+
+// Returns the address the clients obtain the membership from:
+// the discovery server address or, with static membership, a static client address.
+func (opts *clientOptions) membershipAddr() string {
+	if opts.clusterFile != "" {
+		return discovery.StaticClientAddr(opts.clusterFile, int32(opts.firstClientID))
+	}
+	return opts.discoveryAddr
+}
+
+// Parses the command line and runs the given command.
+func runCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "run":
+		runClients(parseClientFlags(args[1:]))
+	case "version":
+		version(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n%s", args[0], usage)
+		os.Exit(2)
+	}
+}
+
+// Parses and validates the flags of the run command.
+// Prints the usage of the command and exits if the flags are invalid.
+func parseClientFlags(args []string) *clientOptions {
+	opts := &clientOptions{}
+	homeDir, _ := os.UserHomeDir()
+
+	fs := flag.NewFlagSet("orderingclient run", flag.ExitOnError)
+	fs.StringVar(&opts.configFile, "config", "", "Configuration file. (required)")
+	fs.StringVar(&opts.discoveryAddr, "discovery", "", "Address (host:port) of the discovery server. "+
+		"Exactly one of -discovery and -cluster is required.")
+	fs.StringVar(&opts.clusterFile, "cluster", "", "Cluster file for static membership, generated by orderingpeer keygen.")
+	fs.IntVar(&opts.firstClientID, "first-client-id", 0, "ID of the first client of this process with static membership. "+
+		"The clients of the process use consecutive IDs.")
+	fs.StringVar(&opts.outFilePrefix, "out", "", "Prefix of the log and trace files of the clients. (required)")
+	fs.StringVar(&opts.profilePrefix, "profile", "", "Prefix of the CPU, block and mutex profile files. "+
+		"Profiling is disabled if empty.")
+	fs.StringVar(&opts.dataDir, "data-dir", homeDir, "Directory containing the precomputed transactions (ethtx.csv) "+
+		"and the initial account balances (balance.csv).")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: orderingclient run -config FILE (-discovery HOST:PORT | -cluster FILE) -out PREFIX [flags]\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		usageError(fs, "unexpected arguments: %v", fs.Args())
+	}
+	if opts.configFile == "" {
+		usageError(fs, "-config is required")
+	}
+	if info, err := os.Stat(opts.configFile); err != nil || info.IsDir() {
+		usageError(fs, "-config %q is not a readable file", opts.configFile)
+	}
+	switch {
+	case (opts.discoveryAddr == "") == (opts.clusterFile == ""):
+		usageError(fs, "exactly one of -discovery and -cluster is required")
+	case opts.discoveryAddr != "":
+		if _, _, err := net.SplitHostPort(opts.discoveryAddr); err != nil {
+			usageError(fs, "-discovery must be HOST:PORT, got %q", opts.discoveryAddr)
+		}
+	case opts.firstClientID < 0:
+		usageError(fs, "-first-client-id must not be negative")
+	}
+	if opts.outFilePrefix == "" {
+		usageError(fs, "-out is required")
+	}
+	if info, err := os.Stat(opts.dataDir); err != nil || !info.IsDir() {
+		usageError(fs, "-data-dir %q is not a directory", opts.dataDir)
+	}
+
+	return opts
+}
+
+// Implements the version command.
+func version(args []string) {
+	var configFile string
+	fs := flag.NewFlagSet("orderingclient version", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "Configuration file whose protocol configuration is printed. "+
+		"The default configuration if empty.")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		usageError(fs, "unexpected arguments: %v", fs.Args())
+	}
+
+	c := config.Default()
+	if configFile != "" {
+		var err error
+		if c, err = config.Load(configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration file %s: %s\n", configFile, err.Error())
+			os.Exit(1)
+		}
+	}
+	if err := config.WriteVersion(os.Stdout, "orderingclient", c); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not print version: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// Prints an error message followed by the usage of the command and exits.
+func usageError(fs *flag.FlagSet, format string, args ...interface{}) {
+	fmt.Fprintf(fs.Output(), "Error: "+format+"\n\n", args...)
+	fs.Usage()
+	os.Exit(2)
+}
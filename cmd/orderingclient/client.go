@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -20,6 +21,7 @@ import (
 	"github.com/Hanzheng2021/Orthrus/manager"
 	"github.com/Hanzheng2021/Orthrus/membership"
 	"github.com/Hanzheng2021/Orthrus/messenger"
+	"github.com/Hanzheng2021/Orthrus/metrics"
 	pb "github.com/Hanzheng2021/Orthrus/protobufs"
 	"github.com/Hanzheng2021/Orthrus/request"
 	"github.com/Hanzheng2021/Orthrus/tracing"
@@ -31,10 +33,18 @@ import (
 
 const (
 	reqFanout = 3
+
+	// Bounds of the exponential backoff before resubmitting a request rejected by the admission control of a peer.
+	rejectBackoffMin = 100 * time.Millisecond
+	rejectBackoffMax = 5 * time.Second
 )
 
 var (
 	lock sync.RWMutex
+
+	// Number of clients in this process that obtained their IDs from a static client address.
+	// Accessed atomically.
+	staticClients int32
 )
 
 type client struct {
@@ -83,10 +93,24 @@ type client struct {
 	sentTimestamps   map[int32]int64
 	submitTimestamps map[int32]int64
 
+	// For each traced request (see config.RequestTraceSampling), the span covering the whole request.
+	spans map[int32]*tracing.RequestSpan
+
 	// For each request, stores a flag indicating whether the request is finished.
 	// Initialized to false on request submission, set to true when enoughResponses() returns true.
 	finished map[int32]bool
 
+	// For each request rejected by the admission control of a peer, the number of times it has been rejected.
+	// Determines the backoff before resubmitting the request (see rejectBackoff).
+	rejections map[int32]int
+
+	// Set when the channels in reqSinks are closed. Delayed resubmissions must not write to them any more.
+	sinksClosed bool
+
+	// Highest order sequence number the client has seen in a response. Used for setting request expiry.
+	// Accessed atomically.
+	highestOrderSn int32
+
 	// The sequence number of the oldest in-flight request (i.e. submitted request to which not enough responses have been
 	// received yet).
 	oldestClientSN int32
@@ -133,6 +157,8 @@ func newClient(dServAddr string, numRequests int) *client {
 		sentTimestamps:         make(map[int32]int64, numRequests),
 		submitTimestamps:       make(map[int32]int64, numRequests),
 		finished:               make(map[int32]bool, numRequests),
+		rejections:             make(map[int32]int),
+		spans:                  make(map[int32]*tracing.RequestSpan),
 		oldestClientSN:         0,
 		watermarkWindow:        make(chan *pb.ClientRequest, config.Config.ClientWatermarkWindowSize),
 		sendBufferSize:         config.Config.ClientWatermarkWindowSize,
@@ -200,16 +226,27 @@ func (c *client) loadPrivKey(privKeyFile string) {
 
 func (c *client) discoverPeers(dServAddr string) {
 	// Get orderer identities from discovery server.
+	// With static membership, get them from the cluster file instead.
 	var ordererIdentities []*pb.NodeIdentity
-	c.ownClientID, ordererIdentities = discovery.RegisterClient(dServAddr)
-	logger.Info().
-		Int32("ownClientId", c.ownClientID).
-		Int("numOrderers", len(ordererIdentities)).
-		Msg("Registared with discovery server.")
+	if strings.HasPrefix(dServAddr, discovery.StaticClientPrefix) {
+		var firstClientID int32
+		firstClientID, ordererIdentities = discovery.LoadStaticClient(dServAddr)
+		c.ownClientID = firstClientID + atomic.AddInt32(&staticClients, 1) - 1
+		logger.Info().
+			Int32("ownClientId", c.ownClientID).
+			Int("numOrderers", len(ordererIdentities)).
+			Msg("Loaded static membership.")
+	} else {
+		c.ownClientID, ordererIdentities = discovery.RegisterClient(dServAddr)
+		logger.Info().
+			Int32("ownClientId", c.ownClientID).
+			Int("numOrderers", len(ordererIdentities)).
+			Msg("Registared with discovery server.")
+	}
 
 	// Initialize membership only once.
 	membershipInitializer.Do(func() {
-		membership.InitNodeIdentities(ordererIdentities)
+		membership.InitNodeIdentities(ordererIdentities, config.Config)
 	})
 }
 
@@ -219,8 +256,7 @@ func (c *client) fetchFromFile(numRequests int) {
 
 	cnt := 0
 
-	homedir, _ := os.UserHomeDir()
-	file, err := os.Open(homedir + "/ethtx.csv")
+	file, err := os.Open(filepath.Join(dataDir, "ethtx.csv"))
 	if err != nil {
 		panic(err)
 	}
@@ -311,6 +347,9 @@ func (c *client) createRequest(seqNr int32) *pb.ClientRequest {
 		Payload:   randomRequestPayload,
 		Signature: nil,
 	}
+	if config.Config.RequestTTL > 0 {
+		req.ValidUntilSn = atomic.LoadInt32(&c.highestOrderSn) + int32(config.Config.RequestTTL)
+	}
 
 	c.log.Debug().Int32("clSeqNr", req.RequestId.ClientSn).Msg("Created request.")
 
@@ -336,7 +375,7 @@ func (c *client) Run(wg *sync.WaitGroup) {
 	// Only consider non-crashed orderers when simulating failures.
 	var ordererIDs []int32
 	if config.Config.LeaderPolicy == "SimulatedRandomFailures" {
-		ordererIDs = manager.NewLeaderPolicy(config.Config.LeaderPolicy).GetLeaders(0)
+		ordererIDs = manager.NewLeaderPolicy(config.Config.LeaderPolicy, config.Config).GetLeaders(0)
 		//} else if config.Config.Failures > 0 && (config.Config.CrashTiming == "EpochStart" || config.Config.CrashTiming == "EpochEnd") {
 		//	ordererIDs = membership.CorrectPeers()
 	} else {
@@ -345,7 +384,7 @@ func (c *client) Run(wg *sync.WaitGroup) {
 
 	// Create connections to ordering servers.
 	var reqConns map[int32]*grpc.ClientConn
-	c.reqClients, c.bucketClients, reqConns = messenger.ConnectToOrderers(c.ownClientID, c.log, ordererIDs)
+	c.reqClients, c.bucketClients, reqConns = messenger.ConnectToOrderers(c.ownClientID, c.log, ordererIDs, config.Config)
 	c.startRequestSenders()
 	c.startBucketAssignmentReceivers()
 
@@ -441,9 +480,12 @@ func (c *client) Run(wg *sync.WaitGroup) {
 	}
 
 	// Close request connections
+	c.Lock()
+	c.sinksClosed = true
 	for _, ch := range c.reqSinks {
 		close(ch)
 	}
+	c.Unlock()
 
 	// Close bucket assignment connections
 	for peerID, cl := range c.bucketClients {
@@ -531,6 +573,12 @@ func (c *client) submitRequest(seqNr int32) {
 		destIDs = membership.AllNodeIDs()
 	}
 
+	// Attach a trace context to the requests selected for request tracing.
+	if tracing.RequestTracingEnabled() && seqNr%int32(config.Config.RequestTraceSampling) == 0 {
+		req.Trace = tracing.NewTraceContext()
+		c.spans[seqNr] = tracing.StartRequestSpan(req)
+	}
+
 	// Initialize request-related data structures.
 	lock.Lock()
 	c.requests[seqNr] = req // for the case where requests are not precomputed. otherwise not necessary.
@@ -543,7 +591,12 @@ func (c *client) submitRequest(seqNr int32) {
 	}
 	c.Unlock()
 
-	c.trace.Event(tracing.REQ_SEND, int64(seqNr), 0)
+	reqKind := tracing.ReqKindPayment
+	if req.IsContract == 1 {
+		reqKind = tracing.ReqKindContract
+	}
+	c.trace.Event(tracing.REQ_SEND, int64(seqNr), reqKind)
+	metrics.ClientRequestsSubmitted.Inc()
 
 	// Send message to all orderers.
 	for _, ordererID := range destIDs {
@@ -587,6 +640,26 @@ func (c *client) handleResponses(clientStub pb.Messenger_RequestClient, peerID i
 	var err error
 	for response, err = clientStub.Recv(); err == nil; response, err = clientStub.Recv() {
 
+		// Requests rejected by the peer's admission control are not registered.
+		// Unless they expired, they are resubmitted to the same peer after a backoff.
+		if response.Status != pb.ClientResponse_COMMITTED {
+			c.log.Warn().Int32("clSeqNr", response.ClientSn).
+				Int32("peerId", peerID).
+				Str("status", response.Status.String()).
+				Msg("Request rejected.")
+			switch response.Status {
+			case pb.ClientResponse_RATE_LIMITED, pb.ClientResponse_MEMPOOL_FULL, pb.ClientResponse_EVICTED:
+				c.scheduleResubmission(response.ClientSn, peerID)
+			}
+			continue
+		}
+
+		for highest := atomic.LoadInt32(&c.highestOrderSn); response.OrderSn > highest; highest = atomic.LoadInt32(&c.highestOrderSn) {
+			if atomic.CompareAndSwapInt32(&c.highestOrderSn, highest, response.OrderSn) {
+				break
+			}
+		}
+
 		// Receive response and register it.
 		// Note that responses might be received out of order.
 		c.log.Debug().Int32("clSeqNr", response.ClientSn).
@@ -598,6 +671,54 @@ func (c *client) handleResponses(clientStub pb.Messenger_RequestClient, peerID i
 	c.log.Info().Err(err).Int32("peerId", peerID).Msg("Response handler done.")
 }
 
+// Resubmits the request with clientSN to peer peerID after a backoff
+// that grows exponentially with the number of times the request has been rejected.
+func (c *client) scheduleResubmission(clientSN int32, peerID int32) {
+	c.Lock()
+	c.rejections[clientSN]++
+	backoff := rejectBackoff(c.rejections[clientSN])
+	c.Unlock()
+
+	time.AfterFunc(backoff, func() { c.resubmitRejected(clientSN, peerID) })
+}
+
+// Returns the backoff before resubmitting a request that has been rejected the given number of times.
+func rejectBackoff(rejections int) time.Duration {
+	backoff := rejectBackoffMin
+	for i := 1; i < rejections && backoff < rejectBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > rejectBackoffMax {
+		backoff = rejectBackoffMax
+	}
+	return backoff
+}
+
+// Sends the rejected request with clientSN to peer peerID again, unless the request finished in the meantime.
+func (c *client) resubmitRejected(clientSN int32, peerID int32) {
+	c.Lock()
+	defer c.Unlock()
+
+	lock.RLock()
+	req := c.requests[clientSN]
+	lock.RUnlock()
+	if c.sinksClosed || c.finished[clientSN] || req == nil || c.reqSinks[peerID] == nil {
+		return
+	}
+
+	// The request sender locks the client, so the client must not block on a full channel while holding the lock.
+	// If the channel is full, try again after another backoff.
+	select {
+	case c.reqSinks[peerID] <- req:
+		c.log.Debug().Int32("clSeqNr", clientSN).
+			Int32("ordererID", peerID).
+			Int("rejections", c.rejections[clientSN]).
+			Msg("Resubmitted rejected request.")
+	default:
+		time.AfterFunc(rejectBackoff(c.rejections[clientSN]), func() { c.resubmitRejected(clientSN, peerID) })
+	}
+}
+
 // Registers response to request with clientSN from replica peerID.
 // If this is the last response necessary for the oldest pending request, advances the watermark window accordingly.
 func (c *client) registerResponse(clientSN int32, peerID int32) {
@@ -620,6 +741,7 @@ func (c *client) registerResponse(clientSN int32, peerID int32) {
 			c.responses[clientSN][peerID] = true
 		}
 		lock.Unlock()
+		c.spans[clientSN].Response(peerID)
 
 		// Mark request as finished if enough responses were received (for the first time)
 		lock.Lock()
@@ -630,7 +752,15 @@ func (c *client) registerResponse(clientSN int32, peerID int32) {
 			c.trace.Event(tracing.REQ_FINISHED, int64(clientSN), now-c.submitTimestamps[clientSN])
 			c.finished[clientSN] = true
 			delete(c.submittedTo, clientSN)
+			delete(c.rejections, clientSN)
+			c.spans[clientSN].End()
+			delete(c.spans, clientSN)
 			lock.Lock()
+			if req := c.requests[clientSN]; req != nil {
+				path := metrics.RequestPath(req.IsContract)
+				metrics.ClientRequestsFinished.Inc(path)
+				metrics.ClientResponseLatency.Observe(path, float64(now-c.submitTimestamps[clientSN])/1000000)
+			}
 			c.requests[clientSN] = nil
 			lock.Unlock()
 			c.log.Debug().Int32("clSeqNr", clientSN).Msg("Request finished (out of order).")
@@ -785,7 +915,7 @@ func (c *client) newBucketsReady(epoch int32) *pb.BucketAssignment {
 func (c *client) guessTargetOrderers(req *pb.ClientRequest) []int32 {
 
 	guess := make([]int32, reqFanout, reqFanout)
-	b := request.GetBucketNr(req.RequestId.ClientId, req.RequestId.ClientSn, req.RequestId.SenderId)
+	b := request.GetBucketNr(req.RequestId.ClientId, req.RequestId.ClientSn, req.RequestId.SenderId, config.Config.NumBuckets)
 
 	for i := 0; i < reqFanout; i++ {
 		guess[i] = c.currentBucketAssignment[b]
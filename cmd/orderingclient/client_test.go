@@ -0,0 +1,98 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	"github.com/rs/zerolog"
+)
+
+func TestRejectBackoff(t *testing.T) {
+	tests := []struct {
+		rejections int
+		want       time.Duration
+	}{
+		{1, rejectBackoffMin},
+		{2, 2 * rejectBackoffMin},
+		{3, 4 * rejectBackoffMin},
+		{100, rejectBackoffMax},
+	}
+	for _, tc := range tests {
+		if got := rejectBackoff(tc.rejections); got != tc.want {
+			t.Errorf("backoff after %d rejections is %v, expected %v", tc.rejections, got, tc.want)
+		}
+	}
+}
+
+// Returns a client with one submitted request (client sequence number 0) and a request channel to peer 1.
+func newRejectingClient() (*client, chan *pb.ClientRequest) {
+	sink := make(chan *pb.ClientRequest, 1)
+	c := &client{
+		requests:   make(map[int32]*pb.ClientRequest),
+		finished:   map[int32]bool{0: false},
+		rejections: make(map[int32]int),
+		reqSinks:   map[int32]chan *pb.ClientRequest{1: sink},
+		log:        zerolog.Nop(),
+	}
+	lock.Lock()
+	c.requests[0] = &pb.ClientRequest{RequestId: &pb.RequestID{ClientSn: 0}}
+	lock.Unlock()
+	return c, sink
+}
+
+func TestResubmitRejected(t *testing.T) {
+	c, sink := newRejectingClient()
+	c.scheduleResubmission(0, 1)
+	select {
+	case req := <-sink:
+		if req.RequestId.ClientSn != 0 {
+			t.Fatalf("resubmitted request %d, expected 0", req.RequestId.ClientSn)
+		}
+	case <-time.After(10 * rejectBackoffMin):
+		t.Fatalf("rejected request not resubmitted")
+	}
+	if c.rejections[0] != 1 {
+		t.Errorf("request rejected %d times, expected 1", c.rejections[0])
+	}
+
+	// Finished requests and requests of a stopped client are not resubmitted.
+	c, sink = newRejectingClient()
+	c.finished[0] = true
+	c.resubmitRejected(0, 1)
+	c.finished[0] = false
+	c.sinksClosed = true
+	c.resubmitRejected(0, 1)
+	if len(sink) != 0 {
+		t.Errorf("request resubmitted after it finished or the client stopped")
+	}
+
+	// With a full request channel, the resubmission is retried without blocking.
+	c, sink = newRejectingClient()
+	sink <- &pb.ClientRequest{RequestId: &pb.RequestID{ClientSn: 1}}
+	c.rejections[0] = 1
+	c.resubmitRejected(0, 1)
+	<-sink
+	select {
+	case req := <-sink:
+		if req.RequestId.ClientSn != 0 {
+			t.Fatalf("resubmitted request %d, expected 0", req.RequestId.ClientSn)
+		}
+	case <-time.After(10 * rejectBackoffMin):
+		t.Fatalf("rejected request not resubmitted after the request channel was full")
+	}
+}
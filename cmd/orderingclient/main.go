@@ -1,14 +1,19 @@
 package main
 
 import (
+	"fmt"
 	"math/rand"
+	"net"
 	"os"
+	"strconv"
 	"sync"
 
 	"github.com/Hanzheng2021/Orthrus/account"
 	"github.com/Hanzheng2021/Orthrus/config"
 	"github.com/Hanzheng2021/Orthrus/membership"
+	"github.com/Hanzheng2021/Orthrus/metrics"
 	"github.com/Hanzheng2021/Orthrus/profiling"
+	"github.com/Hanzheng2021/Orthrus/tracing"
 	"github.com/rs/zerolog"
 	logger "github.com/rs/zerolog/log"
 )
@@ -17,6 +22,9 @@ var (
 	// Prefix of the client-specific output files, to which the client ID will be appended.
 	outFilePrefix string
 
+	// Directory containing the precomputed transactions and the initial account balances.
+	dataDir string
+
 	// Used to initialize membership only once.
 	membershipInitializer sync.Once
 
@@ -31,16 +39,12 @@ func enoughResponses(n int) bool {
 }
 
 func main() {
-	// Check number of parameters
-	if len(os.Args) <= 2 {
-		logger.Fatal().
-			Int("argsGiven", len(os.Args)-1).
-			Msg("usage: orderingclient config_file_name discovery_server_addr:port out_file_prefix [profiler_output_prefix]")
-	}
+	runCommand(os.Args[1:])
+}
 
-	// Get config file name
-	configFileName := os.Args[1]
-	config.LoadFile(configFileName)
+// Runs the clients of this process with the given (validated) options. Implements the run command.
+func runClients(opts *clientOptions) {
+	config.LoadFile(opts.configFile)
 
 	// Configure logger.
 	zerolog.SetGlobalLevel(config.Config.LoggingLevel)
@@ -56,20 +60,34 @@ func main() {
 	//	TimeFormat: "15:04:05.000",
 	//})
 
-	// Get discovery server address from command line.
-	// The membership will be obtained from this server
-	dServAddr := os.Args[2]
+	// Start the metrics endpoint if configured.
+	if config.Config.ClientMetricsPort != 0 {
+		if err := metrics.Start(fmt.Sprintf(":%d", config.Config.ClientMetricsPort)); err != nil {
+			logger.Fatal().Err(err).Msg("Could not start metrics endpoint.")
+		}
+	}
+
+	// Start the debug server (on-demand profiling) if configured.
+	if config.Config.ClientDebugPort != 0 {
+		if err := profiling.StartDebugServer(net.JoinHostPort(config.Config.DebugHost, strconv.Itoa(config.Config.ClientDebugPort)),
+			config.Config.DebugProfileRate); err != nil {
+			logger.Fatal().Err(err).Msg("Could not start debug server.")
+		}
+	}
+
+	// The membership will be obtained from the discovery server (or the cluster file)
+	dServAddr := opts.membershipAddr()
 
-	// Get output file prefix from command line.
 	// Log and trace files will all begin with this
-	outFilePrefix = os.Args[3]
+	outFilePrefix = opts.outFilePrefix
+	dataDir = opts.dataDir
 
 	// Initialize membership module
-	membership.Init()
+	membership.Init(config.Config)
 
 	// Start profiler if necessary
-	if len(os.Args) > 4 {
-		setUpProfiling(os.Args[4])
+	if opts.profilePrefix != "" {
+		setUpProfiling(opts.profilePrefix)
 		defer profiling.StopProfiler()
 	}
 
@@ -96,7 +114,8 @@ func main() {
 
 	// Load Tx data from file
 	if config.Config.PrecomputeRequests {
-		account.LoadData()
+		account.Init(config.Config)
+		account.LoadData(dataDir)
 	}
 
 	wg.Add(numClients)
@@ -108,6 +127,15 @@ func main() {
 	wg.Wait()
 	logger.Info().Msg("Clients initialized.")
 
+	// Start exporting the spans of traced requests if configured.
+	if config.Config.RequestTraceSampling > 0 {
+		if err := tracing.StartRequestTracing("orthrus-client", clients[0].ownClientID,
+			config.Config.RequestTraceFile, config.Config.RequestTraceCollector); err != nil {
+			logger.Fatal().Err(err).Msg("Could not start request tracing.")
+		}
+		defer tracing.StopRequestTracing()
+	}
+
 	// Run all clients
 	logger.Info().Msg("Launching clients.")
 	wg.Add(numClients)
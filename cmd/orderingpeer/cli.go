@@ -0,0 +1,184 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+)
+
+const usage = `Usage: orderingpeer <command> [flags]
+
+Commands:
+  run      Run a peer that registers with the discovery server, which assigns its ID and distributes the membership.
+  static   Run a peer with static membership, read from the cluster file and the peer's key file (see keygen).
+  keygen   Generate the cluster file and the key files of all peers for static membership.
+  version  Print the build information and the protocol configuration.
+
+Run "orderingpeer <command> -help" for the flags of a command.
+`
+
+// Options of the run and static commands.
+type peerOptions struct {
+	configFile string
+
+	// Dynamic membership (run command).
+	discoveryAddr string
+	publicIP      string
+	privateIP     string
+
+	// Static membership (static command).
+	staticMembership bool
+	clusterFile      string
+	keyFile          string
+
+	traceFile     string // Main event trace. Tracing is disabled if empty.
+	trace2File    string // Client request event trace. Set if and only if traceFile is set.
+	profilePrefix string // Prefix of the profiler output files. Profiling is disabled if empty.
+	dataDir       string // Directory containing the initial account balances (balance.csv).
+}
+
+// Parses the command line and runs the given command.
+func runCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "run":
+		runPeer(parsePeerFlags("run", args[1:]))
+	case "static":
+		runPeer(parsePeerFlags("static", args[1:]))
+	case "keygen":
+		keygen(args[1:])
+	case "version":
+		version(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n%s", args[0], usage)
+		os.Exit(2)
+	}
+}
+
+// Parses and validates the flags of the run (if command is "run") or static (if command is "static") command.
+// Prints the usage of the command and exits if the flags are invalid.
+func parsePeerFlags(command string, args []string) *peerOptions {
+	opts := &peerOptions{staticMembership: command == "static"}
+	homeDir, _ := os.UserHomeDir()
+
+	fs := flag.NewFlagSet("orderingpeer "+command, flag.ExitOnError)
+	fs.StringVar(&opts.configFile, "config", "", "Configuration file. (required)")
+	if opts.staticMembership {
+		fs.StringVar(&opts.clusterFile, "cluster", "", "Cluster file generated by keygen. (required)")
+		fs.StringVar(&opts.keyFile, "key", "", "Key file of this peer generated by keygen. (required)")
+	} else {
+		fs.StringVar(&opts.discoveryAddr, "discovery", "", "Address (host:port) of the discovery server. (required)")
+		fs.StringVar(&opts.publicIP, "public-ip", "", "IP address under which clients reach this peer. (required)")
+		fs.StringVar(&opts.privateIP, "private-ip", "", "IP address under which other peers reach this peer. (required)")
+	}
+	fs.StringVar(&opts.traceFile, "trace", "", "Output file of the event trace. Requires -trace2. Tracing is disabled if empty.")
+	fs.StringVar(&opts.trace2File, "trace2", "", "Output file of the client request event trace. Requires -trace.")
+	fs.StringVar(&opts.profilePrefix, "profile", "", "Prefix of the CPU, block and mutex profile files, "+
+		"written when the peer is interrupted. Profiling is disabled if empty.")
+	fs.StringVar(&opts.dataDir, "data-dir", homeDir, "Directory containing the initial account balances (balance.csv).")
+	fs.Usage = func() {
+		if opts.staticMembership {
+			fmt.Fprintf(fs.Output(), "Usage: orderingpeer static -config FILE -cluster FILE -key FILE [flags]\n\n")
+		} else {
+			fmt.Fprintf(fs.Output(), "Usage: orderingpeer run -config FILE -discovery HOST:PORT -public-ip IP -private-ip IP [flags]\n\n")
+		}
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		usageError(fs, "unexpected arguments: %v", fs.Args())
+	}
+	requireFile(fs, "config", opts.configFile)
+	if opts.staticMembership {
+		requireFile(fs, "cluster", opts.clusterFile)
+		requireFile(fs, "key", opts.keyFile)
+	} else {
+		if _, _, err := net.SplitHostPort(opts.discoveryAddr); err != nil {
+			usageError(fs, "-discovery must be HOST:PORT, got %q", opts.discoveryAddr)
+		}
+		requireIP(fs, "public-ip", opts.publicIP)
+		requireIP(fs, "private-ip", opts.privateIP)
+	}
+	if (opts.traceFile == "") != (opts.trace2File == "") {
+		usageError(fs, "-trace and -trace2 must be given together")
+	}
+	if info, err := os.Stat(opts.dataDir); err != nil || !info.IsDir() {
+		usageError(fs, "-data-dir %q is not a directory", opts.dataDir)
+	}
+
+	return opts
+}
+
+// Implements the version command.
+func version(args []string) {
+	var configFile string
+	fs := flag.NewFlagSet("orderingpeer version", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "", "Configuration file whose protocol configuration is printed. "+
+		"The default configuration if empty.")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		usageError(fs, "unexpected arguments: %v", fs.Args())
+	}
+
+	c := config.Default()
+	if configFile != "" {
+		var err error
+		if c, err = config.Load(configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid configuration file %s: %s\n", configFile, err.Error())
+			os.Exit(1)
+		}
+	}
+	if err := config.WriteVersion(os.Stdout, "orderingpeer", c); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not print version: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// Prints an error message followed by the usage of the command and exits.
+func usageError(fs *flag.FlagSet, format string, args ...interface{}) {
+	fmt.Fprintf(fs.Output(), "Error: "+format+"\n\n", args...)
+	fs.Usage()
+	os.Exit(2)
+}
+
+func requireFile(fs *flag.FlagSet, name string, fileName string) {
+	if fileName == "" {
+		usageError(fs, "-%s is required", name)
+	}
+	if info, err := os.Stat(fileName); err != nil || info.IsDir() {
+		usageError(fs, "-%s %q is not a readable file", name, fileName)
+	}
+}
+
+func requireIP(fs *flag.FlagSet, name string, ip string) {
+	if ip == "" {
+		usageError(fs, "-%s is required", name)
+	}
+	if net.ParseIP(ip) == nil {
+		usageError(fs, "-%s must be an IP address, got %q", name, ip)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/Hanzheng2021/Orthrus/discovery"
+	logger "github.com/rs/zerolog/log"
+)
+
+// Implements the keygen command.
+// Generates the cluster file and the key files of all peers for static membership and writes them to a directory.
+// The peers are assigned IDs in the order of their addresses on the command line.
+// If a peer's private IP is omitted, it is the same as its public IP.
+func keygen(args []string) {
+	var outDir string
+	fs := flag.NewFlagSet("orderingpeer keygen", flag.ExitOnError)
+	fs.StringVar(&outDir, "out", "", "Output directory of the cluster and key files. (required)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: orderingpeer keygen -out DIR PUBLIC_IP[,PRIVATE_IP] ...\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if outDir == "" {
+		usageError(fs, "-out is required")
+	}
+	if fs.NArg() == 0 {
+		usageError(fs, "at least one peer address is required")
+	}
+
+	publicAddrs := make([]string, 0, fs.NArg())
+	privateAddrs := make([]string, 0, fs.NArg())
+	for _, addr := range fs.Args() {
+		ips := strings.Split(addr, ",")
+		if len(ips) > 2 || ips[0] == "" {
+			usageError(fs, "invalid peer address %q", addr)
+		}
+		publicAddrs = append(publicAddrs, ips[0])
+		privateAddrs = append(privateAddrs, ips[len(ips)-1])
+	}
+
+	cluster, keys, err := discovery.GenerateStaticCluster(publicAddrs, privateAddrs)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Could not generate keys.")
+	}
+	if err := discovery.WriteStaticCluster(outDir, cluster, keys); err != nil {
+		logger.Fatal().Err(err).Str("outDir", outDir).Msg("Could not write cluster files.")
+	}
+
+	fmt.Printf("Wrote %s and key files for %d peers to %s.\n", discovery.ClusterFileName, len(keys), outDir)
+	fmt.Printf("Start peer 0 with: orderingpeer static -config CONFIG_FILE -cluster %s -key %s\n",
+		filepath.Join(outDir, discovery.ClusterFileName),
+		filepath.Join(outDir, fmt.Sprintf(discovery.KeyFileNameFormat, 0)))
+}
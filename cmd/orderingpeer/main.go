@@ -1,20 +1,28 @@
 package main
 
 import (
+	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/Hanzheng2021/Orthrus/account"
+	"github.com/Hanzheng2021/Orthrus/admin"
 	"github.com/Hanzheng2021/Orthrus/checkpoint"
 	"github.com/Hanzheng2021/Orthrus/config"
 	"github.com/Hanzheng2021/Orthrus/crypto"
 	"github.com/Hanzheng2021/Orthrus/discovery"
+	"github.com/Hanzheng2021/Orthrus/dissemination"
+	"github.com/Hanzheng2021/Orthrus/evidence"
 	"github.com/Hanzheng2021/Orthrus/manager"
 	"github.com/Hanzheng2021/Orthrus/membership"
 	"github.com/Hanzheng2021/Orthrus/messenger"
+	"github.com/Hanzheng2021/Orthrus/metrics"
 	"github.com/Hanzheng2021/Orthrus/orderer"
 	"github.com/Hanzheng2021/Orthrus/profiling"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
 	"github.com/Hanzheng2021/Orthrus/request"
 	"github.com/Hanzheng2021/Orthrus/statetransfer"
 	"github.com/Hanzheng2021/Orthrus/tracing"
@@ -24,19 +32,21 @@ import (
 
 // Flag indicating whether profiling is enabled.
 // Used to decide whether the tracer should shut down the process on the INT signal or not.
-// TODO: This is ugly and dirty. Implement graceful shutdown!
+// TODO: Implement graceful shutdown, so that the profiler and the tracer do not need to coordinate exiting.
 var profilingEnabled = false
 
 func main() {
+	runCommand(os.Args[1:])
+}
 
-	// Get command line arguments
-	configFileName := os.Args[1]
-	discoveryServAddr := os.Args[2]
-	ownPublicIP := os.Args[3]
-	ownPrivateIP := os.Args[4]
+// Runs a peer with the given (validated) options. Implements the run and static commands.
+func runPeer(opts *peerOptions) {
+	staticMembership := opts.staticMembership
+	discoveryServAddr := opts.discoveryAddr
 
-	config.LoadFile(configFileName)
-	account.LoadData()
+	config.LoadFile(opts.configFile)
+	account.Init(config.Config)
+	account.LoadData(opts.dataDir)
 
 	// Configure logger
 	zerolog.SetGlobalLevel(config.Config.LoggingLevel)
@@ -52,27 +62,75 @@ func main() {
 	//	TimeFormat: "15:04:05.000",
 	//})
 
-	// Initialize packages that need the configuration to be loaded for initialization
-	membership.Init()
-	request.Init()
-	tracing.Init()
-	statetransfer.Init()
-
-	// Register with the discovery service and obtain:
+	// Register with the discovery service (or read the static cluster and key files) and obtain:
 	// - Own ID
 	// - Identities of all other peers
 	// - Private key
 	// - Public key for BLS threshold cryptosystem
 	// - Private key share for BLS threshold cryptosystem
-	ownID, nodeIdentities, privateKey, serializedTBLSPubKey, serializedTBLSPrivKeyShare :=
-		discovery.RegisterPeer(discoveryServAddr, ownPublicIP, ownPrivateIP)
+	var ownID int32
+	var nodeIdentities []*pb.NodeIdentity
+	var privateKey, serializedTBLSPubKey, serializedTBLSPrivKeyShare []byte
+	if staticMembership {
+		ownID, nodeIdentities, privateKey, serializedTBLSPubKey, serializedTBLSPrivKeyShare =
+			discovery.LoadStaticPeer(opts.clusterFile, opts.keyFile)
+		logger.Info().
+			Int32("ownID", ownID).
+			Int("numPeers", len(nodeIdentities)).
+			Str("clusterFile", opts.clusterFile).
+			Msg("Loaded static membership.")
+	} else {
+		ownID, nodeIdentities, privateKey, serializedTBLSPubKey, serializedTBLSPrivKeyShare =
+			discovery.RegisterPeer(discoveryServAddr, opts.publicIP, opts.privateIP)
+		logger.Info().
+			Int32("ownID", ownID).
+			Int("numPeers", len(nodeIdentities)).
+			Msg("Registered with discovery server.")
+	}
+
+	// Apply the configuration overrides for this peer, now that its ID is known.
+	config.ApplyNodeOverrides(ownID)
+	zerolog.SetGlobalLevel(config.Config.LoggingLevel)
+	if err := config.Config.ValidateMembership(len(nodeIdentities)); err != nil {
+		logger.Fatal().Err(err).Int("numPeers", len(nodeIdentities)).Msg("Invalid configuration.")
+	}
+
+	// Initialize packages that need the configuration to be loaded for initialization
+	membership.Init(config.Config)
+	request.Init(config.Config)
+	messenger.Init(config.Config)
+	dissemination.Init(config.Config)
+	tracing.Init(config.Config)
+	statetransfer.Init()
+
+	// Start the metrics endpoint if configured.
+	// This must happen before connecting to the other peers, for the messenger to count the bytes sent.
+	if config.Config.MetricsPort != 0 {
+		if err := metrics.Start(fmt.Sprintf(":%d", config.Config.MetricsPort+int(ownID))); err != nil {
+			logger.Fatal().Err(err).Msg("Could not start metrics endpoint.")
+		}
+	}
+
+	// Start the debug server (on-demand profiling) if configured.
+	if config.Config.DebugPort != 0 {
+		if err := profiling.StartDebugServer(net.JoinHostPort(config.Config.DebugHost, strconv.Itoa(config.Config.DebugPort+int(ownID))),
+			config.Config.DebugProfileRate); err != nil {
+			logger.Fatal().Err(err).Msg("Could not start debug server.")
+		}
+	}
+
+	// Start exporting the spans of traced requests if configured.
+	// As peers are stopped by a signal, the spans of the last flush period (up to a second) may be lost.
+	if config.Config.RequestTraceSampling > 0 {
+		if err := tracing.StartRequestTracing("orthrus-peer", ownID,
+			config.Config.RequestTraceFile, config.Config.RequestTraceCollector); err != nil {
+			logger.Fatal().Err(err).Msg("Could not start request tracing.")
+		}
+	}
+
 	membership.OwnID = ownID
 	membership.OwnPrivKey = privateKey
-	membership.InitNodeIdentities(nodeIdentities)
-	logger.Info().
-		Int32("ownID", ownID).
-		Int("numPeers", len(nodeIdentities)).
-		Msg("Registered with discovery server.")
+	membership.InitNodeIdentities(nodeIdentities, config.Config)
 
 	// Desirialize TBLS keys
 	TBLSPubKey, err := crypto.TBLSPubKeyFromBytes(serializedTBLSPubKey)
@@ -87,17 +145,16 @@ func main() {
 	membership.TBLSPrivKeyShare = TBLSPrivKeyShare
 
 	// Start profiler if necessary
-	// ATTENTION! We first look for argument 6, and only then check argument 5
-	//            (as the presence of profiling influences setting up of tracing).
-	if len(os.Args) > 7 {
-		profilingEnabled = true // UGLY DIRTY CODE!
+	// This must happen before setting up tracing, as the presence of profiling influences setting up of tracing.
+	if opts.profilePrefix != "" {
+		profilingEnabled = true
 		logger.Info().Msg("Profiling enabled.")
-		setUpProfiling(os.Args[7])
+		setUpProfiling(opts.profilePrefix)
 	}
 
 	// Set up tracing if necessary
-	if len(os.Args) > 6 {
-		setUpTracing(os.Args[5], os.Args[6], ownID)
+	if opts.traceFile != "" {
+		setUpTracing(opts.traceFile, opts.trace2File, ownID)
 	}
 
 	// Declare variables for component modules.
@@ -107,9 +164,9 @@ func main() {
 	var rsp *request.Responder
 
 	// Instantiate component modules (with stubs).
-	mngr = setManager(config.Config.Manager)
-	ord = setOrderer(config.Config.Orderer)
-	chkp = setCheckpointer(config.Config.Checkpointer)
+	mngr = setManager(config.Config)
+	ord = setOrderer(config.Config)
+	chkp = setCheckpointer(config.Config)
 	rsp = request.NewResponder()
 
 	// Initialize modules.
@@ -128,8 +185,25 @@ func main() {
 	messenger.OrdererMsgHandler = ord.HandleMessage
 	messenger.ClientRequestHandler = request.HandleRequest
 	messenger.StateTransferMsgHandler = statetransfer.HandleMessage
+	messenger.EvidenceMsgHandler = evidence.HandleMessage
+	messenger.DisseminationMsgHandler = dissemination.HandleMessage
+	messenger.ForwardedRequestHandler = request.HandleForwardedRequest
 	statetransfer.OrdererEntryHandler = ord.HandleEntry
 
+	// Set up network fault injection, if configured.
+	if config.Config.NetFaultInjection {
+		faults, err := messenger.NetFaultsFromConfig()
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Invalid network fault configuration.")
+		}
+		messenger.SetNetFaults(faults)
+		if config.Config.NetFaultControl && staticMembership {
+			logger.Warn().Msg("Network fault control requires the discovery server. Ignoring NetFaultControl.")
+		} else if config.Config.NetFaultControl {
+			go discovery.WatchNetFaults(discoveryServAddr, ownID, messenger.SetNetFaults)
+		}
+	}
+
 	// Create wait group for all the modules that will run as separate goroutines.
 	// (Currently the graceful termination is not implemented, so waiting on wg will take forever and the process
 	// needs to be killed.)
@@ -143,14 +217,28 @@ func main() {
 	messenger.Connect()
 	logger.Info().Msg("Connected to all peers.")
 
+	// Start the admin service if configured.
+	// This must happen after connecting, as the admin service reports the state of the established connections.
+	if config.Config.AdminPort != 0 {
+		if err := admin.Start(net.JoinHostPort(config.Config.AdminHost, strconv.Itoa(config.Config.AdminPort+int(ownID))), mngr, ord); err != nil {
+			logger.Fatal().Err(err).Msg("Could not start admin service.")
+		}
+	}
+
 	// Synchronize with master again to make sure that all peers finished connecting.
-	discovery.SyncPeer(discoveryServAddr, ownID)
-	logger.Info().Msg("All peers finished connecting. Starting ISS.")
+	// With static membership there is no master. Messages from peers that are still connecting are simply
+	// delivered as soon as their connections are established.
+	if staticMembership {
+		logger.Info().Msg("Starting ISS.")
+	} else {
+		discovery.SyncPeer(discoveryServAddr, ownID)
+		logger.Info().Msg("All peers finished connecting. Starting ISS.")
+	}
 
 	// // If we are simulating a crashed node, exit immediately.
 	// if config.Config.LeaderPolicy == "SimulatedRandomFailures" {
 	// 	crash := true
-	// 	for _, l := range manager.NewLeaderPolicy(config.Config.LeaderPolicy).GetLeaders(0) {
+	// 	for _, l := range manager.NewLeaderPolicy(config.Config.LeaderPolicy, config.Config).GetLeaders(0) {
 	// 		if l == membership.OwnID {
 	// 			crash = false
 	// 		}
@@ -211,40 +299,42 @@ func setUpTracing(outFileName string, outFileName2 string, ownID int32) {
 	logger.Info().Str("traceFile", outFileName).Msg("Started tracing.")
 }
 
-func setManager(managerType string) (mngr manager.Manager) {
-	switch managerType {
+func setManager(cfg *config.Configuration) (mngr manager.Manager) {
+	switch cfg.Manager {
 	case "Dummy":
-		mngr = manager.NewDummyManager()
+		mngr = manager.NewDummyManager(cfg)
 	case "Mir":
-		mngr = manager.NewMirManager()
+		mngr = manager.NewMirManager(cfg)
 	default:
 		logger.Fatal().Msg("Unsupported manager type")
 	}
 	return mngr
 }
 
-func setOrderer(ordererType string) (ord orderer.Orderer) {
-	switch ordererType {
+func setOrderer(cfg *config.Configuration) (ord orderer.Orderer) {
+	switch cfg.Orderer {
 	case "Dummy":
-		ord = &orderer.DummyOrderer{}
+		ord = orderer.NewDummyOrderer(cfg)
 	case "Pbft":
-		ord = &orderer.PbftOrderer{}
+		ord = orderer.NewPbftOrderer(cfg)
 	case "HotStuff":
-		ord = &orderer.HotStuffOrderer{}
+		ord = orderer.NewHotStuffOrderer(cfg)
 	case "Raft":
-		ord = &orderer.RaftOrderer{}
+		ord = orderer.NewRaftOrderer(cfg)
+	case "Tendermint":
+		ord = orderer.NewTendermintOrderer(cfg)
 	default:
 		logger.Fatal().Msg("Unsupported orderer type")
 	}
 	return ord
 }
 
-func setCheckpointer(managerType string) (chkp checkpoint.Checkpointer) {
-	switch managerType {
+func setCheckpointer(cfg *config.Configuration) (chkp checkpoint.Checkpointer) {
+	switch cfg.Checkpointer {
 	case "Simple":
-		chkp = checkpoint.NewSimpleCheckpointer()
+		chkp = checkpoint.NewSimpleCheckpointer(cfg)
 	case "Signing":
-		chkp = checkpoint.NewSigningCheckpointer()
+		chkp = checkpoint.NewSigningCheckpointer(cfg)
 	default:
 		logger.Fatal().Msg("Unsupported manager type")
 	}
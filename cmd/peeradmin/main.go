@@ -0,0 +1,89 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The peeradmin command queries the admin service of a running peer (see the admin package and AdminPort).
+//
+// Usage:
+//
+//	peeradmin [flags] status           Prints the status of the peer as JSON.
+//	peeradmin [flags] loglevel LEVEL   Sets the logging level of the peer (trace, debug, info, warning or error).
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	"github.com/rs/zerolog"
+	logger "github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+)
+
+var (
+	addr    = flag.String("addr", "localhost:9500", "Address (host:port) of the admin service of the peer.")
+	timeout = flag.Duration("timeout", 5*time.Second, "Timeout for connecting to the peer and for the request.")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] status | loglevel LEVEL\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	logger.Logger = logger.Output(zerolog.ConsoleWriter{
+		Out:        os.Stderr,
+		NoColor:    true,
+		TimeFormat: "15:04:05.000"})
+
+	args := flag.Args()
+	if len(args) == 0 || (args[0] == "status" && len(args) != 1) || (args[0] == "loglevel" && len(args) != 2) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, *addr, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		logger.Fatal().Err(err).Str("addr", *addr).Msg("Could not connect to admin service.")
+	}
+	defer conn.Close()
+	client := pb.NewAdminClient(conn)
+
+	var response interface{}
+	switch args[0] {
+	case "status":
+		response, err = client.Status(ctx, &pb.StatusRequest{})
+	case "loglevel":
+		response, err = client.SetLogLevel(ctx, &pb.LogLevelRequest{Level: args[1]})
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		logger.Fatal().Err(err).Str("addr", *addr).Str("command", args[0]).Msg("Admin request failed.")
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(response); err != nil {
+		logger.Fatal().Err(err).Msg("Could not encode response.")
+	}
+}
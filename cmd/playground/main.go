@@ -393,9 +393,9 @@ func loadPubKey(pubKeyFile string) interface{} {
 
 func testBatchCutting() {
 	// Create buckets and a buffer
-	b0 := request.NewBucket(0)
-	b1 := request.NewBucket(1)
-	buf := request.NewBuffer(0)
+	b0 := request.NewBucket(0, config.Config)
+	b1 := request.NewBucket(1, config.Config)
+	buf := request.NewBuffer(0, config.Config)
 
 	request.Buckets = make([]*request.Bucket, 2)
 	request.Buckets[0] = b0
@@ -424,7 +424,7 @@ func testBatchCutting() {
 		})
 	}
 
-	bg := request.NewBucketGroup([]int{0, 1})
+	bg := request.NewBucketGroup([]int{0, 1}, config.Config)
 
 	logger.Info().Int("len", bg.CountRequests()).Msg("Bucket group created.")
 
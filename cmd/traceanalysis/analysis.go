@@ -0,0 +1,291 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/tracing"
+	logger "github.com/rs/zerolog/log"
+)
+
+// Names of the request paths in the results.
+// Payments take the fast path (response at commit), contracts the slow path (response at in-order delivery).
+const (
+	pathAll  = "all"
+	pathFast = "fast"
+	pathSlow = "slow"
+)
+
+// Latency percentiles reported for each path.
+var percentiles = []float64{50, 90, 95, 99}
+
+// The results of the analysis. All times are in seconds relative to the first event and all latencies in ms.
+type report struct {
+	Interval   float64         `json:"interval"`
+	Window     window          `json:"window"`
+	Throughput throughput      `json:"throughput"`
+	Latency    []latencyStats  `json:"latency"`
+	Leaders    []leaderStats   `json:"leaders"`
+	Timeline   []timelinePoint `json:"timeline"`
+}
+
+// The time window over which the aggregate values (throughput, latency and leader rates) are computed.
+// Trimmed is false if the whole experiment is used instead, as there are no client traces
+// or trimming would have left an empty window.
+type window struct {
+	Start    float64 `json:"start"`
+	End      float64 `json:"end"`
+	Duration float64 `json:"duration"`
+	Trimmed  bool    `json:"trimmed"`
+}
+
+// Requests per second.
+type throughput struct {
+	All      float64 `json:"all"`
+	Fast     float64 `json:"fast"`
+	Slow     float64 `json:"slow"`
+	Proposed float64 `json:"proposed"`
+}
+
+type latencyStats struct {
+	Path        string             `json:"path"`
+	Count       int                `json:"count"` // Number of sampled requests.
+	Avg         float64            `json:"avg"`
+	Max         float64            `json:"max"`
+	Percentiles map[string]float64 `json:"percentiles"` // Keyed by "p50", "p90", ...
+}
+
+type leaderStats struct {
+	Peer         int32   `json:"peer"`
+	Proposals    int64   `json:"proposals"`
+	Requests     int64   `json:"requests"`
+	ProposalRate float64 `json:"proposalRate"` // Per second.
+	RequestRate  float64 `json:"requestRate"`  // Per second.
+	AvgBatchSize float64 `json:"avgBatchSize"`
+}
+
+// Number of events in one interval of the timeline.
+type timelinePoint struct {
+	Time             float64 `json:"time"` // Start of the interval.
+	Finished         int64   `json:"finished"`
+	Fast             int64   `json:"fast"`
+	Slow             int64   `json:"slow"`
+	Proposals        int64   `json:"proposals"`
+	ProposedRequests int64   `json:"proposedRequests"`
+}
+
+// Computes the results from the collected trace events.
+// Request counts are multiplied by sampling (the client trace sampling)
+// and proposal counts by peerSampling (the peer trace sampling).
+func analyze(td *traceData, interval time.Duration, trim time.Duration, sampling int, peerSampling int) *report {
+	r := &report{Interval: interval.Seconds()}
+	if td.first > td.last {
+		logger.Warn().Msg("No requests or proposals found in the traces.")
+		return r
+	}
+
+	start, end, trimmed := td.window(trim.Microseconds())
+	r.Window = window{
+		Start:    seconds(start - td.first),
+		End:      seconds(end - td.first),
+		Duration: seconds(end - start),
+		Trimmed:  trimmed,
+	}
+
+	requests := td.finishedRequests()
+	inWindow := make([]finishedRequest, 0, len(requests))
+	unknown := 0
+	for _, req := range requests {
+		if req.time >= start && req.time < end {
+			inWindow = append(inWindow, req)
+		}
+		if req.kind == tracing.ReqKindUnknown {
+			unknown++
+		}
+	}
+	if unknown > 0 {
+		logger.Warn().Int("requests", unknown).
+			Msg("Kind of requests not recorded in the client traces. They only count towards the totals.")
+	}
+
+	r.Throughput = td.throughput(inWindow, start, end, sampling, peerSampling)
+	r.Latency = []latencyStats{
+		latencies(pathAll, inWindow, func(kind int64) bool { return true }),
+		latencies(pathFast, inWindow, func(kind int64) bool { return kind == tracing.ReqKindPayment }),
+		latencies(pathSlow, inWindow, func(kind int64) bool { return kind == tracing.ReqKindContract }),
+	}
+	r.Leaders = td.leaders(start, end, peerSampling)
+	r.Timeline = td.timeline(requests, interval.Microseconds(), sampling, peerSampling)
+
+	return r
+}
+
+// Returns the start and end (in us) of the window over which aggregate values are computed.
+// As the SQL analysis did, the window starts trim after the last client finished its first request
+// and ends trim before the first client sent its last request, so that all clients are running during the window.
+// Both bounds are included in the window, i.e., the returned end is one past the last included time.
+// Without client traces, or if the trimmed window is empty, the whole experiment is used and false is returned.
+func (td *traceData) window(trim int64) (int64, int64, bool) {
+	start := int64(math.MinInt64)
+	end := int64(math.MaxInt64)
+	for _, cs := range td.clients {
+		if cs.firstFinished == math.MaxInt64 || cs.lastSent == math.MinInt64 {
+			continue
+		}
+		start = max64(start, cs.firstFinished+trim)
+		end = min64(end, cs.lastSent-trim+1)
+	}
+
+	if start == math.MinInt64 || end == math.MaxInt64 {
+		return td.first, td.last + 1, false
+	}
+	if start >= end {
+		logger.Warn().Msg("Trimmed window is empty. Using the whole experiment. Consider reducing -trim.")
+		return td.first, td.last + 1, false
+	}
+	return start, end, true
+}
+
+func (td *traceData) throughput(requests []finishedRequest, start int64, end int64, sampling int, peerSampling int) throughput {
+	duration := seconds(end - start)
+	t := throughput{}
+	for _, req := range requests {
+		t.All++
+		switch req.kind {
+		case tracing.ReqKindPayment:
+			t.Fast++
+		case tracing.ReqKindContract:
+			t.Slow++
+		}
+	}
+	for _, p := range td.proposals {
+		if p.time >= start && p.time < end {
+			t.Proposed += float64(p.requests)
+		}
+	}
+
+	t.All *= float64(sampling) / duration
+	t.Fast *= float64(sampling) / duration
+	t.Slow *= float64(sampling) / duration
+	t.Proposed *= float64(peerSampling) / duration
+	return t
+}
+
+// Computes the latency statistics of the requests of the kinds selected by include.
+func latencies(path string, requests []finishedRequest, include func(kind int64) bool) latencyStats {
+	values := make([]float64, 0, len(requests))
+	sum := 0.0
+	for _, req := range requests {
+		if include(req.kind) {
+			ms := float64(req.latency) / 1000
+			values = append(values, ms)
+			sum += ms
+		}
+	}
+
+	stats := latencyStats{Path: path, Count: len(values), Percentiles: make(map[string]float64)}
+	if len(values) == 0 {
+		return stats
+	}
+
+	sort.Float64s(values)
+	stats.Avg = sum / float64(len(values))
+	stats.Max = values[len(values)-1]
+	for _, p := range percentiles {
+		stats.Percentiles[percentileName(p)] = percentile(values, p)
+	}
+	return stats
+}
+
+// Returns the p-th percentile of sorted values.
+// As the SQL analysis did (ORDER BY ... OFFSET count * p / 100), this is the value at (zero-based) index len*p/100.
+func percentile(sorted []float64, p float64) float64 {
+	i := int(float64(len(sorted)) * p / 100)
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func percentileName(p float64) string {
+	return "p" + formatFloat(p)
+}
+
+// Computes the proposal statistics of each leader within the window, ordered by peer ID.
+func (td *traceData) leaders(start int64, end int64, peerSampling int) []leaderStats {
+	byPeer := make(map[int32]*leaderStats)
+	for _, p := range td.proposals {
+		if p.time < start || p.time >= end {
+			continue
+		}
+		ls, ok := byPeer[p.peer]
+		if !ok {
+			ls = &leaderStats{Peer: p.peer}
+			byPeer[p.peer] = ls
+		}
+		ls.Proposals++
+		ls.Requests += p.requests
+	}
+
+	duration := seconds(end - start)
+	leaders := make([]leaderStats, 0, len(byPeer))
+	for _, ls := range byPeer {
+		ls.AvgBatchSize = float64(ls.Requests) / float64(ls.Proposals)
+		ls.Proposals *= int64(peerSampling)
+		ls.Requests *= int64(peerSampling)
+		ls.ProposalRate = float64(ls.Proposals) / duration
+		ls.RequestRate = float64(ls.Requests) / duration
+		leaders = append(leaders, *ls)
+	}
+	sort.Slice(leaders, func(i, j int) bool {
+		return leaders[i].Peer < leaders[j].Peer
+	})
+	return leaders
+}
+
+// Counts the finished requests and the proposals in each interval (of length interval, in us)
+// over the whole experiment.
+func (td *traceData) timeline(requests []finishedRequest, interval int64, sampling int, peerSampling int) []timelinePoint {
+	points := make([]timelinePoint, (td.last-td.first)/interval+1)
+	for i := range points {
+		points[i].Time = seconds(int64(i) * interval)
+	}
+
+	for _, req := range requests {
+		p := &points[(req.time-td.first)/interval]
+		p.Finished += int64(sampling)
+		switch req.kind {
+		case tracing.ReqKindPayment:
+			p.Fast += int64(sampling)
+		case tracing.ReqKindContract:
+			p.Slow += int64(sampling)
+		}
+	}
+	for _, prop := range td.proposals {
+		p := &points[(prop.time-td.first)/interval]
+		p.Proposals += int64(peerSampling)
+		p.ProposedRequests += prop.requests * int64(peerSampling)
+	}
+
+	return points
+}
+
+// Converts us to seconds.
+func seconds(us int64) float64 {
+	return float64(us) / 1e6
+}
@@ -0,0 +1,225 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The expected values are the results of the SQL analysis on testdata/fixture.trc, obtained with
+//
+//	python3 deployment/scripts/analyze/load-logs.py fixture.db cmd/traceanalysis/testdata/fixture.trc
+//	python3 deployment/scripts/analyze/run-queries.py fixture.db deployment/queries/aggregates.sql out
+//
+// The fixture contains the traces of two clients sending 32 and 31 requests (payments and contracts alternating)
+// and of four leaders proposing 45 batches. Two requests finish exactly at the bounds of the trimmed window.
+
+package main
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/tracing"
+)
+
+const fixtureEvents = 171
+
+// Bounds of request_truncated in aggregates.sql (5s cut off at each end) on the fixture, both included.
+const (
+	fixtureStart = 6260500
+	fixtureEnd   = 10500000
+)
+
+func loadFixture(t *testing.T) *traceData {
+	td := newTraceData()
+	n, err := td.load("testdata/fixture.trc")
+	if err != nil {
+		t.Fatalf("failed loading fixture: %s", err.Error())
+	}
+	if n != fixtureEvents {
+		t.Fatalf("loaded %d events from fixture, expected %d", n, fixtureEvents)
+	}
+	return td
+}
+
+// Returns the requests that finished in the window [start, end).
+func requestsIn(td *traceData, start int64, end int64) []finishedRequest {
+	requests := make([]finishedRequest, 0)
+	for _, req := range td.finishedRequests() {
+		if req.time >= start && req.time < end {
+			requests = append(requests, req)
+		}
+	}
+	return requests
+}
+
+// Returns the sorted latencies (in ms) of the requests that finished in the window [start, end).
+func sortedLatencies(td *traceData, start int64, end int64) []float64 {
+	values := make([]float64, 0)
+	for _, req := range requestsIn(td, start, end) {
+		values = append(values, float64(req.latency)/1000)
+	}
+	sort.Float64s(values)
+	return values
+}
+
+// Returns the sorted sizes of the batches proposed in the window [start, end).
+func sortedBatchSizes(td *traceData, start int64, end int64) []float64 {
+	values := make([]float64, 0)
+	for _, p := range td.proposals {
+		if p.time >= start && p.time < end {
+			values = append(values, float64(p.requests))
+		}
+	}
+	sort.Float64s(values)
+	return values
+}
+
+func TestPercentile(t *testing.T) {
+	td := loadFixture(t)
+
+	tests := []struct {
+		name   string
+		values []float64
+		p      float64
+		want   float64
+	}{
+		// latency-95pctile-raw.val
+		{"latency raw p95", sortedLatencies(td, math.MinInt64, math.MaxInt64), 95, 16.5},
+		// latency-95pctile-trunc.val. With 20 requests, the nearest rank (19th) would be 16.5.
+		{"latency trunc p95", sortedLatencies(td, fixtureStart, fixtureEnd+1), 95, 20},
+		// batch-size-10pctile-trunc.val
+		{"batch size trunc p10", sortedBatchSizes(td, fixtureStart, fixtureEnd+1), 10, 4},
+		// batch-size-90pctile-trunc.val
+		{"batch size trunc p90", sortedBatchSizes(td, fixtureStart, fixtureEnd+1), 90, 13},
+		// OFFSET 1 * 99 / 100
+		{"single value", []float64{7}, 99, 7},
+		// Never past the last value.
+		{"p100", []float64{1, 2, 3}, 100, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := percentile(test.values, test.p); got != test.want {
+				t.Errorf("p%v of %d values is %v, expected %v", test.p, len(test.values), got, test.want)
+			}
+		})
+	}
+}
+
+func TestWindow(t *testing.T) {
+	noClients := func(t *testing.T) *traceData {
+		td := newTraceData()
+		td.add(&event{Time: 1000, NodeID: 0, Val0: 3, Message: tracing.PROPOSE.String()})
+		td.add(&event{Time: 2000, NodeID: 1, Val0: 5, Message: tracing.PROPOSE.String()})
+		return td
+	}
+
+	tests := []struct {
+		name      string
+		td        func(t *testing.T) *traceData
+		trim      time.Duration
+		start     int64
+		end       int64
+		trimmed   bool
+		requests  int     // nreq-trunc.val
+		avg       float64 // latency-avg-trunc.val
+		proposals int64   // Rows of protocol_truncated with event = 'PROPOSE'.
+	}{
+		{"trim 5s", loadFixture, 5 * time.Second, fixtureStart, fixtureEnd + 1, true, 20, 9.925, 11},
+		// aggregates.sql with 5000000 replaced by 0.
+		{"no trim", loadFixture, 0, 1260500, 15500001, true, 60, 9.283333333333333, 35},
+		// The SQL analysis yields no rows. The whole experiment is used instead (nreq-raw.val, latency-avg-raw.val).
+		{"empty trimmed window", loadFixture, 10 * time.Second, 800000, 18400001, false, 63, 9.174603174603176, 45},
+		{"no client traces", noClients, 5 * time.Second, 1000, 2001, false, 0, 0, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			td := test.td(t)
+			start, end, trimmed := td.window(test.trim.Microseconds())
+			if start != test.start || end != test.end || trimmed != test.trimmed {
+				t.Fatalf("window is [%d, %d) (trimmed: %t), expected [%d, %d) (trimmed: %t)",
+					start, end, trimmed, test.start, test.end, test.trimmed)
+			}
+
+			stats := latencies(pathAll, requestsIn(td, start, end), func(kind int64) bool { return true })
+			if stats.Count != test.requests {
+				t.Errorf("%d requests in window, expected %d", stats.Count, test.requests)
+			}
+			if math.Abs(stats.Avg-test.avg) > 1e-9 {
+				t.Errorf("average latency in window is %v, expected %v", stats.Avg, test.avg)
+			}
+
+			proposals := int64(0)
+			for _, ls := range td.leaders(start, end, 1) {
+				proposals += ls.Proposals
+			}
+			if proposals != test.proposals {
+				t.Errorf("%d proposals in window, expected %d", proposals, test.proposals)
+			}
+		})
+	}
+}
+
+// The expected points are the results of the throughput in time query of misc.sql,
+// grouped by interval instead of by millisecond and relative to the first event instead of the first finished request:
+//
+//	SELECT (f.ts - <first>)/<interval> AS i, count(), sum(s.latency = 1), sum(s.latency = 2)
+//	FROM request f JOIN request s ON f.nodeId = s.nodeId AND f.clSn = s.clSn
+//	    AND f.event = 'REQ_FINISHED' AND s.event = 'REQ_SEND'
+//	GROUP BY i
+//
+//	SELECT (ts - <first>)/<interval> AS i, count(), sum(val)
+//	FROM protocol
+//	WHERE event = 'PROPOSE'
+//	GROUP BY i
+//
+// multiplied by sampling and peerSampling respectively.
+func TestTimeline(t *testing.T) {
+	td := loadFixture(t)
+
+	tests := []struct {
+		name         string
+		interval     time.Duration
+		sampling     int
+		peerSampling int
+		want         []timelinePoint
+	}{
+		{"5s", 5 * time.Second, 1, 1, []timelinePoint{
+			{0, 20, 10, 10, 13, 104},
+			{5, 23, 11, 12, 12, 94},
+			{10, 20, 10, 10, 13, 104},
+			{15, 0, 0, 0, 7, 58},
+		}},
+		{"5s sampled", 5 * time.Second, 10, 4, []timelinePoint{
+			{0, 200, 100, 100, 52, 416},
+			{5, 230, 110, 120, 48, 376},
+			{10, 200, 100, 100, 52, 416},
+			{15, 0, 0, 0, 28, 232},
+		}},
+		{"10s", 10 * time.Second, 1, 1, []timelinePoint{
+			{0, 43, 21, 22, 25, 198},
+			{10, 20, 10, 10, 20, 162},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := td.timeline(td.finishedRequests(), test.interval.Microseconds(), test.sampling, test.peerSampling)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("timeline is %v, expected %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The traceanalysis command analyzes the event traces written by the peers and clients of an experiment
+// directly, without loading them into a database first (as opposed to deployment/scripts/analyze).
+// It computes:
+// - the throughput timeline (requests finished by the clients and requests proposed by the peers per interval),
+// - the latency percentiles of all requests, of payments (fast path) and of contracts (slow path),
+// - the number and rate of proposals (and proposed requests) of each leader.
+// The results are printed as text or written as CSV files or a JSON document.
+//
+// Usage: traceanalysis [flags] trace-file-or-directory ...
+// Directories are searched recursively for trace files (.trc and .trc2 suffix).
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/rs/zerolog"
+	logger "github.com/rs/zerolog/log"
+)
+
+var (
+	interval = flag.Duration("interval", time.Second, "Length of the intervals of the timelines.")
+	trim     = flag.Duration("trim", 5*time.Second, "Time cut off at the start and at the end of the experiment "+
+		"(when not all clients are running) when computing the aggregate values.")
+	sampling = flag.Int("sampling", 1, "Multiplier for the request counts. "+
+		"Set to the ClientTraceSampling of the experiment to get the actual number of requests.")
+	peerSampling = flag.Int("peer-sampling", 1, "Multiplier for the proposal counts. "+
+		"Set to the TraceSampling of the experiment to get the actual number of proposals.")
+	configFile = flag.String("config", "", "Configuration file of the experiment. If given, -sampling and -peer-sampling "+
+		"default to its ClientTraceSampling and TraceSampling.")
+	format = flag.String("format", "text", "Output format: text, csv or json. "+
+		"The csv format also writes the aggregate values as .val files, like the SQL analysis.")
+	out = flag.String("out", "", "Output file (text, json) or directory (csv). Standard output (text, json) "+
+		"or the working directory (csv) if empty.")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] trace-file-or-directory ...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	logger.Logger = logger.Output(zerolog.ConsoleWriter{
+		Out:        os.Stderr,
+		NoColor:    true,
+		TimeFormat: "15:04:05.000"})
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *configFile != "" {
+		applyConfig(*configFile)
+	}
+	if *interval <= 0 || *trim < 0 || *sampling < 1 || *peerSampling < 1 {
+		logger.Fatal().
+			Dur("interval", *interval).
+			Dur("trim", *trim).
+			Int("sampling", *sampling).
+			Int("peerSampling", *peerSampling).
+			Msg("Invalid flags. Interval and sampling factors must be positive, trim must not be negative.")
+	}
+	if *format != "text" && *format != "csv" && *format != "json" {
+		logger.Fatal().Str("format", *format).Msg("Unknown output format.")
+	}
+
+	files, err := traceFiles(flag.Args())
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Could not list trace files.")
+	}
+	if len(files) == 0 {
+		logger.Fatal().Strs("paths", flag.Args()).Msg("No trace files found.")
+	}
+
+	traces := newTraceData()
+	for _, file := range files {
+		n, err := traces.load(file)
+		if err != nil {
+			logger.Fatal().Err(err).Str("file", file).Msg("Could not read trace file.")
+		}
+		logger.Info().Str("file", file).Int("events", n).Msg("Loaded trace file.")
+	}
+
+	report := analyze(traces, *interval, *trim, *sampling, *peerSampling)
+
+	switch *format {
+	case "text":
+		err = writeOutput(*out, report.writeText)
+	case "json":
+		err = writeOutput(*out, report.writeJSON)
+	case "csv":
+		err = report.writeCSV(*out)
+	}
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Could not write results.")
+	}
+}
+
+// Takes the trace sampling factors from the experiment's configuration file,
+// unless they were given explicitly on the command line.
+func applyConfig(fileName string) {
+	c, err := config.Load(fileName)
+	if err != nil {
+		logger.Fatal().Err(err).Str("fileName", fileName).Msg("Could not load configuration.")
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	if !explicit["sampling"] {
+		*sampling = c.ClientTraceSampling
+	}
+	if !explicit["peer-sampling"] {
+		*peerSampling = c.TraceSampling
+	}
+}
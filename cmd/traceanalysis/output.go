@@ -0,0 +1,238 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	logger "github.com/rs/zerolog/log"
+)
+
+// Names of the files written by writeCSV.
+const (
+	summaryFileName  = "summary.csv"
+	latencyFileName  = "latency.csv"
+	leadersFileName  = "leaders.csv"
+	timelineFileName = "timeline.csv"
+)
+
+// Calls write with the file fileName, or with the standard output if fileName is empty.
+func writeOutput(fileName string, write func(w io.Writer) error) error {
+	if fileName == "" {
+		return write(os.Stdout)
+	}
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	logger.Info().Str("file", fileName).Msg("Wrote results.")
+	return f.Close()
+}
+
+func (r *report) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func (r *report) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+
+	trimmed := ""
+	if !r.Window.Trimmed {
+		trimmed = " (not trimmed)"
+	}
+	fmt.Fprintf(tw, "Window: %.3fs - %.3fs (%.3fs)%s\n\n", r.Window.Start, r.Window.End, r.Window.Duration, trimmed)
+
+	fmt.Fprintf(tw, "Throughput (req/s)\n")
+	fmt.Fprintf(tw, "all\tfast\tslow\tproposed\t\n")
+	fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t\n",
+		formatFloat(r.Throughput.All), formatFloat(r.Throughput.Fast),
+		formatFloat(r.Throughput.Slow), formatFloat(r.Throughput.Proposed))
+	fmt.Fprintf(tw, "\nLatency (ms), fast: payments, slow: contracts\n")
+	fmt.Fprintf(tw, "%s\t\n", joinTabs(latencyHeader()))
+	for _, ls := range r.Latency {
+		fmt.Fprintf(tw, "%s\t\n", joinTabs(ls.row()))
+	}
+	fmt.Fprintf(tw, "\nLeaders\n")
+	fmt.Fprintf(tw, "%s\t\n", joinTabs(leaderHeader()))
+	for _, ls := range r.Leaders {
+		fmt.Fprintf(tw, "%s\t\n", joinTabs(ls.row()))
+	}
+	fmt.Fprintf(tw, "\nTimeline (per %ss)\n", formatFloat(r.Interval))
+	fmt.Fprintf(tw, "%s\t\n", joinTabs(timelineHeader()))
+	for _, p := range r.Timeline {
+		fmt.Fprintf(tw, "%s\t\n", joinTabs(p.row()))
+	}
+
+	return tw.Flush()
+}
+
+// Writes the results as CSV files to the directory dir (the working directory if empty).
+func (r *report) writeCSV(dir string) error {
+	if dir == "" {
+		dir = "."
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	summary := [][]string{
+		{"window-start", "window-end", "window-duration", "trimmed",
+			"throughput-all", "throughput-fast", "throughput-slow", "throughput-proposed"},
+		{formatFloat(r.Window.Start), formatFloat(r.Window.End), formatFloat(r.Window.Duration),
+			strconv.FormatBool(r.Window.Trimmed),
+			formatFloat(r.Throughput.All), formatFloat(r.Throughput.Fast),
+			formatFloat(r.Throughput.Slow), formatFloat(r.Throughput.Proposed)},
+	}
+	latency := [][]string{latencyHeader()}
+	for _, ls := range r.Latency {
+		latency = append(latency, ls.row())
+	}
+	leaders := [][]string{leaderHeader()}
+	for _, ls := range r.Leaders {
+		leaders = append(leaders, ls.row())
+	}
+	timeline := [][]string{timelineHeader()}
+	for _, p := range r.Timeline {
+		timeline = append(timeline, p.row())
+	}
+
+	files := []struct {
+		name    string
+		records [][]string
+	}{
+		{summaryFileName, summary},
+		{latencyFileName, latency},
+		{leadersFileName, leaders},
+		{timelineFileName, timeline},
+	}
+	for _, file := range files {
+		records := file.records
+		err := writeOutput(filepath.Join(dir, file.name), func(w io.Writer) error {
+			cw := csv.NewWriter(w)
+			if err := cw.WriteAll(records); err != nil {
+				return err
+			}
+			return cw.Error()
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.writeVals(dir)
+}
+
+// Writes the aggregate values to separate .val files in the directory dir,
+// named like the values exported by the SQL analysis (deployment/queries) and read by scripts/analyze/summarize.sh.
+func (r *report) writeVals(dir string) error {
+	proposeRate := 0.0
+	for _, ls := range r.Leaders {
+		proposeRate += ls.ProposalRate
+	}
+	vals := map[string]float64{
+		"duration-trunc":     r.Window.Duration,
+		"throughput-trunc":   r.Throughput.All,
+		"propose-rate-trunc": proposeRate,
+	}
+	for _, ls := range r.Latency {
+		suffix := "trunc"
+		if ls.Path != pathAll {
+			suffix = ls.Path + "-trunc"
+		} else {
+			vals["nreq-trunc"] = float64(ls.Count)
+		}
+		vals["latency-avg-"+suffix] = ls.Avg
+		vals["latency-95pctile-"+suffix] = ls.Percentiles[percentileName(95)]
+	}
+
+	for name, value := range vals {
+		fileName := filepath.Join(dir, name+".val")
+		if err := ioutil.WriteFile(fileName, []byte(formatFloat(value)+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func latencyHeader() []string {
+	header := []string{"path", "count", "avg"}
+	for _, p := range percentiles {
+		header = append(header, percentileName(p))
+	}
+	return append(header, "max")
+}
+
+func (ls *latencyStats) row() []string {
+	row := []string{ls.Path, strconv.Itoa(ls.Count), formatFloat(ls.Avg)}
+	for _, p := range percentiles {
+		row = append(row, formatFloat(ls.Percentiles[percentileName(p)]))
+	}
+	return append(row, formatFloat(ls.Max))
+}
+
+func leaderHeader() []string {
+	return []string{"peer", "proposals", "requests", "proposals/s", "requests/s", "avg-batch"}
+}
+
+func (ls *leaderStats) row() []string {
+	return []string{
+		strconv.Itoa(int(ls.Peer)),
+		strconv.FormatInt(ls.Proposals, 10),
+		strconv.FormatInt(ls.Requests, 10),
+		formatFloat(ls.ProposalRate),
+		formatFloat(ls.RequestRate),
+		formatFloat(ls.AvgBatchSize),
+	}
+}
+
+func timelineHeader() []string {
+	return []string{"time", "finished", "fast", "slow", "proposals", "proposed-requests"}
+}
+
+func (p *timelinePoint) row() []string {
+	return []string{
+		formatFloat(p.Time),
+		strconv.FormatInt(p.Finished, 10),
+		strconv.FormatInt(p.Fast, 10),
+		strconv.FormatInt(p.Slow, 10),
+		strconv.FormatInt(p.Proposals, 10),
+		strconv.FormatInt(p.ProposedRequests, 10),
+	}
+}
+
+func joinTabs(fields []string) string {
+	return strings.Join(fields, "\t")
+}
+
+// Formats a value with at most 3 decimal places.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(math.Round(v*1000)/1000, 'f', -1, 64)
+}
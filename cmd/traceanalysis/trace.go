@@ -0,0 +1,198 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Hanzheng2021/Orthrus/tracing"
+)
+
+// A single line of a trace file, as written by tracing.BufferedTrace.Stop.
+type event struct {
+	Time       int64  `json:"time"` // In us.
+	NodeID     int32  `json:"nodeId"`
+	SampledVal int64  `json:"sampledVal"`
+	Val0       int64  `json:"val0"`
+	Message    string `json:"message"`
+}
+
+// Identifies a request in the client traces. In client traces, nodeId is the negated client ID.
+type requestKey struct {
+	client int32
+	clSn   int64
+}
+
+// A request for which the client received enough responses.
+type finishedRequest struct {
+	time    int64 // In us.
+	latency int64 // From submission until enough responses were received, in us.
+	kind    int64 // One of the tracing.ReqKind* values.
+}
+
+// A batch proposed by a leader.
+type proposal struct {
+	peer     int32
+	time     int64 // In us.
+	requests int64
+}
+
+// Time of the first finished and the last sent request of a client, in us.
+type clientSpan struct {
+	firstFinished int64
+	lastSent      int64
+}
+
+// The events relevant to the analysis, collected from all trace files.
+// Other events (e.g. those of the per-request peer traces) are skipped.
+type traceData struct {
+	kinds     map[requestKey]int64 // Kind of each sent request.
+	finished  map[requestKey]int64 // Time each request finished, in us.
+	latencies map[requestKey]int64 // Latency of each finished request, in us.
+	proposals []proposal
+	clients   map[int32]*clientSpan
+
+	first int64 // Time of the first relevant event, in us.
+	last  int64 // Time of the last relevant event, in us.
+}
+
+func newTraceData() *traceData {
+	return &traceData{
+		kinds:     make(map[requestKey]int64),
+		finished:  make(map[requestKey]int64),
+		latencies: make(map[requestKey]int64),
+		proposals: make([]proposal, 0),
+		clients:   make(map[int32]*clientSpan),
+		first:     math.MaxInt64,
+		last:      math.MinInt64,
+	}
+}
+
+// Returns the trace files among the given paths, searching directories recursively.
+func traceFiles(paths []string) ([]string, error) {
+	files := make([]string, 0)
+	for _, path := range paths {
+		err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if p == path && !info.IsDir() {
+				// Files given explicitly are read whatever their name.
+				files = append(files, p)
+			} else if !info.IsDir() && (strings.HasSuffix(p, ".trc") || strings.HasSuffix(p, ".trc2")) {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Reads the relevant events of a trace file. Returns the number of events in the file.
+func (td *traceData) load(fileName string) (int, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	n := 0
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return n, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		td.add(&e)
+		n++
+	}
+	return n, scanner.Err()
+}
+
+func (td *traceData) add(e *event) {
+	switch e.Message {
+	case tracing.REQ_SEND.String():
+		key := requestKey{client: -e.NodeID, clSn: e.SampledVal}
+		td.kinds[key] = e.Val0
+		td.client(key.client).lastSent = max64(td.client(key.client).lastSent, e.Time)
+	case tracing.REQ_FINISHED.String():
+		key := requestKey{client: -e.NodeID, clSn: e.SampledVal}
+		td.finished[key] = e.Time
+		td.latencies[key] = e.Val0
+		td.client(key.client).firstFinished = min64(td.client(key.client).firstFinished, e.Time)
+	case tracing.PROPOSE.String():
+		td.proposals = append(td.proposals, proposal{peer: e.NodeID, time: e.Time, requests: e.Val0})
+	default:
+		return
+	}
+
+	td.first = min64(td.first, e.Time)
+	td.last = max64(td.last, e.Time)
+}
+
+func (td *traceData) client(clientID int32) *clientSpan {
+	cs, ok := td.clients[clientID]
+	if !ok {
+		cs = &clientSpan{firstFinished: math.MaxInt64, lastSent: math.MinInt64}
+		td.clients[clientID] = cs
+	}
+	return cs
+}
+
+// Returns the finished requests, with the kind recorded when they were sent.
+// Requests whose REQ_SEND event is missing are of kind tracing.ReqKindUnknown.
+func (td *traceData) finishedRequests() []finishedRequest {
+	requests := make([]finishedRequest, 0, len(td.finished))
+	for key, t := range td.finished {
+		requests = append(requests, finishedRequest{
+			time:    t,
+			latency: td.latencies[key],
+			kind:    td.kinds[key],
+		})
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].time < requests[j].time
+	})
+	return requests
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
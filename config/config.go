@@ -15,6 +15,8 @@
 package config
 
 import (
+	"fmt"
+
 	"github.com/rs/zerolog"
 	logger "github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v2"
@@ -23,9 +25,16 @@ import (
 	"time"
 )
 
-var Config configuration
+// The configuration of the process.
+// Modules receive the configuration they use at construction time (see the Init functions of the request, messenger,
+// dissemination, membership, tracing and account packages and the constructors of managers, orderers and
+// checkpointers) and do not fall back to this global when none is given.
+// LoadFile loads the configuration file into it. Only the commands (cmd/...) read it directly.
+var Config = &Configuration{}
 
-type configuration struct {
+// Configuration of a peer or client.
+// Treated as read-only once loaded (and, for peers, once the node overrides are applied).
+type Configuration struct {
 	LoggingLevelStr string `yaml:"Logging"`
 	LoggingLevel    zerolog.Level
 
@@ -35,6 +44,7 @@ type configuration struct {
 	CACertFile            string `yaml:"CACertFile"`
 	KeyFile               string `yaml:"KeyFile"`
 	CertFile              string `yaml:"CertFile"`
+	AuthenticatePeers     bool   `yaml:"AuthenticatePeers"`     // Authenticate peers by their identity keys and drop messages with a spoofed sender ID. Ignored if UseTLS is false.
 	BasicConnections      int    `yaml:"PriorityConnections"`   // Number of parallel connections between 2 peers.
 	PriorityConnections   int    `yaml:"BasicConnections"`      // Number of parallel priority connections between 2 peers
 	TestConnections       bool   `yaml:"TestConnections"`       // Enable testing of connections before the actual experiment starts.
@@ -43,10 +53,58 @@ type configuration struct {
 	ConnectionTestPayload int    `yaml:"ConnectionTestPayload"` // Number of bytes in the payload of each connection test message.
 	OutMessageBufSize     int    `yaml:"OutMessageBufsize"`     // Buffer size of channels used for outgoing messages. If 0, no channels are used.
 	OutMessageBatchPeriod int    `yaml:"OutMessageBatchPeriod"` // Batching period of outgoing non-priority messages to each peer.
+	SuperviseConnections  bool   `yaml:"SuperviseConnections"`  // Reconnect to peers whose connections fail.
+	ReconnectBackoffMin   int    `yaml:"ReconnectBackoffMin"`   // Initial delay (ms) between reconnection attempts.
+	ReconnectBackoffMax   int    `yaml:"ReconnectBackoffMax"`   // Maximal delay (ms) between reconnection attempts.
+	RetransmitBufferSize  int    `yaml:"RetransmitBufferSize"`  // Number of unacknowledged messages per peer retransmitted after reconnecting.
+	RetransmitAckPeriod   int    `yaml:"RetransmitAckPeriod"`   // Period (ms) of acknowledging received messages.
 	ThroughputCap         int    `yaml:"ThroughputCap"`         // Batches are not cut faster than at this rate (system-wide).
 	StragglerTolerance    int    `yaml:"StragglerTolerance"`
 	BatchSizeIncrement    int    `yaml:"BatchSizeIncrement"`
 
+	// Followers reject fresh proposals whose timestamp deviates from their local time by more than this (ms).
+	// The Reputation leader policy scores leaders by these timestamps.
+	ProposalTsTolerance int `yaml:"ProposalTsTolerance"`
+
+	// Compression of peer-to-peer messages. Each connection uses compression only if both peers enable it.
+	Compression             string         `yaml:"Compression"`             // One of none, zstd or snappy.
+	CompressionThreshold    int            `yaml:"CompressionThreshold"`    // Minimal size (bytes) of a message to be compressed.
+	CompressionThresholds   map[string]int `yaml:"CompressionThresholds"`   // Per-message-type overrides of CompressionThreshold.
+	CompressionReportPeriod int            `yaml:"CompressionReportPeriod"` // Period (ms) of tracing compression statistics.
+
+	// Network fault injection. The NetFault* options below are ignored if NetFaultInjection is false.
+	NetFaultInjection  bool    `yaml:"NetFaultInjection"`  // Inject faults on the outgoing connections to other peers.
+	NetFaultControl    bool    `yaml:"NetFaultControl"`    // Receive the faults to inject from the discovery server at runtime.
+	NetFaultLatency    string  `yaml:"NetFaultLatency"`    // Latency distribution on all links, e.g. "uniform:10ms:50ms".
+	NetFaultLoss       float64 `yaml:"NetFaultLoss"`       // Probability of dropping a message.
+	NetFaultDuplicate  float64 `yaml:"NetFaultDuplicate"`  // Probability of sending a message twice.
+	NetFaultReorder    float64 `yaml:"NetFaultReorder"`    // Probability of delaying a message past the subsequent ones.
+	NetFaultPartitions string  `yaml:"NetFaultPartitions"` // Named partitions, e.g. "a=0,1;b=2,3".
+
+	// Dissemination of request batches ahead of ordering. Only supported by the PBFT orderer.
+	Dissemination                bool `yaml:"Dissemination"`                // Propose availability certificates instead of batches.
+	DisseminationWindow          int  `yaml:"DisseminationWindow"`          // Max. batches disseminated ahead of the proposals.
+	DisseminationMaxCertificates int  `yaml:"DisseminationMaxCertificates"` // Max. certified batches per proposal.
+	DisseminationRetention       int  `yaml:"DisseminationRetention"`       // Time (ms) committed batch bodies are kept.
+	DisseminationFetchTimeout    int  `yaml:"DisseminationFetchTimeout"`    // Time (ms) before fetching a body from another peer.
+
+	// Forwarding of client requests to the leader of their bucket.
+	ForwardRequests         bool `yaml:"ForwardRequests"`         // Forward requests for buckets led by other peers.
+	RequestForwardRate      int  `yaml:"RequestForwardRate"`      // Max. forwarded requests per second (forwarding budget).
+	RequestForwardDedupSize int  `yaml:"RequestForwardDedupSize"` // Number of forwarded requests remembered for deduplication.
+
+	// Admission control of requests received from clients. Rates of 0 mean no limit.
+	AdmissionClientRate     int  `yaml:"AdmissionClientRate"`     // Max. requests per second admitted from each client.
+	AdmissionClientBurst    int  `yaml:"AdmissionClientBurst"`    // Max. burst of requests admitted from each client.
+	AdmissionGlobalRate     int  `yaml:"AdmissionGlobalRate"`     // Max. requests per second admitted from all clients.
+	AdmissionGlobalBurst    int  `yaml:"AdmissionGlobalBurst"`    // Max. burst of requests admitted from all clients.
+	AdmissionMaxBucketBytes int  `yaml:"AdmissionMaxBucketBytes"` // Max. total size of the requests in the buckets.
+	AdmissionFeeEviction    bool `yaml:"AdmissionFeeEviction"`    // Evict requests with lower fees when the buckets are full.
+
+	// Fee priority mode of batch cutting.
+	FeePriority       bool `yaml:"FeePriority"`       // Cut batches preferring requests with higher fees.
+	FeePriorityMaxAge int  `yaml:"FeePriorityMaxAge"` // Time (ms) after which a request is taken regardless of its fee.
+
 	// Startup config
 	Orderer            string `yaml:"Orderer"`
 	Manager            string `yaml:"Manager"`
@@ -72,6 +130,15 @@ type configuration struct {
 	SegmentLength      int  `yaml:"SegmentLength"`
 	WaitForCheckpoints bool `yaml:"WaitForCheckpoints"`
 
+	// Adaptive segment length. Only applies if SegmentLength (the initial segment length) is not 0.
+	AdaptiveSegmentLength bool `yaml:"AdaptiveSegmentLength"`
+	MinSegmentLength      int  `yaml:"MinSegmentLength"`
+	MaxSegmentLength      int  `yaml:"MaxSegmentLength"`
+	TargetEpochDuration   int  `yaml:"TargetEpochDuration"` // Epoch duration (ms) the adaptive segment length aims for.
+
+	// Checkpointer config
+	CheckpointMsgBufferSize int `yaml:"CheckpointMsgBufferSize"` // Number of unprocessed checkpoint messages buffered.
+
 	// Request Buffer Config
 	ClientWatermarkWindowSize int `yaml:"ClientWatermarkWindowSize"`
 	ClientRequestBacklogSize  int `yaml:"ClientRequestBacklogSize"` // The number of requests beyond client's current window that are backlogged.
@@ -79,6 +146,7 @@ type configuration struct {
 	// Manager config
 	LeaderPolicy     string `yaml:"LeaderPolicy"`
 	DefaultLeaderBan int    `yaml:"DefaultLeaderBan"`
+	BucketAssignment string `yaml:"BucketAssignment"` // One of {RoundRobin, LoadAware}. Defaults to RoundRobin.
 
 	// Orderer config
 	NumBuckets     int           `yaml:"NumBuckets"`
@@ -91,11 +159,34 @@ type configuration struct {
 	ViewChangeTimeoutMs int           `yaml:"ViewChangeTimeout"`
 	ViewChangeTimeout   time.Duration // Timeout (ns) to start a view change when an instance is not progressing.
 
+	// Tendermint Instance config
+	TendermintVoteTimeoutMs int           `yaml:"TendermintVoteTimeout"`
+	TendermintVoteTimeout   time.Duration // Base timeout (ns) of the prevote and precommit steps, increased linearly with the round.
+
 	// Tracing
 	EventBufferSize     int `yaml:"EventBufferSize"`     // Capacity of the tracing event buffer, in number of events.
 	TraceSampling       int `yaml:"TraceSampling"`       // Only trace one out of TraceSampling events.
 	ClientTraceSampling int `yaml:"ClientTraceSampling"` // Only trace one out of TraceSampling events.
 
+	// Request tracing
+	RequestTraceSampling  int    `yaml:"RequestTraceSampling"`  // Clients trace one out of RequestTraceSampling requests across all peers. 0 disables request tracing.
+	RequestTraceFile      string `yaml:"RequestTraceFile"`      // File to write request spans to (OTLP JSON, one export per line). %d is replaced by the peer or client ID.
+	RequestTraceCollector string `yaml:"RequestTraceCollector"` // URL of an OTLP/HTTP collector to send request spans to, e.g. http://localhost:4318/v1/traces.
+
+	// Metrics
+	MetricsPort       int `yaml:"MetricsPort"`       // Port of the metrics endpoint of peer 0, peer i uses MetricsPort+i. 0 disables the endpoint.
+	ClientMetricsPort int `yaml:"ClientMetricsPort"` // Port of the metrics endpoint of a client process. 0 disables the endpoint.
+
+	// Admin service
+	AdminPort int    `yaml:"AdminPort"` // Port of the admin gRPC service of peer 0, peer i uses AdminPort+i. 0 disables the service.
+	AdminHost string `yaml:"AdminHost"` // Host (interface address) the admin service binds to.
+
+	// Debug server (on-demand profiling)
+	DebugPort        int    `yaml:"DebugPort"`        // Port of the debug server of peer 0, peer i uses DebugPort+i. 0 disables the server.
+	ClientDebugPort  int    `yaml:"ClientDebugPort"`  // Port of the debug server of a client process. 0 disables the server.
+	DebugProfileRate int    `yaml:"DebugProfileRate"` // Block and mutex profile rate while the debug server runs. 0 leaves these profiles disabled.
+	DebugHost        string `yaml:"DebugHost"`        // Host (interface address) the debug server binds to.
+
 	// Client configuration
 	ClientsPerProcess    int    `yaml:"ClientsPerProcess"`    // Number of concurrent clients in the orderingclient process (running as separate threads).
 	RequestsPerClient    int    `yaml:"RequestsPerClient"`    // Number of requests each client submits.
@@ -109,29 +200,58 @@ type configuration struct {
 	ClientPrivKeyFile    string `yaml:"ClientPrivKeyFile"`   // Key for client request verification.
 	PrecomputeRequests   bool   `yaml:"PrecomputeRequests"`  // Pre-compute (and sign, if applicable) all requests at a client before starting to submit.
 
+	// Request expiry
+	RequestTTL int `yaml:"RequestTTL"` // Number of sequence numbers after the last one observed by the client for which a request is valid. 0 for no expiry.
+
 	// System parameters
 	RequestHandlerThreads     int    `yaml:"RequestHandlerThreads"` // Number of threads that write incoming requests to request Buffers.
 	RequestInputChannelBuffer int    `yaml:"RequestInputChannelBuffer"`
 	BatchVerifier             string `yaml:"BatchVerifier"`
+
+	// Per-node overrides of the entries above, applied by ApplyNodeOverrides.
+	NodeOverrides map[int32]map[string]interface{} `yaml:"NodeOverrides"`
 }
 
-func LoadFile(configFileName string) {
+// Loads a configuration file, applies the overrides from the environment and validates the result.
+// Unknown and duplicate entries are rejected. Missing entries keep their default values.
+func Load(configFileName string) (*Configuration, error) {
 	f, err := ioutil.ReadFile(configFileName)
-
 	if err != nil {
-		logger.Fatal().Err(err).Str("configFileName", configFileName).Msg("Could not read config file.")
+		return nil, fmt.Errorf("could not read config file: %s", err.Error())
+	}
+
+	c := defaults()
+	if err := yaml.UnmarshalStrict(f, c); err != nil {
+		return nil, fmt.Errorf("could not unmarshal config file: %s", err.Error())
+	}
+	if err := checkNodeOverrides(c); err != nil {
+		return nil, err
+	}
+	if err := applyEnvOverrides(c); err != nil {
+		return nil, fmt.Errorf("invalid configuration override in environment: %s", err.Error())
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
 	}
+	c.deriveValues()
+	return c, nil
+}
 
-	err = yaml.Unmarshal(f, &Config)
+// Loads a configuration file (see Load) into the global Config.
+func LoadFile(configFileName string) {
+	c, err := Load(configFileName)
 	if err != nil {
-		logger.Fatal().Err(err).Str("configFileName", configFileName).Msg("Could not unmarshal config file.")
+		logger.Fatal().Err(err).Str("configFileName", configFileName).Msg("Could not load config file.")
 	}
+	// Update the global in place, so modules holding on to it see the loaded configuration.
+	*Config = *c
 
 	logger.Debug().Str("Logging", Config.LoggingLevelStr).Msg("Config")
 	logger.Debug().Bool("UseTLS", Config.UseTLS).Msg("Config")
 	logger.Debug().Str("CACertFile", Config.CACertFile).Msg("Config")
 	logger.Debug().Str("KeyFile", Config.KeyFile).Msg("Config")
 	logger.Debug().Str("CertFile", Config.CertFile).Msg("Config")
+	logger.Debug().Bool("AuthenticatePeers", Config.AuthenticatePeers).Msg("Config")
 	logger.Debug().Int("PriorityConnections", Config.PriorityConnections).Msg("Config")
 	logger.Debug().Int("BasicConnections", Config.BasicConnections).Msg("Config")
 	logger.Debug().Bool("TestConnections", Config.TestConnections).Msg("Config")
@@ -139,10 +259,43 @@ func LoadFile(configFileName string) {
 	logger.Debug().Int("ConnectionTestMsgs", Config.ConnectionTestMsgs).Msg("Config")
 	logger.Debug().Int("ConnectionTestPayload", Config.ConnectionTestPayload).Msg("Config")
 	logger.Debug().Int("OutMessageBufsize", Config.OutMessageBufSize).Msg("Config")
-	logger.Debug().Int("OutMessageBufsize", Config.OutMessageBatchPeriod).Msg("Config")
+	logger.Debug().Int("OutMessageBatchPeriod", Config.OutMessageBatchPeriod).Msg("Config")
+	logger.Debug().Bool("SuperviseConnections", Config.SuperviseConnections).Msg("Config")
+	logger.Debug().Int("ReconnectBackoffMin", Config.ReconnectBackoffMin).Msg("Config")
+	logger.Debug().Int("ReconnectBackoffMax", Config.ReconnectBackoffMax).Msg("Config")
+	logger.Debug().Int("RetransmitBufferSize", Config.RetransmitBufferSize).Msg("Config")
+	logger.Debug().Int("RetransmitAckPeriod", Config.RetransmitAckPeriod).Msg("Config")
+	logger.Debug().Str("Compression", Config.Compression).Msg("Config")
+	logger.Debug().Int("CompressionThreshold", Config.CompressionThreshold).Msg("Config")
+	logger.Debug().Int("CompressionReportPeriod", Config.CompressionReportPeriod).Msg("Config")
+	logger.Debug().Interface("CompressionThresholds", Config.CompressionThresholds).Msg("Config")
+	logger.Debug().Bool("NetFaultInjection", Config.NetFaultInjection).Msg("Config")
+	logger.Debug().Bool("NetFaultControl", Config.NetFaultControl).Msg("Config")
+	logger.Debug().Str("NetFaultLatency", Config.NetFaultLatency).Msg("Config")
+	logger.Debug().Float64("NetFaultLoss", Config.NetFaultLoss).Msg("Config")
+	logger.Debug().Float64("NetFaultDuplicate", Config.NetFaultDuplicate).Msg("Config")
+	logger.Debug().Float64("NetFaultReorder", Config.NetFaultReorder).Msg("Config")
+	logger.Debug().Str("NetFaultPartitions", Config.NetFaultPartitions).Msg("Config")
+	logger.Debug().Bool("Dissemination", Config.Dissemination).Msg("Config")
+	logger.Debug().Int("DisseminationWindow", Config.DisseminationWindow).Msg("Config")
+	logger.Debug().Int("DisseminationMaxCertificates", Config.DisseminationMaxCertificates).Msg("Config")
+	logger.Debug().Int("DisseminationRetention", Config.DisseminationRetention).Msg("Config")
+	logger.Debug().Int("DisseminationFetchTimeout", Config.DisseminationFetchTimeout).Msg("Config")
+	logger.Debug().Bool("ForwardRequests", Config.ForwardRequests).Msg("Config")
+	logger.Debug().Int("RequestForwardRate", Config.RequestForwardRate).Msg("Config")
+	logger.Debug().Int("RequestForwardDedupSize", Config.RequestForwardDedupSize).Msg("Config")
+	logger.Debug().Int("AdmissionClientRate", Config.AdmissionClientRate).Msg("Config")
+	logger.Debug().Int("AdmissionClientBurst", Config.AdmissionClientBurst).Msg("Config")
+	logger.Debug().Int("AdmissionGlobalRate", Config.AdmissionGlobalRate).Msg("Config")
+	logger.Debug().Int("AdmissionGlobalBurst", Config.AdmissionGlobalBurst).Msg("Config")
+	logger.Debug().Int("AdmissionMaxBucketBytes", Config.AdmissionMaxBucketBytes).Msg("Config")
+	logger.Debug().Bool("AdmissionFeeEviction", Config.AdmissionFeeEviction).Msg("Config")
+	logger.Debug().Bool("FeePriority", Config.FeePriority).Msg("Config")
+	logger.Debug().Int("FeePriorityMaxAge", Config.FeePriorityMaxAge).Msg("Config")
 	logger.Debug().Int("ThroughputCap", Config.ThroughputCap).Msg("Config")
 	logger.Debug().Int("StragglerTolerance", Config.StragglerTolerance).Msg("Config")
 	logger.Debug().Int("BatchSizeIncrement", Config.BatchSizeIncrement).Msg("Config")
+	logger.Debug().Int("ProposalTsTolerance", Config.ProposalTsTolerance).Msg("Config")
 	logger.Debug().Str("Orderer", Config.Orderer).Msg("Config")
 	logger.Debug().Str("Manager", Config.Manager).Msg("Config")
 	logger.Debug().Int("Failures", Config.Failures).Msg("Config")
@@ -153,23 +306,41 @@ func LoadFile(configFileName string) {
 	logger.Debug().Int("TotalClients", Config.TotalClients).Msg("Config")
 	logger.Debug().Str("CrashTiming", Config.CrashTiming).Msg("Config")
 	logger.Debug().Int("CheckpointInterval", Config.CheckpointInterval).Msg("Config")
+	logger.Debug().Int("CheckpointMsgBufferSize", Config.CheckpointMsgBufferSize).Msg("Config")
 	logger.Debug().Int("WatermarkWindowSize", Config.WatermarkWindowSize).Msg("Config")
 	logger.Debug().Int("EpochLength", Config.EpochLength).Msg("Config")
 	logger.Debug().Int("SegmentLength", Config.SegmentLength).Msg("Config")
 	logger.Debug().Bool("WaitForCheckpoints", Config.WaitForCheckpoints).Msg("Config")
+	logger.Debug().Bool("AdaptiveSegmentLength", Config.AdaptiveSegmentLength).Msg("Config")
+	logger.Debug().Int("MinSegmentLength", Config.MinSegmentLength).Msg("Config")
+	logger.Debug().Int("MaxSegmentLength", Config.MaxSegmentLength).Msg("Config")
+	logger.Debug().Int("TargetEpochDuration", Config.TargetEpochDuration).Msg("Config")
 	logger.Debug().Int("ClientWatermarkWindowSize", Config.ClientWatermarkWindowSize).Msg("Config")
 	logger.Debug().Int("ClientRequestBacklogSize", Config.ClientRequestBacklogSize).Msg("Config")
 	logger.Debug().Int64("RandomSeed", Config.RandomSeed).Msg("Config")
 	logger.Debug().Int("NodeToLeaderRatio", Config.NodeToLeaderRatio).Msg("Config")
 	logger.Debug().Str("LeaderPolicy", Config.LeaderPolicy).Msg("Config")
 	logger.Debug().Int("DefaultLeaderBan", Config.DefaultLeaderBan).Msg("Config")
+	logger.Debug().Str("BucketAssignment", Config.BucketAssignment).Msg("Config")
 	logger.Debug().Int("NumBuckets", Config.NumBuckets).Msg("Config")
 	logger.Debug().Int("BatchTimeoutMs", Config.BatchTimeoutMs).Msg("Config")
 	logger.Debug().Bool("DisabledViewChange", Config.DisabledViewChange).Msg("Config")
 	logger.Debug().Int("ViewChangeTimeout", Config.ViewChangeTimeoutMs).Msg("Config")
+	logger.Debug().Int("TendermintVoteTimeout", Config.TendermintVoteTimeoutMs).Msg("Config")
 	logger.Debug().Int("ClientTraceSampling", Config.ClientTraceSampling).Msg("Config")
 	logger.Debug().Int("EventBufferSize", Config.EventBufferSize).Msg("Config")
 	logger.Debug().Int("TraceSampling", Config.TraceSampling).Msg("Config")
+	logger.Debug().Int("RequestTraceSampling", Config.RequestTraceSampling).Msg("Config")
+	logger.Debug().Str("RequestTraceFile", Config.RequestTraceFile).Msg("Config")
+	logger.Debug().Str("RequestTraceCollector", Config.RequestTraceCollector).Msg("Config")
+	logger.Debug().Int("MetricsPort", Config.MetricsPort).Msg("Config")
+	logger.Debug().Int("ClientMetricsPort", Config.ClientMetricsPort).Msg("Config")
+	logger.Debug().Int("AdminPort", Config.AdminPort).Msg("Config")
+	logger.Debug().Str("AdminHost", Config.AdminHost).Msg("Config")
+	logger.Debug().Int("DebugPort", Config.DebugPort).Msg("Config")
+	logger.Debug().Int("ClientDebugPort", Config.ClientDebugPort).Msg("Config")
+	logger.Debug().Int("DebugProfileRate", Config.DebugProfileRate).Msg("Config")
+	logger.Debug().Str("DebugHost", Config.DebugHost).Msg("Config")
 	logger.Debug().Int("ClientsPerProcess", Config.ClientsPerProcess).Msg("Config")
 	logger.Debug().Int("RequestsPerClient", Config.RequestsPerClient).Msg("Config")
 	logger.Debug().Int("ClientRunTime", Config.ClientRunTime).Msg("Config")
@@ -180,31 +351,45 @@ func LoadFile(configFileName string) {
 	logger.Debug().Str("ClientPrivKeyFile", Config.ClientPrivKeyFile).Msg("Config")
 	logger.Debug().Str("ClientPubKeyFile", Config.ClientPubKeyFile).Msg("Config")
 	logger.Debug().Bool("PrecomputeRequests", Config.PrecomputeRequests).Msg("Config")
+	logger.Debug().Int("RequestTTL", Config.RequestTTL).Msg("Config")
 	logger.Debug().Int("RequestHandlerThreads", Config.RequestHandlerThreads).Msg("Config")
 	logger.Debug().Int("RequestInputChannelBuffer", Config.RequestInputChannelBuffer).Msg("Config")
 	logger.Debug().Str("BatchVerifier", Config.BatchVerifier).Msg("Config")
+	logger.Debug().Int("NodeOverrides", len(Config.NodeOverrides)).Msg("Config")
+}
 
-	Config.LoggingLevel = setLoggingLevel(Config.LoggingLevelStr)
-
-	Config.BatchTimeout = time.Duration(Config.BatchTimeoutMs) * time.Millisecond
-	Config.ViewChangeTimeout = time.Duration(Config.ViewChangeTimeoutMs) * time.Millisecond
+// Computes the configuration values that are not read directly from the configuration file.
+func (c *Configuration) deriveValues() {
+	c.LoggingLevel = setLoggingLevel(c.LoggingLevelStr)
 
+	c.BatchTimeout = time.Duration(c.BatchTimeoutMs) * time.Millisecond
+	c.ViewChangeTimeout = time.Duration(c.ViewChangeTimeoutMs) * time.Millisecond
+	c.TendermintVoteTimeout = time.Duration(c.TendermintVoteTimeoutMs) * time.Millisecond
 }
 
 func setLoggingLevel(level string) zerolog.Level {
+	l, err := ParseLoggingLevel(level)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Unsupported logging level")
+	}
+	return l
+}
+
+// Converts the name of a logging level, as used in the configuration file, to the zerolog level.
+// Also used for changing the level at runtime (see the admin package).
+func ParseLoggingLevel(level string) (zerolog.Level, error) {
 	switch level {
 	case "trace":
-		return zerolog.TraceLevel
+		return zerolog.TraceLevel, nil
 	case "debug":
-		return zerolog.DebugLevel
+		return zerolog.DebugLevel, nil
 	case "info":
-		return zerolog.InfoLevel
+		return zerolog.InfoLevel, nil
 	case "warning":
-		return zerolog.WarnLevel
+		return zerolog.WarnLevel, nil
 	case "error":
-		return zerolog.ErrorLevel
+		return zerolog.ErrorLevel, nil
 	default:
-		logger.Fatal().Msg("Unsupported logging level")
+		return zerolog.NoLevel, fmt.Errorf("unsupported logging level: %q", level)
 	}
-	return zerolog.NoLevel
 }
@@ -0,0 +1,150 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	logger "github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+// Overrides of configuration entries.
+// The values in the configuration file can be overridden by (in increasing order of precedence):
+// 1. The NodeOverrides section of the configuration file, containing entries that only apply to a specific peer, e.g.
+//      NodeOverrides:
+//        3:
+//          Logging: trace
+//    As the ID of a peer is only known after registration with the discovery service,
+//    per-node overrides are applied by ApplyNodeOverrides, not by LoadFile.
+// 2. Environment variables named EnvPrefix followed by the name of the entry, e.g. ORTHRUS_MetricsPort=9100.
+//    The values are parsed as YAML.
+// Only node-local entries (see nodeLocalEntries) can be overridden. All other entries must be the same at all peers.
+
+// Prefix of the environment variables overriding configuration entries.
+const EnvPrefix = "ORTHRUS_"
+
+// Entries of the configuration that only affect the local process (logging, listening ports and hosts,
+// trace and profiling outputs, TLS files) and thus can differ between peers.
+var nodeLocalEntries = map[string]bool{
+	"Logging":               true,
+	"CACertFile":            true,
+	"KeyFile":               true,
+	"CertFile":              true,
+	"MetricsPort":           true,
+	"ClientMetricsPort":     true,
+	"AdminPort":             true,
+	"AdminHost":             true,
+	"DebugPort":             true,
+	"ClientDebugPort":       true,
+	"DebugHost":             true,
+	"DebugProfileRate":      true,
+	"RequestTraceFile":      true,
+	"RequestTraceCollector": true,
+}
+
+// Applies the entries of the NodeOverrides section for the given peer (and the environment variables again,
+// as they take precedence), then validates the resulting configuration.
+// Must be called before passing the configuration to any module.
+func (c *Configuration) ApplyNodeOverrides(nodeID int32) error {
+	section, ok := c.NodeOverrides[nodeID]
+	if !ok {
+		return nil
+	}
+
+	if err := checkNodeLocal(section); err != nil {
+		return fmt.Errorf("node override section %d: %s", nodeID, err.Error())
+	}
+	if err := applyEntries(c, section); err != nil {
+		return fmt.Errorf("node override section %d: %s", nodeID, err.Error())
+	}
+	for key, value := range section {
+		logger.Debug().Int32("nodeID", nodeID).Str("key", key).Interface("value", value).Msg("Config override")
+	}
+	if err := applyEnvOverrides(c); err != nil {
+		return fmt.Errorf("invalid configuration override in environment: %s", err.Error())
+	}
+
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	c.deriveValues()
+	return nil
+}
+
+// Applies the node overrides (see Configuration.ApplyNodeOverrides) to the global Config.
+func ApplyNodeOverrides(nodeID int32) {
+	if err := Config.ApplyNodeOverrides(nodeID); err != nil {
+		logger.Fatal().Err(err).Int32("nodeID", nodeID).Msg("Invalid configuration after applying node overrides.")
+	}
+}
+
+// Checks that all node override sections only contain valid entries.
+func checkNodeOverrides(c *Configuration) error {
+	for nodeID, section := range c.NodeOverrides {
+		if err := checkNodeLocal(section); err != nil {
+			return fmt.Errorf("node override section %d: %s", nodeID, err.Error())
+		}
+		if err := applyEntries(defaults(), section); err != nil {
+			return fmt.Errorf("node override section %d: %s", nodeID, err.Error())
+		}
+	}
+	return nil
+}
+
+// Overrides the configuration entries for which an environment variable is set.
+func applyEnvOverrides(c *Configuration) error {
+	entries := make(map[string]interface{})
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, EnvPrefix) {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(env, EnvPrefix), "=", 2)
+		var value interface{}
+		if err := yaml.Unmarshal([]byte(kv[1]), &value); err != nil {
+			return fmt.Errorf("%s%s: %s", EnvPrefix, kv[0], err.Error())
+		}
+		entries[kv[0]] = value
+		logger.Debug().Str("key", kv[0]).Str("value", kv[1]).Msg("Config override from environment")
+	}
+	if err := checkNodeLocal(entries); err != nil {
+		return err
+	}
+	return applyEntries(c, entries)
+}
+
+// Returns an error if any of the entries is not node-local.
+func checkNodeLocal(entries map[string]interface{}) error {
+	for key := range entries {
+		if !nodeLocalEntries[key] {
+			return fmt.Errorf("%s is not a node-local entry and cannot be overridden", key)
+		}
+	}
+	return nil
+}
+
+// Overrides configuration entries, rejecting unknown entries and invalid values.
+func applyEntries(c *Configuration, entries map[string]interface{}) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	data, err := yaml.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(data, c)
+}
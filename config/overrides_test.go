@@ -0,0 +1,86 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		value string
+		valid bool
+	}{
+		{"node-local entry", "MetricsPort", "9100", true},
+		{"logging", "Logging", "trace", true},
+		{"protocol entry", "BatchSize", "100", false},
+		{"client load entry", "RequestRate", "10", false},
+		{"node overrides", "NodeOverrides", "{}", false},
+		{"unknown entry", "NoSuchEntry", "1", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(EnvPrefix+tc.key, tc.value)
+			c := defaults()
+			err := applyEnvOverrides(c)
+			if tc.valid && err != nil {
+				t.Fatalf("%s%s=%s rejected: %s", EnvPrefix, tc.key, tc.value, err.Error())
+			}
+			if !tc.valid && err == nil {
+				t.Fatalf("%s%s=%s accepted", EnvPrefix, tc.key, tc.value)
+			}
+		})
+	}
+
+	t.Setenv(EnvPrefix+"MetricsPort", "9100")
+	c := defaults()
+	if err := applyEnvOverrides(c); err != nil || c.MetricsPort != 9100 {
+		t.Fatalf("MetricsPort not overridden: %d (%v)", c.MetricsPort, err)
+	}
+}
+
+func TestNodeOverrides(t *testing.T) {
+	c := defaults()
+	c.NodeOverrides = map[int32]map[string]interface{}{
+		1: {"AdminPort": 9200, "Logging": "debug"},
+	}
+	if err := checkNodeOverrides(c); err != nil {
+		t.Fatalf("node-local overrides rejected: %s", err.Error())
+	}
+	if err := c.ApplyNodeOverrides(1); err != nil {
+		t.Fatalf("could not apply node-local overrides: %s", err.Error())
+	}
+	if c.AdminPort != 9200 || c.LoggingLevelStr != "debug" {
+		t.Errorf("overrides not applied: AdminPort %d, Logging %s", c.AdminPort, c.LoggingLevelStr)
+	}
+
+	for _, section := range []map[string]interface{}{
+		{"BatchSize": 100},
+		{"Logging": "debug", "EpochLength": 64},
+		{"NodeOverrides": map[int32]interface{}{}},
+	} {
+		c := defaults()
+		c.NodeOverrides = map[int32]map[string]interface{}{0: section}
+		if err := checkNodeOverrides(c); err == nil {
+			t.Errorf("node override section %v accepted", section)
+		}
+		if err := c.ApplyNodeOverrides(0); err == nil {
+			t.Errorf("node override section %v applied", section)
+		}
+	}
+}
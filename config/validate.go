@@ -0,0 +1,255 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Returns the configuration used for all entries missing in the configuration file.
+// Only entries for which the zero value is not a sensible choice have defaults.
+// The default values correspond to the ones in the config.yml file shipped with the code.
+func defaults() *Configuration {
+	return &Configuration{
+		LoggingLevelStr:         "info",
+		BasicConnections:        1,
+		PriorityConnections:     1,
+		ReconnectBackoffMin:     100,
+		ReconnectBackoffMax:     5000,
+		RetransmitAckPeriod:     50,
+		Compression:             "none",
+		CompressionThreshold:    4096,
+		CompressionReportPeriod: 1000,
+
+		DisseminationWindow:          8,
+		DisseminationMaxCertificates: 4,
+		DisseminationRetention:       5000,
+		DisseminationFetchTimeout:    1000,
+		RequestForwardRate:           10000,
+		RequestForwardDedupSize:      65536,
+		FeePriorityMaxAge:            1000,
+
+		Orderer:           "Pbft",
+		Manager:           "Mir",
+		Checkpointer:      "Simple",
+		CrashTiming:       "EpochEnd",
+		NodeToLeaderRatio: 1,
+
+		CheckpointInterval:        64,
+		CheckpointMsgBufferSize:   4096,
+		WatermarkWindowSize:       64,
+		EpochLength:               64,
+		MinSegmentLength:          4,
+		MaxSegmentLength:          256,
+		TargetEpochDuration:       5000,
+		ClientWatermarkWindowSize: 100,
+		ClientRequestBacklogSize:  100,
+
+		LeaderPolicy:     "Simple",
+		DefaultLeaderBan: 2,
+		BucketAssignment: "RoundRobin",
+
+		NumBuckets:              16,
+		BatchSize:               40,
+		BatchTimeoutMs:          50,
+		ViewChangeTimeoutMs:     20000,
+		TendermintVoteTimeoutMs: 1000,
+		ProposalTsTolerance:     1000,
+
+		AdminHost: "127.0.0.1",
+		DebugHost: "127.0.0.1",
+
+		EventBufferSize:     1048576,
+		TraceSampling:       1,
+		ClientTraceSampling: 10,
+
+		ClientsPerProcess:  1,
+		RequestPayloadSize: 250,
+
+		RequestHandlerThreads:     16,
+		RequestInputChannelBuffer: 1024,
+		BatchVerifier:             "sequential",
+	}
+}
+
+// Checks the configuration for invalid values and invalid combinations of values.
+// Returns an error describing all the problems found, or nil if the configuration is valid.
+// Checks depending on the number of peers are performed by ValidateMembership.
+func (c *Configuration) Validate() error {
+	v := &validator{}
+
+	v.oneOf("Logging", c.LoggingLevelStr, "trace", "debug", "info", "warning", "error")
+	v.oneOf("Orderer", c.Orderer, "Dummy", "Pbft", "HotStuff", "Raft", "Tendermint")
+	v.oneOf("Manager", c.Manager, "Dummy", "Mir")
+	v.oneOf("Checkpointer", c.Checkpointer, "Simple", "Signing")
+	v.oneOf("LeaderPolicy", c.LeaderPolicy,
+		"Simple", "Single", "Backoff", "Blacklist", "Combined", "Reputation", "SimulatedRandomFailures")
+	if c.BucketAssignment != "" {
+		v.oneOf("BucketAssignment", c.BucketAssignment, "RoundRobin", "LoadAware")
+	}
+	if c.Compression != "" {
+		v.oneOf("Compression", c.Compression, "none", "zstd", "snappy")
+	}
+	v.oneOf("CrashTiming", c.CrashTiming,
+		"EpochStart", "EpochEnd", "Straggler", "ByzantineStraggler", "SilentStraggler", "Equivocation")
+	v.oneOf("BatchVerifier", c.BatchVerifier, "sequential", "parallel", "external")
+
+	v.positive("BasicConnections", c.BasicConnections)
+	v.positive("NumBuckets", c.NumBuckets)
+	v.positive("BatchSize", c.BatchSize)
+	v.positive("NodeToLeaderRatio", c.NodeToLeaderRatio)
+	v.positive("CheckpointInterval", c.CheckpointInterval)
+	v.positive("CheckpointMsgBufferSize", c.CheckpointMsgBufferSize)
+	v.positive("WatermarkWindowSize", c.WatermarkWindowSize)
+	v.positive("EpochLength", c.EpochLength)
+	v.positive("ClientWatermarkWindowSize", c.ClientWatermarkWindowSize)
+	v.positive("ClientsPerProcess", c.ClientsPerProcess)
+	v.positive("TraceSampling", c.TraceSampling)
+	v.positive("ClientTraceSampling", c.ClientTraceSampling)
+	v.positive("RequestHandlerThreads", c.RequestHandlerThreads)
+	v.positive("ProposalTsTolerance", c.ProposalTsTolerance)
+	v.nonNegative("BatchTimeout", c.BatchTimeoutMs)
+	v.nonNegative("ViewChangeTimeout", c.ViewChangeTimeoutMs)
+	v.nonNegative("TendermintVoteTimeout", c.TendermintVoteTimeoutMs)
+	v.nonNegative("Failures", c.Failures)
+	v.nonNegative("StragglerCnt", c.StragglerCnt)
+	v.nonNegative("RequestTTL", c.RequestTTL)
+	v.nonNegative("ClientRequestBacklogSize", c.ClientRequestBacklogSize)
+	v.nonNegative("OutMessageBufsize", c.OutMessageBufSize)
+	v.nonNegative("OutMessageBatchPeriod", c.OutMessageBatchPeriod)
+	v.nonNegative("SegmentLength", c.SegmentLength)
+	v.nonNegative("TotalClients", c.TotalClients)
+	v.nonNegative("RequestTraceSampling", c.RequestTraceSampling)
+	v.nonNegative("MetricsPort", c.MetricsPort)
+	v.nonNegative("ClientMetricsPort", c.ClientMetricsPort)
+	v.nonNegative("AdminPort", c.AdminPort)
+	v.nonNegative("DebugPort", c.DebugPort)
+	v.nonNegative("ClientDebugPort", c.ClientDebugPort)
+	v.nonNegative("DebugProfileRate", c.DebugProfileRate)
+
+	if c.ContractProportion < 0 || c.ContractProportion > 100 {
+		v.errorf("ContractProportion must be between 0 and 100, got %d", c.ContractProportion)
+	}
+	if c.RequestPayloadSize < 50 {
+		// The client reserves 50 bytes of the payload for request metadata.
+		v.errorf("RequestPayloadSize must be at least 50, got %d", c.RequestPayloadSize)
+	}
+
+	// Cross-field checks.
+	if c.PrecomputeRequests && c.RequestsPerClient == 0 {
+		v.errorf("RequestsPerClient must not be 0 if PrecomputeRequests is true")
+	}
+	if c.UseTLS && (c.CACertFile == "" || c.KeyFile == "" || c.CertFile == "") {
+		v.errorf("CACertFile, KeyFile and CertFile must be set if UseTLS is true")
+	}
+	if c.SignRequests && c.ClientPubKeyFile == "" {
+		v.errorf("ClientPubKeyFile must be set if SignRequests is true")
+	}
+	if c.Dissemination && c.Orderer != "Pbft" {
+		v.errorf("Dissemination is only supported by the Pbft orderer, not by %s", c.Orderer)
+	}
+	if c.Dissemination {
+		v.positive("DisseminationWindow", c.DisseminationWindow)
+		v.positive("DisseminationMaxCertificates", c.DisseminationMaxCertificates)
+		v.positive("DisseminationFetchTimeout", c.DisseminationFetchTimeout)
+	}
+	if c.SuperviseConnections && c.ReconnectBackoffMin > c.ReconnectBackoffMax {
+		v.errorf("ReconnectBackoffMin (%d) must not exceed ReconnectBackoffMax (%d)",
+			c.ReconnectBackoffMin, c.ReconnectBackoffMax)
+	}
+	if c.SuperviseConnections {
+		v.positive("RetransmitAckPeriod", c.RetransmitAckPeriod)
+	}
+	if c.AdaptiveSegmentLength && (c.MinSegmentLength <= 0 || c.MinSegmentLength > c.MaxSegmentLength) {
+		v.errorf("MinSegmentLength (%d) must be positive and not exceed MaxSegmentLength (%d)",
+			c.MinSegmentLength, c.MaxSegmentLength)
+	}
+	if c.FeePriority {
+		v.nonNegative("FeePriorityMaxAge", c.FeePriorityMaxAge)
+	}
+	if c.AdmissionFeeEviction && c.AdmissionMaxBucketBytes <= 0 {
+		v.errorf("AdmissionMaxBucketBytes must be set if AdmissionFeeEviction is true")
+	}
+	if c.RequestTraceCollector != "" &&
+		!strings.HasPrefix(c.RequestTraceCollector, "http://") && !strings.HasPrefix(c.RequestTraceCollector, "https://") {
+		v.errorf("RequestTraceCollector must be an http:// or https:// URL, got \"%s\"", c.RequestTraceCollector)
+	}
+	if c.TotalClients > 0 && c.ClientsPerProcess > c.TotalClients {
+		v.errorf("ClientsPerProcess (%d) must not exceed TotalClients (%d)", c.ClientsPerProcess, c.TotalClients)
+	}
+
+	return v.err()
+}
+
+// Performs the checks of the configuration that depend on the number of peers.
+// Must be called once the membership is known.
+func (c *Configuration) ValidateMembership(numNodes int) error {
+	v := &validator{}
+
+	leaders := numNodes / c.NodeToLeaderRatio
+	if leaders < 1 {
+		v.errorf("NodeToLeaderRatio (%d) leaves no leaders among %d peers", c.NodeToLeaderRatio, numNodes)
+	}
+	// Each leader needs at least one bucket.
+	if c.NumBuckets < leaders {
+		v.errorf("NumBuckets (%d) must not be smaller than the number of leaders (%d)", c.NumBuckets, leaders)
+	}
+	if c.Failures > numNodes {
+		v.errorf("Failures (%d) must not exceed the number of peers (%d)", c.Failures, numNodes)
+	}
+	if c.StragglerCnt > numNodes {
+		v.errorf("StragglerCnt (%d) must not exceed the number of peers (%d)", c.StragglerCnt, numNodes)
+	}
+
+	return v.err()
+}
+
+// Collects the problems found in a configuration.
+type validator struct {
+	problems []string
+}
+
+func (v *validator) errorf(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) oneOf(key string, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.errorf("%s must be one of {%s}, got \"%s\"", key, strings.Join(allowed, ", "), value)
+}
+
+func (v *validator) positive(key string, value int) {
+	if value <= 0 {
+		v.errorf("%s must be positive, got %d", key, value)
+	}
+}
+
+func (v *validator) nonNegative(key string, value int) {
+	if value < 0 {
+		v.errorf("%s must not be negative, got %d", key, value)
+	}
+}
+
+func (v *validator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration: %s", strings.Join(v.problems, "; "))
+}
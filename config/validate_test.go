@@ -0,0 +1,183 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Template used by the experiment scripts to generate the configuration files of the peers.
+const mirModularTemplate = "../deployment/config-file-templates/mir-modular.yml"
+
+// Placeholders of the template and the values substituted by generate-config.sh, in the order of substitution.
+// CRASHTIMING is substituted separately.
+var templateValues = [][2]string{
+	{"LOGGINGLEVEL", "info"},
+	{"ORDERER", "Pbft"},
+	{"CHECKPOINTER", "Simple"},
+	{"FAILURES", "1"},
+	{"STRAGGLERCNT", "1"},
+	{"FIXBATCHRATE", "false"},
+	{"CONTRACTPROPORTION", "0"},
+	{"GASFEE", "0"},
+	{"TOTALCLIENTS", "16"},
+	{"PRIORITYCONNECTIONS", "1"},
+	{"VIEWCHANGETIMEOUT", "10000"},
+	{"LEADERPOLICY", "Simple"},
+	{"EPOCH", "256"},
+	{"SEGMENTLENGTH", "16"},
+	{"WATERMARK", "128"},
+	{"BUCKETS", "16"},
+	{"BATCHSIZE", "2048"},
+	{"PAYLOAD", "500"},
+	{"BATCHTIMEOUT", "1000"},
+	{"THROUGHPUTCAP", "100000"},
+	{"MSGBATCHPERIOD", "0"},
+	{"CLIENTS", "16"},
+	{"REQUESTS", "10000"},
+	{"DURATION", "60000"},
+	{"REQUESTRATE", "1000"},
+	{"HARDRATELIMIT", "false"},
+	{"BATCHVERIFIER", "sequential"},
+	{"REQUESTHANDLERTHREADS", "8"},
+	{"REQUESTINPUTBUFFER", "4096"},
+	{"AUTH", "true"},
+	{"VERIFYEARLY", "true"},
+	{"RANDOMSEED", "42"},
+	{"NLR", "1"},
+	{"PRECOMPUTE", "false"},
+}
+
+// Values of CrashTiming used by the experiment scripts (see generate-local-config.sh).
+var crashTimings = []string{"EpochStart", "EpochEnd", "Straggler", "ByzantineStraggler", "SilentStraggler", "Equivocation"}
+
+// Instantiates the template like the sed command in generate-config.sh,
+// i.e., replacing the first occurrence of each placeholder in each line.
+func instantiateTemplate(t *testing.T, crashTiming string) string {
+	data, err := ioutil.ReadFile(mirModularTemplate)
+	if err != nil {
+		t.Fatalf("Could not read template: %s", err.Error())
+	}
+	values := append([][2]string{{"CRASHTIMING", crashTiming}}, templateValues...)
+
+	lines := strings.Split(string(data), "\n")
+	for i := range lines {
+		for _, v := range values {
+			lines[i] = strings.Replace(lines[i], v[0], v[1], 1)
+		}
+	}
+
+	fileName := filepath.Join(t.TempDir(), "config-"+crashTiming+".yml")
+	if err := ioutil.WriteFile(fileName, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatalf("Could not write config file: %s", err.Error())
+	}
+	return fileName
+}
+
+func TestLoad_ShippedConfig(t *testing.T) {
+	c, err := Load("config.yml")
+	if err != nil {
+		t.Fatalf("Shipped config.yml is invalid: %s", err.Error())
+	}
+
+	// The defaults correspond to the shipped config file, so the file must validate with the defaults' values too.
+	if err := defaults().Validate(); err != nil {
+		t.Errorf("Defaults are invalid: %s", err.Error())
+	}
+	if c.Orderer != defaults().Orderer || c.CrashTiming != defaults().CrashTiming {
+		t.Errorf("Shipped config.yml differs from defaults: Orderer %s, CrashTiming %s", c.Orderer, c.CrashTiming)
+	}
+}
+
+func TestLoad_MirModularTemplate(t *testing.T) {
+	for _, crashTiming := range crashTimings {
+		t.Run(crashTiming, func(t *testing.T) {
+			c, err := Load(instantiateTemplate(t, crashTiming))
+			if err != nil {
+				t.Fatalf("Generated config file is invalid: %s", err.Error())
+			}
+			if c.CrashTiming != crashTiming {
+				t.Errorf("Expected CrashTiming %s, got %s", crashTiming, c.CrashTiming)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Configuration)
+		valid  bool
+	}{
+		{"defaults", func(c *Configuration) {}, true},
+		{"CrashTiming EpochStart", func(c *Configuration) { c.CrashTiming = "EpochStart" }, true},
+		{"CrashTiming Straggler", func(c *Configuration) { c.CrashTiming = "Straggler" }, true},
+		{"CrashTiming ByzantineStraggler", func(c *Configuration) { c.CrashTiming = "ByzantineStraggler" }, true},
+		{"CrashTiming SilentStraggler", func(c *Configuration) { c.CrashTiming = "SilentStraggler" }, true},
+		{"CrashTiming Equivocation", func(c *Configuration) { c.CrashTiming = "Equivocation" }, true},
+		{"CrashTiming unknown", func(c *Configuration) { c.CrashTiming = "Sometimes" }, false},
+		{"Orderer Tendermint", func(c *Configuration) { c.Orderer = "Tendermint" }, true},
+		{"Orderer unknown", func(c *Configuration) { c.Orderer = "Paxos" }, false},
+		{"BatchSize zero", func(c *Configuration) { c.BatchSize = 0 }, false},
+		{"BatchTimeout negative", func(c *Configuration) { c.BatchTimeoutMs = -1 }, false},
+		{"RequestPayloadSize too small", func(c *Configuration) { c.RequestPayloadSize = 49 }, false},
+		{"PrecomputeRequests without RequestsPerClient", func(c *Configuration) {
+			c.PrecomputeRequests = true
+			c.RequestsPerClient = 0
+		}, false},
+		{"UseTLS without certificates", func(c *Configuration) { c.UseTLS = true }, false},
+		{"Dissemination with HotStuff", func(c *Configuration) {
+			c.Dissemination = true
+			c.Orderer = "HotStuff"
+		}, false},
+		{"ReconnectBackoffMin above max", func(c *Configuration) {
+			c.SuperviseConnections = true
+			c.ReconnectBackoffMin = c.ReconnectBackoffMax + 1
+		}, false},
+		{"RetransmitAckPeriod zero", func(c *Configuration) {
+			c.SuperviseConnections = true
+			c.RetransmitAckPeriod = 0
+		}, false},
+		{"RetransmitAckPeriod zero without supervision", func(c *Configuration) { c.RetransmitAckPeriod = 0 }, true},
+		{"RequestTraceCollector without scheme", func(c *Configuration) { c.RequestTraceCollector = "localhost:4318" }, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := defaults()
+			test.modify(c)
+			err := c.Validate()
+			if test.valid && err != nil {
+				t.Errorf("Expected valid configuration, got: %s", err.Error())
+			} else if !test.valid && err == nil {
+				t.Errorf("Expected invalid configuration.")
+			}
+		})
+	}
+}
+
+func TestMain(m *testing.M) {
+	// Environment overrides would make the loaded configuration depend on the environment of the test.
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, EnvPrefix) {
+			os.Unsetenv(strings.SplitN(e, "=", 2)[0])
+		}
+	}
+	os.Exit(m.Run())
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Entries of the configuration that determine the protocol run by the peers
+// (as opposed to the deployment, tracing, monitoring and client load entries).
+// All peers of a deployment must agree on them. Printed by the version subcommands of the peer and the client.
+var protocolEntries = []string{
+	"Orderer",
+	"Manager",
+	"Checkpointer",
+	"LeaderPolicy",
+	"BucketAssignment",
+	"NumBuckets",
+	"BatchSize",
+	"BatchTimeout",
+	"EpochLength",
+	"SegmentLength",
+	"AdaptiveSegmentLength",
+	"WaitForCheckpoints",
+	"CheckpointInterval",
+	"WatermarkWindowSize",
+	"ClientWatermarkWindowSize",
+	"Failures",
+	"DisabledViewChange",
+	"ViewChangeTimeout",
+	"TendermintVoteTimeout",
+	"SignRequests",
+	"Dissemination",
+	"ForwardRequests",
+	"FeePriority",
+	"Compression",
+	"UseTLS",
+	"AuthenticatePeers",
+}
+
+// Returns the default configuration, i.e., the configuration of an empty configuration file.
+func Default() *Configuration {
+	c := defaults()
+	c.deriveValues()
+	return c
+}
+
+// Writes the build information of the running binary (module version, VCS revision and Go version)
+// followed by the protocol entries of c (see protocolEntries) in the YAML format of the configuration file.
+func WriteVersion(w io.Writer, binary string, c *Configuration) error {
+	version, revision, goVersion := "unknown", "unknown", "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+		goVersion = info.GoVersion
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				revision = s.Value
+			case "vcs.modified":
+				if s.Value == "true" {
+					revision += " (modified)"
+				}
+			}
+		}
+	}
+	fmt.Fprintf(w, "%s %s\nrevision: %s\ngo: %s\n\n", binary, version, revision, goVersion)
+
+	protocol, err := c.protocol()
+	if err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(protocol)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "# Protocol configuration\n%s", data)
+	return err
+}
+
+// Returns the protocol entries of the configuration, in the order of protocolEntries.
+func (c *Configuration) protocol() (yaml.MapSlice, error) {
+	// Round-trip through YAML to get the entries by the names used in the configuration file.
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	protocol := make(yaml.MapSlice, 0, len(protocolEntries))
+	for _, key := range protocolEntries {
+		value, ok := entries[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown protocol entry: %s", key)
+		}
+		protocol = append(protocol, yaml.MapItem{Key: key, Value: value})
+	}
+	return protocol, nil
+}
@@ -288,9 +288,21 @@ GROUP BY msec
 -- export bandwidths-list.csv
 SELECT nodeId as sender, seqNr as receiver, val as bandwidth
 FROM protocol
-WHERE event = 'BANDWIDTH'
+WHERE event = 'BANDWIDTH' AND seqNr < 1000000
 -- (sender, receiver, bandwidth[kB/s])
 
+-- Compression of messages between all pairs of peers (latest reported values).
+-- Compression statistics are BANDWIDTH events with the receiver offset by 1000000 (bytes saved)
+-- or 2000000 (compressed/uncompressed size in permille).
+-- export compression.csv
+SELECT nodeId as sender, seqNr % 1000000 as receiver,
+       max(CASE WHEN seqNr / 1000000 = 1 THEN val END) as saved,
+       min(CASE WHEN seqNr / 1000000 = 2 THEN val END) as ratio
+FROM protocol
+WHERE event = 'BANDWIDTH' AND seqNr >= 1000000
+GROUP BY sender, receiver
+-- (sender, receiver, saved[B], ratio[permille])
+
 -- Leaders in epochs.
 -- export epoch-leaders.csv
 SELECT seqNr as epoch, avg(val) as leaders
@@ -8,6 +8,8 @@ dbfile=eventDB.sqlite
 queryOutput=performance
 
 queries=
+traceAnalysis=
+traceSampling=10
 forcePeerBinary=
 forceClientBinary=
 forceDB=false
@@ -21,6 +23,18 @@ function analyze() {
 
   echo "Analyzing: $dir"
 
+  # Native trace analysis, replacing the database and the SQL queries.
+  if [ -n "$traceAnalysis" ]; then
+    if $forceQueries || [ ! -r "$dir/$queryOutput" ]; then
+      echo "  > Analyzing traces using $traceAnalysis"
+      $traceAnalysis -sampling $traceSampling -format csv -out "$dir" $dir/slave-*/ #the last argument must not be quoted!
+      $traceAnalysis -sampling $traceSampling -format text $dir/slave-*/ > "$dir/$queryOutput"
+    else
+      echo "  > Nothing to do. Skipping."
+    fi
+    return
+  fi
+
   if $forceDB || [ ! -r "$dir/$dbfile" ]; then
     echo "  > Loading trace into database..."
     startTimeNs=$(gdate +%s%N 2>/dev/null || date +%s%N) # This is due to a different date command on Mac.
@@ -69,6 +83,14 @@ while [ -n "$1" ]; do
   # Delete raw data when done (even if failed, use with care!!!)
   elif [ "$1" = "-d" ]; then
     deleteRawData=true
+  # Trace analysis binary (cmd/traceanalysis). If given, it is used instead of the SQL queries.
+  elif [ "$1" = "-t" ]; then
+    shift
+    traceAnalysis=$1
+  # Client trace sampling (multiplier for the request counts of the trace analysis binary)
+  elif [ "$1" = "-s" ]; then
+    shift
+    traceSampling=$1
   # SQL query file
   elif [ "$1" = "-q" ]; then
     shift
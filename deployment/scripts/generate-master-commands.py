@@ -116,9 +116,10 @@ def startPeers(expID, peers):
     output("discover-reset {0}".format(numPeers))
     for p in peers:
         output(
-            "exec-start {0} experiment-output/{1}/slave-__id__/peer.log orderingpeer "
-            "{2} $own_public_ip:$master_port __public_ip__ __private_ip__ "
-            "experiment-output/{1}/slave-__id__/peer.trc experiment-output/{1}/slave-__id__/peerT2.trc experiment-output/{1}/slave-__id__/prof".format(
+            "exec-start {0} experiment-output/{1}/slave-__id__/peer.log orderingpeer run "
+            "-config {2} -discovery $own_public_ip:$master_port -public-ip __public_ip__ -private-ip __private_ip__ "
+            "-trace experiment-output/{1}/slave-__id__/peer.trc -trace2 experiment-output/{1}/slave-__id__/peerT2.trc "
+            "-profile experiment-output/{1}/slave-__id__/prof".format(
                 p, expID, SLAVE_CONFIG_FILE))
     output("discover-wait")
     output("")
@@ -142,9 +143,10 @@ def startLocalPeers(expID, peers):
     output("discover-reset {0}".format(numPeers))
     for p in peers:
         output(
-            "exec-start {0} experiment-output/{1}/slave-__id__/peer.log orderingpeer "
-            "experiment-output/{1}/slave-__id__/{2} {3}:{4} {3} {3} "
-            "experiment-output/{1}/slave-__id__/peer.trc experiment-output/{1}/slave-__id__/peerT2.trc  experiment-output/{1}/slave-__id__/prof".format(
+            "exec-start {0} experiment-output/{1}/slave-__id__/peer.log orderingpeer run "
+            "-config experiment-output/{1}/slave-__id__/{2} -discovery {3}:{4} -public-ip {3} -private-ip {3} "
+            "-trace experiment-output/{1}/slave-__id__/peer.trc -trace2 experiment-output/{1}/slave-__id__/peerT2.trc "
+            "-profile experiment-output/{1}/slave-__id__/prof".format(
                 p, expID, SLAVE_CONFIG_FILE, LOCAL_IP_ADDRESS, LOCAL_MASTER_PORT))
     output("discover-wait")
     output("")
@@ -154,9 +156,9 @@ def runClients(expID, clients):
     output("# Run clients and wait for them to stop.")
     for c in clients:
         output(
-            "exec-start {0} experiment-output/{1}/slave-__id__/clients.log orderingclient "
-            "{2} $own_public_ip:$master_port experiment-output/{1}/slave-__id__/client "
-            "experiment-output/{1}/slave-__id__/prof-client".format(
+            "exec-start {0} experiment-output/{1}/slave-__id__/clients.log orderingclient run "
+            "-config {2} -discovery $own_public_ip:$master_port -out experiment-output/{1}/slave-__id__/client "
+            "-profile experiment-output/{1}/slave-__id__/prof-client".format(
                 c, expID, SLAVE_CONFIG_FILE))
     timeout = CLIENT_TIMEOUT
     for c in clients:
@@ -240,9 +242,9 @@ def runLocalClients(expID, clients):
 
     for c in clients:
         output(
-            "exec-start {0} experiment-output/{1}/slave-__id__/clients.log orderingclient "
-            "experiment-output/{1}/slave-__id__/{2} {3}:{4} experiment-output/{1}/slave-__id__/client "
-            "experiment-output/{1}/slave-__id__/prof-client".format(
+            "exec-start {0} experiment-output/{1}/slave-__id__/clients.log orderingclient run "
+            "-config experiment-output/{1}/slave-__id__/{2} -discovery {3}:{4} -out experiment-output/{1}/slave-__id__/client "
+            "-profile experiment-output/{1}/slave-__id__/prof-client".format(
                 c, expID, SLAVE_CONFIG_FILE, LOCAL_IP_ADDRESS, LOCAL_MASTER_PORT))
     timeoutSet = False
     for c in clients:
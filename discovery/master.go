@@ -24,6 +24,7 @@ import (
 	"time"
 
 	logger "github.com/rs/zerolog/log"
+	"github.com/Hanzheng2021/Orthrus/messenger"
 	pb "github.com/Hanzheng2021/Orthrus/protobufs"
 )
 
@@ -282,6 +283,79 @@ func (ds *DiscoveryServer) processCommand(cmdName string, params chan string) {
 			f.Close()
 		}
 
+	// Injects faults on the links between peers that watch the network faults (see NetFaultControl in the config).
+	// Format: net-fault <from> <to> <latency> <loss> <duplicate> <reorder>
+	// - from, to: peer IDs or * for all peers
+	// - latency: latency distribution (e.g. uniform:10ms:50ms, see NetFaultLatency in the config) or none
+	// - loss, duplicate, reorder: probabilities of dropping, duplicating and reordering a message
+	// Replaces the previous rule for the same link.
+	case "net-fault":
+		fromStr := <-params
+		toStr := <-params
+		latency := <-params
+		lossStr := <-params
+		duplicateStr := <-params
+		reorderStr := <-params
+
+		logger.Info().
+			Str("cmdName", "net-fault").
+			Str("from", fromStr).
+			Str("to", toStr).
+			Str("latency", latency).
+			Str("loss", lossStr).
+			Str("duplicate", duplicateStr).
+			Str("reorder", reorderStr).
+			Msg("Processing command.")
+
+		if rule, err := parseNetFaultRule(fromStr, toStr, latency, lossStr, duplicateStr, reorderStr); err == nil {
+			ds.updateNetFaults(func(faults *pb.NetFaultConfig) { addNetFaultRule(faults, rule) })
+		} else {
+			logger.Error().Err(err).Msg("Cannot parse network fault.")
+		}
+
+	// Isolates a group of peers from all peers not in the group.
+	// Format: net-partition <name> <id1,id2,...>
+	case "net-partition":
+		name := <-params
+		peersStr := <-params
+
+		logger.Info().
+			Str("cmdName", "net-partition").
+			Str("name", name).
+			Str("peers", peersStr).
+			Msg("Processing command.")
+
+		if partition, err := messenger.ParseNetPartition(name + "=" + peersStr); err == nil {
+			ds.updateNetFaults(func(faults *pb.NetFaultConfig) { addNetPartition(faults, partition) })
+		} else {
+			logger.Error().Err(err).Msg("Cannot parse network partition.")
+		}
+
+	// Removes a named partition, or all injected faults (rules and partitions) if the parameter is "all".
+	// Format: net-heal <name>|all
+	case "net-heal":
+		name := <-params
+
+		logger.Info().
+			Str("cmdName", "net-heal").
+			Str("name", name).
+			Msg("Processing command.")
+
+		ds.updateNetFaults(func(faults *pb.NetFaultConfig) {
+			if name == "all" {
+				faults.Rules = nil
+				faults.Partitions = nil
+				return
+			}
+			partitions := make([]*pb.NetPartition, 0, len(faults.Partitions))
+			for _, p := range faults.Partitions {
+				if p.Name != name {
+					partitions = append(partitions, p)
+				}
+			}
+			faults.Partitions = partitions
+		})
+
 	// Unknown command
 	default:
 		logger.Error().Str("cmd", cmdName).Msg("Unknown command.")
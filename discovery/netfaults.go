@@ -0,0 +1,215 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	"github.com/golang/protobuf/proto"
+	logger "github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+)
+
+// Implements the WatchNetFaults RPC.
+// Sends the currently injected network faults (if any have been set) to the subscribed peer,
+// followed by each new configuration, until the peer disconnects.
+func (ds *DiscoveryServer) WatchNetFaults(req *pb.NetFaultSubscription, stream pb.Discovery_WatchNetFaultsServer) error {
+	logger.Info().Int32("peerId", req.PeerId).Msg("Peer watching network faults.")
+
+	// Only the latest configuration matters. If the peer is slow, older configurations are skipped.
+	updates := make(chan *pb.NetFaultConfig, 1)
+
+	ds.netFaultLock.Lock()
+	ds.netFaultSubscribers[updates] = struct{}{}
+	if ds.netFaults != nil {
+		updates <- ds.netFaults
+	}
+	ds.netFaultLock.Unlock()
+
+	defer func() {
+		ds.netFaultLock.Lock()
+		delete(ds.netFaultSubscribers, updates)
+		ds.netFaultLock.Unlock()
+	}()
+
+	for {
+		select {
+		case faults := <-updates:
+			if err := stream.Send(faults); err != nil {
+				logger.Warn().Err(err).Int32("peerId", req.PeerId).Msg("Failed to send network faults.")
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// Applies a modification to a copy of the injected network faults and sends the result to all subscribed peers.
+func (ds *DiscoveryServer) updateNetFaults(modify func(faults *pb.NetFaultConfig)) {
+	ds.netFaultLock.Lock()
+	defer ds.netFaultLock.Unlock()
+
+	faults := &pb.NetFaultConfig{}
+	if ds.netFaults != nil {
+		faults = proto.Clone(ds.netFaults).(*pb.NetFaultConfig)
+	}
+	modify(faults)
+	ds.netFaults = faults
+
+	for updates := range ds.netFaultSubscribers {
+		// Replace a configuration the subscriber has not yet picked up.
+		select {
+		case <-updates:
+		default:
+		}
+		updates <- faults
+	}
+
+	logger.Info().
+		Int("nRules", len(faults.Rules)).
+		Int("nPartitions", len(faults.Partitions)).
+		Int("nSubscribers", len(ds.netFaultSubscribers)).
+		Msg("Updated network faults.")
+}
+
+// Adds a fault rule, replacing any existing rule for the same link.
+// Rules are kept ordered from the most to the least specific, as peers apply the first matching rule.
+func addNetFaultRule(faults *pb.NetFaultConfig, rule *pb.NetFaultRule) {
+	rules := make([]*pb.NetFaultRule, 0, len(faults.Rules)+1)
+	for _, r := range faults.Rules {
+		if r.From != rule.From || r.To != rule.To {
+			rules = append(rules, r)
+		}
+	}
+	rules = append(rules, rule)
+
+	wildcards := func(r *pb.NetFaultRule) int {
+		n := 0
+		if r.From == -1 {
+			n++
+		}
+		if r.To == -1 {
+			n++
+		}
+		return n
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return wildcards(rules[i]) < wildcards(rules[j])
+	})
+
+	faults.Rules = rules
+}
+
+// Adds a named partition, replacing any existing partition with the same name.
+// Peers in the new partition are removed from all other partitions.
+func addNetPartition(faults *pb.NetFaultConfig, partition *pb.NetPartition) {
+	inNew := make(map[int32]bool)
+	for _, peerID := range partition.Peers {
+		inNew[peerID] = true
+	}
+
+	partitions := make([]*pb.NetPartition, 0, len(faults.Partitions)+1)
+	for _, p := range faults.Partitions {
+		if p.Name == partition.Name {
+			continue
+		}
+		peers := make([]int32, 0, len(p.Peers))
+		for _, peerID := range p.Peers {
+			if !inNew[peerID] {
+				peers = append(peers, peerID)
+			}
+		}
+		if len(peers) > 0 {
+			partitions = append(partitions, &pb.NetPartition{Name: p.Name, Peers: peers})
+		}
+	}
+
+	faults.Partitions = append(partitions, partition)
+}
+
+// Parses a peer ID in a network fault master command. "*" stands for all peers and is returned as -1.
+func parseNetFaultPeer(peerStr string) (int32, error) {
+	if peerStr == "*" {
+		return -1, nil
+	}
+	id, err := strconv.Atoi(peerStr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid peer ID: %s", peerStr)
+	}
+	return int32(id), nil
+}
+
+// Parses the parameters of the net-fault master command into a fault rule.
+func parseNetFaultRule(fromStr, toStr, latency, lossStr, duplicateStr, reorderStr string) (*pb.NetFaultRule, error) {
+	from, err := parseNetFaultPeer(fromStr)
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseNetFaultPeer(toStr)
+	if err != nil {
+		return nil, err
+	}
+	if latency == "none" {
+		latency = ""
+	}
+
+	probabilities := make([]float64, 3)
+	for i, pStr := range []string{lossStr, duplicateStr, reorderStr} {
+		if probabilities[i], err = strconv.ParseFloat(pStr, 64); err != nil || probabilities[i] < 0 || probabilities[i] > 1 {
+			return nil, fmt.Errorf("invalid probability: %s", pStr)
+		}
+	}
+
+	return &pb.NetFaultRule{
+		From:      from,
+		To:        to,
+		Latency:   latency,
+		Loss:      probabilities[0],
+		Duplicate: probabilities[1],
+		Reorder:   probabilities[2],
+	}, nil
+}
+
+// Subscribes to the network faults published by the discovery server and calls handler on each new configuration.
+// Blocks until the connection to the server fails. Meant to be run as a separate goroutine.
+func WatchNetFaults(serverAddrPort string, ownPeerID int32, handler func(faults *pb.NetFaultConfig)) {
+
+	// Set up a GRPC connection.
+	conn, err := grpc.Dial(serverAddrPort, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		logger.Error().Str("srvAddr", serverAddrPort).Msg("Couldn't connect to discovery server.")
+		return
+	}
+	defer conn.Close()
+
+	// Register client stub.
+	client := pb.NewDiscoveryClient(conn)
+
+	stream, err := client.WatchNetFaults(context.Background(), &pb.NetFaultSubscription{PeerId: ownPeerID})
+	if err != nil {
+		logger.Error().Err(err).Msg("WatchNetFaults request failed.")
+		return
+	}
+
+	for faults, err := stream.Recv(); err == nil; faults, err = stream.Recv() {
+		handler(faults)
+	}
+	logger.Info().Msg("Stopped watching network faults.")
+}
@@ -49,6 +49,11 @@ type DiscoveryServer struct {
 	// Fields related to master and slaves.
 	slaves sync.Map // Maps slave IDs to slaves. Used as map[int32]*slave
 
+	// Fields related to network fault injection.
+	netFaults           *pb.NetFaultConfig                   // Injected faults. Nil until set by the first master command.
+	netFaultSubscribers map[chan *pb.NetFaultConfig]struct{} // Channels of the peers watching the injected faults.
+	netFaultLock        sync.Mutex                           // Guards the two fields above.
+
 	// Channel with peer IDs that will be distributed to peers as they are being discovered.
 	// We use a channel instead of a simple counter variable, as IDs may be issued concurrently.
 	// The channel is not buffered and a background thread generates peerIDs on demand (see DistributeIDs()).
@@ -96,6 +101,7 @@ func NewDiscoveryServer() *DiscoveryServer {
 	ds.slaveIDs = make(chan int32)
 	ds.cmdIDs = make(chan int32)
 	ds.idResetChan = make(chan struct{})
+	ds.netFaultSubscribers = make(map[chan *pb.NetFaultConfig]struct{})
 
 	// Initially not waiting for any command.
 	ds.waitingForCmd = -1
@@ -0,0 +1,283 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Hanzheng2021/Orthrus/crypto"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	logger "github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+// Static membership.
+// Instead of registering with the discovery server, peers (and clients) can obtain the membership from a static
+// cluster file, listing the identities of all peers and the public key of the BLS threshold cryptosystem.
+// The private key and the private TBLS key share of each peer are stored in a separate key file per peer.
+// Both kinds of files are produced by GenerateStaticCluster.
+
+// Default names of the files written by GenerateStaticCluster.
+const (
+	ClusterFileName   = "cluster.yml"
+	KeyFileNameFormat = "peer-%d.keys.yml" // Takes the peer ID as parameter.
+)
+
+// Prefix of a static client address.
+// Clients given a static client address (see StaticClientAddr) instead of the address of the discovery server
+// read the peer identities from the cluster file.
+const StaticClientPrefix = "static:"
+
+// Public information about all peers, shared by all peers and clients.
+type StaticCluster struct {
+	Peers      []StaticPeer `yaml:"Peers"`
+	TBLSPubKey []byte       `yaml:"TBLSPubKey"` // Public key of the BLS threshold cryptosystem
+}
+
+// Identity of a single peer in the cluster file.
+type StaticPeer struct {
+	ID          int32  `yaml:"ID"`
+	PublicAddr  string `yaml:"PublicAddr"`
+	PrivateAddr string `yaml:"PrivateAddr"`
+	Port        int32  `yaml:"Port"`
+	PubKey      []byte `yaml:"PubKey"`
+}
+
+// Secret keys of a single peer.
+type StaticPeerKeys struct {
+	ID               int32  `yaml:"ID"`
+	PrivKey          []byte `yaml:"PrivKey"`
+	TBLSPrivKeyShare []byte `yaml:"TBLSPrivKeyShare"` // Private key share of the BLS threshold cryptosystem
+}
+
+// Generates the identities and keys of a cluster of peers with the given addresses.
+// Peer i is assigned ID i, and, as with the discovery server, port PeerBasePort + 11*i.
+// The threshold of the BLS threshold cryptosystem is 2f+1, where f = (n-1)/3.
+func GenerateStaticCluster(publicAddrs []string, privateAddrs []string) (*StaticCluster, []*StaticPeerKeys, error) {
+	if len(publicAddrs) != len(privateAddrs) {
+		return nil, nil, fmt.Errorf("got %d public and %d private addresses", len(publicAddrs), len(privateAddrs))
+	}
+	if len(publicAddrs) == 0 {
+		return nil, nil, fmt.Errorf("no peers")
+	}
+
+	cluster := &StaticCluster{Peers: make([]StaticPeer, len(publicAddrs))}
+	keys := make([]*StaticPeerKeys, len(publicAddrs))
+
+	// Generate a key pair for each peer.
+	for i := range publicAddrs {
+		privKey, pubKey, err := crypto.GenerateKeyPair()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate key pair: %s", err.Error())
+		}
+		pubKeyBytes, err := crypto.PublicKeyToBytes(pubKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to serialize public key: %s", err.Error())
+		}
+		privKeyBytes, err := crypto.PrivateKeyToBytes(privKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to serialize private key: %s", err.Error())
+		}
+
+		cluster.Peers[i] = StaticPeer{
+			ID:          int32(i),
+			PublicAddr:  publicAddrs[i],
+			PrivateAddr: privateAddrs[i],
+			Port:        PeerBasePort + (11 * int32(i)),
+			PubKey:      pubKeyBytes,
+		}
+		keys[i] = &StaticPeerKeys{ID: int32(i), PrivKey: privKeyBytes}
+	}
+
+	// Generate keys for the BLS threshold cryptosystem.
+	n := len(publicAddrs)
+	f := (n - 1) / 3
+	pubKey, privKeyShares := crypto.TBLSKeyGeneration(2*f+1, n)
+	serializedPubKey, err := crypto.TBLSPubKeyToBytes(pubKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not serialize TBLS public key: %s", err.Error())
+	}
+	cluster.TBLSPubKey = serializedPubKey
+	for i, priv := range privKeyShares {
+		if keys[i].TBLSPrivKeyShare, err = crypto.TBLSPrivKeyShareΤοBytes(priv); err != nil {
+			return nil, nil, fmt.Errorf("could not serialize TBLS private key share: %s", err.Error())
+		}
+	}
+
+	return cluster, keys, nil
+}
+
+// Writes the cluster file and the key files of all peers to a directory, using the default file names.
+// The key files are only readable by their owner.
+func WriteStaticCluster(dir string, cluster *StaticCluster, keys []*StaticPeerKeys) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := writeYaml(filepath.Join(dir, ClusterFileName), cluster, 0644); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := writeYaml(filepath.Join(dir, fmt.Sprintf(KeyFileNameFormat, k.ID)), k, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads a cluster file.
+// The IDs of the n peers in the file must be exactly 0, ..., n-1 (in any order), as with the discovery server.
+func LoadStaticCluster(clusterFileName string) (*StaticCluster, error) {
+	cluster := &StaticCluster{}
+	if err := readYaml(clusterFileName, cluster); err != nil {
+		return nil, err
+	}
+	if len(cluster.Peers) == 0 {
+		return nil, fmt.Errorf("no peers in cluster file %s", clusterFileName)
+	}
+	ids := make(map[int32]bool, len(cluster.Peers))
+	for _, p := range cluster.Peers {
+		if p.ID < 0 || int(p.ID) >= len(cluster.Peers) {
+			return nil, fmt.Errorf("peer ID %d out of range 0-%d in cluster file %s",
+				p.ID, len(cluster.Peers)-1, clusterFileName)
+		}
+		if ids[p.ID] {
+			return nil, fmt.Errorf("duplicate peer ID %d in cluster file %s", p.ID, clusterFileName)
+		}
+		ids[p.ID] = true
+	}
+	return cluster, nil
+}
+
+// Returns the peer identities in the format used by the discovery server.
+func (c *StaticCluster) NodeIdentities() []*pb.NodeIdentity {
+	identities := make([]*pb.NodeIdentity, len(c.Peers))
+	for i, p := range c.Peers {
+		identities[i] = &pb.NodeIdentity{
+			NodeId:      p.ID,
+			PublicAddr:  p.PublicAddr,
+			PrivateAddr: p.PrivateAddr,
+			Port:        p.Port,
+			PubKey:      p.PubKey,
+		}
+	}
+	return identities
+}
+
+// Counterpart of RegisterPeer for static membership.
+// Obtains the same values from a cluster file and the key file of the own peer instead of the discovery server.
+func LoadStaticPeer(clusterFileName string, keyFileName string) (int32, []*pb.NodeIdentity, []byte, []byte, []byte) {
+	cluster, err := LoadStaticCluster(clusterFileName)
+	if err != nil {
+		logger.Fatal().Err(err).Str("clusterFile", clusterFileName).Msg("Could not load cluster file.")
+	}
+
+	keys, err := loadStaticPeerKeys(cluster, keyFileName)
+	if err != nil {
+		logger.Fatal().
+			Err(err).
+			Str("clusterFile", clusterFileName).
+			Str("keyFile", keyFileName).
+			Msg("Could not load key file.")
+	}
+
+	return keys.ID, cluster.NodeIdentities(), keys.PrivKey, cluster.TBLSPubKey, keys.TBLSPrivKeyShare
+}
+
+// Reads the key file of a peer of the cluster.
+// Checks that the private key in the file belongs to the public key listed for the peer in the cluster file.
+func loadStaticPeerKeys(cluster *StaticCluster, keyFileName string) (*StaticPeerKeys, error) {
+	keys := &StaticPeerKeys{}
+	if err := readYaml(keyFileName, keys); err != nil {
+		return nil, err
+	}
+
+	var peer *StaticPeer
+	for i := range cluster.Peers {
+		if cluster.Peers[i].ID == keys.ID {
+			peer = &cluster.Peers[i]
+		}
+	}
+	if peer == nil {
+		return nil, fmt.Errorf("own ID %d not in cluster file", keys.ID)
+	}
+
+	// Check that the keys match by signing with the private key and verifying with the public key.
+	privKey, err := crypto.PrivateKeyFromBytes(keys.PrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %s", err.Error())
+	}
+	pubKey, err := crypto.PublicKeyFromBytes(peer.PubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key of peer %d in cluster file: %s", keys.ID, err.Error())
+	}
+	hash := crypto.Hash([]byte(fmt.Sprintf("static peer %d", keys.ID)))
+	sig, err := crypto.Sign(hash, privKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not sign with private key: %s", err.Error())
+	}
+	if err := crypto.CheckSig(hash, pubKey, sig); err != nil {
+		return nil, fmt.Errorf("private key does not match the public key of peer %d in cluster file", keys.ID)
+	}
+
+	return keys, nil
+}
+
+// Returns the address to pass to a client instead of the discovery server address for using static membership.
+// The clients of the process obtain consecutive client IDs, starting at firstClientID.
+func StaticClientAddr(clusterFileName string, firstClientID int32) string {
+	return fmt.Sprintf("%s%s:%d", StaticClientPrefix, clusterFileName, firstClientID)
+}
+
+// Counterpart of RegisterClient for static membership.
+// Parses a static client address and returns the first client ID of the process and the peer identities
+// from the cluster file.
+func LoadStaticClient(staticClientAddr string) (int32, []*pb.NodeIdentity) {
+	spec := strings.TrimPrefix(staticClientAddr, StaticClientPrefix)
+	sep := strings.LastIndex(spec, ":")
+	if sep == -1 {
+		logger.Fatal().Str("addr", staticClientAddr).Msg("Static client address must be static:cluster_file:first_client_id.")
+	}
+	firstClientID, err := strconv.ParseInt(spec[sep+1:], 10, 32)
+	if err != nil {
+		logger.Fatal().Err(err).Str("addr", staticClientAddr).Msg("Invalid first client ID.")
+	}
+
+	cluster, err := LoadStaticCluster(spec[:sep])
+	if err != nil {
+		logger.Fatal().Err(err).Str("clusterFile", spec[:sep]).Msg("Could not load cluster file.")
+	}
+	return int32(firstClientID), cluster.NodeIdentities()
+}
+
+func readYaml(fileName string, out interface{}) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(data, out)
+}
+
+func writeYaml(fileName string, in interface{}, perm os.FileMode) error {
+	data, err := yaml.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, data, perm)
+}
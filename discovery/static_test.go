@@ -0,0 +1,166 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Hanzheng2021/Orthrus/crypto"
+)
+
+// Generates a static cluster of 4 peers and writes it to a temporary directory, which is returned.
+func writeTestCluster(t *testing.T) (string, *StaticCluster, []*StaticPeerKeys) {
+	addrs := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	cluster, keys, err := GenerateStaticCluster(addrs, addrs)
+	if err != nil {
+		t.Fatalf("could not generate cluster: %s", err)
+	}
+	dir := t.TempDir()
+	if err := WriteStaticCluster(dir, cluster, keys); err != nil {
+		t.Fatalf("could not write cluster: %s", err)
+	}
+	return dir, cluster, keys
+}
+
+func keyFile(dir string, id int32) string {
+	return filepath.Join(dir, fmt.Sprintf(KeyFileNameFormat, id))
+}
+
+func TestStaticCluster_RoundTrip(t *testing.T) {
+	dir, cluster, keys := writeTestCluster(t)
+
+	loaded, err := LoadStaticCluster(filepath.Join(dir, ClusterFileName))
+	if err != nil {
+		t.Fatalf("could not load cluster: %s", err)
+	}
+	if len(loaded.Peers) != len(cluster.Peers) {
+		t.Fatalf("loaded %d peers, expected %d", len(loaded.Peers), len(cluster.Peers))
+	}
+	for i, p := range loaded.Peers {
+		want := cluster.Peers[i]
+		if p.ID != want.ID || p.PublicAddr != want.PublicAddr || p.PrivateAddr != want.PrivateAddr ||
+			p.Port != want.Port || !bytes.Equal(p.PubKey, want.PubKey) {
+			t.Errorf("loaded peer %v, expected %v", p, want)
+		}
+	}
+	if _, err := crypto.TBLSPubKeyFromBytes(loaded.TBLSPubKey); err != nil {
+		t.Errorf("could not parse loaded TBLS public key: %s", err)
+	}
+
+	for _, k := range keys {
+		info, err := os.Stat(keyFile(dir, k.ID))
+		if err != nil {
+			t.Fatalf("key file of peer %d not written: %s", k.ID, err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("key file of peer %d has permissions %v, expected only readable by owner", k.ID, info.Mode().Perm())
+		}
+
+		id, identities, privKey, tblsPubKey, tblsPrivKeyShare :=
+			LoadStaticPeer(filepath.Join(dir, ClusterFileName), keyFile(dir, k.ID))
+		if id != k.ID || !bytes.Equal(privKey, k.PrivKey) || !bytes.Equal(tblsPrivKeyShare, k.TBLSPrivKeyShare) {
+			t.Errorf("loaded keys of peer %d do not match the generated ones", k.ID)
+		}
+		if !bytes.Equal(tblsPubKey, cluster.TBLSPubKey) {
+			t.Errorf("loaded TBLS public key does not match the generated one")
+		}
+		if len(identities) != len(cluster.Peers) || identities[k.ID].NodeId != k.ID {
+			t.Errorf("loaded identities %v do not match the cluster", identities)
+		}
+		if _, err := crypto.TBLSPrivKeyShareFromBytes(tblsPrivKeyShare); err != nil {
+			t.Errorf("could not parse loaded TBLS private key share of peer %d: %s", k.ID, err)
+		}
+	}
+}
+
+func TestLoadStaticCluster_InvalidIDs(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []int32
+	}{
+		{"duplicate", []int32{0, 1, 1, 3}},
+		{"gap", []int32{0, 1, 2, 4}},
+		{"not starting at 0", []int32{1, 2, 3, 4}},
+		{"negative", []int32{-1, 0, 1, 2}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, cluster, _ := writeTestCluster(t)
+			for i, id := range tc.ids {
+				cluster.Peers[i].ID = id
+			}
+			fileName := filepath.Join(dir, ClusterFileName)
+			if err := writeYaml(fileName, cluster, 0644); err != nil {
+				t.Fatalf("could not write cluster file: %s", err)
+			}
+			if _, err := LoadStaticCluster(fileName); err == nil {
+				t.Fatalf("cluster with peer IDs %v loaded", tc.ids)
+			}
+		})
+	}
+
+	// Any order of the IDs is fine.
+	dir, cluster, _ := writeTestCluster(t)
+	cluster.Peers[0], cluster.Peers[3] = cluster.Peers[3], cluster.Peers[0]
+	fileName := filepath.Join(dir, ClusterFileName)
+	if err := writeYaml(fileName, cluster, 0644); err != nil {
+		t.Fatalf("could not write cluster file: %s", err)
+	}
+	if _, err := LoadStaticCluster(fileName); err != nil {
+		t.Fatalf("could not load cluster with shuffled peers: %s", err)
+	}
+}
+
+func TestLoadStaticPeerKeys_Mismatch(t *testing.T) {
+	dir, cluster, keys := writeTestCluster(t)
+
+	// Key file claiming the ID of another peer.
+	forged := *keys[1]
+	forged.ID = 2
+	if err := writeYaml(keyFile(dir, 1), &forged, 0600); err != nil {
+		t.Fatalf("could not write key file: %s", err)
+	}
+	if _, err := loadStaticPeerKeys(cluster, keyFile(dir, 1)); err == nil {
+		t.Fatalf("private key of peer 1 accepted for peer 2")
+	}
+
+	// Key file of a peer not in the cluster.
+	forged.ID = 4
+	if err := writeYaml(keyFile(dir, 1), &forged, 0600); err != nil {
+		t.Fatalf("could not write key file: %s", err)
+	}
+	if _, err := loadStaticPeerKeys(cluster, keyFile(dir, 1)); err == nil {
+		t.Fatalf("key file of peer not in the cluster accepted")
+	}
+
+	// Key file with an invalid private key.
+	forged = *keys[1]
+	forged.PrivKey = []byte("invalid")
+	if err := writeYaml(keyFile(dir, 1), &forged, 0600); err != nil {
+		t.Fatalf("could not write key file: %s", err)
+	}
+	if _, err := loadStaticPeerKeys(cluster, keyFile(dir, 1)); err == nil {
+		t.Fatalf("invalid private key accepted")
+	}
+
+	if loaded, err := loadStaticPeerKeys(cluster, keyFile(dir, 2)); err != nil || loaded.ID != 2 {
+		t.Fatalf("could not load valid key file: %v", err)
+	}
+}
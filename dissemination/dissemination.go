@@ -0,0 +1,423 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dissemination decouples the dissemination of request batches from their ordering (as in Narwhal).
+// Instead of shipping whole batches inside its proposals, a leader broadcasts the bodies of its batches
+// ahead of time. Each peer storing a body signs an availability acknowledgment for it and,
+// once f+1 peers have acknowledged a batch, the acknowledgments form an availability certificate.
+// The leader then proposes only the certificates. As at least one correct peer stores each certified batch,
+// followers can always fetch bodies they are missing on demand.
+// This way, the bandwidth of the leader's uplink is spent on dissemination in the background,
+// off the critical path of the ordering protocol.
+package dissemination
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/crypto"
+	"github.com/Hanzheng2021/Orthrus/membership"
+	"github.com/Hanzheng2021/Orthrus/messenger"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	"github.com/Hanzheng2021/Orthrus/request"
+	logger "github.com/rs/zerolog/log"
+)
+
+var (
+	// Configuration of the dissemination package. Set by Init, which must be called before any other function.
+	cfg *config.Configuration
+
+	// Bodies of disseminated batches stored by this peer, indexed by their digest.
+	bodies = make(map[string]*pb.DisseminatedBatch)
+
+	// For each stored body of a batch not known to be committed, the epoch (see AdvanceEpoch) it was stored in.
+	uncommitted = make(map[string]int)
+
+	// Number of epochs finished so far.
+	epoch = 0
+
+	// Missing bodies being fetched, indexed by their digest.
+	fetches = make(map[string]*fetch)
+
+	// Own batches that are being disseminated and still collecting acknowledgments, indexed by their digest.
+	collecting = make(map[string]*certifiedBatch)
+
+	// Guards the above data structures.
+	lock sync.Mutex
+
+	// Own private key, decoded from membership.OwnPrivKey on first use.
+	ownPrivKey     interface{}
+	ownPrivKeyOnce sync.Once
+	ownPrivKeyErr  error
+)
+
+// A missing batch body this peer is fetching, together with the callbacks waiting for it.
+// The body is requested from one peer that acknowledged it at a time, rotating through the acknowledgments of the
+// certificate every DisseminationFetchTimeout until the body arrives or the fetch is dropped.
+type fetch struct {
+	cert      *pb.AvailabilityCertificate
+	callbacks []func()
+	attempts  int         // Number of acknowledgments of cert tried so far.
+	timer     *time.Timer // Triggers the next fetch request.
+	epoch     int         // Epoch (see AdvanceEpoch) in which the fetch started.
+}
+
+// Initializes the dissemination package with the given configuration.
+func Init(c *config.Configuration) {
+	if c == nil {
+		panic("Dissemination initialized without a configuration.")
+	}
+	cfg = c
+}
+
+// Handles dissemination messages received from other peers.
+// Registered with the messenger as the handler for DisseminatedBatch, BatchAvailable and BatchFetchRequest messages.
+func HandleMessage(msg *pb.ProtocolMessage) {
+	switch m := msg.Msg.(type) {
+	case *pb.ProtocolMessage_DisseminatedBatch:
+		handleBody(m.DisseminatedBatch, msg.SenderId)
+	case *pb.ProtocolMessage_BatchAvailable:
+		handleAvailable(m.BatchAvailable, msg.SenderId)
+	case *pb.ProtocolMessage_BatchFetchReq:
+		handleFetchRequest(m.BatchFetchReq, msg.SenderId)
+	default:
+		logger.Error().Int32("senderID", msg.SenderId).Msg("Dissemination cannot handle message. Unknown message type.")
+	}
+}
+
+// Checks whether an availability certificate contains valid acknowledgments of at least f+1 distinct peers.
+func VerifyCertificate(cert *pb.AvailabilityCertificate) error {
+	if cert == nil {
+		return fmt.Errorf("missing certificate")
+	}
+	hash := availabilityHash(cert.Origin, cert.Digest)
+	signers := make(map[int32]bool)
+	for _, ack := range cert.Acks {
+		if signers[ack.Signer] {
+			continue
+		}
+		if err := checkAck(hash, ack.Signer, ack.Signature); err != nil {
+			return fmt.Errorf("invalid acknowledgment of batch from %d: %s", cert.Origin, err)
+		}
+		signers[ack.Signer] = true
+	}
+	if len(signers) < membership.Faults()+1 {
+		return fmt.Errorf("batch from %d acknowledged by %d peers only", cert.Origin, len(signers))
+	}
+	return nil
+}
+
+// Looks up the bodies of the certified batches and returns their requests (in the order of the certificates).
+// If all bodies are stored locally, Resolve returns the requests and true.
+// Otherwise, it requests the missing bodies from the peers that acknowledged them and returns false.
+// In this case, onAvailable is called (from a different goroutine) as soon as all the bodies have been fetched.
+// If a body is not fetched before it is forgotten (see Forget and AdvanceEpoch), onAvailable is never called.
+// The certificates must have been verified before calling Resolve.
+func Resolve(certs []*pb.AvailabilityCertificate, onAvailable func()) ([]*pb.ClientRequest, bool) {
+	lock.Lock()
+
+	requests := make([]*pb.ClientRequest, 0)
+	missing := make([]*pb.AvailabilityCertificate, 0)
+	for _, cert := range certs {
+		if body, ok := bodies[string(cert.Digest)]; ok {
+			requests = append(requests, body.Requests...)
+		} else {
+			missing = append(missing, cert)
+		}
+	}
+	if len(missing) == 0 {
+		lock.Unlock()
+		return requests, true
+	}
+
+	// Call onAvailable once the last missing body arrives.
+	// The callbacks may be called concurrently, as bodies arrive over different connections.
+	remaining := int32(len(missing))
+	callback := func() {
+		if atomic.AddInt32(&remaining, -1) == 0 {
+			go onAvailable()
+		}
+	}
+
+	// Start fetching the bodies that are not being fetched yet.
+	started := make([]*pb.AvailabilityCertificate, 0)
+	sources := make([]int32, 0)
+	for _, cert := range missing {
+		key := string(cert.Digest)
+		f, ok := fetches[key]
+		if !ok {
+			f = &fetch{cert: cert, epoch: epoch}
+			fetches[key] = f
+			started = append(started, cert)
+			sources = append(sources, f.nextSource())
+			f.timer = time.AfterFunc(fetchTimeout(), func() { retryFetch(key, f) })
+		}
+		f.callbacks = append(f.callbacks, callback)
+	}
+	lock.Unlock()
+
+	for i, cert := range started {
+		logger.Info().Int32("origin", cert.Origin).Int32("source", sources[i]).Msg("Fetching missing batch body.")
+		requestBody(cert, sources[i])
+	}
+	return nil, false
+}
+
+// Requests a missing body again, from the next peer that acknowledged it, unless it arrived or has been forgotten.
+// Called when the fetch request sent before timed out.
+func retryFetch(key string, f *fetch) {
+	lock.Lock()
+	if fetches[key] != f {
+		lock.Unlock()
+		return
+	}
+	source := f.nextSource()
+	f.timer = time.AfterFunc(fetchTimeout(), func() { retryFetch(key, f) })
+	lock.Unlock()
+
+	logger.Warn().Int32("origin", f.cert.Origin).Int32("source", source).Msg("Fetching missing batch body timed out. Retrying.")
+	requestBody(f.cert, source)
+}
+
+// Returns the next peer to fetch the body from, i.e., the next peer (other than this one) in the acknowledgments
+// of the certificate, wrapping around after the last one. Returns -1 if there is no such peer.
+// Must be called with lock held.
+func (f *fetch) nextSource() int32 {
+	for range f.cert.Acks {
+		signer := f.cert.Acks[f.attempts%len(f.cert.Acks)].Signer
+		f.attempts++
+		if signer != membership.OwnID {
+			return signer
+		}
+	}
+	return -1
+}
+
+// Stops fetching a missing body and drops the callbacks waiting for it.
+// Must be called with lock held.
+func dropFetch(key string) {
+	if f, ok := fetches[key]; ok {
+		f.timer.Stop()
+		delete(fetches, key)
+		logger.Info().Int32("origin", f.cert.Origin).Int("nWaiting", len(f.callbacks)).Msg("Stopped fetching forgotten batch body.")
+	}
+}
+
+// Sends a request for the body of a certified batch to the given peer.
+func requestBody(cert *pb.AvailabilityCertificate, source int32) {
+	if source < 0 {
+		logger.Error().Int32("origin", cert.Origin).Msg("Cannot fetch missing batch body. No peer to fetch it from.")
+		return
+	}
+	messenger.EnqueuePriorityMsg(&pb.ProtocolMessage{
+		SenderId: membership.OwnID,
+		Sn:       -1,
+		Msg: &pb.ProtocolMessage_BatchFetchReq{BatchFetchReq: &pb.BatchFetchRequest{
+			Origin: cert.Origin,
+			Digest: cert.Digest,
+		}},
+	}, source)
+}
+
+// Returns the time after which a fetch request is sent to the next peer.
+func fetchTimeout() time.Duration {
+	return time.Duration(cfg.DisseminationFetchTimeout) * time.Millisecond
+}
+
+// Discards the bodies of the certified batches after DisseminationRetention milliseconds.
+// Called when a batch consisting of these certificates has been committed,
+// and by the leader for certified batches it discards without proposing them.
+// The bodies are retained for a while to serve fetch requests of peers lagging behind.
+// Bodies still being fetched are not fetched any more.
+func Forget(certs []*pb.AvailabilityCertificate) {
+	if len(certs) == 0 {
+		return
+	}
+	time.AfterFunc(time.Duration(cfg.DisseminationRetention)*time.Millisecond, func() {
+		lock.Lock()
+		defer lock.Unlock()
+
+		for _, cert := range certs {
+			delete(bodies, string(cert.Digest))
+		}
+	})
+
+	lock.Lock()
+	for _, cert := range certs {
+		delete(uncommitted, string(cert.Digest))
+		dropFetch(string(cert.Digest))
+	}
+	lock.Unlock()
+}
+
+// Discards the bodies of batches that have not been committed and were stored before the epoch that just finished.
+// Called at the end of each epoch, when all batches proposed in the epoch have been committed.
+// Such bodies belong to batches whose leader stopped proposing them (e.g. at the end of its segment).
+// Bodies stored in the finished epoch are kept for one more epoch, as they might have been disseminated
+// early by a leader that already proceeded to the next epoch.
+// Likewise, bodies this peer started fetching before the finished epoch are not fetched any more.
+func AdvanceEpoch() {
+	lock.Lock()
+	defer lock.Unlock()
+
+	epoch++
+	discarded := 0
+	for key, storedIn := range uncommitted {
+		if storedIn < epoch-1 {
+			delete(uncommitted, key)
+			delete(bodies, key)
+			discarded++
+		}
+	}
+	if discarded > 0 {
+		logger.Info().Int("epoch", epoch).Int("nBodies", discarded).Msg("Discarded bodies of uncommitted batches.")
+	}
+	for key, f := range fetches {
+		if f.epoch < epoch-1 {
+			dropFetch(key)
+		}
+	}
+}
+
+// Stores the body of a batch that has not been committed yet.
+// Must be called with lock held.
+func store(key string, body *pb.DisseminatedBatch) {
+	if _, ok := bodies[key]; ok {
+		return
+	}
+	bodies[key] = body
+	uncommitted[key] = epoch
+}
+
+// Stores the body of a disseminated batch and acknowledges it to the batch's origin.
+// Bodies received from other peers than the origin are only stored if this peer fetched them.
+func handleBody(body *pb.DisseminatedBatch, senderID int32) {
+	key := string(body.Digest)
+	digest := request.BatchDigest(&pb.Batch{Requests: body.Requests})
+	if string(digest) != key {
+		logger.Warn().Int32("origin", body.Origin).Int32("senderID", senderID).Msg("Ignoring batch body with wrong digest.")
+		return
+	}
+
+	lock.Lock()
+	var callbacks []func()
+	f, fetched := fetches[key]
+	if fetched {
+		f.timer.Stop()
+		callbacks = f.callbacks
+		delete(fetches, key)
+	}
+	if senderID != body.Origin && !fetched {
+		lock.Unlock()
+		logger.Debug().Int32("origin", body.Origin).Int32("senderID", senderID).Msg("Ignoring batch body not fetched.")
+		return
+	}
+	store(key, body)
+	lock.Unlock()
+
+	for _, callback := range callbacks {
+		callback()
+	}
+
+	// Only acknowledge bodies received from their origin. Fetched bodies are not acknowledged.
+	if senderID != body.Origin {
+		return
+	}
+	sig, err := signAvailability(body.Origin, body.Digest)
+	if err != nil {
+		logger.Error().Err(err).Int32("origin", body.Origin).Msg("Failed to acknowledge batch body.")
+		return
+	}
+	messenger.EnqueuePriorityMsg(&pb.ProtocolMessage{
+		SenderId: membership.OwnID,
+		Sn:       -1,
+		Msg: &pb.ProtocolMessage_BatchAvailable{BatchAvailable: &pb.BatchAvailable{
+			Origin:    body.Origin,
+			Digest:    body.Digest,
+			Signature: sig,
+		}},
+	}, senderID)
+}
+
+// Adds the acknowledgment of a peer to the own batch it refers to.
+func handleAvailable(available *pb.BatchAvailable, senderID int32) {
+	if available.Origin != membership.OwnID {
+		return
+	}
+	if err := checkAck(availabilityHash(available.Origin, available.Digest), senderID, available.Signature); err != nil {
+		logger.Warn().Err(err).Int32("senderID", senderID).Msg("Ignoring invalid batch acknowledgment.")
+		return
+	}
+
+	lock.Lock()
+	cb, ok := collecting[string(available.Digest)]
+	lock.Unlock()
+
+	if ok {
+		cb.acknowledge(senderID, available.Signature)
+	}
+}
+
+// Sends a stored body to a peer that is missing it.
+func handleFetchRequest(req *pb.BatchFetchRequest, senderID int32) {
+	lock.Lock()
+	body, ok := bodies[string(req.Digest)]
+	lock.Unlock()
+
+	if !ok {
+		logger.Warn().Int32("origin", req.Origin).Int32("senderID", senderID).Msg("Cannot serve fetch request. Batch body not stored.")
+		return
+	}
+	messenger.EnqueueMsg(&pb.ProtocolMessage{
+		SenderId: membership.OwnID,
+		Sn:       -1,
+		Msg:      &pb.ProtocolMessage_DisseminatedBatch{DisseminatedBatch: body},
+	}, senderID)
+}
+
+// Signs an availability acknowledgment of a batch.
+func signAvailability(origin int32, digest []byte) ([]byte, error) {
+	ownPrivKeyOnce.Do(func() {
+		ownPrivKey, ownPrivKeyErr = crypto.PrivateKeyFromBytes(membership.OwnPrivKey)
+	})
+	if ownPrivKeyErr != nil {
+		return nil, ownPrivKeyErr
+	}
+	return crypto.Sign(availabilityHash(origin, digest), ownPrivKey)
+}
+
+// Checks the signature of an availability acknowledgment.
+func checkAck(hash []byte, signer int32, signature []byte) error {
+	identity := membership.NodeIdentity(signer)
+	if identity == nil {
+		return fmt.Errorf("unknown signer: %d", signer)
+	}
+	pk, err := crypto.PublicKeyFromBytes(identity.PubKey)
+	if err != nil {
+		return err
+	}
+	return crypto.CheckSig(hash, pk, signature)
+}
+
+// Computes the hash signed in availability acknowledgments.
+func availabilityHash(origin int32, digest []byte) []byte {
+	buffer := make([]byte, 4, 4+len(digest))
+	binary.LittleEndian.PutUint32(buffer[0:4], uint32(origin))
+	buffer = append(buffer, digest...)
+	return crypto.Hash(buffer)
+}
@@ -0,0 +1,241 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dissemination
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/membership"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	"github.com/Hanzheng2021/Orthrus/request"
+)
+
+func TestMain(m *testing.M) {
+	membership.OwnID = 0
+	os.Exit(m.Run())
+}
+
+// Resets the state of the package and returns a body of a batch from origin 1.
+// Fetches of previous tests are stopped.
+func setup(t *testing.T) *pb.DisseminatedBatch {
+	lock.Lock()
+	defer lock.Unlock()
+
+	for key := range fetches {
+		dropFetch(key)
+	}
+	cfg = config.Default()
+	cfg.DisseminationRetention = 3600000
+	cfg.DisseminationFetchTimeout = 3600000
+	bodies = make(map[string]*pb.DisseminatedBatch)
+	uncommitted = make(map[string]int)
+	fetches = make(map[string]*fetch)
+	epoch = 0
+
+	requests := []*pb.ClientRequest{{RequestId: &pb.RequestID{ClientId: 1, ClientSn: 1}, Payload: []byte{1}}}
+	return &pb.DisseminatedBatch{
+		Origin:   1,
+		Digest:   request.BatchDigest(&pb.Batch{Requests: requests}),
+		Requests: requests,
+	}
+}
+
+func TestHandleBody_NotFetched(t *testing.T) {
+	body := setup(t)
+
+	handleBody(body, 2)
+	if _, ok := bodies[string(body.Digest)]; ok {
+		t.Fatalf("stored a body received from another peer than its origin without fetching it")
+	}
+}
+
+func TestHandleBody_Fetched(t *testing.T) {
+	body := setup(t)
+
+	called := 0
+	fetches[string(body.Digest)] = &fetch{
+		cert:      &pb.AvailabilityCertificate{Origin: 1, Digest: body.Digest},
+		callbacks: []func(){func() { called++ }},
+		timer:     time.AfterFunc(time.Hour, func() {}),
+	}
+	handleBody(body, 2)
+	if _, ok := bodies[string(body.Digest)]; !ok {
+		t.Fatalf("fetched body not stored")
+	}
+	if called != 1 {
+		t.Fatalf("callback waiting for the body called %d times", called)
+	}
+	if _, ok := fetches[string(body.Digest)]; ok {
+		t.Fatalf("callbacks still waiting after the body arrived")
+	}
+}
+
+func TestAdvanceEpoch(t *testing.T) {
+	body := setup(t)
+	committed := &pb.DisseminatedBatch{Origin: 1, Digest: []byte("committed")}
+	store(string(body.Digest), body)
+	store(string(committed.Digest), committed)
+	Forget([]*pb.AvailabilityCertificate{{Origin: 1, Digest: committed.Digest}})
+
+	// Bodies are kept until the end of the epoch after the one they have been stored in.
+	AdvanceEpoch()
+	if _, ok := bodies[string(body.Digest)]; !ok {
+		t.Fatalf("body discarded at the end of the epoch it has been stored in")
+	}
+	AdvanceEpoch()
+	if _, ok := bodies[string(body.Digest)]; ok {
+		t.Fatalf("body of uncommitted batch not discarded")
+	}
+	if _, ok := uncommitted[string(body.Digest)]; ok {
+		t.Fatalf("discarded body still tracked")
+	}
+
+	// Bodies of committed batches are retained for DisseminationRetention to serve lagging peers.
+	if _, ok := bodies[string(committed.Digest)]; !ok {
+		t.Fatalf("body of committed batch discarded before the end of its retention")
+	}
+}
+
+// Returns a certificate of the body, acknowledged by the given peers.
+// The acknowledgments are not signed, as Resolve expects certificates to be verified by the caller.
+func testCertificate(body *pb.DisseminatedBatch, signers ...int32) *pb.AvailabilityCertificate {
+	cert := &pb.AvailabilityCertificate{Origin: body.Origin, Digest: body.Digest}
+	for _, signer := range signers {
+		cert.Acks = append(cert.Acks, &pb.AvailabilityAck{Signer: signer})
+	}
+	return cert
+}
+
+func TestResolve_Stored(t *testing.T) {
+	body := setup(t)
+	store(string(body.Digest), body)
+
+	requests, ok := Resolve([]*pb.AvailabilityCertificate{testCertificate(body, 1, 2)}, func() {
+		t.Errorf("onAvailable called for a stored body")
+	})
+	if !ok || len(requests) != 1 || requests[0] != body.Requests[0] {
+		t.Fatalf("resolved %v (%v), expected the requests of the stored body", requests, ok)
+	}
+	if len(fetches) != 0 {
+		t.Fatalf("fetching a stored body")
+	}
+}
+
+func TestResolve_Fetch(t *testing.T) {
+	body := setup(t)
+	lock.Lock()
+	cfg.DisseminationFetchTimeout = 10
+	lock.Unlock()
+
+	available := make(chan struct{}, 2)
+	cert := testCertificate(body, 1, 0, 2)
+	if _, ok := Resolve([]*pb.AvailabilityCertificate{cert}, func() { available <- struct{}{} }); ok {
+		t.Fatalf("missing body resolved")
+	}
+	Resolve([]*pb.AvailabilityCertificate{cert}, func() { available <- struct{}{} })
+
+	// The body is fetched once, with a request to the next signer (skipping this peer) after each timeout.
+	lock.Lock()
+	f := fetches[string(body.Digest)]
+	lock.Unlock()
+	if f == nil || len(f.callbacks) != 2 {
+		t.Fatalf("fetch %v, expected one fetch with 2 callbacks", f)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lock.Lock()
+		attempts := f.attempts
+		lock.Unlock()
+		if attempts >= 6 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fetch request sent to %d peers only", attempts)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	lock.Lock()
+	if next := f.nextSource(); next != 1 && next != 2 {
+		t.Errorf("fetching from peer %d, expected one of the other signers", next)
+	}
+	lock.Unlock()
+
+	handleBody(body, 2)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-available:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("onAvailable not called after the body arrived")
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if _, ok := fetches[string(body.Digest)]; ok {
+		t.Fatalf("still fetching after the body arrived")
+	}
+}
+
+func TestFetch_NextSource(t *testing.T) {
+	setup(t)
+
+	f := &fetch{cert: &pb.AvailabilityCertificate{Acks: []*pb.AvailabilityAck{{Signer: 1}, {Signer: 0}, {Signer: 3}}}}
+	for i, want := range []int32{1, 3, 1, 3} {
+		if got := f.nextSource(); got != want {
+			t.Fatalf("source %d is %d, expected %d", i, got, want)
+		}
+	}
+
+	f = &fetch{cert: &pb.AvailabilityCertificate{Acks: []*pb.AvailabilityAck{{Signer: 0}}}}
+	if got := f.nextSource(); got != -1 {
+		t.Fatalf("source %d, expected none", got)
+	}
+}
+
+func TestForget_StopsFetching(t *testing.T) {
+	body := setup(t)
+
+	Resolve([]*pb.AvailabilityCertificate{testCertificate(body, 1, 2)}, func() {
+		t.Errorf("onAvailable called for a forgotten body")
+	})
+	Forget([]*pb.AvailabilityCertificate{testCertificate(body)})
+	if _, ok := fetches[string(body.Digest)]; ok {
+		t.Fatalf("still fetching a forgotten body")
+	}
+
+	// A forgotten body arriving late is not stored.
+	handleBody(body, 2)
+	if _, ok := bodies[string(body.Digest)]; ok {
+		t.Fatalf("stored a forgotten body received from another peer than its origin")
+	}
+}
+
+func TestAdvanceEpoch_StopsFetching(t *testing.T) {
+	body := setup(t)
+
+	Resolve([]*pb.AvailabilityCertificate{testCertificate(body, 1, 2)}, func() {})
+
+	// Like stored bodies, bodies are fetched until the end of the epoch after the one the fetch started in.
+	AdvanceEpoch()
+	if _, ok := fetches[string(body.Digest)]; !ok {
+		t.Fatalf("stopped fetching at the end of the epoch the fetch started in")
+	}
+	AdvanceEpoch()
+	if _, ok := fetches[string(body.Digest)]; ok {
+		t.Fatalf("still fetching a body of a previous epoch")
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dissemination
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/membership"
+	"github.com/Hanzheng2021/Orthrus/messenger"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	"github.com/Hanzheng2021/Orthrus/request"
+	logger "github.com/rs/zerolog/log"
+)
+
+// A batch cut by this peer, together with the acknowledgments collected for it so far.
+type certifiedBatch struct {
+	disseminator *Disseminator
+	batch        *request.Batch
+	cert         *pb.AvailabilityCertificate
+	signers      map[int32]bool
+}
+
+// Disseminates the request batches of one segment led by this peer.
+// The Disseminator continuously cuts batches from the segment's buckets, broadcasts their bodies
+// to the followers of the segment and collects the availability acknowledgments.
+// The leader of the segment takes the certified batches from the Disseminator when it proposes.
+// At most DisseminationWindow batches are disseminated but not yet proposed at any time.
+type Disseminator struct {
+	buckets   *request.BucketGroup
+	batchSize int
+	followers []int32
+	cfg       *config.Configuration
+
+	// Batches still collecting acknowledgments and certified batches that have not been proposed yet.
+	// Guarded by cond.L.
+	uncertified map[*certifiedBatch]bool
+	certified   []*certifiedBatch
+	cond        *sync.Cond
+	stopped     bool
+}
+
+// Creates a new Disseminator for the requests in the given buckets, cutting batches of batchSize requests.
+// The batch bodies are sent to the given followers.
+// The cfg parameter determines the dissemination window, the batch timeout and the number of certificates per proposal.
+func NewDisseminator(buckets *request.BucketGroup, batchSize int, followers []int32, cfg *config.Configuration) *Disseminator {
+	return &Disseminator{
+		buckets:     buckets,
+		batchSize:   batchSize,
+		followers:   followers,
+		cfg:         cfg,
+		uncertified: make(map[*certifiedBatch]bool),
+		certified:   make([]*certifiedBatch, 0),
+		cond:        sync.NewCond(&sync.Mutex{}),
+	}
+}
+
+// Cuts and disseminates batches until the Disseminator is stopped.
+// Meant to be run as a separate goroutine.
+func (d *Disseminator) Run() {
+	for {
+		// Do not get more than DisseminationWindow batches ahead of the proposals.
+		d.cond.L.Lock()
+		for !d.stopped && len(d.uncertified)+len(d.certified) >= d.cfg.DisseminationWindow {
+			d.cond.Wait()
+		}
+		stopped := d.stopped
+		d.cond.L.Unlock()
+		if stopped {
+			return
+		}
+
+		d.buckets.WaitForRequests(d.batchSize, d.cfg.BatchTimeout)
+		batch := d.buckets.CutBatch(d.batchSize, 0)
+		if len(batch.Requests) == 0 {
+			continue
+		}
+		if d.cfg.SignRequests {
+			if err := batch.CheckSignatures(); err != nil {
+				logger.Error().Msg("Signature verification of request in freshly cut batch failed.")
+			}
+		}
+		batch.MarkInFlight()
+
+		d.cond.L.Lock()
+		if d.stopped {
+			d.cond.L.Unlock()
+			batch.Resurrect()
+			return
+		}
+		d.disseminate(batch)
+		d.cond.L.Unlock()
+	}
+}
+
+// Blocks until at least one certified batch is ready to be proposed, until timeout elapses,
+// or until the Disseminator is stopped.
+func (d *Disseminator) WaitForCertified(timeout time.Duration) {
+	timer := time.AfterFunc(timeout, func() {
+		d.cond.L.Lock()
+		d.cond.Broadcast()
+		d.cond.L.Unlock()
+	})
+	defer timer.Stop()
+
+	deadline := time.Now().Add(timeout)
+	d.cond.L.Lock()
+	for !d.stopped && len(d.certified) == 0 && time.Now().Before(deadline) {
+		d.cond.Wait()
+	}
+	d.cond.L.Unlock()
+}
+
+// Removes up to DisseminationMaxCertificates certified batches from the Disseminator (oldest first)
+// and returns the batch of all their requests together with their certificates, to be proposed for sequence number sn.
+// Certified batches containing requests that expire before sn cannot be proposed any more, as their bodies are fixed.
+// They are discarded together with their bodies and certificates, and their requests that have not expired
+// are returned to their buckets.
+// The returned batch may be empty.
+func (d *Disseminator) CutCertified(sn int32) (*request.Batch, []*pb.AvailabilityCertificate) {
+	d.cond.L.Lock()
+	defer d.cond.L.Unlock()
+
+	batch := &request.Batch{Requests: make([]*request.Request, 0)}
+	certs := make([]*pb.AvailabilityCertificate, 0)
+	discarded := make([]*pb.AvailabilityCertificate, 0)
+	for len(d.certified) > 0 && len(certs) < d.cfg.DisseminationMaxCertificates {
+		cb := d.certified[0]
+		d.certified = d.certified[1:]
+
+		if err := cb.batch.CheckExpired(sn); err != nil {
+			logger.Info().Err(err).Int32("sn", sn).Msg("Discarding certified batch.")
+			for _, req := range cb.batch.Requests {
+				req.InFlight = false
+			}
+			cb.batch.DropExpired(sn)
+			cb.batch.Resurrect()
+			discarded = append(discarded, cb.cert)
+			continue
+		}
+
+		batch.Requests = append(batch.Requests, cb.batch.Requests...)
+		certs = append(certs, cb.cert)
+	}
+
+	// The discarded batches will never be proposed. Followers discard their bodies at the end of the next epoch.
+	Forget(discarded)
+
+	// Make room for disseminating more batches.
+	d.cond.Broadcast()
+
+	return batch, certs
+}
+
+// Stops disseminating and returns the requests of all batches that have not been proposed to their buckets.
+func (d *Disseminator) Stop() {
+	d.cond.L.Lock()
+	defer d.cond.L.Unlock()
+
+	if d.stopped {
+		return
+	}
+	d.stopped = true
+	d.cond.Broadcast()
+
+	lock.Lock()
+	for cb := range d.uncertified {
+		delete(collecting, string(cb.cert.Digest))
+		cb.batch.Resurrect()
+	}
+	lock.Unlock()
+	for _, cb := range d.certified {
+		cb.batch.Resurrect()
+	}
+	d.uncertified = make(map[*certifiedBatch]bool)
+	d.certified = make([]*certifiedBatch, 0)
+}
+
+// Stores the body of a batch locally, acknowledges it and sends it to all other followers.
+// Must be called with d.cond.L held.
+func (d *Disseminator) disseminate(batch *request.Batch) {
+	requests := batch.Message().Requests
+	digest := request.BatchDigest(&pb.Batch{Requests: requests})
+	body := &pb.DisseminatedBatch{
+		Origin:   membership.OwnID,
+		Digest:   digest,
+		Requests: requests,
+	}
+
+	cb := &certifiedBatch{
+		disseminator: d,
+		batch:        batch,
+		cert: &pb.AvailabilityCertificate{
+			Origin: membership.OwnID,
+			Digest: digest,
+			Acks:   make([]*pb.AvailabilityAck, 0, membership.Faults()+1),
+		},
+		signers: make(map[int32]bool),
+	}
+	d.uncertified[cb] = true
+
+	lock.Lock()
+	store(string(digest), body)
+	collecting[string(digest)] = cb
+	lock.Unlock()
+
+	logger.Debug().Int("nReq", len(requests)).Msg("Disseminating batch.")
+
+	// The own acknowledgment counts towards the certificate.
+	if sig, err := signAvailability(membership.OwnID, digest); err != nil {
+		logger.Error().Err(err).Msg("Failed to acknowledge own batch body.")
+	} else {
+		cb.addAck(membership.OwnID, sig)
+	}
+
+	msg := &pb.ProtocolMessage{
+		SenderId: membership.OwnID,
+		Sn:       -1,
+		Msg:      &pb.ProtocolMessage_DisseminatedBatch{DisseminatedBatch: body},
+	}
+	for _, nodeID := range d.followers {
+		if nodeID != membership.OwnID {
+			messenger.EnqueueMsg(msg, nodeID)
+		}
+	}
+}
+
+// Adds the (already verified) acknowledgment of a peer.
+func (cb *certifiedBatch) acknowledge(signer int32, signature []byte) {
+	cb.disseminator.cond.L.Lock()
+	defer cb.disseminator.cond.L.Unlock()
+
+	if cb.disseminator.uncertified[cb] {
+		cb.addAck(signer, signature)
+	}
+}
+
+// Adds an acknowledgment and, if it completes the certificate, makes the batch available for proposing.
+// Must be called with cb.disseminator.cond.L held.
+func (cb *certifiedBatch) addAck(signer int32, signature []byte) {
+	if cb.signers[signer] {
+		return
+	}
+	cb.signers[signer] = true
+	cb.cert.Acks = append(cb.cert.Acks, &pb.AvailabilityAck{Signer: signer, Signature: signature})
+	if len(cb.cert.Acks) < membership.Faults()+1 {
+		return
+	}
+
+	d := cb.disseminator
+	delete(d.uncertified, cb)
+	d.certified = append(d.certified, cb)
+	d.cond.Broadcast()
+
+	lock.Lock()
+	delete(collecting, string(cb.cert.Digest))
+	lock.Unlock()
+
+	logger.Debug().Int("nAcks", len(cb.cert.Acks)).Msg("Batch certified.")
+}
@@ -0,0 +1,273 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package evidence detects equivocating leaders and produces provable evidence of their misbehavior.
+// Leaders sign the header (view, sequence number, height, digest) of each proposal they make.
+// Whenever a peer observes two validly signed proposals from the same leader for the same
+// (view, sequence number, height) that have different digests, it creates a MisbehaviorEvidence object
+// containing both signed proposals and broadcasts it to all other peers.
+// Leaders piggyback known evidence on the batches they propose. Once evidence is committed to the log,
+// the manager (deterministically, at all peers) permanently excludes the offender from the leader set.
+package evidence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Hanzheng2021/Orthrus/crypto"
+	"github.com/Hanzheng2021/Orthrus/membership"
+	"github.com/Hanzheng2021/Orthrus/messenger"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	logger "github.com/rs/zerolog/log"
+)
+
+// Identifies a proposal slot. A correct leader makes at most one proposal per slot.
+type proposalKey struct {
+	leader int32
+	view   int32
+	sn     int32
+	height int32
+}
+
+var (
+	// Signed proposals observed so far, indexed by proposal slot.
+	// Only the first validly signed proposal for each slot is kept.
+	proposals = make(map[proposalKey]*pb.SignedProposal)
+
+	// Evidence of misbehavior known to this peer, indexed by the ID of the offending node.
+	known = make(map[int32]*pb.MisbehaviorEvidence)
+
+	// Offenders whose evidence has already been committed to the log and thus needs not be proposed any more.
+	convicted = make(map[int32]bool)
+
+	// Guards the above data structures.
+	lock sync.Mutex
+
+	// Own private key, decoded from membership.OwnPrivKey on first use.
+	ownPrivKey     interface{}
+	ownPrivKeyOnce sync.Once
+	ownPrivKeyErr  error
+)
+
+// Signs the header of a proposal made by this peer and returns the signature.
+func SignProposal(view int32, sn int32, height int32, digest []byte) ([]byte, error) {
+	ownPrivKeyOnce.Do(func() {
+		ownPrivKey, ownPrivKeyErr = crypto.PrivateKeyFromBytes(membership.OwnPrivKey)
+	})
+	if ownPrivKeyErr != nil {
+		return nil, fmt.Errorf("could not sign proposal: %s", ownPrivKeyErr)
+	}
+
+	sig, err := crypto.Sign(proposalHash(membership.OwnID, view, sn, height, digest), ownPrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not sign proposal: %s", err)
+	}
+	return sig, nil
+}
+
+// Checks whether a signed proposal carries a valid signature of its leader.
+func CheckProposal(p *pb.SignedProposal) error {
+	if p == nil {
+		return fmt.Errorf("missing proposal")
+	}
+	identity := membership.NodeIdentity(p.Leader)
+	if identity == nil {
+		return fmt.Errorf("unknown leader: %d", p.Leader)
+	}
+	pk, err := crypto.PublicKeyFromBytes(identity.PubKey)
+	if err != nil {
+		return fmt.Errorf("could not verify proposal signature: %s", err)
+	}
+	if err := crypto.CheckSig(proposalHash(p.Leader, p.View, p.Sn, p.Height, p.Digest), pk, p.Signature); err != nil {
+		return fmt.Errorf("could not verify proposal signature: %s", err)
+	}
+	return nil
+}
+
+// Registers a signed proposal observed by this peer (e.g. in a preprepare message or echoed in a prepare message).
+// The signature of the proposal is only checked if it conflicts with a previously observed proposal.
+// If the proposal proves that its leader equivocated, Observe returns the corresponding evidence and,
+// if this evidence is new to this peer, broadcasts it to all other peers. Otherwise, Observe returns nil.
+func Observe(p *pb.SignedProposal) *pb.MisbehaviorEvidence {
+	key := proposalKey{leader: p.Leader, view: p.View, sn: p.Sn, height: p.Height}
+
+	lock.Lock()
+	first, ok := proposals[key]
+	if !ok {
+		proposals[key] = p
+		lock.Unlock()
+		return nil
+	}
+	lock.Unlock()
+
+	// Matching proposals do not prove anything.
+	if bytes.Equal(first.Digest, p.Digest) {
+		return nil
+	}
+
+	// The new proposal conflicts with the observed one. Only the signatures decide whether this proves misbehavior.
+	if err := CheckProposal(p); err != nil {
+		logger.Warn().Err(err).Int32("leader", p.Leader).Int32("sn", p.Sn).Msg("Ignoring conflicting proposal.")
+		return nil
+	}
+	if err := CheckProposal(first); err != nil {
+		// The stored proposal was forged (it is only checked lazily). Replace it by the valid one.
+		lock.Lock()
+		proposals[key] = p
+		lock.Unlock()
+		return nil
+	}
+
+	ev := &pb.MisbehaviorEvidence{
+		Offender: p.Leader,
+		First:    first,
+		Second:   p,
+	}
+	logger.Warn().
+		Int32("offender", ev.Offender).
+		Int32("view", p.View).
+		Int32("sn", p.Sn).
+		Int32("height", p.Height).
+		Msg("Detected equivocation.")
+
+	if add(ev) {
+		broadcast(ev)
+	}
+	return ev
+}
+
+// Checks whether evidence proves misbehavior of its offender, i.e., whether it contains two validly signed proposals
+// of the offender for the same (view, sequence number, height) with different digests.
+func Verify(ev *pb.MisbehaviorEvidence) error {
+	if ev == nil || ev.First == nil || ev.Second == nil {
+		return fmt.Errorf("incomplete evidence")
+	}
+	first, second := ev.First, ev.Second
+	if first.Leader != ev.Offender || second.Leader != ev.Offender {
+		return fmt.Errorf("proposals not made by offender %d", ev.Offender)
+	}
+	if first.View != second.View || first.Sn != second.Sn || first.Height != second.Height {
+		return fmt.Errorf("proposals for different slots")
+	}
+	if bytes.Equal(first.Digest, second.Digest) {
+		return fmt.Errorf("proposals not conflicting")
+	}
+	if err := CheckProposal(first); err != nil {
+		return err
+	}
+	return CheckProposal(second)
+}
+
+// Handles evidence received from another peer.
+// Registered with the messenger as the handler for MisbehaviorEvidence messages.
+func HandleMessage(ev *pb.MisbehaviorEvidence, senderID int32) {
+	if err := Verify(ev); err != nil {
+		logger.Warn().Err(err).Int32("from", senderID).Msg("Received invalid misbehavior evidence.")
+		return
+	}
+
+	if add(ev) {
+		logger.Info().Int32("offender", ev.Offender).Int32("from", senderID).Msg("Received misbehavior evidence.")
+	}
+}
+
+// Returns all known evidence that has not yet been committed to the log, ordered by offender ID.
+// Leaders attach this evidence to the batches they propose.
+func Pending() []*pb.MisbehaviorEvidence {
+	lock.Lock()
+	defer lock.Unlock()
+
+	pending := make([]*pb.MisbehaviorEvidence, 0)
+	for offender, ev := range known {
+		if !convicted[offender] {
+			pending = append(pending, ev)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Offender < pending[j].Offender
+	})
+	return pending
+}
+
+// Marks an offender as convicted, i.e., evidence of its misbehavior has been committed to the log.
+// Evidence against convicted offenders is not proposed any more.
+func MarkConvicted(offender int32) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	convicted[offender] = true
+}
+
+// Returns true if evidence of misbehavior of the given node has been committed to the log.
+func Convicted(nodeID int32) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return convicted[nodeID]
+}
+
+// Discards all observed proposals with sequence numbers up to (and including) sn.
+// Called when the corresponding segment is garbage-collected.
+func Prune(sn int32) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	for key := range proposals {
+		if key.sn <= sn {
+			delete(proposals, key)
+		}
+	}
+}
+
+// Adds evidence to the known evidence. Returns true if no evidence against the offender was known before.
+func add(ev *pb.MisbehaviorEvidence) bool {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, ok := known[ev.Offender]; ok {
+		return false
+	}
+	known[ev.Offender] = ev
+	return true
+}
+
+// Sends evidence to all other peers.
+func broadcast(ev *pb.MisbehaviorEvidence) {
+	msg := &pb.ProtocolMessage{
+		SenderId: membership.OwnID,
+		Sn:       ev.First.Sn,
+		Msg: &pb.ProtocolMessage_Evidence{
+			Evidence: ev,
+		},
+	}
+	for _, nodeID := range membership.AllNodeIDs() {
+		if nodeID != membership.OwnID {
+			messenger.EnqueuePriorityMsg(msg, nodeID)
+		}
+	}
+}
+
+// Computes the hash signed by the leader of a proposal.
+func proposalHash(leader int32, view int32, sn int32, height int32, digest []byte) []byte {
+	buffer := make([]byte, 16, 16+len(digest))
+	binary.LittleEndian.PutUint32(buffer[0:4], uint32(leader))
+	binary.LittleEndian.PutUint32(buffer[4:8], uint32(view))
+	binary.LittleEndian.PutUint32(buffer[8:12], uint32(sn))
+	binary.LittleEndian.PutUint32(buffer[12:16], uint32(height))
+	buffer = append(buffer, digest...)
+	return crypto.Hash(buffer)
+}
@@ -0,0 +1,328 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package evidence
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/crypto"
+	"github.com/Hanzheng2021/Orthrus/membership"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+)
+
+// Number of peers in the tests.
+const testNodes = 4
+
+// Private keys of the peers in the tests, indexed by node ID.
+var testKeys = make([]interface{}, testNodes)
+
+func TestMain(m *testing.M) {
+	cfg := config.Default()
+	cfg.Failures = 0
+	cfg.StragglerCnt = 0
+	membership.Init(cfg)
+
+	identities := make([]*pb.NodeIdentity, testNodes)
+	for i := range identities {
+		privKey, pubKey, err := crypto.GenerateKeyPair()
+		if err != nil {
+			panic(err)
+		}
+		pubKeyBytes, err := crypto.PublicKeyToBytes(pubKey)
+		if err != nil {
+			panic(err)
+		}
+		testKeys[i] = privKey
+		identities[i] = &pb.NodeIdentity{NodeId: int32(i), PubKey: pubKeyBytes}
+	}
+	membership.InitNodeIdentities(identities, cfg)
+
+	membership.OwnID = 0
+	ownPrivKey, err := crypto.PrivateKeyToBytes(testKeys[0])
+	if err != nil {
+		panic(err)
+	}
+	membership.OwnPrivKey = ownPrivKey
+
+	os.Exit(m.Run())
+}
+
+// Resets the state of the package.
+func setup() {
+	proposals = make(map[proposalKey]*pb.SignedProposal)
+	known = make(map[int32]*pb.MisbehaviorEvidence)
+	convicted = make(map[int32]bool)
+}
+
+// Returns a proposal of leader for sequence number sn (in view 0, at height 0) signed by signer.
+func signedProposal(t *testing.T, leader int32, signer int32, sn int32, digest string) *pb.SignedProposal {
+	sig, err := crypto.Sign(proposalHash(leader, 0, sn, 0, []byte(digest)), testKeys[signer])
+	if err != nil {
+		t.Fatalf("could not sign proposal: %s", err)
+	}
+	return &pb.SignedProposal{Leader: leader, Sn: sn, Digest: []byte(digest), Signature: sig}
+}
+
+// Returns a proposal of leader for sequence number sn with an invalid signature.
+func forgedProposal(leader int32, sn int32, digest string) *pb.SignedProposal {
+	return &pb.SignedProposal{Leader: leader, Sn: sn, Digest: []byte(digest), Signature: []byte("forged")}
+}
+
+func TestSignProposal(t *testing.T) {
+	sig, err := SignProposal(1, 5, 2, []byte("a"))
+	if err != nil {
+		t.Fatalf("could not sign proposal: %s", err)
+	}
+	p := &pb.SignedProposal{Leader: 0, View: 1, Sn: 5, Height: 2, Digest: []byte("a"), Signature: sig}
+	if err := CheckProposal(p); err != nil {
+		t.Fatalf("own proposal rejected: %s", err)
+	}
+
+	p.Height = 3
+	if err := CheckProposal(p); err == nil {
+		t.Fatalf("proposal accepted with a signature for another height")
+	}
+}
+
+func TestCheckProposal_NonLeader(t *testing.T) {
+	// Proposal of leader 1 signed by peer 2.
+	p := signedProposal(t, 1, 2, 0, "a")
+	if err := CheckProposal(p); err == nil {
+		t.Fatalf("proposal signed by a non-leader accepted")
+	}
+
+	if err := CheckProposal(signedProposal(t, 1, 1, 0, "a")); err != nil {
+		t.Fatalf("proposal signed by its leader rejected: %s", err)
+	}
+	if err := CheckProposal(&pb.SignedProposal{Leader: testNodes}); err == nil {
+		t.Fatalf("proposal of unknown leader accepted")
+	}
+}
+
+func TestObserve(t *testing.T) {
+	setup()
+
+	first := signedProposal(t, 1, 1, 0, "a")
+	if ev := Observe(first); ev != nil {
+		t.Fatalf("evidence returned for the first proposal")
+	}
+	if ev := Observe(signedProposal(t, 1, 1, 0, "a")); ev != nil {
+		t.Fatalf("evidence returned for a matching proposal")
+	}
+
+	// Proposals of another leader, for another sequence number, view or height are not conflicting.
+	for _, p := range []*pb.SignedProposal{
+		signedProposal(t, 2, 2, 0, "b"),
+		signedProposal(t, 1, 1, 1, "b"),
+		{Leader: 1, View: 1, Digest: []byte("b")},
+		{Leader: 1, Height: 1, Digest: []byte("b")},
+	} {
+		if ev := Observe(p); ev != nil {
+			t.Fatalf("evidence returned for proposal in another slot: %v", p)
+		}
+	}
+
+	second := signedProposal(t, 1, 1, 0, "b")
+	ev := Observe(second)
+	if ev == nil {
+		t.Fatalf("no evidence returned for conflicting proposals")
+	}
+	if ev.Offender != 1 || ev.First != first || ev.Second != second {
+		t.Fatalf("evidence %v, expected proposals %v and %v of offender 1", ev, first, second)
+	}
+	if err := Verify(ev); err != nil {
+		t.Fatalf("observed evidence not valid: %s", err)
+	}
+	if pending := Pending(); len(pending) != 1 || pending[0] != ev {
+		t.Fatalf("pending evidence %v, expected %v", pending, ev)
+	}
+
+	// Further conflicting proposals produce evidence, but do not replace the known evidence.
+	if ev := Observe(signedProposal(t, 1, 1, 0, "c")); ev == nil {
+		t.Fatalf("no evidence returned for a third conflicting proposal")
+	}
+	if pending := Pending(); len(pending) != 1 || pending[0] != ev {
+		t.Fatalf("pending evidence %v, expected %v", pending, ev)
+	}
+}
+
+func TestObserve_LazySignatureCheck(t *testing.T) {
+	setup()
+
+	// Non-conflicting proposals are stored without checking their signature.
+	forged := forgedProposal(1, 0, "a")
+	if ev := Observe(forged); ev != nil {
+		t.Fatalf("evidence returned for the first proposal")
+	}
+	if ev := Observe(forgedProposal(1, 0, "a")); ev != nil {
+		t.Fatalf("evidence returned for a matching proposal")
+	}
+	if stored := proposals[proposalKey{leader: 1}]; stored != forged {
+		t.Fatalf("stored proposal %v, expected the forged one", stored)
+	}
+
+	// A conflicting proposal with an invalid signature is ignored.
+	if ev := Observe(forgedProposal(1, 0, "b")); ev != nil {
+		t.Fatalf("evidence returned for a forged conflicting proposal")
+	}
+	if stored := proposals[proposalKey{leader: 1}]; stored != forged {
+		t.Fatalf("stored proposal replaced by a forged conflicting one")
+	}
+	if len(Pending()) != 0 {
+		t.Fatalf("evidence made of forged proposals")
+	}
+}
+
+func TestObserve_ForgedFirst(t *testing.T) {
+	setup()
+
+	// A forged first proposal cannot frame its leader. It is replaced by the first valid conflicting proposal.
+	Observe(forgedProposal(1, 0, "a"))
+	valid := signedProposal(t, 1, 1, 0, "b")
+	if ev := Observe(valid); ev != nil {
+		t.Fatalf("evidence returned against a leader whose first observed proposal was forged")
+	}
+	if stored := proposals[proposalKey{leader: 1}]; stored != valid {
+		t.Fatalf("stored proposal %v, expected the valid one", stored)
+	}
+	if len(Pending()) != 0 {
+		t.Fatalf("evidence made of a forged proposal")
+	}
+
+	// A valid proposal conflicting with the replacement proves misbehavior.
+	conflicting := signedProposal(t, 1, 1, 0, "c")
+	ev := Observe(conflicting)
+	if ev == nil {
+		t.Fatalf("no evidence returned for conflicting proposals")
+	}
+	if ev.First != valid || ev.Second != conflicting {
+		t.Fatalf("evidence made of %v and %v, expected %v and %v", ev.First, ev.Second, valid, conflicting)
+	}
+	if err := Verify(ev); err != nil {
+		t.Fatalf("observed evidence not valid: %s", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	a := signedProposal(t, 1, 1, 0, "a")
+	b := signedProposal(t, 1, 1, 0, "b")
+
+	tests := []struct {
+		name  string
+		ev    *pb.MisbehaviorEvidence
+		valid bool
+	}{
+		{"valid", &pb.MisbehaviorEvidence{Offender: 1, First: a, Second: b}, true},
+		{"nil", nil, false},
+		{"incomplete", &pb.MisbehaviorEvidence{Offender: 1, First: a}, false},
+		{"other offender", &pb.MisbehaviorEvidence{Offender: 2, First: a, Second: b}, false},
+		{"not conflicting", &pb.MisbehaviorEvidence{Offender: 1, First: a, Second: signedProposal(t, 1, 1, 0, "a")}, false},
+		{"different slots", &pb.MisbehaviorEvidence{Offender: 1, First: a, Second: signedProposal(t, 1, 1, 1, "b")}, false},
+		{"forged", &pb.MisbehaviorEvidence{Offender: 1, First: a, Second: forgedProposal(1, 0, "b")}, false},
+		{"signed by non-leader", &pb.MisbehaviorEvidence{Offender: 1, First: a, Second: signedProposal(t, 1, 2, 0, "b")}, false},
+		{"signed by other leaders", &pb.MisbehaviorEvidence{
+			Offender: 1,
+			First:    signedProposal(t, 1, 2, 0, "a"),
+			Second:   signedProposal(t, 1, 3, 0, "b"),
+		}, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := Verify(tc.ev); (err == nil) != tc.valid {
+				t.Fatalf("verification error %v, expected valid %v", err, tc.valid)
+			}
+		})
+	}
+}
+
+func TestHandleMessage(t *testing.T) {
+	setup()
+
+	HandleMessage(&pb.MisbehaviorEvidence{
+		Offender: 1,
+		First:    signedProposal(t, 1, 2, 0, "a"),
+		Second:   signedProposal(t, 1, 2, 0, "b"),
+	}, 2)
+	if len(Pending()) != 0 {
+		t.Fatalf("invalid evidence accepted")
+	}
+
+	ev := &pb.MisbehaviorEvidence{Offender: 1, First: signedProposal(t, 1, 1, 0, "a"), Second: signedProposal(t, 1, 1, 0, "b")}
+	HandleMessage(ev, 2)
+	if pending := Pending(); len(pending) != 1 || pending[0] != ev {
+		t.Fatalf("pending evidence %v, expected %v", pending, ev)
+	}
+}
+
+func TestPendingAndMarkConvicted(t *testing.T) {
+	setup()
+
+	for _, offender := range []int32{3, 1, 2} {
+		Observe(signedProposal(t, offender, offender, 0, "a"))
+		if Observe(signedProposal(t, offender, offender, 0, "b")) == nil {
+			t.Fatalf("no evidence against %d", offender)
+		}
+	}
+
+	pending := Pending()
+	if len(pending) != 3 {
+		t.Fatalf("%d pending pieces of evidence, expected 3", len(pending))
+	}
+	for i, ev := range pending {
+		if ev.Offender != int32(i+1) {
+			t.Fatalf("pending evidence not ordered by offender: %d at position %d", ev.Offender, i)
+		}
+	}
+
+	MarkConvicted(2)
+	if !Convicted(2) || Convicted(1) {
+		t.Fatalf("convicted 1: %v, 2: %v, expected only 2", Convicted(1), Convicted(2))
+	}
+	pending = Pending()
+	if len(pending) != 2 || pending[0].Offender != 1 || pending[1].Offender != 3 {
+		t.Fatalf("pending evidence %v, expected evidence against 1 and 3", pending)
+	}
+
+	// Convicting an offender without known evidence only marks it.
+	MarkConvicted(0)
+	if !Convicted(0) || len(Pending()) != 2 {
+		t.Fatalf("convicting an offender without evidence changed the pending evidence")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	setup()
+
+	for sn := int32(0); sn < 4; sn++ {
+		Observe(signedProposal(t, 1, 1, sn, "a"))
+	}
+	Prune(1)
+	for sn := int32(0); sn < 4; sn++ {
+		if _, ok := proposals[proposalKey{leader: 1, sn: sn}]; ok != (sn > 1) {
+			t.Fatalf("proposal for sequence number %d stored: %v", sn, ok)
+		}
+	}
+
+	// After pruning, a conflicting proposal for a pruned sequence number is not detected.
+	if ev := Observe(signedProposal(t, 1, 1, 0, "b")); ev != nil {
+		t.Fatalf("evidence returned for a pruned sequence number")
+	}
+	if ev := Observe(signedProposal(t, 1, 1, 2, "b")); ev == nil {
+		t.Fatalf("no evidence returned for a sequence number that was not pruned")
+	}
+}
@@ -17,6 +17,7 @@ package log
 import (
 	"sync"
 
+	"github.com/Hanzheng2021/Orthrus/metrics"
 	pb "github.com/Hanzheng2021/Orthrus/protobufs"
 	"github.com/Hanzheng2021/Orthrus/tracing"
 	logger "github.com/rs/zerolog/log"
@@ -56,7 +57,11 @@ var (
 	// Guarded by entryPublishLock
 	firstEmptySN int32 = 0
 
-	// Guards logSubscribers, logSubscribersOutOfOrder, entrySubscribers and firstEmptySN
+	// Highest sequence number of a committed entry, -1 if none has been committed yet.
+	// Guarded by entryPublishLock
+	highestCommittedSN int32 = -1
+
+	// Guards logSubscribers, logSubscribersOutOfOrder, entrySubscribers, firstEmptySN and highestCommittedSN
 	entryPublishLock = sync.Mutex{}
 
 	// The most recent stable checkpoint.
@@ -94,6 +99,8 @@ func CommitEntry(entry *Entry) {
 			//Time("committed", time.Unix(0, entry.CommitTs)).
 			Int64("latency", (entry.CommitTs-entry.CommitTs)/1000000).
 			Msg("Committed entry.")
+		metrics.RequestsCommitted.Add(len(entry.Batch.Requests))
+		tracing.BatchStage(entry.Batch.Requests, tracing.StageCommit, entry.Sn)
 		go func() {
 			for i := 0; i < len(entry.Batch.Requests); i++ {
 				if entry.Batch.Requests[i].IsContract == 0 {
@@ -103,6 +110,9 @@ func CommitEntry(entry *Entry) {
 		}()
 	}
 	entryPublishLock.Lock()
+	if entry.Sn > highestCommittedSN {
+		highestCommittedSN = entry.Sn
+	}
 	publishEntry(entry, logSubscribersOutOfOrder)
 	entryPublishLock.Unlock()
 
@@ -119,14 +129,18 @@ func GetEntry(sn int32) *Entry {
 	}
 }
 
-// Returns the sequence numbers of all empty log entries up to (and including) until
-func Missing(until int32) []int32 {
+// Returns the sequence numbers of the empty log entries up to (and including) until, in increasing order.
+// At most max sequence numbers are returned. If max is negative, all of them are returned.
+// The log is scanned without holding entryPublishLock, so entries committed concurrently might or might not be
+// reported as missing.
+func Missing(until int32, max int) []int32 {
 	missing := make([]int32, 0)
 
 	entryPublishLock.Lock()
-	defer entryPublishLock.Unlock()
+	first := firstEmptySN
+	entryPublishLock.Unlock()
 
-	for sn := firstEmptySN; sn <= until; sn++ {
+	for sn := first; sn <= until && (max < 0 || len(missing) < max); sn++ {
 		if _, ok := entries.Load(sn); !ok {
 			missing = append(missing, sn)
 		}
@@ -135,6 +149,15 @@ func Missing(until int32) []int32 {
 	return missing
 }
 
+// Returns the sequence number of the first empty slot in the log (i.e., of the next entry to be delivered in order)
+// and the highest sequence number of a committed entry (-1 if none).
+func FirstEmptyAndHighestSN() (int32, int32) {
+	entryPublishLock.Lock()
+	defer entryPublishLock.Unlock()
+
+	return firstEmptySN, highestCommittedSN
+}
+
 // Creates and returns a new channel to which all the new log entries will be pushed in order.
 func Entries() chan *Entry {
 
@@ -274,6 +297,8 @@ func publishEntries() {
 				Int32("sn", firstEmptySN).
 				Int("nReq", len(entry.(*Entry).Batch.Requests)).
 				Msg("Delivered batch.")
+			metrics.RequestsDelivered.Add(len(entry.(*Entry).Batch.Requests))
+			tracing.BatchStage(entry.(*Entry).Batch.Requests, tracing.StageDeliver, firstEmptySN)
 			if len(entry.(*Entry).Batch.Requests) > 0 {
 				go func(entry *Entry) {
 					for i := 0; i < len(entry.Batch.Requests); i++ {
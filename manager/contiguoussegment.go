@@ -15,7 +15,6 @@
 package manager
 
 import (
-	"github.com/Hanzheng2021/Orthrus/config"
 	"github.com/Hanzheng2021/Orthrus/request"
 )
 
@@ -30,6 +29,7 @@ type ContiguousSegment struct {
 	snLength    int32
 	startsAfter int32
 	buckets     *request.BucketGroup
+	batchSize   int
 }
 
 func (c *ContiguousSegment) SegID() int {
@@ -74,5 +74,5 @@ func (c *ContiguousSegment) Buckets() *request.BucketGroup {
 }
 
 func (c *ContiguousSegment) BatchSize() int {
-	return config.Config.BatchSize
+	return c.batchSize
 }
@@ -47,22 +47,27 @@ type DummyManager struct {
 	// Buffers all the log entries committed during one epoch.
 	// Used for garbage collection and client watermark advancing.
 	epochEntryBuffer *util.ChannelBuffer
+
+	// Configuration the manager was created with.
+	cfg *config.Configuration
 }
 
 // Create a new DummyManager with with fresh state
-func NewDummyManager() *DummyManager {
+func NewDummyManager(cfg *config.Configuration) *DummyManager {
 	return &DummyManager{
 		segmentChannel:      make(chan Segment),
 		checkpointSNChannel: make(chan int32),
 		nextSegmentID:       0,
 		entriesChannel:      log.Entries(),
 		checkpointChannel:   log.Checkpoints(),
-		epochEntryBuffer:    util.NewChannelBuffer(config.Config.EpochLength),
+		epochEntryBuffer:    util.NewChannelBuffer(cfg.EpochLength),
 
 		// After every checkpoint, new segments can be issued (i.e., watermark can be advanced).
 		// It is thus natural to advance the watermark by as much as the log advanced through the checkpoint,
 		// devided by the number of leaders (Dummy manager has all nodes a leaders).
-		segmentLength: config.Config.CheckpointInterval / membership.NumNodes(),
+		segmentLength: cfg.CheckpointInterval / membership.NumNodes(),
+
+		cfg: cfg,
 	}
 }
 
@@ -117,8 +122,9 @@ func (dm *DummyManager) NewDummySegment(segID int, offset int32, leaderOffset in
 		snOffset:  offset,
 		snLength:  int32(dm.segmentLength),
 		// To parallelize the segment execution, subtract length for each extra bucket.
-		startsAfter: offset - (int32(config.Config.NumBuckets)-1)*int32(dm.segmentLength) - 1,
-		buckets:     request.NewBucketGroup([]int{segID % config.Config.NumBuckets}), // Round-robin bucket assignment
+		startsAfter: offset - (int32(dm.cfg.NumBuckets)-1)*int32(dm.segmentLength) - 1,
+		buckets:     request.NewBucketGroup([]int{segID % dm.cfg.NumBuckets}, dm.cfg), // Round-robin bucket assignment
+		batchSize:   dm.cfg.BatchSize,
 	}
 }
 
@@ -127,7 +133,7 @@ func (dm *DummyManager) NewDummySegment(segID int, offset int32, leaderOffset in
 // Decrements the provided wait group when done.
 func (dm *DummyManager) handleLogEntries(wg *sync.WaitGroup) {
 	defer wg.Done()
-	checkpointInterval := int32(config.Config.CheckpointInterval)
+	checkpointInterval := int32(dm.cfg.CheckpointInterval)
 
 	// Channel should be closed on shutdown for this loop to exit.
 	for entry := <-dm.entriesChannel; entry != nil; entry = <-dm.entriesChannel {
@@ -181,7 +187,7 @@ func (dm *DummyManager) issueSegments(chkp *pb.StableCheckpoint) {
 	// ( (dm.nextSegmentID + 1) * dummySegmentLength is the first SN of the segment after the next segment
 	// and offset + watermarkWindowSize is the first SN not in the watermark window)
 	for int32((dm.nextSegmentID+1)*dm.segmentLength) <=
-		offset+int32(config.Config.WatermarkWindowSize) {
+		offset+int32(dm.cfg.WatermarkWindowSize) {
 
 		// Create new segment
 		dm.segmentChannel <- dm.NewDummySegment(
@@ -203,7 +209,7 @@ func (dm *DummyManager) issueSkippingSegments(offset int32) {
 	// The distance of the sequence numbers in the skipping segment equals the number of mir-leaders
 	// so that sequence numbers are distributed among leaders in a round robin way
 	nLeaders := membership.NumNodes()
-	epochLength := config.Config.WatermarkWindowSize
+	epochLength := dm.cfg.WatermarkWindowSize
 
 	// The sequence numbers of the epoch are distributed evenly among the segments
 	segmentLength, remainder := epochLength/nLeaders, epochLength%nLeaders
@@ -230,7 +236,7 @@ func (dm *DummyManager) issueSkippingSegments(offset int32) {
 			snOffset:    offset + int32(i),
 			snLength:    segmentLengths[i],
 			startsAfter: offset - 1,
-			buckets:     request.NewBucketGroup(buckets[int32(i)]),
+			buckets:     request.NewBucketGroup(buckets[int32(i)], dm.cfg),
 			batchSize:   0,
 		}
 		seg.initSNs()
@@ -15,8 +15,11 @@
 package manager
 
 import (
+	"sort"
+
 	logger "github.com/rs/zerolog/log"
 	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/log"
 	"github.com/Hanzheng2021/Orthrus/membership"
 )
 
@@ -26,44 +29,94 @@ type leaderPolicy interface {
 	// Updates information about the leaders accoring to the specific policy.
 	// The method receives a list of suspected nodes for epoch e.
 	Update(e int32, suspect int32)
+	// Permanently excludes a node from the leader set, starting from the epoch following epoch e.
+	// Called when provable evidence of the node's misbehavior (e.g. equivocation) has been committed to the log.
+	Exclude(e int32, offender int32)
 }
 
-func NewLeaderPolicy(policyName string) leaderPolicy {
+// Creates the leader policy with the given name, parametrized by the given configuration.
+func NewLeaderPolicy(policyName string, cfg *config.Configuration) leaderPolicy {
 	switch policyName {
 	case "Simple":
-		return newSimpleLeaderPolicy()
+		return newSimpleLeaderPolicy(cfg.NodeToLeaderRatio)
 	case "Single":
 		return newSingleLeaderPolicy()
 	case "Backoff":
-		return newBackoffLeaderPolicy()
+		return newBackoffLeaderPolicy(cfg.DefaultLeaderBan)
 	case "Blacklist":
 		return newBlacklistLeaderPolicy()
 	case "Combined":
-		return newCombinedLeaderPolicy()
+		return newCombinedLeaderPolicy(cfg.DefaultLeaderBan)
+	case "Reputation":
+		return newReputationLeaderPolicy(cfg.DefaultLeaderBan, cfg.StragglerTolerance)
 	case "SimulatedRandomFailures":
-		return newSimulatedRandomFailuresLeaderPolicy(config.Config.Failures, config.Config.RandomSeed)
+		return newSimulatedRandomFailuresLeaderPolicy(cfg.Failures, cfg.RandomSeed)
 	default:
-		logger.Fatal().Msgf("Unsupported leader policy %s", config.Config.LeaderPolicy)
+		logger.Fatal().Msgf("Unsupported leader policy %s", policyName)
 	}
 	return nil
 }
 
+//============================================================
+// Excluded nodes
+//============================================================
+
+// Keeps track of the nodes permanently excluded from the leader set because of provable misbehavior.
+// Embedded in the leader policies, which apply it on top of their own leader selection.
+type excludedNodes struct {
+	excluded map[int32]bool
+}
+
+func (en *excludedNodes) Exclude(e int32, offender int32) {
+	if en.excluded == nil {
+		en.excluded = make(map[int32]bool)
+	}
+	en.excluded[offender] = true
+	logger.Info().Int32("epoch", e).Int32("id", offender).Msg("Excluding misbehaving node from leader set.")
+}
+
+// Returns the node IDs that have not been excluded, preserving their order.
+// If all nodes have been excluded (which is only possible if more than f nodes misbehaved), returns nodeIDs unchanged,
+// such that each epoch has at least one leader.
+func (en *excludedNodes) eligible(nodeIDs []int32) []int32 {
+	eligible := make([]int32, 0, len(nodeIDs))
+	for _, id := range nodeIDs {
+		if !en.excluded[id] {
+			eligible = append(eligible, id)
+		}
+	}
+	if len(eligible) == 0 {
+		logger.Error().Int("excluded", len(en.excluded)).Msg("All nodes excluded from leader set.")
+		return nodeIDs
+	}
+	return eligible
+}
+
 //============================================================
 // Simple
 //============================================================
 
 //The SIMPLE leader selection policy always selects all nodes to be leaders in each epoch.
-type simpleLeaderPolicy struct{}
+type simpleLeaderPolicy struct {
+	// Only every nodeToLeaderRatio-th node is a leader.
+	nodeToLeaderRatio int
 
-func newSimpleLeaderPolicy() *simpleLeaderPolicy {
-	return &simpleLeaderPolicy{}
+	excludedNodes
+}
+
+func newSimpleLeaderPolicy(nodeToLeaderRatio int) *simpleLeaderPolicy {
+	return &simpleLeaderPolicy{nodeToLeaderRatio: nodeToLeaderRatio}
 }
 
 func (sp *simpleLeaderPolicy) GetLeaders(e int32) []int32 {
 	allNodeIDs := membership.AllNodeIDs()
-	leadersCount := len(allNodeIDs) / config.Config.NodeToLeaderRatio
+	leadersCount := len(allNodeIDs) / sp.nodeToLeaderRatio
+	eligibleNodeIDs := sp.eligible(allNodeIDs)
+	if leadersCount > len(eligibleNodeIDs) {
+		leadersCount = len(eligibleNodeIDs)
+	}
 	leaders := make([]int32, 0, 0)
-	leaders = append(leaders, allNodeIDs[:leadersCount]...)
+	leaders = append(leaders, eligibleNodeIDs[:leadersCount]...)
 	return leaders
 }
 
@@ -75,14 +128,16 @@ func (sp *simpleLeaderPolicy) Update(e int32, suspect int32) {
 // Single
 //============================================================
 
-type singleLeaderPolicy struct{}
+type singleLeaderPolicy struct {
+	excludedNodes
+}
 
 func newSingleLeaderPolicy() *singleLeaderPolicy {
 	return &singleLeaderPolicy{}
 }
 
 func (sp *singleLeaderPolicy) GetLeaders(e int32) []int32 {
-	allNodeIDs := membership.AllNodeIDs()
+	allNodeIDs := sp.eligible(membership.AllNodeIDs())
 	return []int32{allNodeIDs[int(e)%len(allNodeIDs)]}
 }
 
@@ -102,19 +157,24 @@ type backoffLeaderPolicy struct {
 	ban map[int32]int32
 	// For each peer, the epoch starting from which the peer can be leader again.
 	bannedUntil map[int32]int32
+	// Ban period of a node suspected for the first time.
+	defaultBan int32
+
+	excludedNodes
 }
 
-func newBackoffLeaderPolicy() *backoffLeaderPolicy {
+func newBackoffLeaderPolicy(defaultBan int) *backoffLeaderPolicy {
 	return &backoffLeaderPolicy{
 		ban:         make(map[int32]int32),
 		bannedUntil: make(map[int32]int32),
+		defaultBan:  int32(defaultBan),
 	}
 }
 
 func (bp *backoffLeaderPolicy) Update(e int32, suspect int32) {
 	if _, ok := bp.ban[suspect]; !ok {
 		// Use default ban if the peer has not been suspected before.
-		bp.ban[suspect] = int32(config.Config.DefaultLeaderBan)
+		bp.ban[suspect] = bp.defaultBan
 	} else {
 		// Double the penalty for nodes that have alrady been suspected.
 		bp.ban[suspect] = bp.ban[suspect] * 2
@@ -136,7 +196,7 @@ func (bp *backoffLeaderPolicy) Update(e int32, suspect int32) {
 
 func (bp *backoffLeaderPolicy) GetLeaders(e int32) []int32 {
 	leaders := make([]int32, 0, 0)
-	allNodeIDs := membership.AllNodeIDs()
+	allNodeIDs := bp.eligible(membership.AllNodeIDs())
 
 	for _, id := range allNodeIDs {
 		// Select leaders that are 1) not banned (!ok) or 2) their ban expired (bannedUntil < e).
@@ -156,6 +216,8 @@ func (bp *backoffLeaderPolicy) GetLeaders(e int32) []int32 {
 type blacklistLeaderPolicy struct {
 	bannedList []int32
 	bannedMap  map[int32]bool
+
+	excludedNodes
 }
 
 func newBlacklistLeaderPolicy() *blacklistLeaderPolicy {
@@ -181,7 +243,7 @@ func (bp *blacklistLeaderPolicy) Update(e int32, suspect int32) {
 func (bp *blacklistLeaderPolicy) GetLeaders(e int32) []int32 {
 	leaders := make([]int32, 0, 0)
 
-	for _, leader := range membership.AllNodeIDs() {
+	for _, leader := range bp.eligible(membership.AllNodeIDs()) {
 		if !bp.bannedMap[leader] {
 			leaders = append(leaders, leader)
 		}
@@ -201,9 +263,9 @@ type combinedLeaderPolicy struct {
 	blacklist *blacklistLeaderPolicy
 }
 
-func newCombinedLeaderPolicy() leaderPolicy {
+func newCombinedLeaderPolicy(defaultBan int) leaderPolicy {
 	return &combinedLeaderPolicy{
-		backoff:   newBackoffLeaderPolicy(),
+		backoff:   newBackoffLeaderPolicy(defaultBan),
 		blacklist: newBlacklistLeaderPolicy(),
 	}
 }
@@ -213,6 +275,11 @@ func (cp *combinedLeaderPolicy) Update(e int32, suspect int32) {
 	cp.blacklist.Update(e, suspect)
 }
 
+func (cp *combinedLeaderPolicy) Exclude(e int32, offender int32) {
+	cp.backoff.Exclude(e, offender)
+	cp.blacklist.Exclude(e, offender)
+}
+
 func (cp *combinedLeaderPolicy) GetLeaders(e int32) []int32 {
 
 	// Create map of leaders from both policies.
@@ -240,6 +307,7 @@ func (cp *combinedLeaderPolicy) GetLeaders(e int32) []int32 {
 // SIMULATEDRANDOMFAILURES leader selection policy simulates the state of the system after the crash of some peers
 // and their eviction from the leader set.
 type simulatedRandomFailuresLeaderPolicy struct {
+	excludedNodes
 }
 
 func newSimulatedRandomFailuresLeaderPolicy(failures int, seed int64) *simulatedRandomFailuresLeaderPolicy {
@@ -251,5 +319,198 @@ func (srfp *simulatedRandomFailuresLeaderPolicy) Update(e int32, suspect int32)
 }
 
 func (srfp *simulatedRandomFailuresLeaderPolicy) GetLeaders(e int32) []int32 {
-	return membership.CorrectPeers()
+	return srfp.eligible(membership.CorrectPeers())
+}
+
+//============================================================
+// Reputation
+//============================================================
+
+const (
+	// Maximal (and initial) reputation of a peer. Also the bucket share (in percent) of a peer with full reputation.
+	maxReputation = 100
+
+	// Reputation lost by a leader for each epoch in which it was lagging behind or suspected.
+	reputationPenalty = 25
+
+	// Reputation regained by a leader for each epoch in which it kept up with the other leaders.
+	reputationRecovery = 10
+)
+
+// Leader policies that evaluate the performance of the leaders also implement performancePolicy.
+// At the end of each epoch, the MirManager feeds them with the log entries committed in that epoch.
+type performancePolicy interface {
+	// Evaluates the leaders of epoch e, given the log entries committed in epoch e and the segments of epoch e
+	// (indexed by leader ID). The entries must be of type *log.Entry.
+	Observe(e int32, entries []interface{}, segments map[int32]Segment)
+
+	// Returns the share (in percent) of its regular number of buckets a leader is assigned in epoch e.
+	BucketShare(e int32, leader int32) int
+}
+
+// REPUTATION leader selection policy scores each peer based on how much its proposals lag behind
+// the proposals of the other leaders.
+// The lag is computed from the proposal timestamps in the committed batches. Since those timestamps are
+// agreed upon as part of the batches, all peers compute the same scores. Followers reject proposals whose timestamp
+// deviates from their local time by more than ProposalTsTolerance, so a leader cannot misrepresent its lag by more.
+// A leader whose median lag in an epoch exceeds StragglerTolerance loses reputation, otherwise it regains it.
+// The reputation of a leader determines its share of buckets. When its reputation drops to 0, the leader is
+// excluded from the leader set for DefaultLeaderBan epochs, but never more than f peers are excluded at a time.
+type reputationLeaderPolicy struct {
+	// Reputation of each peer, between 0 and maxReputation. Peers not present have maximal reputation.
+	reputation map[int32]int
+
+	// For each peer excluded for bad reputation, the epoch starting from which the peer can be leader again.
+	bannedUntil map[int32]int32
+
+	// Number of epochs a peer is excluded for when its reputation drops to 0.
+	defaultBan int32
+	// Maximal median lag (in milliseconds) of a leader not losing reputation.
+	stragglerTolerance int
+
+	excludedNodes
+}
+
+func newReputationLeaderPolicy(defaultBan int, stragglerTolerance int) *reputationLeaderPolicy {
+	return &reputationLeaderPolicy{
+		reputation:         make(map[int32]int),
+		bannedUntil:        make(map[int32]int32),
+		defaultBan:         int32(defaultBan),
+		stragglerTolerance: stragglerTolerance,
+	}
+}
+
+func (rp *reputationLeaderPolicy) GetLeaders(e int32) []int32 {
+	leaders := make([]int32, 0, 0)
+	for _, id := range rp.eligible(membership.AllNodeIDs()) {
+		if bannedUntil, ok := rp.bannedUntil[id]; !ok || bannedUntil < e {
+			leaders = append(leaders, id)
+		}
+	}
+	return leaders
+}
+
+func (rp *reputationLeaderPolicy) Update(e int32, suspect int32) {
+	rp.penalize(e, suspect)
+}
+
+func (rp *reputationLeaderPolicy) Observe(e int32, entries []interface{}, segments map[int32]Segment) {
+
+	// Index the leaders of the epoch and their timestamped (i.e., not aborted) proposals by sequence number.
+	snLeaders := make(map[int32]int32)
+	rounds := make(map[int32]int) // Position of each sequence number in its segment.
+	for leader, seg := range segments {
+		for i, sn := range seg.SNs() {
+			snLeaders[sn] = leader
+			rounds[sn] = i
+		}
+	}
+	timestamps := make(map[int][]int64)         // Proposal timestamps of each round.
+	leaderTimestamps := make(map[int32][]int64) // Proposal timestamps of each leader.
+	leaderRounds := make(map[int32][]int)       // Round of each proposal timestamp in leaderTimestamps.
+	for _, item := range entries {
+		entry := item.(*log.Entry)
+		leader, ok := snLeaders[entry.Sn]
+		if !ok || entry.Aborted || entry.Batch == nil || entry.Batch.ProposalTs == 0 {
+			continue
+		}
+		round := rounds[entry.Sn]
+		timestamps[round] = append(timestamps[round], entry.Batch.ProposalTs)
+		leaderTimestamps[leader] = append(leaderTimestamps[leader], entry.Batch.ProposalTs)
+		leaderRounds[leader] = append(leaderRounds[leader], round)
+	}
+
+	// The lag of a proposal is its delay with respect to the median proposal of the same round.
+	// The lag of a leader is the median lag of its proposals.
+	roundMedians := make(map[int]int64, len(timestamps))
+	for round, ts := range timestamps {
+		roundMedians[round] = median(ts)
+	}
+
+	// Iterate over leaders in a deterministic order, as penalizing a leader depends on the already excluded ones.
+	leaders := make([]int32, 0, len(segments))
+	for leader := range segments {
+		leaders = append(leaders, leader)
+	}
+	sort.Slice(leaders, func(i, j int) bool {
+		return leaders[i] < leaders[j]
+	})
+
+	for _, leader := range leaders {
+		if len(leaderTimestamps[leader]) == 0 {
+			continue
+		}
+		lags := make([]int64, len(leaderTimestamps[leader]))
+		for i, ts := range leaderTimestamps[leader] {
+			if lag := ts - roundMedians[leaderRounds[leader][i]]; lag > 0 {
+				lags[i] = lag
+			}
+		}
+		lagMs := median(lags) / 1000000
+
+		logger.Info().
+			Int32("epoch", e).
+			Int32("leader", leader).
+			Int64("lag", lagMs).
+			Int("reputation", rp.getReputation(leader)).
+			Msg("Leader performance.")
+
+		if lagMs > int64(rp.stragglerTolerance) {
+			rp.penalize(e, leader)
+		} else if reputation := rp.getReputation(leader) + reputationRecovery; reputation < maxReputation {
+			rp.reputation[leader] = reputation
+		} else {
+			rp.reputation[leader] = maxReputation
+		}
+	}
+}
+
+func (rp *reputationLeaderPolicy) BucketShare(e int32, leader int32) int {
+	return rp.getReputation(leader)
+}
+
+func (rp *reputationLeaderPolicy) getReputation(peer int32) int {
+	if reputation, ok := rp.reputation[peer]; ok {
+		return reputation
+	}
+	return maxReputation
+}
+
+// Decreases the reputation of a peer and bans the peer from the leader set if its reputation drops to 0.
+func (rp *reputationLeaderPolicy) penalize(e int32, peer int32) {
+	rp.reputation[peer] = rp.getReputation(peer) - reputationPenalty
+	if rp.reputation[peer] > 0 {
+		return
+	}
+	rp.reputation[peer] = 0
+
+	// Count currently banned peers. As in GetLeaders, a peer banned until e is still banned in epoch e.
+	banned := 0
+	for _, until := range rp.bannedUntil {
+		if until >= e {
+			banned++
+		}
+	}
+	if banned >= membership.Faults() {
+		return
+	}
+
+	// After the ban, the peer starts with a reputation that only tolerates one more bad epoch.
+	rp.bannedUntil[peer] = e + rp.defaultBan
+	rp.reputation[peer] = reputationPenalty
+	logger.Info().Int32("epoch", e).
+		Int32("id", peer).
+		Int32("until", rp.bannedUntil[peer]).
+		Msg("Banning leader with bad reputation.")
+}
+
+// Returns the median of the given values. Sorts values in place.
+func median(values []int64) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i] < values[j]
+	})
+	return values[len(values)/2]
 }
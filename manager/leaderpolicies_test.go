@@ -0,0 +1,242 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manager
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/log"
+	"github.com/Hanzheng2021/Orthrus/membership"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+)
+
+// Number of peers in the tests. At most 1 peer is faulty.
+const testNodes = 4
+
+func TestMain(m *testing.M) {
+	cfg := config.Default()
+	cfg.Failures = 0
+	cfg.StragglerCnt = 0
+	membership.Init(cfg)
+	identities := make([]*pb.NodeIdentity, testNodes)
+	for i := range identities {
+		identities[i] = &pb.NodeIdentity{NodeId: int32(i)}
+	}
+	membership.InitNodeIdentities(identities, cfg)
+	os.Exit(m.Run())
+}
+
+// Builds an epoch in which each peer leads a segment of 4 sequence numbers.
+// The proposal of round i of each segment is made at i*100ms, plus the lag (in ms) of its leader.
+// The entries of the leaders in aborted are aborted.
+func testEpoch(lags map[int32]int64, aborted map[int32]bool) ([]interface{}, map[int32]Segment) {
+	const segLen = 4
+	start := time.Now().UnixNano()
+
+	entries := make([]interface{}, 0, testNodes*segLen)
+	segments := make(map[int32]Segment, testNodes)
+	for leader := int32(0); leader < testNodes; leader++ {
+		seg := &ContiguousSegment{
+			segID:    int(leader),
+			leaders:  []int32{leader},
+			snOffset: leader * segLen,
+			snLength: segLen,
+		}
+		segments[leader] = seg
+		for i, sn := range seg.SNs() {
+			ts := start + (int64(i)*100+lags[leader])*int64(time.Millisecond)
+			entries = append(entries, &log.Entry{
+				Sn:      sn,
+				Batch:   &pb.Batch{ProposalTs: ts},
+				Aborted: aborted[leader],
+			})
+		}
+	}
+	return entries, segments
+}
+
+func TestReputationLeaderPolicy_Observe(t *testing.T) {
+	tests := []struct {
+		name       string
+		reputation map[int32]int   // Reputation before the epoch. Peers not present have maximal reputation.
+		lags       map[int32]int64 // Lag (ms) of the proposals of each leader.
+		aborted    map[int32]bool  // Leaders whose entries are aborted.
+		want       map[int32]int   // Reputation after the epoch.
+		wantBanned []int32
+	}{
+		{
+			name: "all on time",
+			want: map[int32]int{0: 100, 1: 100, 2: 100, 3: 100},
+		},
+		{
+			name: "lag within tolerance",
+			lags: map[int32]int64{3: 900},
+			want: map[int32]int{0: 100, 1: 100, 2: 100, 3: 100},
+		},
+		{
+			name: "lag beyond tolerance",
+			lags: map[int32]int64{3: 2000},
+			want: map[int32]int{0: 100, 1: 100, 2: 100, 3: 75},
+		},
+		{
+			name:       "recovery",
+			reputation: map[int32]int{1: 50, 2: 95},
+			want:       map[int32]int{0: 100, 1: 60, 2: 100, 3: 100},
+		},
+		{
+			name:       "aborted entries are not scored",
+			reputation: map[int32]int{3: 50},
+			lags:       map[int32]int64{3: 2000},
+			aborted:    map[int32]bool{3: true},
+			want:       map[int32]int{0: 100, 1: 100, 2: 100, 3: 50},
+		},
+		{
+			name:       "ban at zero reputation",
+			reputation: map[int32]int{2: 25},
+			lags:       map[int32]int64{2: 5000},
+			want:       map[int32]int{0: 100, 1: 100, 2: 25, 3: 100},
+			wantBanned: []int32{2},
+		},
+		{
+			// The median proposal of each round is the third one, which is late as well.
+			name: "lag of a majority is not detected",
+			lags: map[int32]int64{1: 2000, 2: 2000, 3: 2000},
+			want: map[int32]int{0: 100, 1: 100, 2: 100, 3: 100},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			const e = 5
+			rp := newReputationLeaderPolicy(2, 1000)
+			for peer, reputation := range tc.reputation {
+				rp.reputation[peer] = reputation
+			}
+
+			entries, segments := testEpoch(tc.lags, tc.aborted)
+			rp.Observe(e, entries, segments)
+
+			for peer, want := range tc.want {
+				if got := rp.BucketShare(e+1, peer); got != want {
+					t.Errorf("reputation of peer %d is %d, expected %d", peer, got, want)
+				}
+			}
+			leaders := rp.GetLeaders(e + 1)
+			if len(leaders) != testNodes-len(tc.wantBanned) {
+				t.Fatalf("leaders in next epoch are %v, expected all but %v", leaders, tc.wantBanned)
+			}
+			for _, leader := range leaders {
+				for _, banned := range tc.wantBanned {
+					if leader == banned {
+						t.Fatalf("banned peer %d is leader in next epoch", banned)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReputationLeaderPolicy_Penalize(t *testing.T) {
+	tests := []struct {
+		name        string
+		reputation  map[int32]int   // Reputation before the epoch. Peers not present have maximal reputation.
+		bannedUntil map[int32]int32 // Bans before the epoch.
+		suspects    []int32         // Peers penalized in the epoch, in order.
+		want        map[int32]int   // Reputation after the epoch.
+		wantBanned  map[int32]int32 // Bans after the epoch.
+	}{
+		{
+			name:       "single penalty",
+			suspects:   []int32{1},
+			want:       map[int32]int{1: 75},
+			wantBanned: map[int32]int32{},
+		},
+		{
+			name:       "repeated penalties ban",
+			suspects:   []int32{1, 1, 1, 1},
+			want:       map[int32]int{1: 25},
+			wantBanned: map[int32]int32{1: 7},
+		},
+		{
+			name:       "at most f banned",
+			reputation: map[int32]int{1: 25, 2: 25},
+			suspects:   []int32{1, 2},
+			want:       map[int32]int{1: 25, 2: 0},
+			wantBanned: map[int32]int32{1: 7},
+		},
+		{
+			name:        "expired ban does not count",
+			reputation:  map[int32]int{2: 25},
+			bannedUntil: map[int32]int32{1: 4},
+			suspects:    []int32{2},
+			want:        map[int32]int{2: 25},
+			wantBanned:  map[int32]int32{1: 4, 2: 7},
+		},
+		{
+			name:        "ban ending in the epoch counts",
+			reputation:  map[int32]int{2: 25},
+			bannedUntil: map[int32]int32{1: 5},
+			suspects:    []int32{2},
+			want:        map[int32]int{2: 0},
+			wantBanned:  map[int32]int32{1: 5},
+		},
+		{
+			name:       "f+1 peers penalized in the same epoch",
+			reputation: map[int32]int{1: 25, 2: 25, 3: 25},
+			suspects:   []int32{3, 1, 2},
+			want:       map[int32]int{1: 0, 2: 0, 3: 25},
+			wantBanned: map[int32]int32{3: 7},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			const e = 5
+			rp := newReputationLeaderPolicy(2, 1000)
+			for peer, reputation := range tc.reputation {
+				rp.reputation[peer] = reputation
+			}
+			for peer, until := range tc.bannedUntil {
+				rp.bannedUntil[peer] = until
+			}
+
+			for _, suspect := range tc.suspects {
+				rp.Update(e, suspect)
+			}
+
+			for peer, want := range tc.want {
+				if got := rp.getReputation(peer); got != want {
+					t.Errorf("reputation of peer %d is %d, expected %d", peer, got, want)
+				}
+			}
+			if len(rp.bannedUntil) != len(tc.wantBanned) {
+				t.Fatalf("banned peers are %v, expected %v", rp.bannedUntil, tc.wantBanned)
+			}
+			for peer, want := range tc.wantBanned {
+				if got, ok := rp.bannedUntil[peer]; !ok || got != want {
+					t.Errorf("peer %d banned until %d (%v), expected %d", peer, got, ok, want)
+				}
+			}
+
+			// At most f peers are excluded from the leaders of the epoch.
+			if leaders := rp.GetLeaders(e); len(leaders) < testNodes-membership.Faults() {
+				t.Errorf("leaders of epoch %d are %v, expected at least %d", e, leaders, testNodes-membership.Faults())
+			}
+		})
+	}
+}
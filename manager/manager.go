@@ -15,8 +15,10 @@
 package manager
 
 import (
+	"sort"
 	"sync"
 
+	"github.com/Hanzheng2021/Orthrus/config"
 	"github.com/Hanzheng2021/Orthrus/membership"
 	"github.com/Hanzheng2021/Orthrus/request"
 )
@@ -56,7 +58,7 @@ type Manager interface {
 // OPT: Most of the variables used in this function can be allocated statically and simply re-initialized,
 //      instead of allocating new copies on each call. However, as this function is not called very often,
 //      it probably has negligible impact on performance.
-func assignBuckets(e int32, leaders []int32) []*request.BucketGroup {
+func assignBuckets(e int32, leaders []int32, cfg *config.Configuration) []*request.BucketGroup {
 
 	// Convenience variables
 	numPeers := membership.NumNodes()
@@ -101,9 +103,53 @@ func assignBuckets(e int32, leaders []int32) []*request.BucketGroup {
 	// For each bucket assignment to a leader, create a BucketGroup
 	bucketGroups := make([]*request.BucketGroup, numLeaders)
 	for i, l := range leaders {
-		bucketGroups[i] = request.NewBucketGroup(assignedBuckets[l])
+		bucketGroups[i] = request.NewBucketGroup(assignedBuckets[l], cfg)
 	}
 
 	// Return the resulting bucketGroups
 	return bucketGroups
 }
+
+// Calculates an assignment of buckets to leaders in epoch e that balances the load of the leaders.
+// loads[b] is the load of bucket b, e.g., the number of requests from bucket b committed in the previous epoch.
+// Buckets are assigned greedily in decreasing order of load, each to the leader with the lowest total load so far.
+// Ties are broken by the number of buckets already assigned and then by the order of leaders, rotated by epoch.
+// The result only depends on the arguments, so that all peers compute the same assignment.
+// Returns a map from leader ID to the (sorted) list of bucket IDs assigned to that leader.
+func balanceBuckets(e int32, leaders []int32, loads []int) map[int32][]int {
+
+	// Order the buckets by decreasing load. Buckets with equal load are rotated by epoch.
+	order := make([]int, len(loads))
+	for i := range order {
+		order[i] = (i + int(e)) % len(loads)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return loads[order[i]] > loads[order[j]]
+	})
+
+	assignment := make(map[int32][]int, len(leaders))
+	for _, l := range leaders {
+		assignment[l] = make([]int, 0)
+	}
+	leaderLoads := make([]int, len(leaders))
+
+	for _, b := range order {
+		// Find the least loaded leader.
+		best := -1
+		for k := range leaders {
+			i := (k + int(e)) % len(leaders)
+			if best == -1 || leaderLoads[i] < leaderLoads[best] ||
+				(leaderLoads[i] == leaderLoads[best] && len(assignment[leaders[i]]) < len(assignment[leaders[best]])) {
+				best = i
+			}
+		}
+		assignment[leaders[best]] = append(assignment[leaders[best]], b)
+		leaderLoads[best] += loads[b]
+	}
+
+	for _, buckets := range assignment {
+		sort.Ints(buckets)
+	}
+
+	return assignment
+}
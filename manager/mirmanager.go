@@ -19,9 +19,12 @@ import (
 	"sync"
 
 	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/dissemination"
+	"github.com/Hanzheng2021/Orthrus/evidence"
 	"github.com/Hanzheng2021/Orthrus/log"
 	"github.com/Hanzheng2021/Orthrus/membership"
 	"github.com/Hanzheng2021/Orthrus/messenger"
+	"github.com/Hanzheng2021/Orthrus/metrics"
 	pb "github.com/Hanzheng2021/Orthrus/protobufs"
 	"github.com/Hanzheng2021/Orthrus/request"
 	"github.com/Hanzheng2021/Orthrus/statetransfer"
@@ -44,9 +47,24 @@ type MirManager struct {
 	// we don't update the leader policy more than once per epoch for the same node
 	currentSuspects map[int32]bool
 
+	// Nodes for which evidence of misbehavior has been committed to the log.
+	// Such nodes are permanently excluded from the leader set.
+	convicted map[int32]bool
+
+	// Length of the segments issued in the current epoch. 0 if the epoch length is fixed (see config.EpochLength).
+	// Adapted at the end of each epoch if config.AdaptiveSegmentLength is set.
+	segmentLength int
+
+	// Number of requests from each bucket committed in the previous epoch.
+	// Used for load-aware bucket assignment. Nil in the first epoch.
+	bucketLoads []int
+
 	// Segment issued for the current epoch, indexed by leader ID.
 	currentSegments map[int32]Segment
 
+	// Guards updates of epoch and currentSegments, which are only read outside of handleLogEntries() by Status().
+	statusLock sync.Mutex
+
 	// Channel used to announce segments to the orderer.
 	segmentChannel chan Segment
 
@@ -63,26 +81,34 @@ type MirManager struct {
 	// Buffers all the log entries committed during one epoch.
 	// Used for garbage collection and client watermark advancing.
 	epochEntryBuffer *util.ChannelBuffer
+
+	// Configuration the manager was created with.
+	cfg *config.Configuration
 }
 
 // Create a new MirManager with with fresh state
 // The set of leaders is initialized to contain all the nodes
-func NewMirManager() *MirManager {
-	maxEpochLength := config.Config.EpochLength
-	if config.Config.SegmentLength != 0 {
-		maxEpochLength = membership.NumNodes() * config.Config.SegmentLength
-	}
-	return &MirManager{
+func NewMirManager(cfg *config.Configuration) *MirManager {
+	mm := &MirManager{
 		epoch:               0,
-		leaderPolicy:        NewLeaderPolicy(config.Config.LeaderPolicy),
+		leaderPolicy:        NewLeaderPolicy(cfg.LeaderPolicy, cfg),
 		segmentChannel:      make(chan Segment),
 		checkpointSNChannel: make(chan int32),
 		nextSegmentID:       0,
 		entriesChannel:      log.Entries(),
 		checkpointChannel:   log.Checkpoints(),
-		epochEntryBuffer:    util.NewChannelBuffer(maxEpochLength),
 		currentSuspects:     make(map[int32]bool),
+		segmentLength:       cfg.SegmentLength,
+		convicted:           make(map[int32]bool),
+		cfg:                 cfg,
 	}
+
+	maxEpochLength := cfg.EpochLength
+	if cfg.SegmentLength != 0 {
+		maxEpochLength = membership.NumNodes() * mm.maxSegmentLength()
+	}
+	mm.epochEntryBuffer = util.NewChannelBuffer(maxEpochLength)
+	return mm
 }
 
 // Starts the MirManager. Afer the call to Start(), the MirManager starts observing the log and:
@@ -123,13 +149,13 @@ func (mm *MirManager) SubscribeCheckpointer() chan int32 {
 func (mm *MirManager) handleLogEntries(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	lastEpochSN := config.Config.EpochLength - 1
-	if config.Config.SegmentLength != 0 {
-		lastEpochSN = (config.Config.SegmentLength * len(mm.leaderPolicy.GetLeaders(0))) - 1
+	lastEpochSN := mm.cfg.EpochLength - 1
+	if mm.segmentLength != 0 {
+		lastEpochSN = (mm.segmentLength * len(mm.leaderPolicy.GetLeaders(0))) - 1
 	}
 
 	var stableCheckpoints chan *pb.StableCheckpoint = nil
-	if config.Config.WaitForCheckpoints {
+	if mm.cfg.WaitForCheckpoints {
 		stableCheckpoints = log.Checkpoints()
 	}
 
@@ -137,6 +163,7 @@ func (mm *MirManager) handleLogEntries(wg *sync.WaitGroup) {
 	initialLeaders := mm.leaderPolicy.GetLeaders(0)
 	mm.issueSegments([]interface{}{}, initialLeaders, 0)
 	tracing.MainTrace.Event(tracing.NEW_EPOCH, 0, int64(len(initialLeaders)))
+	metrics.Epoch.Set(0)
 	// Channel should be closed on shutdown for this loop to exit.
 	for entry := <-mm.entriesChannel; entry != nil; entry = <-mm.entriesChannel {
 		if entry.Aborted {
@@ -147,6 +174,11 @@ func (mm *MirManager) handleLogEntries(wg *sync.WaitGroup) {
 			}
 		}
 
+		// Evidence of misbehavior is handled at the point it appears in the log.
+		// Since all peers process the same log entries in the same order, all of them exclude the same nodes
+		// from the leader set starting at the same epoch.
+		mm.handleEvidence(entry)
+
 		mm.epochEntryBuffer.Add(entry)
 
 		// Advance epoch
@@ -181,11 +213,27 @@ func (mm *MirManager) handleLogEntries(wg *sync.WaitGroup) {
 			//   before Get() is called from handleCheckpoints.
 			epochEntries := mm.epochEntryBuffer.Get()
 			request.AdvanceWatermarks(epochEntries)
+			dissemination.AdvanceEpoch()
+
+			// Record the load of the buckets in the finished epoch.
+			mm.bucketLoads = countBucketLoads(epochEntries)
+
+			// Let the leader policy evaluate the performance of the leaders in the finished epoch.
+			if pp, ok := mm.leaderPolicy.(performancePolicy); ok {
+				pp.Observe(mm.epoch, epochEntries, mm.currentSegments)
+			}
+
+			// Derive the segment length of the next epoch from the finished one.
+			if mm.cfg.AdaptiveSegmentLength && mm.segmentLength != 0 {
+				mm.segmentLength = mm.adaptedSegmentLength(mm.segmentLength, epochEntries, mm.currentSegments)
+			}
 
 			// Only after the watermarks are up to date, we can move on to the next epoch and create new segments.
 			// This cannot happen before or even concurrently, as the orderers might misinterpret incoming messages
 			// if all the state is not up to date.
+			mm.statusLock.Lock()
 			mm.epoch++
+			mm.statusLock.Unlock()
 			mm.currentSuspects = make(map[int32]bool)
 
 			newLeaders := mm.leaderPolicy.GetLeaders(mm.epoch)
@@ -193,16 +241,36 @@ func (mm *MirManager) handleLogEntries(wg *sync.WaitGroup) {
 			logger.Debug().Int32("sn", entry.Sn+1).Int32("epoch", mm.epoch).Msg("Issuing new segments.")
 			mm.issueSegments(epochEntries, newLeaders, entry.Sn+1)
 			tracing.MainTrace.Event(tracing.NEW_EPOCH, int64(mm.epoch), int64(len(newLeaders)))
+			metrics.Epoch.Set(int64(mm.epoch))
 
-			if config.Config.SegmentLength != 0 {
-				lastEpochSN += config.Config.SegmentLength * len(newLeaders)
+			if mm.segmentLength != 0 {
+				lastEpochSN += mm.segmentLength * len(newLeaders)
 			} else {
-				lastEpochSN += config.Config.EpochLength
+				lastEpochSN += mm.cfg.EpochLength
 			}
 		}
 	}
 }
 
+// Permanently excludes from the leader set the offenders of all valid misbehavior evidence committed with the entry.
+func (mm *MirManager) handleEvidence(entry *log.Entry) {
+	if entry.Batch == nil {
+		return
+	}
+	for _, ev := range entry.Batch.Evidence {
+		if mm.convicted[ev.Offender] {
+			continue
+		}
+		if err := evidence.Verify(ev); err != nil {
+			logger.Warn().Err(err).Int32("sn", entry.Sn).Msg("Ignoring invalid misbehavior evidence in log.")
+			continue
+		}
+		mm.convicted[ev.Offender] = true
+		mm.leaderPolicy.Exclude(mm.epoch, ev.Offender)
+		evidence.MarkConvicted(ev.Offender)
+	}
+}
+
 // Observes the appearing stable checkpoints and advances the watermark window by issuing new segments.
 // Meant to be run as a separate goroutine.
 // Decrements the provided wait group when done.
@@ -226,7 +294,10 @@ func (mm *MirManager) handleCheckpoints(wg *sync.WaitGroup) {
 // and save them in the index (by sequence number) of this epoch's Segments.
 func (mm *MirManager) issueSegments(oldEpochEntries []interface{}, leaders []int32, offset int32) {
 	// Create new segments
-	mm.currentSegments = mm.createSegments(mm.currentSegments, oldEpochEntries, leaders, offset)
+	newSegments := mm.createSegments(mm.currentSegments, oldEpochEntries, leaders, offset)
+	mm.statusLock.Lock()
+	mm.currentSegments = newSegments
+	mm.statusLock.Unlock()
 
 	// Announce newly created segments to the orderer.
 	for _, segment := range mm.currentSegments {
@@ -234,7 +305,7 @@ func (mm *MirManager) issueSegments(oldEpochEntries []interface{}, leaders []int
 		//// Introduce an artificial delay in starting a segment for faulty nodes.
 		//// Only leave the else branch.
 		//// TODO: Consider removing this and only keeping the else branch.
-		//if segment.Leaders()[0] == membership.OwnID && membership.OwnID < int32(config.Config.Failures) {
+		//if segment.Leaders()[0] == membership.OwnID && membership.OwnID < int32(mm.cfg.Failures) {
 		//
 		//	logger.Warn().Int("segID", segment.SegID()).Interface("sns", segment.SNs()).Msg("Delaying segment.")
 		//
@@ -250,6 +321,38 @@ func (mm *MirManager) issueSegments(oldEpochEntries []interface{}, leaders []int
 	}
 }
 
+// Returns the current epoch and the segments issued for it, ordered by segment ID.
+// Safe to call concurrently with the running manager.
+func (mm *MirManager) Status() (int32, []*pb.SegmentStatus) {
+	mm.statusLock.Lock()
+	defer mm.statusLock.Unlock()
+
+	segments := make([]*pb.SegmentStatus, 0, len(mm.currentSegments))
+	for _, seg := range mm.currentSegments {
+		buckets := make([]int32, 0)
+		if seg.Buckets() != nil {
+			for _, id := range seg.Buckets().GetBucketIDs() {
+				buckets = append(buckets, int32(id))
+			}
+		}
+		segments = append(segments, &pb.SegmentStatus{
+			SegId:       int32(seg.SegID()),
+			Leaders:     seg.Leaders(),
+			Followers:   seg.Followers(),
+			FirstSn:     seg.FirstSN(),
+			LastSn:      seg.LastSN(),
+			Len:         seg.Len(),
+			StartsAfter: seg.StartsAfter(),
+			Buckets:     buckets,
+			BatchSize:   int32(seg.BatchSize()),
+		})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].SegId < segments[j].SegId
+	})
+	return mm.epoch, segments
+}
+
 // Create segments that completely fit inside the epoch.
 // The epoch is an interval of sequence numbers starting at the last stable checkpoint with a length of epoch.
 // In each epoch the number of segments issued equals the number of mir-leaders.
@@ -261,9 +364,9 @@ func (mm *MirManager) createSegments(oldSegments map[int32]Segment, oldEpochEntr
 	// so that sequence numbers are distributed among leaders in a round robin way
 	distance := len(leaders)
 
-	epochLength := config.Config.EpochLength
-	if config.Config.SegmentLength != 0 {
-		epochLength = config.Config.SegmentLength * len(leaders)
+	epochLength := mm.cfg.EpochLength
+	if mm.segmentLength != 0 {
+		epochLength = mm.segmentLength * len(leaders)
 	}
 
 	// The sequence numbers of the epoch are distributed evenly among the segments
@@ -304,8 +407,8 @@ func (mm *MirManager) createSegments(oldSegments map[int32]Segment, oldEpochEntr
 			snOffset:    offset + int32(i),
 			snLength:    segmentLengths[i],
 			startsAfter: offset - 1,
-			buckets:     request.NewBucketGroup(buckets[leader]),
-			batchSize:   0,
+			buckets:     request.NewBucketGroup(buckets[leader], mm.cfg),
+			batchSize:   mm.cfg.BatchSize,
 		}
 		seg.initSNs()
 
@@ -318,10 +421,12 @@ func (mm *MirManager) createSegments(oldSegments map[int32]Segment, oldEpochEntr
 		mm.nextSegmentID++
 	}
 
+	// All segments use the configured batch size, which lets all peers compute the same fill ratio of the batches
+	// when adapting the segment length. Adaptive batch sizes would need to be agreed upon.
 	if ownSegment != nil {
 		// TODO: Return to adaptive batch sizes after considering all the implications
-		ownSegment.batchSize = config.Config.BatchSize
-		//ownSegment.batchSize = adaptedBatchSize(oldSegments, oldEpochEntries, leaders, segments)
+		ownSegment.batchSize = mm.cfg.BatchSize
+		//ownSegment.batchSize = mm.adaptedBatchSize(oldSegments, oldEpochEntries, leaders, segments)
 		//logger.Info().Int("batchSize", ownSegment.batchSize).Msg("Adapted batch size.")
 	}
 
@@ -335,21 +440,40 @@ func (mm *MirManager) createSegments(oldSegments map[int32]Segment, oldEpochEntr
 // assigning one list of Bucket IDs to each leader.
 func (mm *MirManager) assignBuckets(leaders []int32) map[int32][]int {
 
+	sortedLeaders := make([]int32, len(leaders))
+	copy(sortedLeaders, leaders)
+	sort.Slice(sortedLeaders, func(i, j int) bool {
+		return sortedLeaders[i] < sortedLeaders[j]
+	})
+
+	var finalBuckets map[int32][]int
+	if mm.cfg.BucketAssignment == "LoadAware" && mm.bucketLoads != nil {
+		finalBuckets = balanceBuckets(mm.epoch, sortedLeaders, mm.bucketLoads)
+	} else {
+		finalBuckets = mm.assignBucketsRoundRobin(sortedLeaders)
+	}
+
+	// Take buckets away from leaders the leader policy considers underperforming.
+	if pp, ok := mm.leaderPolicy.(performancePolicy); ok {
+		finalBuckets = mm.applyBucketShares(finalBuckets, sortedLeaders, pp)
+	}
+
+	return finalBuckets
+}
+
+// Given a sorted list of leader IDs, distributes the buckets round-robin among all peers (shifted by epoch)
+// and re-distributes the buckets of non-leaders among the leaders.
+func (mm *MirManager) assignBucketsRoundRobin(sortedLeaders []int32) map[int32][]int {
+
 	// Convenience variables
 
 	allNodeIDs := membership.AllNodeIDs()
 
-	isLeader := make(map[int32]bool, len(leaders)) // Index of leaders
-	for _, l := range leaders {
+	isLeader := make(map[int32]bool, len(sortedLeaders)) // Index of leaders
+	for _, l := range sortedLeaders {
 		isLeader[l] = true
 	}
 
-	sortedLeaders := make([]int32, len(leaders))
-	copy(sortedLeaders, leaders)
-	sort.Slice(sortedLeaders, func(i, j int) bool {
-		return sortedLeaders[i] < sortedLeaders[j]
-	})
-
 	// First uniformly distribute the buckets to all peers, even those that are not leaders.
 	initBuckets := make(map[int32][]int)
 	// For each node in the current membership
@@ -389,6 +513,65 @@ func (mm *MirManager) assignBuckets(leaders []int32) map[int32][]int {
 	return finalBuckets
 }
 
+// Counts the committed requests of each bucket in the given log entries (which must be of type *log.Entry).
+func countBucketLoads(entries []interface{}) []int {
+	loads := make([]int, len(request.Buckets))
+	for _, item := range entries {
+		entry := item.(*log.Entry)
+		if entry.Batch == nil {
+			continue
+		}
+		for _, req := range entry.Batch.Requests {
+			b := request.GetBucketNr(req.RequestId.ClientId, req.RequestId.ClientSn, req.RequestId.SenderId, len(loads))
+			if b < len(loads) {
+				loads[b]++
+			}
+		}
+	}
+	return loads
+}
+
+// Reduces the number of buckets of each leader according to its bucket share (relative to the highest share of
+// any leader) and redistributes the surplus buckets among the leaders with the highest share.
+// All peers compute the same result, as the bucket shares only depend on the log.
+func (mm *MirManager) applyBucketShares(buckets map[int32][]int, sortedLeaders []int32, pp performancePolicy) map[int32][]int {
+
+	shares := make(map[int32]int, len(sortedLeaders))
+	maxShare := 0
+	for _, leaderID := range sortedLeaders {
+		shares[leaderID] = pp.BucketShare(mm.epoch, leaderID)
+		if shares[leaderID] > maxShare {
+			maxShare = shares[leaderID]
+		}
+	}
+	if maxShare == 0 {
+		return buckets
+	}
+
+	// Collect surplus buckets.
+	surplus := make([]int, 0)
+	receivers := make([]int32, 0)
+	for _, leaderID := range sortedLeaders {
+		if shares[leaderID] == maxShare {
+			receivers = append(receivers, leaderID)
+			continue
+		}
+		keep := (len(buckets[leaderID])*shares[leaderID] + maxShare - 1) / maxShare // Rounded up
+		surplus = append(surplus, buckets[leaderID][keep:]...)
+		buckets[leaderID] = buckets[leaderID][:keep]
+	}
+
+	logger.Debug().Interface("buckets", surplus).Msg("Surplus buckets of underperforming leaders.")
+
+	// Redistribute surplus buckets.
+	for i, b := range surplus {
+		leaderID := receivers[(i+int(mm.epoch))%len(receivers)]
+		buckets[leaderID] = append(buckets[leaderID], b)
+	}
+
+	return buckets
+}
+
 func (mm *MirManager) createBucketAssignmentMsg(assignment map[int32][]int) *pb.BucketAssignment {
 
 	// Allocate new message.
@@ -414,11 +597,110 @@ func (mm *MirManager) createBucketAssignmentMsg(assignment map[int32][]int) *pb.
 	return msg
 }
 
-func adaptedBatchSize(oldSegments map[int32]Segment, entries []interface{}, leaders []int32, newSegments map[int32]Segment) int { // entries must be of type []*log.Entry
+// Computes the segment length for the next epoch from the log entries of the previous epoch,
+// where the segments (indexed by leader) had length segmentLength. The entries must be of type *log.Entry.
+// Only the proposal timestamps (bounded by the followers, see ProposalTsTolerance), the contents of the batches
+// and the batch sizes of the segments are used, such that all peers compute the same value.
+// The duration of the epoch is the median over the leaders of the time between their first and last proposal,
+// such that a single straggling leader does not distort it.
+// The segment length is scaled (by at most a factor of 2) such that an epoch takes about TargetEpochDuration
+// milliseconds. If the batches are mostly empty (the system is not saturated), the segment length is never increased,
+// as longer epochs would only slow down the recovery from stragglers without saving significant checkpointing overhead.
+// The result is bounded by MinSegmentLength and MaxSegmentLength.
+func (mm *MirManager) adaptedSegmentLength(segmentLength int, entries []interface{}, segments map[int32]Segment) int {
+
+	snLeaders := make(map[int32]int32)
+	for leader, seg := range segments {
+		for _, sn := range seg.SNs() {
+			snLeaders[sn] = leader
+		}
+	}
+
+	// Compute the proposal time span of each leader and the number of requests in the non-aborted proposed batches,
+	// as well as the number of requests that would have fit in those batches.
+	first := make(map[int32]int64)
+	last := make(map[int32]int64)
+	nBatches := make(map[int32]int)
+	nRequests := 0
+	capacity := 0
+	for _, item := range entries {
+		entry := item.(*log.Entry)
+		leader, ok := snLeaders[entry.Sn]
+		if !ok || entry.Aborted || entry.Batch == nil || entry.Batch.ProposalTs == 0 {
+			continue
+		}
+		if first[leader] == 0 || entry.Batch.ProposalTs < first[leader] {
+			first[leader] = entry.Batch.ProposalTs
+		}
+		if entry.Batch.ProposalTs > last[leader] {
+			last[leader] = entry.Batch.ProposalTs
+		}
+		nBatches[leader]++
+		nRequests += len(entry.Batch.Requests)
+		capacity += segments[leader].BatchSize()
+	}
+	spans := make([]int64, 0, len(nBatches))
+	for leader, n := range nBatches {
+		if n >= 2 {
+			spans = append(spans, last[leader]-first[leader])
+		}
+	}
+
+	// Not enough information, keep the segment length.
+	durationMs := int(median(spans) / 1000000)
+	if len(spans) == 0 || durationMs <= 0 || capacity <= 0 || mm.cfg.TargetEpochDuration <= 0 {
+		return segmentLength
+	}
+
+	// Scale the segment length to meet the target epoch duration.
+	newLength := segmentLength * mm.cfg.TargetEpochDuration / durationMs
+	if newLength > 2*segmentLength {
+		newLength = 2 * segmentLength
+	} else if newLength < segmentLength/2 {
+		newLength = segmentLength / 2
+	}
+
+	// Do not increase the segment length if batches are less than half full on average.
+	fillPercent := 100 * nRequests / capacity
+	if fillPercent < 50 && newLength > segmentLength {
+		newLength = segmentLength
+	}
+
+	// Enforce bounds
+	if newLength > mm.maxSegmentLength() {
+		newLength = mm.maxSegmentLength()
+	}
+	if newLength < mm.cfg.MinSegmentLength {
+		newLength = mm.cfg.MinSegmentLength
+	}
+	if newLength < 1 {
+		newLength = 1
+	}
+
+	logger.Info().
+		Int("duration", durationMs).
+		Int("fill", fillPercent).
+		Int("oldSegmentLength", segmentLength).
+		Int("newSegmentLength", newLength).
+		Msg("Adapted segment length.")
+
+	return newLength
+}
+
+// Returns the maximal length of a segment.
+// The epoch entry buffer must be large enough to hold an epoch consisting of segments of this length.
+func (mm *MirManager) maxSegmentLength() int {
+	if mm.cfg.AdaptiveSegmentLength && mm.cfg.MaxSegmentLength > mm.cfg.SegmentLength {
+		return mm.cfg.MaxSegmentLength
+	}
+	return mm.cfg.SegmentLength
+}
+
+func (mm *MirManager) adaptedBatchSize(oldSegments map[int32]Segment, entries []interface{}, leaders []int32, newSegments map[int32]Segment) int { // entries must be of type []*log.Entry
 
 	// Convenience variables
 	ownID := membership.OwnID
-	lastBatchSize := config.Config.BatchSize
+	lastBatchSize := mm.cfg.BatchSize
 	oldSegmentIndex := make(map[int32]Segment) // maps sequence numbers from previous epoch to their leaders
 	for _, seg := range oldSegments {
 		for _, sn := range seg.SNs() {
@@ -468,8 +750,8 @@ func adaptedBatchSize(oldSegments map[int32]Segment, entries []interface{}, lead
 	// If I did not submit anything in the previous epoch (i.e. I was most likely not a leader), use maximum batch size.
 	ownRequests := nRequests[ownID]
 	if ownRequests == 0 {
-		logger.Info().Int("batchSize", config.Config.BatchSize).Msg("No own requests committed in last epoch.")
-		return config.Config.BatchSize
+		logger.Info().Int("batchSize", mm.cfg.BatchSize).Msg("No own requests committed in last epoch.")
+		return mm.cfg.BatchSize
 	}
 
 	// Compute the duration of each leader's segment
@@ -494,9 +776,9 @@ func adaptedBatchSize(oldSegments map[int32]Segment, entries []interface{}, lead
 
 	// If there is fewer than f+1 better leaders, I increase my batch size.
 	if len(fastLeaders) <= membership.Faults() {
-		batchSize := lastBatchSize + (config.Config.BatchSizeIncrement * (membership.Faults() + 1 - len(fastLeaders)) / (membership.Faults() + 1))
-		if batchSize > config.Config.BatchSize {
-			batchSize = config.Config.BatchSize
+		batchSize := lastBatchSize + (mm.cfg.BatchSizeIncrement * (membership.Faults() + 1 - len(fastLeaders)) / (membership.Faults() + 1))
+		if batchSize > mm.cfg.BatchSize {
+			batchSize = mm.cfg.BatchSize
 		}
 		logger.Info().
 			Int("rank", len(fastLeaders)+1).
@@ -512,7 +794,7 @@ func adaptedBatchSize(oldSegments map[int32]Segment, entries []interface{}, lead
 
 		// If there are at least f+1 better leaders, but the f+1st did not have to wait too much for me,
 		// I keep the old batch size (StragglerTolerance in milliseconds)
-		if durations[ownID]-durations[fastLeaders[membership.Faults()]] <= config.Config.StragglerTolerance {
+		if durations[ownID]-durations[fastLeaders[membership.Faults()]] <= mm.cfg.StragglerTolerance {
 			logger.Info().
 				Int("delay", durations[ownID]-durations[fastLeaders[membership.Faults()]]).
 				Int("batchSize", lastBatchSize).
@@ -536,10 +818,10 @@ func adaptedBatchSize(oldSegments map[int32]Segment, entries []interface{}, lead
 				Int("newBatchSize", batchSize).
 				Msg("Straggling. Adapting batch size.")
 
-			if batchSize <= config.Config.BatchSize {
+			if batchSize <= mm.cfg.BatchSize {
 				return batchSize
 			} else {
-				return config.Config.BatchSize
+				return mm.cfg.BatchSize
 			}
 		}
 	}
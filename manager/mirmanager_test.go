@@ -0,0 +1,134 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/log"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+)
+
+func TestMirManager_AdaptedSegmentLength(t *testing.T) {
+	tests := []struct {
+		name      string
+		nBatches  int             // Number of (non-aborted) batches committed by each leader.
+		spans     map[int32]int64 // Time (ms) between the first and last proposal of each leader.
+		nRequests int             // Number of requests in each batch.
+		batchSize int             // Batch size of the segments.
+		want      int
+	}{
+		{
+			name:      "slow epoch",
+			nBatches:  5,
+			spans:     map[int32]int64{0: 2000, 1: 2000, 2: 2000, 3: 2000},
+			nRequests: 10,
+			batchSize: 10,
+			want:      8,
+		},
+		{
+			name:      "fast epoch grows at most twofold",
+			nBatches:  5,
+			spans:     map[int32]int64{0: 250, 1: 250, 2: 250, 3: 250},
+			nRequests: 10,
+			batchSize: 10,
+			want:      32,
+		},
+		{
+			name:      "fast epoch with mostly empty batches",
+			nBatches:  5,
+			spans:     map[int32]int64{0: 250, 1: 250, 2: 250, 3: 250},
+			nRequests: 4,
+			batchSize: 10,
+			want:      16,
+		},
+		{
+			name:      "fill ratio against the batch size of the segments",
+			nBatches:  5,
+			spans:     map[int32]int64{0: 250, 1: 250, 2: 250, 3: 250},
+			nRequests: 3,
+			batchSize: 4,
+			want:      32,
+		},
+		{
+			name:      "straggler does not distort the duration",
+			nBatches:  5,
+			spans:     map[int32]int64{0: 500, 1: 500, 2: 500, 3: 10000},
+			nRequests: 10,
+			batchSize: 10,
+			want:      32,
+		},
+		{
+			name:      "shrinks at most twofold",
+			nBatches:  5,
+			spans:     map[int32]int64{0: 6000, 1: 6000, 2: 6000, 3: 6000},
+			nRequests: 10,
+			batchSize: 10,
+			want:      8,
+		},
+		{
+			name:      "single batch per leader",
+			nBatches:  1,
+			spans:     map[int32]int64{0: 0, 1: 0, 2: 0, 3: 0},
+			nRequests: 10,
+			batchSize: 10,
+			want:      16,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			const segmentLength = 16
+			mm := &MirManager{cfg: &config.Configuration{
+				AdaptiveSegmentLength: true,
+				SegmentLength:         segmentLength,
+				MinSegmentLength:      4,
+				MaxSegmentLength:      256,
+				TargetEpochDuration:   1000,
+				BatchSize:             10,
+			}}
+
+			start := time.Now().UnixNano()
+			entries := make([]interface{}, 0)
+			segments := make(map[int32]Segment)
+			for leader, span := range tc.spans {
+				seg := &ContiguousSegment{
+					segID:     int(leader),
+					leaders:   []int32{leader},
+					snOffset:  leader * segmentLength,
+					snLength:  segmentLength,
+					batchSize: tc.batchSize,
+				}
+				segments[leader] = seg
+				for i := 0; i < tc.nBatches; i++ {
+					ts := start
+					if tc.nBatches > 1 {
+						ts += span * int64(time.Millisecond) * int64(i) / int64(tc.nBatches-1)
+					}
+					entries = append(entries, &log.Entry{
+						Sn:    seg.SNs()[i],
+						Batch: &pb.Batch{Requests: make([]*pb.ClientRequest, tc.nRequests), ProposalTs: ts},
+					})
+				}
+			}
+
+			if got := mm.adaptedSegmentLength(segmentLength, entries, segments); got != tc.want {
+				t.Errorf("adapted segment length is %d, expected %d", got, tc.want)
+			}
+		})
+	}
+}
@@ -21,6 +21,7 @@ import (
 
 	"github.com/Hanzheng2021/Orthrus/config"
 	"github.com/Hanzheng2021/Orthrus/crypto"
+	"github.com/Hanzheng2021/Orthrus/metrics"
 	pb "github.com/Hanzheng2021/Orthrus/protobufs"
 	logger "github.com/rs/zerolog/log"
 )
@@ -62,19 +63,19 @@ var (
 	lock sync.Mutex
 )
 
-// Initializes the Client key (to be changed at some point).
+// Initializes the membership package with the given configuration and loads the client key (to be changed at some point).
 // Cannot be part of the init() function, as the configuration file is not yet loaded when init() is executed.
-func Init() {
+func Init(c *config.Configuration) {
 
 	// TODO: Here we just use a pre-shared client key for verification of requests.
 	//       Implement each client sending its own key during client handshake.
-	if config.Config.ClientPubKeyFile != "" {
-		if pk, err := crypto.PublicKeyFromFile(config.Config.ClientPubKeyFile); err == nil {
+	if c.ClientPubKeyFile != "" {
+		if pk, err := crypto.PublicKeyFromFile(c.ClientPubKeyFile); err == nil {
 			clientPubKey = pk
 		} else {
 			logger.Error().
 				Err(err).
-				Str("keyFile", config.Config.ClientPubKeyFile).
+				Str("keyFile", c.ClientPubKeyFile).
 				Msg("Could not load client public key.")
 		}
 	}
@@ -90,6 +91,7 @@ func SetHtn(newHtn int32) {
 	lock.Lock()
 	htn = newHtn
 	lock.Unlock()
+	metrics.Htn.Set(int64(newHtn))
 }
 
 func GetHtn() int32 {
@@ -101,7 +103,8 @@ func GetHtn() int32 {
 // Ladon
 
 // Initializes the known node identities.
-func InitNodeIdentities(identities []*pb.NodeIdentity) {
+// The simulated crashes and stragglers are chosen according to the given configuration.
+func InitNodeIdentities(identities []*pb.NodeIdentity, c *config.Configuration) {
 
 	// Allocate memory for data structures
 	nodeIdentities = make(map[int32]*pb.NodeIdentity, len(identities))
@@ -122,18 +125,18 @@ func InitNodeIdentities(identities []*pb.NodeIdentity) {
 	// This is only used for benchmarking purposes.
 	// Shuffle the order of all peer IDs.
 	allNodeIDs := AllNodeIDs()
-	r := rand.New(rand.NewSource(config.Config.RandomSeed))
+	r := rand.New(rand.NewSource(c.RandomSeed))
 	r.Shuffle(len(allNodeIDs), func(i, j int) {
 		allNodeIDs[i], allNodeIDs[j] = allNodeIDs[j], allNodeIDs[i]
 	})
-	for _, p := range allNodeIDs[:config.Config.Failures] {
+	for _, p := range allNodeIDs[:c.Failures] {
 		SimulatedCrashes[p] = nodeIdentities[p]
 	}
-	for _, p := range allNodeIDs[:config.Config.Failures] {
+	for _, p := range allNodeIDs[:c.Failures] {
 		SimulatedEquivocation[p] = 1
 	}
-	// rand.Seed(config.Config.RandomSeed)
-	// for i := 0; i < config.Config.StragglerCnt; i++ {
+	// rand.Seed(cfg.RandomSeed)
+	// for i := 0; i < cfg.StragglerCnt; i++ {
 	// 	randi := int32(rand.Intn(len(allNodeIDs)))
 	// 	for SimulatedStraggler[randi] == 1 {
 	// 		randi = int32(rand.Intn(len(allNodeIDs)))
@@ -141,7 +144,7 @@ func InitNodeIdentities(identities []*pb.NodeIdentity) {
 	// 	SimulatedStraggler[randi] = 1
 	// }
 	// logger.Debug().Msgf("SimulatedStraggler is %v", SimulatedStraggler)
-	for _, p := range allNodeIDs[:config.Config.StragglerCnt] {
+	for _, p := range allNodeIDs[:c.StragglerCnt] {
 		SimulatedStraggler[p] = 1
 	}
 }
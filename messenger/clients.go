@@ -39,6 +39,7 @@ var (
 	bucketAssignmentLock sync.Mutex
 	bucketSubscriptions  = make(map[int32]pb.Messenger_BucketsServer)
 	bucketAssignmentMsg  *pb.BucketAssignment
+	bucketLeaders        = make(map[int]int32) // Current leader of each bucket, derived from bucketAssignmentMsg.
 
 	ClientRequestHandler func(msg *pb.ClientRequest)
 )
@@ -121,6 +122,12 @@ func AnnounceBucketAssignment(assignment *pb.BucketAssignment) {
 
 	// Update current bucket assignment.
 	bucketAssignmentMsg = assignment
+	bucketLeaders = make(map[int]int32)
+	for peerID, buckets := range assignment.Buckets {
+		for _, b := range buckets.Vals {
+			bucketLeaders[int(b)] = peerID
+		}
+	}
 
 	// Announce new assignment to all subscribers.
 	for clID, msgSink := range bucketSubscriptions {
@@ -130,6 +137,16 @@ func AnnounceBucketAssignment(assignment *pb.BucketAssignment) {
 	}
 }
 
+// Returns the peer leading the given bucket in the current epoch.
+// Returns false if no bucket assignment has been announced yet or the bucket is not assigned to any peer.
+func BucketLeader(bucketID int) (int32, bool) {
+	bucketAssignmentLock.Lock()
+	defer bucketAssignmentLock.Unlock()
+
+	leader, ok := bucketLeaders[bucketID]
+	return leader, ok
+}
+
 // Performs an initial handshake with a connecting client.
 // One dummy request message and one dummy response message are used for this.
 // Those messages are not treated by the ordering protocol and only serve for synchronizing the client and the peer.
@@ -201,8 +218,8 @@ func RespondToClient(clientID int32, response *pb.ClientResponse) {
 }
 
 // Creates connections to all the orderers and returns them as a slice of gRPC client stubs.
-// This function is used by the client.
-func ConnectToOrderers(ownClientID int32, clientLog zerolog.Logger, ordererIDs []int32) (map[int32]pb.Messenger_RequestClient, map[int32]pb.Messenger_BucketsClient, map[int32]*grpc.ClientConn) {
+// This function is used by the client, which connects according to its own configuration (TLS settings).
+func ConnectToOrderers(ownClientID int32, clientLog zerolog.Logger, ordererIDs []int32, cfg *config.Configuration) (map[int32]pb.Messenger_RequestClient, map[int32]pb.Messenger_BucketsClient, map[int32]*grpc.ClientConn) {
 
 	var mapLock sync.Mutex
 	var wg sync.WaitGroup
@@ -219,7 +236,7 @@ func ConnectToOrderers(ownClientID int32, clientLog zerolog.Logger, ordererIDs [
 			defer wg.Done()
 
 			// Create a connection to orderer (represented by a gRPC client stub).
-			reqClient, bucketClient, reqConn := connectToOrderer(peerID, ownClientID, clientLog)
+			reqClient, bucketClient, reqConn := connectToOrderer(peerID, ownClientID, clientLog, cfg)
 
 			// Save client stub in clientStubs (or log an error on failure).
 			if reqClient != nil && bucketClient != nil {
@@ -241,7 +258,7 @@ func ConnectToOrderers(ownClientID int32, clientLog zerolog.Logger, ordererIDs [
 // Connects to a single orderer node and returns a message sink (gRPC stub),
 // through which messages destined to the orderer node can be sent.
 // This function is used by connectToOrderers when the client is connecting to the system.
-func connectToOrderer(ordererID int32, ownClientID int32, clientLog zerolog.Logger) (pb.Messenger_RequestClient, pb.Messenger_BucketsClient, *grpc.ClientConn) {
+func connectToOrderer(ordererID int32, ownClientID int32, clientLog zerolog.Logger, cfg *config.Configuration) (pb.Messenger_RequestClient, pb.Messenger_BucketsClient, *grpc.ClientConn) {
 
 	// Get network address of orderer.
 	// The client uses the public address of the orderer
@@ -252,14 +269,14 @@ func connectToOrderer(ordererID int32, ownClientID int32, clientLog zerolog.Logg
 	clientLog.Info().Int32("peerId", ordererID).Str("addrStr", addrString).Msg("Connecting to orderer.")
 
 	// Create connection for requests
-	reqConn, err := newGRPCClientConnection(addrString)
+	reqConn, err := newGRPCClientConnection(addrString, cfg)
 	if err != nil {
 		clientLog.Error().Str("addrStr", addrString).Msg("Couldn't connect to orderer")
 		return nil, nil, nil
 	}
 
 	// Create connection for bucket assignment updates
-	bucketConn, err := newGRPCClientConnection(addrString)
+	bucketConn, err := newGRPCClientConnection(addrString, cfg)
 	if err != nil {
 		clientLog.Error().Str("addrStr", addrString).Msg("Couldn't connect to orderer")
 		return nil, nil, nil
@@ -303,7 +320,7 @@ func connectToOrderer(ordererID int32, ownClientID int32, clientLog zerolog.Logg
 	return reqClient, bucketClient, reqConn
 }
 
-func newGRPCClientConnection(addrString string) (*grpc.ClientConn, error) {
+func newGRPCClientConnection(addrString string, cfg *config.Configuration) (*grpc.ClientConn, error) {
 
 	// Set general gRPC dial options.
 	dialOpts := []grpc.DialOption{
@@ -312,8 +329,8 @@ func newGRPCClientConnection(addrString string) (*grpc.ClientConn, error) {
 	}
 
 	// Add TLS-specific gRPC dial options, depending on configuration
-	if config.Config.UseTLS {
-		tlsConfig := ConfigureTLS(config.Config.CertFile, config.Config.KeyFile)
+	if cfg.UseTLS {
+		tlsConfig := ConfigureTLS(cfg.CertFile, cfg.KeyFile, cfg.CACertFile)
 		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
 	} else {
 		dialOpts = append(dialOpts, grpc.WithInsecure())
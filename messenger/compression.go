@@ -0,0 +1,253 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package messenger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	"github.com/Hanzheng2021/Orthrus/tracing"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	logger "github.com/rs/zerolog/log"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// gRPC metadata key used to negotiate the compression of a Listen stream.
+	// The dialing peer lists the algorithms it offers (in order of preference) in the request metadata,
+	// the accepting peer responds with the chosen algorithm in the response header.
+	compressionHeader = "orthrus-compression"
+
+	compressionNone   = "none"
+	compressionZstd   = "zstd"
+	compressionSnappy = "snappy"
+
+	// Compression statistics are reported as BANDWIDTH trace events with the peer ID offset by a multiple of this
+	// value, to distinguish them from the bandwidth measured when testing connections (which uses the plain peer ID).
+	bandwidthStatOffset = 1000000
+	bandwidthStatSaved  = 1 // val0 is the total number of bytes saved by compression
+	bandwidthStatRatio  = 2 // val0 is the ratio of compressed to uncompressed size in permille
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	// A decompressed message cannot be larger than an uncompressed one, which gRPC limits to maxMessageSize.
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxMessageSize))
+)
+
+// Compression statistics of the messages sent to each peer, indexed by peer ID.
+var compressionStats = make(map[int32]*compressionStat)
+var compressionStatsLock sync.Mutex
+
+type compressionStat struct {
+	uncompressed int64 // Total size of compressed messages before compression.
+	compressed   int64 // Total size of compressed messages after compression.
+}
+
+// Returns the algorithms this peer supports for compressing the messages it sends, in order of preference.
+func offeredCompression() []string {
+	switch cfg.Compression {
+	case compressionZstd:
+		return []string{compressionZstd, compressionSnappy}
+	case compressionSnappy:
+		return []string{compressionSnappy, compressionZstd}
+	default:
+		return []string{}
+	}
+}
+
+// Chooses the compression of an incoming Listen stream from the algorithms offered by the dialing peer.
+// If this peer does not use compression itself, it does not accept compressed messages either
+// (as compression trades CPU for bandwidth in both directions).
+func negotiateCompression(ctx context.Context) string {
+	if cfg.Compression == "" || cfg.Compression == compressionNone {
+		return compressionNone
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return compressionNone
+	}
+	for _, offer := range md.Get(compressionHeader) {
+		for _, algorithm := range strings.Split(offer, ",") {
+			if algorithm == compressionZstd || algorithm == compressionSnappy {
+				return algorithm
+			}
+		}
+	}
+	return compressionNone
+}
+
+// Returns a context for invoking the Listen RPC that offers the supported compression algorithms.
+func compressionContext() context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(),
+		compressionHeader, strings.Join(offeredCompression(), ","))
+}
+
+// Wraps an outgoing Listen stream to peer nodeID in a compressingSink if the peer agreed to compression.
+// Blocks until the response header of the stream has been received.
+func withCompression(msgSink pb.Messenger_ListenClient, nodeID int32) pb.Messenger_ListenClient {
+	if len(offeredCompression()) == 0 {
+		return msgSink
+	}
+
+	header, err := msgSink.Header()
+	if err != nil {
+		logger.Warn().Err(err).Int32("peerId", nodeID).Msg("Could not negotiate compression.")
+		return msgSink
+	}
+
+	algorithm := compressionNone
+	if values := header.Get(compressionHeader); len(values) > 0 {
+		algorithm = values[0]
+	}
+	if algorithm != compressionZstd && algorithm != compressionSnappy {
+		logger.Info().Int32("peerId", nodeID).Msg("Peer does not accept compressed messages.")
+		return msgSink
+	}
+
+	logger.Info().Int32("peerId", nodeID).Str("algorithm", algorithm).Msg("Compressing messages to peer.")
+	compressionStatsLock.Lock()
+	if _, ok := compressionStats[nodeID]; !ok {
+		compressionStats[nodeID] = &compressionStat{}
+	}
+	stat := compressionStats[nodeID]
+	compressionStatsLock.Unlock()
+
+	return &compressingSink{
+		Messenger_ListenClient: msgSink,
+		algorithm:              algorithm,
+		stat:                   stat,
+	}
+}
+
+// Outgoing Listen stream that compresses messages exceeding the threshold configured for their type.
+type compressingSink struct {
+	pb.Messenger_ListenClient
+	algorithm string
+	stat      *compressionStat
+}
+
+func (cs *compressingSink) Send(msg *pb.ProtocolMessage) error {
+	size := proto.Size(msg)
+	if size < compressionThreshold(msg) {
+		return cs.Messenger_ListenClient.Send(msg)
+	}
+
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	compressed := compress(cs.algorithm, data)
+
+	// Incompressible messages (e.g. random payloads) are sent as they are.
+	if len(compressed) >= len(data) {
+		return cs.Messenger_ListenClient.Send(msg)
+	}
+
+	atomic.AddInt64(&cs.stat.uncompressed, int64(len(data)))
+	atomic.AddInt64(&cs.stat.compressed, int64(len(compressed)))
+
+	return cs.Messenger_ListenClient.Send(&pb.ProtocolMessage{
+		SenderId: msg.SenderId,
+		Sn:       msg.Sn,
+		Msg: &pb.ProtocolMessage_Compressed{Compressed: &pb.CompressedMessage{
+			Algorithm: cs.algorithm,
+			Data:      compressed,
+		}},
+	})
+}
+
+// Returns the minimal size of a message (in bytes) for it to be compressed.
+// The threshold can be configured for each message type (e.g. "Preprepare", "Proposal", "Multi"),
+// named after the corresponding field of the ProtocolMessage.
+// For messages sent over supervised connections, the type of the message wrapped in the SequencedMessage counts.
+func compressionThreshold(msg *pb.ProtocolMessage) int {
+	if wrapped := msg.GetSequenced().GetMsg(); wrapped != nil {
+		msg = wrapped
+	}
+	msgType := strings.TrimPrefix(fmt.Sprintf("%T", msg.Msg), "*protobufs.ProtocolMessage_")
+	if threshold, ok := cfg.CompressionThresholds[msgType]; ok {
+		return threshold
+	}
+	return cfg.CompressionThreshold
+}
+
+func compress(algorithm string, data []byte) []byte {
+	switch algorithm {
+	case compressionZstd:
+		return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)))
+	case compressionSnappy:
+		return snappy.Encode(nil, data)
+	default:
+		return data
+	}
+}
+
+// Decompresses a message received from a peer.
+// Fails if the decompressed message would exceed maxMessageSize.
+func decompress(cm *pb.CompressedMessage) (*pb.ProtocolMessage, error) {
+	var data []byte
+	var err error
+	switch cm.Algorithm {
+	case compressionZstd:
+		data, err = zstdDecoder.DecodeAll(cm.Data, nil)
+	case compressionSnappy:
+		var size int
+		if size, err = snappy.DecodedLen(cm.Data); err == nil && size > maxMessageSize {
+			err = fmt.Errorf("decompressed message size %d exceeds %d bytes", size, maxMessageSize)
+		}
+		if err == nil {
+			data, err = snappy.Decode(nil, cm.Data)
+		}
+	default:
+		err = fmt.Errorf("unknown compression algorithm: %s", cm.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &pb.ProtocolMessage{}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Periodically reports the bytes saved by compression and the compression ratio for each peer
+// as BANDWIDTH trace events. Meant to be run as a separate goroutine.
+func reportCompression() {
+	for range time.Tick(time.Duration(cfg.CompressionReportPeriod) * time.Millisecond) {
+		compressionStatsLock.Lock()
+		for nodeID, stat := range compressionStats {
+			uncompressed := atomic.LoadInt64(&stat.uncompressed)
+			compressed := atomic.LoadInt64(&stat.compressed)
+			if uncompressed == 0 {
+				continue
+			}
+			tracing.MainTrace.Event(tracing.BANDWIDTH,
+				bandwidthStatSaved*bandwidthStatOffset+int64(nodeID), uncompressed-compressed)
+			tracing.MainTrace.Event(tracing.BANDWIDTH,
+				bandwidthStatRatio*bandwidthStatOffset+int64(nodeID), compressed*1000/uncompressed)
+		}
+		compressionStatsLock.Unlock()
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package messenger
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestCompressionThreshold(t *testing.T) {
+	cfg = &config.Configuration{
+		CompressionThreshold:  1000,
+		CompressionThresholds: map[string]int{"Preprepare": 10},
+	}
+	defer func() { cfg = nil }()
+
+	preprepare := &pb.ProtocolMessage{Msg: &pb.ProtocolMessage_Preprepare{Preprepare: &pb.PbftPreprepare{}}}
+	tests := []struct {
+		name string
+		msg  *pb.ProtocolMessage
+		want int
+	}{
+		{"configured type", preprepare, 10},
+		{"other type", &pb.ProtocolMessage{Msg: &pb.ProtocolMessage_Commit{Commit: &pb.PbftCommit{}}}, 1000},
+		{"sequenced", &pb.ProtocolMessage{Msg: &pb.ProtocolMessage_Sequenced{Sequenced: &pb.SequencedMessage{
+			SeqNr: 1,
+			Msg:   preprepare,
+		}}}, 10},
+		{"sequenced without message", &pb.ProtocolMessage{Msg: &pb.ProtocolMessage_Sequenced{
+			Sequenced: &pb.SequencedMessage{},
+		}}, 1000},
+	}
+	for _, tc := range tests {
+		if got := compressionThreshold(tc.msg); got != tc.want {
+			t.Errorf("%s: threshold %d, expected %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	msg := &pb.ProtocolMessage{SenderId: 3, Sn: 42, Msg: &pb.ProtocolMessage_Preprepare{Preprepare: &pb.PbftPreprepare{
+		Sn:    42,
+		Batch: &pb.Batch{Requests: []*pb.ClientRequest{{Payload: make([]byte, 4096)}}},
+	}}}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, algorithm := range []string{compressionZstd, compressionSnappy} {
+		decompressed, err := decompress(&pb.CompressedMessage{Algorithm: algorithm, Data: compress(algorithm, data)})
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if !proto.Equal(decompressed, msg) {
+			t.Errorf("%s: decompressed message differs from the original", algorithm)
+		}
+	}
+
+	// A snappy block announcing a decompressed size above the gRPC limit is rejected before allocating it.
+	bomb := make([]byte, binary.MaxVarintLen64)
+	bomb = bomb[:binary.PutUvarint(bomb, maxMessageSize+1)]
+	_, err = decompress(&pb.CompressedMessage{Algorithm: compressionSnappy, Data: bomb})
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("snappy message exceeding the maximal message size not rejected by size: %v", err)
+	}
+
+	if _, err := decompress(&pb.CompressedMessage{Algorithm: "gzip", Data: data}); err == nil {
+		t.Errorf("unknown algorithm not rejected")
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package messenger
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/membership"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	logger "github.com/rs/zerolog/log"
+)
+
+// Network faults currently injected on the outgoing connections of this peer.
+var netFaults = &pb.NetFaultConfig{}
+
+// Partition of each peer, computed from netFaults. Peers not in any partition are not included.
+var netPartitionOf = make(map[int32]string)
+
+// Latency distribution of each rule in netFaults, parsed from the rule's latency specification.
+var netLatencies = make(map[*pb.NetFaultRule]func(r *rand.Rand) time.Duration)
+
+// Randomness used for injecting faults. Seeded from the configured random seed and the own ID.
+var netFaultRand *rand.Rand
+
+// Guards the above variables.
+var netFaultLock sync.Mutex
+
+// Replaces the network faults injected on the outgoing connections of this peer.
+// Used as a handler for the fault configurations received from the discovery server.
+func SetNetFaults(faults *pb.NetFaultConfig) {
+	partitionOf := make(map[int32]string)
+	for _, partition := range faults.Partitions {
+		for _, peerID := range partition.Peers {
+			partitionOf[peerID] = partition.Name
+		}
+	}
+	latencies := make(map[*pb.NetFaultRule]func(r *rand.Rand) time.Duration)
+	for _, rule := range faults.Rules {
+		sample, err := parseLatency(rule.Latency)
+		if err != nil {
+			logger.Error().Err(err).Int32("from", rule.From).Int32("to", rule.To).Msg("Ignoring latency of network fault rule.")
+			sample, _ = parseLatency("")
+		}
+		latencies[rule] = sample
+	}
+
+	netFaultLock.Lock()
+	netFaults = faults
+	netPartitionOf = partitionOf
+	netLatencies = latencies
+	netFaultLock.Unlock()
+
+	logger.Info().
+		Int("nRules", len(faults.Rules)).
+		Int("nPartitions", len(faults.Partitions)).
+		Msg("Updated injected network faults.")
+}
+
+// Creates the network fault configuration specified in the config file (NetFault* options).
+func NetFaultsFromConfig() (*pb.NetFaultConfig, error) {
+	faults := &pb.NetFaultConfig{
+		Rules:      make([]*pb.NetFaultRule, 0),
+		Partitions: make([]*pb.NetPartition, 0),
+	}
+
+	if cfg.NetFaultLatency != "" || cfg.NetFaultLoss > 0 ||
+		cfg.NetFaultDuplicate > 0 || cfg.NetFaultReorder > 0 {
+		if _, err := parseLatency(cfg.NetFaultLatency); err != nil {
+			return nil, err
+		}
+		faults.Rules = append(faults.Rules, &pb.NetFaultRule{
+			From:      -1,
+			To:        -1,
+			Latency:   cfg.NetFaultLatency,
+			Loss:      cfg.NetFaultLoss,
+			Duplicate: cfg.NetFaultDuplicate,
+			Reorder:   cfg.NetFaultReorder,
+		})
+	}
+
+	// Partitions are specified as "name1=0,1,2;name2=3,4"
+	for _, partitionStr := range strings.Split(cfg.NetFaultPartitions, ";") {
+		if strings.TrimSpace(partitionStr) == "" {
+			continue
+		}
+		partition, err := ParseNetPartition(partitionStr)
+		if err != nil {
+			return nil, err
+		}
+		faults.Partitions = append(faults.Partitions, partition)
+	}
+
+	return faults, nil
+}
+
+// Parses a partition specification of the form "name=id1,id2,...".
+// Used for the NetFaultPartitions configuration entry and the net-partition command of the discovery server.
+func ParseNetPartition(partitionStr string) (*pb.NetPartition, error) {
+	fields := strings.SplitN(strings.TrimSpace(partitionStr), "=", 2)
+	if len(fields) != 2 || fields[0] == "" {
+		return nil, fmt.Errorf("invalid partition: %s", partitionStr)
+	}
+
+	partition := &pb.NetPartition{Name: fields[0], Peers: make([]int32, 0)}
+	for _, idStr := range strings.Split(fields[1], ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(idStr))
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("invalid peer ID in partition %s: %s", fields[0], idStr)
+		}
+		partition.Peers = append(partition.Peers, int32(id))
+	}
+	return partition, nil
+}
+
+// Returns a function sampling latencies from the distribution specified by the given string.
+// Supported distributions are "const:<d>", "uniform:<min>:<max>", "normal:<mean>:<stddev>" and "exp:<mean>",
+// where the parameters are durations parsable by time.ParseDuration. The empty string means no latency.
+// Latencies are never negative.
+func parseLatency(latencyStr string) (func(r *rand.Rand) time.Duration, error) {
+	if latencyStr == "" {
+		return func(*rand.Rand) time.Duration { return 0 }, nil
+	}
+
+	fields := strings.Split(latencyStr, ":")
+	params := make([]time.Duration, len(fields)-1)
+	for i, f := range fields[1:] {
+		d, err := time.ParseDuration(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latency distribution %s: %s", latencyStr, err)
+		}
+		params[i] = d
+	}
+
+	nonNegative := func(d float64) time.Duration {
+		return time.Duration(math.Max(d, 0))
+	}
+
+	switch {
+	case fields[0] == "const" && len(params) == 1:
+		return func(*rand.Rand) time.Duration { return params[0] }, nil
+	case fields[0] == "uniform" && len(params) == 2 && params[1] >= params[0]:
+		return func(r *rand.Rand) time.Duration {
+			return params[0] + time.Duration(r.Int63n(int64(params[1]-params[0])+1))
+		}, nil
+	case fields[0] == "normal" && len(params) == 2:
+		return func(r *rand.Rand) time.Duration {
+			return nonNegative(float64(params[0]) + r.NormFloat64()*float64(params[1]))
+		}, nil
+	case fields[0] == "exp" && len(params) == 1:
+		return func(r *rand.Rand) time.Duration {
+			return nonNegative(r.ExpFloat64() * float64(params[0]))
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid latency distribution: %s", latencyStr)
+	}
+}
+
+// ============================================================
+// FaultyConnection
+// ============================================================
+
+// PeerConnection decorator injecting the currently configured network faults (see SetNetFaults)
+// on the messages sent to one peer: latency, loss, duplication, reordering and partitions.
+// All messages are sent on the underlying connection by a single background goroutine.
+// Delayed messages are sent in FIFO order, except for reordered messages, which overtake the FIFO queue
+// and are sent after twice their sampled latency.
+type FaultyConnection struct {
+	nodeID int32
+	conn   PeerConnection
+
+	// Messages waiting to be sent in FIFO order, and reordered messages, sorted by delivery time.
+	// Guarded by queueCond.L.
+	queue     []delayedMessage
+	reordered []delayedMessage
+	queueCond *sync.Cond
+	closed    bool
+}
+
+type delayedMessage struct {
+	msg       *pb.ProtocolMessage
+	priority  bool
+	deliverAt time.Time
+}
+
+// Wraps a connection to peer nodeID in a FaultyConnection.
+func NewFaultyConnection(nodeID int32, conn PeerConnection) *FaultyConnection {
+	netFaultLock.Lock()
+	if netFaultRand == nil {
+		netFaultRand = rand.New(rand.NewSource(cfg.RandomSeed + int64(membership.OwnID)))
+	}
+	netFaultLock.Unlock()
+
+	fc := &FaultyConnection{
+		nodeID:    nodeID,
+		conn:      conn,
+		queue:     make([]delayedMessage, 0),
+		queueCond: sync.NewCond(&sync.Mutex{}),
+	}
+	go fc.sendDelayed()
+	return fc
+}
+
+func (fc *FaultyConnection) Send(msg *pb.ProtocolMessage) {
+	fc.inject(msg, false)
+}
+
+func (fc *FaultyConnection) SendPriority(msg *pb.ProtocolMessage) {
+	fc.inject(msg, true)
+}
+
+func (fc *FaultyConnection) Close() {
+	fc.queueCond.L.Lock()
+	fc.closed = true
+	fc.queueCond.Broadcast()
+	fc.queueCond.L.Unlock()
+
+	fc.conn.Close()
+}
+
+// Applies the faults configured for the link to fc.nodeID to a message.
+func (fc *FaultyConnection) inject(msg *pb.ProtocolMessage, priority bool) {
+
+	// Decide on the fate of the message.
+	netFaultLock.Lock()
+	partitioned := netPartitionOf[membership.OwnID] != netPartitionOf[fc.nodeID]
+	rule := matchingRule(membership.OwnID, fc.nodeID)
+	var latencies []time.Duration
+	reorder := false
+	if !partitioned {
+		copies := 1
+		if rule != nil {
+			if netFaultRand.Float64() < rule.Loss {
+				copies = 0
+			} else if netFaultRand.Float64() < rule.Duplicate {
+				copies = 2
+			}
+			reorder = netFaultRand.Float64() < rule.Reorder
+		}
+		latencies = make([]time.Duration, copies)
+		for i := range latencies {
+			latencies[i] = sampleLatency(rule)
+		}
+	}
+	netFaultLock.Unlock()
+
+	now := time.Now()
+	fc.queueCond.L.Lock()
+	for _, latency := range latencies {
+		if reorder {
+			dm := delayedMessage{msg: msg, priority: priority, deliverAt: now.Add(2 * latency)}
+			i := sort.Search(len(fc.reordered), func(i int) bool { return fc.reordered[i].deliverAt.After(dm.deliverAt) })
+			fc.reordered = append(fc.reordered, delayedMessage{})
+			copy(fc.reordered[i+1:], fc.reordered[i:])
+			fc.reordered[i] = dm
+		} else {
+			fc.queue = append(fc.queue, delayedMessage{msg: msg, priority: priority, deliverAt: now.Add(latency)})
+		}
+	}
+	fc.queueCond.Signal()
+	fc.queueCond.L.Unlock()
+}
+
+// Sends the queued and the reordered messages on the underlying connection, each after its delivery time.
+// Meant to be run as a separate goroutine. Returns when the FaultyConnection is closed.
+func (fc *FaultyConnection) sendDelayed() {
+	fc.queueCond.L.Lock()
+	defer fc.queueCond.L.Unlock()
+
+	for !fc.closed {
+		// Pick the next message due, from the head of the FIFO queue or from the reordered messages.
+		var next *[]delayedMessage
+		if len(fc.queue) > 0 {
+			next = &fc.queue
+		}
+		if len(fc.reordered) > 0 && (next == nil || fc.reordered[0].deliverAt.Before(fc.queue[0].deliverAt)) {
+			next = &fc.reordered
+		}
+		if next == nil {
+			fc.queueCond.Wait()
+			continue
+		}
+
+		// Wait until the message is due, or until a message that is due earlier is reordered.
+		if wait := time.Until((*next)[0].deliverAt); wait > 0 {
+			timer := time.AfterFunc(wait, func() {
+				fc.queueCond.L.Lock()
+				fc.queueCond.Broadcast()
+				fc.queueCond.L.Unlock()
+			})
+			fc.queueCond.Wait()
+			timer.Stop()
+			continue
+		}
+
+		dm := (*next)[0]
+		*next = (*next)[1:]
+		fc.queueCond.L.Unlock()
+		sendOn(fc.conn, dm.msg, dm.priority)
+		fc.queueCond.L.Lock()
+	}
+}
+
+// Returns the first fault rule matching the link between the two given peers, or nil if there is none.
+// Must be called with netFaultLock held.
+func matchingRule(from int32, to int32) *pb.NetFaultRule {
+	for _, rule := range netFaults.Rules {
+		if (rule.From == -1 || rule.From == from) && (rule.To == -1 || rule.To == to) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Samples the latency of a message according to the given rule.
+// Must be called with netFaultLock held.
+func sampleLatency(rule *pb.NetFaultRule) time.Duration {
+	if rule == nil {
+		return 0
+	}
+	return netLatencies[rule](netFaultRand)
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package messenger
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+)
+
+// PeerConnection recording the sequence numbers of the messages sent and whether sends overlapped.
+type recordingConnection struct {
+	active     int32
+	overlapped int32
+	lock       sync.Mutex
+	sent       []int32
+}
+
+func (rc *recordingConnection) Send(msg *pb.ProtocolMessage) {
+	if atomic.AddInt32(&rc.active, 1) > 1 {
+		atomic.StoreInt32(&rc.overlapped, 1)
+	}
+	time.Sleep(100 * time.Microsecond)
+	rc.lock.Lock()
+	rc.sent = append(rc.sent, msg.Sn)
+	rc.lock.Unlock()
+	atomic.AddInt32(&rc.active, -1)
+}
+
+func (rc *recordingConnection) SendPriority(msg *pb.ProtocolMessage) {
+	rc.Send(msg)
+}
+
+func (rc *recordingConnection) Close() {}
+
+func (rc *recordingConnection) count() int {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return len(rc.sent)
+}
+
+func TestFaultyConnection_Reorder(t *testing.T) {
+	cfg = config.Default()
+	defer func() { cfg = nil }()
+	SetNetFaults(&pb.NetFaultConfig{Rules: []*pb.NetFaultRule{{From: -1, To: -1, Latency: "const:5ms", Reorder: 0.5}}})
+	defer SetNetFaults(&pb.NetFaultConfig{})
+
+	const nMsgs = 50
+	rc := &recordingConnection{}
+	fc := NewFaultyConnection(1, rc)
+	defer fc.Close()
+	for sn := int32(0); sn < nMsgs; sn++ {
+		fc.Send(&pb.ProtocolMessage{Sn: sn})
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rc.count() < nMsgs && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := rc.count(); n != nMsgs {
+		t.Fatalf("%d messages sent, expected %d", n, nMsgs)
+	}
+	if atomic.LoadInt32(&rc.overlapped) != 0 {
+		t.Errorf("messages sent concurrently on the underlying connection")
+	}
+
+	// Reordered messages are overtaken by the messages sent after them.
+	reordered := false
+	for i := 1; i < len(rc.sent); i++ {
+		if rc.sent[i] < rc.sent[i-1] {
+			reordered = true
+		}
+	}
+	if !reordered {
+		t.Errorf("no message reordered: %v", rc.sent)
+	}
+}
+
+func TestParseNetPartition(t *testing.T) {
+	tests := []struct {
+		spec  string
+		name  string
+		peers []int32
+	}{
+		{"a=0,1,2", "a", []int32{0, 1, 2}},
+		{"b=3, 4", "b", []int32{3, 4}},
+		{"c=*", "", nil},
+		{"d=-1", "", nil},
+		{"e=", "", nil},
+		{"=0,1", "", nil},
+		{"0,1", "", nil},
+	}
+	for _, tc := range tests {
+		partition, err := ParseNetPartition(tc.spec)
+		if tc.peers == nil {
+			if err == nil {
+				t.Errorf("%q: invalid partition accepted", tc.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.spec, err)
+			continue
+		}
+		if partition.Name != tc.name || len(partition.Peers) != len(tc.peers) {
+			t.Errorf("%q: parsed %s=%v, expected %s=%v", tc.spec, partition.Name, partition.Peers, tc.name, tc.peers)
+			continue
+		}
+		for i := range tc.peers {
+			if partition.Peers[i] != tc.peers[i] {
+				t.Errorf("%q: parsed peers %v, expected %v", tc.spec, partition.Peers, tc.peers)
+			}
+		}
+	}
+}
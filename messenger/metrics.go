@@ -0,0 +1,50 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package messenger
+
+import (
+	"strconv"
+
+	"github.com/Hanzheng2021/Orthrus/metrics"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	"github.com/golang/protobuf/proto"
+)
+
+// Wraps an outgoing Listen stream to peer nodeID in a countingSink if the metrics endpoint is enabled.
+// Computing the size of every message is not free, so the stream is left untouched otherwise.
+func withByteCount(msgSink pb.Messenger_ListenClient, nodeID int32) pb.Messenger_ListenClient {
+	if msgSink == nil || !metrics.Enabled() {
+		return msgSink
+	}
+	return &countingSink{Messenger_ListenClient: msgSink, peer: strconv.Itoa(int(nodeID))}
+}
+
+// Outgoing Listen stream counting the bytes of the (possibly compressed) messages sent to a peer.
+type countingSink struct {
+	pb.Messenger_ListenClient
+	peer string
+}
+
+func (cs *countingSink) Send(msg *pb.ProtocolMessage) error {
+	metrics.MessengerBytesSent.Add(cs.peer, proto.Size(msg))
+	return cs.Messenger_ListenClient.Send(msg)
+}
+
+// Counts the bytes of a message received from a peer, if the metrics endpoint is enabled.
+func countReceived(msg *pb.ProtocolMessage) {
+	if metrics.Enabled() {
+		metrics.MessengerBytesReceived.Add(strconv.Itoa(int(msg.SenderId)), proto.Size(msg))
+	}
+}
@@ -15,7 +15,6 @@
 package messenger
 
 import (
-	"context"
 	"fmt"
 	"net"
 	"sort"
@@ -28,6 +27,7 @@ import (
 	"github.com/Hanzheng2021/Orthrus/tracing"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 
 	pb "github.com/Hanzheng2021/Orthrus/protobufs"
@@ -43,6 +43,10 @@ const (
 // Simulated Crash Flag. It is set true if the peer is supposed to have crashed.
 var Crashed = false
 
+// Configuration of the messenger. Set by Init, which the peer must call before Start and Connect.
+// Clients connecting to the orderers do not use it, but pass their own configuration to ConnectToOrderers.
+var cfg *config.Configuration
+
 // Channels holding protocol messages to be sent to nodes, indexed by destination node ID.
 var peerConnections = make(map[int32]PeerConnection)
 
@@ -51,6 +55,9 @@ var peerConnections = make(map[int32]PeerConnection)
 var CheckpointMsgHandler func(msg *pb.CheckpointMsg, senderID int32)
 var StateTransferMsgHandler func(msg *pb.ProtocolMessage)
 var OrdererMsgHandler func(msg *pb.ProtocolMessage)
+var EvidenceMsgHandler func(msg *pb.MisbehaviorEvidence, senderID int32)
+var DisseminationMsgHandler func(msg *pb.ProtocolMessage)
+var ForwardedRequestHandler func(msg *pb.ClientRequest, senderID int32)
 
 type connectionTest struct {
 	MsgSink         pb.Messenger_ListenClient
@@ -78,6 +85,22 @@ func (ms *messengerServer) Listen(srv pb.Messenger_ListenServer) error {
 		logger.Error().Msg("Failed to get gRPC peer info from context.")
 	}
 
+	// If peers are authenticated, bind the stream to the node that presented its identity certificate.
+	// A value of -1 means that the sender IDs of the received messages are not checked.
+	authenticatedID := int32(-1)
+	if cfg.UseTLS && cfg.AuthenticatePeers {
+		if authenticatedID, ok = AuthenticatedNodeID(srv.Context()); !ok {
+			logger.Error().Str("addr", p.Addr.String()).Msg("Rejecting unauthenticated connection for protocol messages.")
+			return fmt.Errorf("connection not authenticated as a known node")
+		}
+		logger.Info().Str("addr", p.Addr.String()).Int32("peerId", authenticatedID).Msg("Authenticated connection.")
+	}
+
+	// Tell the connecting peer whether (and how) it can compress the messages it sends.
+	if err := srv.SendHeader(metadata.Pairs(compressionHeader, negotiateCompression(srv.Context()))); err != nil {
+		logger.Error().Err(err).Msg("Failed to send response header.")
+	}
+
 	// Declare loop variables outside, since the err is checked also after the loop finishes.
 	var err error
 	var msg *pb.ProtocolMessage
@@ -86,7 +109,8 @@ func (ms *messengerServer) Listen(srv pb.Messenger_ListenServer) error {
 	finished := false
 	for msg, err = srv.Recv(); !finished && err == nil; msg, err = srv.Recv() {
 		checkForHotStuffProposal(msg, "Received HotStuffProposal.")
-		finished = handleMessage(msg, srv)
+		countReceived(msg)
+		finished = handleMessage(msg, srv, authenticatedID)
 	}
 
 	// Log error message produced on termination of the above loop.
@@ -100,17 +124,27 @@ func (ms *messengerServer) Listen(srv pb.Messenger_ListenServer) error {
 
 // Dispatch message to the appropriate module by calling the corresponding handler.
 // Unpack message batches and dispatch each message separately.
-func handleMessage(msg *pb.ProtocolMessage, srv pb.Messenger_ListenServer) (finished bool) {
+// If authenticatedID is not negative, messages (including those inside batches) with a different sender ID are dropped.
+func handleMessage(msg *pb.ProtocolMessage, srv pb.Messenger_ListenServer, authenticatedID int32) (finished bool) {
 
 	// WARNING: If a simulate crash, the peer ignores all messages
 	if Crashed {
 		return
 	}
 
+	// Drop messages impersonating another node.
+	if authenticatedID >= 0 && msg.SenderId != authenticatedID {
+		logger.Warn().
+			Int32("senderId", msg.SenderId).
+			Int32("authenticatedId", authenticatedID).
+			Msg("Dropping message with mismatched sender ID.")
+		return
+	}
+
 	switch m := msg.Msg.(type) {
 	case *pb.ProtocolMessage_Multi:
 		for _, item := range m.Multi.Msgs {
-			handleMessage(item, srv)
+			handleMessage(item, srv, authenticatedID)
 		}
 	case *pb.ProtocolMessage_Checkpoint:
 		//logger.Trace().Int32("from", msg.SenderId).Msg("Received protocol message: Checkpoint.")
@@ -119,6 +153,24 @@ func handleMessage(msg *pb.ProtocolMessage, srv pb.Messenger_ListenServer) (fini
 		StateTransferMsgHandler(msg)
 	case *pb.ProtocolMessage_MissingEntry:
 		StateTransferMsgHandler(msg)
+	case *pb.ProtocolMessage_Evidence:
+		EvidenceMsgHandler(m.Evidence, msg.SenderId)
+	case *pb.ProtocolMessage_DisseminatedBatch, *pb.ProtocolMessage_BatchAvailable, *pb.ProtocolMessage_BatchFetchReq:
+		DisseminationMsgHandler(msg)
+	case *pb.ProtocolMessage_ForwardedRequest:
+		ForwardedRequestHandler(m.ForwardedRequest, msg.SenderId)
+	case *pb.ProtocolMessage_Sequenced:
+		if acceptSequenced(msg.SenderId, m.Sequenced) {
+			return handleMessage(m.Sequenced.Msg, srv, authenticatedID)
+		}
+	case *pb.ProtocolMessage_Ack:
+		handleAck(msg.SenderId, m.Ack)
+	case *pb.ProtocolMessage_Compressed:
+		if inner, err := decompress(m.Compressed); err == nil {
+			return handleMessage(inner, srv, authenticatedID)
+		} else {
+			logger.Error().Err(err).Int32("peerId", msg.SenderId).Msg("Failed to decompress message.")
+		}
 	case *pb.ProtocolMessage_BandwidthTest:
 		logger.Debug().Int32("peerId", msg.SenderId).Int32("sn", msg.Sn).Int("payloadSize", len(m.BandwidthTest.Payload)).Msg("Received bandwidth test message.")
 		// Only acknowledge messages with sequence number 0.
@@ -138,6 +190,14 @@ func handleMessage(msg *pb.ProtocolMessage, srv pb.Messenger_ListenServer) (fini
 	return false
 }
 
+// Sets the configuration of the messenger. Must be called before Start and Connect.
+func Init(c *config.Configuration) {
+	if c == nil {
+		panic("Messenger initialized without a configuration.")
+	}
+	cfg = c
+}
+
 // Starts the messenger by instantiating a gRPC server that listens to connections from other nodes.
 // Meant to be run as a separate goroutine.
 // Decrements the provided wait group when done.
@@ -148,7 +208,7 @@ func Start(wg *sync.WaitGroup) {
 	port := membership.NodeIdentity(membership.OwnID).Port
 
 	logger.Info().
-		Bool("useTLS", config.Config.UseTLS).
+		Bool("useTLS", cfg.UseTLS).
 		Int32("port", port).
 		Msg("Listening for connections.")
 
@@ -156,8 +216,11 @@ func Start(wg *sync.WaitGroup) {
 	srvOptions := make([]grpc.ServerOption, 0)
 	srvOptions = append(srvOptions, grpc.MaxRecvMsgSize(maxMessageSize))
 	srvOptions = append(srvOptions, grpc.MaxSendMsgSize(maxMessageSize))
-	if config.Config.UseTLS {
-		tlsConfig := ConfigureTLS(config.Config.CertFile, config.Config.KeyFile)
+	if cfg.UseTLS && cfg.AuthenticatePeers {
+		tlsConfig := ConfigurePeerTLS(cfg.CertFile, cfg.KeyFile, cfg.CACertFile)
+		srvOptions = append(srvOptions, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	} else if cfg.UseTLS {
+		tlsConfig := ConfigureTLS(cfg.CertFile, cfg.KeyFile, cfg.CACertFile)
 		srvOptions = append(srvOptions, grpc.Creds(credentials.NewTLS(tlsConfig)))
 	}
 	grpcServer := grpc.NewServer(srvOptions...)
@@ -218,7 +281,7 @@ func Connect() {
 	for _, id := range allNodeIds {
 
 		// If connections are being tested, open them one by one.
-		if config.Config.TestConnections {
+		if cfg.TestConnections {
 			connChan <- struct {
 				nodeID int32
 				conn   PeerConnection
@@ -237,6 +300,42 @@ func Connect() {
 	}
 
 	wg.Wait()
+
+	// If messages are retransmitted on reconnection, acknowledge received messages,
+	// so the senders can discard them.
+	if cfg.SuperviseConnections && cfg.RetransmitBufferSize > 0 {
+		go acknowledgeMessages()
+	}
+
+	// Report the bandwidth saved by compressing outgoing messages.
+	if len(offeredCompression()) > 0 && cfg.CompressionReportPeriod > 0 {
+		go reportCompression()
+	}
+}
+
+// Returns the status of the connections to all peers, ordered by peer ID.
+// Must not be called concurrently with Connect().
+func PeerConnectionStatus() []*pb.ConnectionStatus {
+	status := make([]*pb.ConnectionStatus, 0, len(peerConnections))
+	for nodeID := range peerConnections {
+		cs := &pb.ConnectionStatus{PeerId: nodeID, Connected: true}
+
+		supervisorsLock.Lock()
+		sc, ok := supervisors[nodeID]
+		supervisorsLock.Unlock()
+		if ok {
+			connected, unacknowledged := sc.status()
+			cs.Supervised = true
+			cs.Connected = connected
+			cs.Unacknowledged = int32(unacknowledged)
+		}
+
+		status = append(status, cs)
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].PeerId < status[j].PeerId
+	})
+	return status
 }
 
 // Enqueues a message for sending to a node.
@@ -289,7 +388,27 @@ func EnqueuePriorityMsg(msg *pb.ProtocolMessage, destNodeID int32) {
 // priority messages will be sent through the same network connection(s).
 // If OutMessageBufSize is configured > 0, all messages submitted to the returned PeerConnection will be first placed
 // in a buffered channel and a separate background thread will send them on the network.
+// If SuperviseConnections is set, the returned PeerConnection is a SupervisedConnection that re-establishes the
+// network connections to the peer when they fail.
+// If NetFaultInjection is set, the returned PeerConnection is wrapped in a FaultyConnection.
 func connectToPeer(nodeID int32) PeerConnection {
+	var connection PeerConnection
+	if cfg.SuperviseConnections {
+		connection = NewSupervisedConnection(nodeID)
+	} else if connection, _ = dialPeer(nodeID, cfg.TestConnections); connection == nil {
+		return nil
+	}
+
+	if cfg.NetFaultInjection && nodeID != membership.OwnID {
+		return NewFaultyConnection(nodeID, connection)
+	}
+	return connection
+}
+
+// Creates the network connections to a peer and wraps them in a PeerConnection as described for connectToPeer().
+// If testConnections is set, the connections are selected based on a bandwidth test.
+// Returns the PeerConnection and all the underlying message sinks.
+func dialPeer(nodeID int32, testConnections bool) (PeerConnection, []pb.Messenger_ListenClient) {
 	// Get network address of peer to which we connect.
 	// We use the private address of the other peer.
 	// The peers communicate through their private addresses,
@@ -304,8 +423,11 @@ func connectToPeer(nodeID int32) PeerConnection {
 	}
 
 	// Add TLS-specific gRPC dial options, depending on configuration
-	if config.Config.UseTLS {
-		tlsConfig := ConfigureTLS(config.Config.CertFile, config.Config.KeyFile)
+	if cfg.UseTLS && cfg.AuthenticatePeers {
+		tlsConfig := ConfigurePeerTLS(cfg.CertFile, cfg.KeyFile, cfg.CACertFile)
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else if cfg.UseTLS {
+		tlsConfig := ConfigureTLS(cfg.CertFile, cfg.KeyFile, cfg.CACertFile)
 		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
 	} else {
 		dialOpts = append(dialOpts, grpc.WithInsecure())
@@ -313,45 +435,58 @@ func connectToPeer(nodeID int32) PeerConnection {
 
 	logger.Info().
 		Str("addr", addrString).
-		Int("basicConns", config.Config.BasicConnections).
-		Int("priorityConns", config.Config.PriorityConnections).
+		Int("basicConns", cfg.BasicConnections).
+		Int("priorityConns", cfg.PriorityConnections).
 		Msg("Connecting to peer.")
 
 	// Create new network connections to peer.
 	var basicMsgSinks, priorityMsgSinks []pb.Messenger_ListenClient
-	if config.Config.TestConnections {
+	if testConnections {
 		basicMsgSinks, priorityMsgSinks = createTestedConnections(addrString, dialOpts, nodeID)
 	} else {
 		basicMsgSinks, priorityMsgSinks = createConnections(addrString, dialOpts, nodeID)
 	}
 
+	// If any of the connections failed, close the others and give up.
+	msgSinks := append(append(make([]pb.Messenger_ListenClient, 0), basicMsgSinks...), priorityMsgSinks...)
+	for _, msgSink := range msgSinks {
+		if msgSink == nil {
+			for _, ms := range msgSinks {
+				if ms != nil {
+					ms.CloseSend()
+				}
+			}
+			return nil, nil
+		}
+	}
+
 	// Create a new peer connection (wrapped around the network connection).
 	var connection PeerConnection
-	connection = NewBufferedMultiConnection(basicMsgSinks, priorityMsgSinks, config.Config.OutMessageBufSize)
+	connection = NewBufferedMultiConnection(basicMsgSinks, priorityMsgSinks, cfg.OutMessageBufSize)
 
 	// If configured, add batching to the connection
 	// Note that the batched connection includes "infinite" buffering for the message batches.
 	// Adding extra message buffering to a batched connection is not meaningful, as it only adds
 	// an additional thread shoveling messages from the extra buffer to the batch buffer.
-	if config.Config.OutMessageBatchPeriod > 0 {
-		return NewBatchedConnection(connection, time.Duration(config.Config.OutMessageBatchPeriod)*time.Millisecond)
+	if cfg.OutMessageBatchPeriod > 0 {
+		return NewBatchedConnection(connection, time.Duration(cfg.OutMessageBatchPeriod)*time.Millisecond), msgSinks
 		// Otherwise, return base connection directly.
 	} else {
 		logger.Info().Int32("peerId", nodeID).Msg("Returning unbuffered connection to peer.")
-		return connection
+		return connection, msgSinks
 	}
 }
 
 func createTestedConnections(addrString string, dialOpts []grpc.DialOption, nodeID int32) ([]pb.Messenger_ListenClient, []pb.Messenger_ListenClient) {
 	// Initialize list of gRPC message sinks
-	numConnections := config.Config.BasicConnections + config.Config.PriorityConnections + config.Config.ExcessConnections
+	numConnections := cfg.BasicConnections + cfg.PriorityConnections + cfg.ExcessConnections
 	msgSinks := make([]pb.Messenger_ListenClient, numConnections)
 
 	// Create multiple connections (between the same two peers) in parallel.
 	connChan := make(chan pb.Messenger_ListenClient)
 	for i := 0; i < numConnections; i++ {
 		go func() {
-			msgSink := createConnection(addrString, dialOpts)
+			msgSink := createConnection(addrString, dialOpts, nodeID)
 			if msgSink == nil {
 				logger.Error().Int("connIdx", i).Msg("Could not connect to peer.")
 			}
@@ -384,8 +519,8 @@ func createTestedConnections(addrString string, dialOpts []grpc.DialOption, node
 	})
 
 	// Set priority connections to be the ones with the highest bandwidth, if configured.
-	priority := tests[:config.Config.PriorityConnections]
-	basic := tests[len(priority) : len(priority)+config.Config.BasicConnections]
+	priority := tests[:cfg.PriorityConnections]
+	basic := tests[len(priority) : len(priority)+cfg.BasicConnections]
 	excess := tests[len(priority)+len(basic):]
 
 	// Close excess connections
@@ -429,12 +564,12 @@ func createTestedConnections(addrString string, dialOpts []grpc.DialOption, node
 
 func createConnections(addrString string, dialOpts []grpc.DialOption, nodeID int32) ([]pb.Messenger_ListenClient, []pb.Messenger_ListenClient) {
 
-	numConnections := config.Config.BasicConnections + config.Config.PriorityConnections
+	numConnections := cfg.BasicConnections + cfg.PriorityConnections
 	connChan := make(chan pb.Messenger_ListenClient)
 	// Create multiple connections (between the same two peers) in parallel.
 	for i := 0; i < numConnections; i++ {
 		go func() {
-			msgSink := createConnection(addrString, dialOpts)
+			msgSink := createConnection(addrString, dialOpts, nodeID)
 			if msgSink == nil {
 				logger.Error().Int("connIdx", i).Msg("Could not connect to peer.")
 			}
@@ -443,23 +578,24 @@ func createConnections(addrString string, dialOpts []grpc.DialOption, nodeID int
 	}
 
 	// Get priority message sinks
-	priorityMsgSinks := make([]pb.Messenger_ListenClient, config.Config.PriorityConnections)
-	for i := 0; i < config.Config.PriorityConnections; i++ {
+	priorityMsgSinks := make([]pb.Messenger_ListenClient, cfg.PriorityConnections)
+	for i := 0; i < cfg.PriorityConnections; i++ {
 		priorityMsgSinks[i] = <-connChan
 	}
 
 	// Get basic message sinks
-	basicMsgSinks := make([]pb.Messenger_ListenClient, config.Config.BasicConnections)
-	for i := 0; i < config.Config.BasicConnections; i++ {
+	basicMsgSinks := make([]pb.Messenger_ListenClient, cfg.BasicConnections)
+	for i := 0; i < cfg.BasicConnections; i++ {
 		basicMsgSinks[i] = <-connChan
 	}
 
 	return basicMsgSinks, priorityMsgSinks
 }
 
-// Creates a single connection to a peer at address addr, using options provided as dialOpts.
+// Creates a single connection to peer nodeID at address addr, using options provided as dialOpts.
 // Returns a new Protobuf client stub for sending messages on this connection.
-func createConnection(addr string, dialOpts []grpc.DialOption) pb.Messenger_ListenClient {
+// If the peer agrees, messages sent on the connection are compressed (see Compression in the config file).
+func createConnection(addr string, dialOpts []grpc.DialOption, nodeID int32) pb.Messenger_ListenClient {
 
 	// Set up a gRPC connection.
 	conn, err := grpc.Dial(addr, dialOpts...)
@@ -473,7 +609,7 @@ func createConnection(addr string, dialOpts []grpc.DialOption) pb.Messenger_List
 
 	// Remotely invoke the Listen function on the other node's gRPC server.
 	// As this is "stream of requests"-type RPC, it returns a message sink.
-	msgSink, err := client.Listen(context.Background())
+	msgSink, err := client.Listen(compressionContext())
 	if err != nil {
 		logger.Error().Err(err).Str("addrStr", addr).Msg("Could not invoke Listen RPC.")
 		conn.Close()
@@ -481,7 +617,7 @@ func createConnection(addr string, dialOpts []grpc.DialOption) pb.Messenger_List
 	}
 
 	// Return the message sing connected to the peer.
-	return msgSink
+	return withByteCount(withCompression(msgSink, nodeID), nodeID)
 }
 
 func testConnections(clients []pb.Messenger_ListenClient) []*connectionTest {
@@ -558,12 +694,12 @@ func testConnection(client pb.Messenger_ListenClient) *connectionTest {
 	// All messages have sequence numbers greater than 0, except for the last one.
 	// The server on the other side only acknowledges bandwidth test messages with sequence number 0.
 	// This implementation assumes that the transport guarantees in-order delivery.
-	for i := config.Config.ConnectionTestMsgs - 1; i >= 0; i-- {
+	for i := cfg.ConnectionTestMsgs - 1; i >= 0; i-- {
 		err := client.Send(&pb.ProtocolMessage{
 			SenderId: membership.OwnID,
 			Sn:       int32(i),
 			Msg: &pb.ProtocolMessage_BandwidthTest{BandwidthTest: &pb.BandwidthTest{
-				Payload: make([]byte, config.Config.ConnectionTestPayload, config.Config.ConnectionTestPayload),
+				Payload: make([]byte, cfg.ConnectionTestPayload, cfg.ConnectionTestPayload),
 			}},
 		})
 		if err != nil {
@@ -573,7 +709,7 @@ func testConnection(client pb.Messenger_ListenClient) *connectionTest {
 
 	// Wait for acknowledgment of the reception of all messages and return the computed bandwidth.
 	if _, err := client.Recv(); err == nil {
-		dataTransmitted := config.Config.ConnectionTestMsgs * config.Config.ConnectionTestPayload
+		dataTransmitted := cfg.ConnectionTestMsgs * cfg.ConnectionTestPayload
 		duration := int(time.Since(start).Nanoseconds())
 		bandwidth := 0 // in kB/s
 		if duration != 0 {
@@ -0,0 +1,387 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package messenger
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/membership"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	logger "github.com/rs/zerolog/log"
+)
+
+// Identifies this process. Peers use it to recognize that this node restarted and its sequence numbers start over.
+var incarnation = time.Now().UnixNano()
+
+// Supervised connections, indexed by destination node ID. Used for dispatching acknowledgments.
+var supervisors = make(map[int32]*SupervisedConnection)
+var supervisorsLock sync.Mutex
+
+// Sequence numbers of the messages received from each peer through its supervised connection, indexed by node ID.
+var received = make(map[int32]*receivedSeqNrs)
+var receivedLock sync.Mutex
+
+type receivedSeqNrs struct {
+	incarnation int64           // Incarnation of the sender the sequence numbers belong to.
+	delivered   uint64          // All messages up to this sequence number have been received.
+	ahead       map[uint64]bool // Received sequence numbers higher than delivered+1.
+	acked       uint64          // Highest sequence number acknowledged to the sender.
+}
+
+// ============================================================
+// SupervisedConnection
+// ============================================================
+
+// PeerConnection that detects the failure of the underlying network connections to a peer and re-establishes them,
+// with exponential backoff between attempts. The SupervisedConnection stays registered in peerConnections, only
+// the underlying PeerConnection is replaced.
+// If RetransmitBufferSize is configured > 0, each message is wrapped in a SequencedMessage and kept until the peer
+// acknowledges it. After reconnecting, all unacknowledged messages are retransmitted and the receiver drops duplicates.
+type SupervisedConnection struct {
+	nodeID int32
+	lock   sync.Mutex
+
+	// Underlying connection. Nil while disconnected.
+	conn PeerConnection
+
+	// Messages are sent on conn after releasing lock, such that a slow connection does not block other senders
+	// (nor acknowledgments). Senders hold sendLock in read mode while sending and acquire it before releasing lock.
+	// A connection is only closed while holding sendLock in write mode, after removing it from conn,
+	// such that no message is sent on a closed connection.
+	sendLock sync.RWMutex
+
+	// Incremented each time the connection fails or is re-established.
+	// Allows ignoring failures reported for connections that have already been replaced.
+	generation int
+
+	// Sequence number of the next message.
+	nextSeqNr uint64
+
+	// Sent messages (wrapped in SequencedMessages) that have not been acknowledged yet, ordered by sequence number.
+	retained []retainedMessage
+
+	closed bool
+}
+
+type retainedMessage struct {
+	msg      *pb.ProtocolMessage
+	priority bool
+}
+
+// Connects to a peer and starts supervising the connection.
+// Like connectToPeer(), blocks until the first connection attempt finishes.
+// If it fails, the connection is retried in the background and messages sent in the meantime are retained.
+func NewSupervisedConnection(nodeID int32) *SupervisedConnection {
+	sc := &SupervisedConnection{
+		nodeID:    nodeID,
+		nextSeqNr: 1,
+		retained:  make([]retainedMessage, 0),
+	}
+
+	supervisorsLock.Lock()
+	supervisors[nodeID] = sc
+	supervisorsLock.Unlock()
+
+	conn, msgSinks := dialPeer(nodeID, cfg.TestConnections)
+	if conn == nil {
+		go sc.reconnect()
+	} else {
+		sc.connected(conn, msgSinks)
+	}
+
+	return sc
+}
+
+func (sc *SupervisedConnection) Send(msg *pb.ProtocolMessage) {
+	sc.send(msg, false)
+}
+
+func (sc *SupervisedConnection) SendPriority(msg *pb.ProtocolMessage) {
+	sc.send(msg, true)
+}
+
+func (sc *SupervisedConnection) Close() {
+	sc.lock.Lock()
+	sc.closed = true
+	conn := sc.conn
+	sc.conn = nil
+	sc.lock.Unlock()
+
+	if conn != nil {
+		sc.closeConn(conn)
+	}
+}
+
+// Closes a connection that has been removed from sc.conn, waiting for the messages being sent on it.
+func (sc *SupervisedConnection) closeConn(conn PeerConnection) {
+	sc.sendLock.Lock()
+	defer sc.sendLock.Unlock()
+	conn.Close()
+}
+
+func (sc *SupervisedConnection) send(msg *pb.ProtocolMessage, priority bool) {
+	sc.lock.Lock()
+
+	if sc.closed {
+		sc.lock.Unlock()
+		return
+	}
+
+	// Acknowledgments are cumulative and need not be retransmitted (nor acknowledged themselves).
+	if _, ok := msg.Msg.(*pb.ProtocolMessage_Ack); ok || cfg.RetransmitBufferSize == 0 {
+		sc.sendUnlocked(msg, priority)
+		return
+	}
+
+	// Wrap the message in an envelope instead of modifying it, as the same message may be sent to multiple peers.
+	envelope := &pb.ProtocolMessage{
+		SenderId: msg.SenderId,
+		Sn:       msg.Sn,
+		Msg: &pb.ProtocolMessage_Sequenced{Sequenced: &pb.SequencedMessage{
+			Incarnation: incarnation,
+			SeqNr:       sc.nextSeqNr,
+			Msg:         msg,
+		}},
+	}
+	sc.nextSeqNr++
+
+	// Retain the message, dropping the oldest one if the buffer is full.
+	sc.retained = append(sc.retained, retainedMessage{msg: envelope, priority: priority})
+	if len(sc.retained) > cfg.RetransmitBufferSize {
+		sc.retained = sc.retained[1:]
+	}
+	envelope.GetSequenced().FirstUnacked = sc.retained[0].msg.GetSequenced().SeqNr
+
+	// While disconnected, the message will only be sent after reconnecting.
+	sc.sendUnlocked(envelope, priority)
+}
+
+// Releases sc.lock (which must be held by the caller) and sends a message on the current connection, if any.
+func (sc *SupervisedConnection) sendUnlocked(msg *pb.ProtocolMessage, priority bool) {
+	conn := sc.conn
+	if conn == nil {
+		sc.lock.Unlock()
+		return
+	}
+	sc.sendLock.RLock()
+	sc.lock.Unlock()
+
+	sendOn(conn, msg, priority)
+	sc.sendLock.RUnlock()
+}
+
+// Discards all retained messages up to sequence number seqNr.
+func (sc *SupervisedConnection) acknowledge(seqNr uint64) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	i := 0
+	for i < len(sc.retained) && sc.retained[i].msg.GetSequenced().SeqNr <= seqNr {
+		i++
+	}
+	sc.retained = sc.retained[i:]
+}
+
+// Returns whether the underlying connection is currently established
+// and the number of messages retained for retransmission.
+func (sc *SupervisedConnection) status() (bool, int) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	return sc.conn != nil, len(sc.retained)
+}
+
+// Installs a newly established connection, retransmits all retained messages on it
+// and starts watching the underlying message sinks for failures.
+func (sc *SupervisedConnection) connected(conn PeerConnection, msgSinks []pb.Messenger_ListenClient) {
+	sc.lock.Lock()
+	if sc.closed {
+		sc.lock.Unlock()
+		conn.Close()
+		return
+	}
+
+	sc.conn = conn
+	sc.generation++
+	generation := sc.generation
+
+	// Retransmit after releasing the lock, like in send().
+	// Messages sent concurrently might overtake the retransmitted ones, which the receiver tolerates.
+	retained := make([]retainedMessage, len(sc.retained))
+	copy(retained, sc.retained)
+	sc.sendLock.RLock()
+	sc.lock.Unlock()
+
+	for _, rm := range retained {
+		sendOn(conn, rm.msg, rm.priority)
+	}
+	sc.sendLock.RUnlock()
+	if len(retained) > 0 {
+		logger.Info().Int32("peerId", sc.nodeID).Int("nMsgs", len(retained)).Msg("Retransmitted unacknowledged messages.")
+	}
+
+	// The peer never sends anything on the message sinks except for bandwidth test acknowledgments,
+	// so receiving only returns when the underlying stream fails or is closed by the peer.
+	for _, msgSink := range msgSinks {
+		go func(msgSink pb.Messenger_ListenClient) {
+			for {
+				if _, err := msgSink.Recv(); err != nil {
+					sc.failed(generation, err)
+					return
+				}
+			}
+		}(msgSink)
+	}
+}
+
+// Handles the failure of the connection of the given generation and starts reconnecting.
+func (sc *SupervisedConnection) failed(generation int, err error) {
+	sc.lock.Lock()
+	if sc.closed || generation != sc.generation {
+		sc.lock.Unlock()
+		return
+	}
+	conn := sc.conn
+	sc.conn = nil
+	sc.generation++
+	sc.lock.Unlock()
+
+	logger.Warn().Err(err).Int32("peerId", sc.nodeID).Msg("Connection to peer failed. Reconnecting.")
+	sc.closeConn(conn)
+	go sc.reconnect()
+}
+
+// Tries to re-establish the connection until it succeeds or the SupervisedConnection is closed.
+func (sc *SupervisedConnection) reconnect() {
+	backoff := time.Duration(cfg.ReconnectBackoffMin) * time.Millisecond
+	maxBackoff := time.Duration(cfg.ReconnectBackoffMax) * time.Millisecond
+
+	for {
+		time.Sleep(backoff)
+
+		sc.lock.Lock()
+		closed := sc.closed
+		sc.lock.Unlock()
+		if closed {
+			return
+		}
+
+		if conn, msgSinks := dialPeer(sc.nodeID, false); conn != nil {
+			logger.Info().Int32("peerId", sc.nodeID).Msg("Reconnected to peer.")
+			sc.connected(conn, msgSinks)
+			return
+		}
+
+		logger.Warn().Int32("peerId", sc.nodeID).Dur("backoff", backoff).Msg("Failed to reconnect to peer.")
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func sendOn(conn PeerConnection, msg *pb.ProtocolMessage, priority bool) {
+	if priority {
+		conn.SendPriority(msg)
+	} else {
+		conn.Send(msg)
+	}
+}
+
+// ============================================================
+// Receiver side
+// ============================================================
+
+// Registers a sequenced message received from a peer.
+// Returns false if the message is a duplicate (or belongs to an old incarnation of the sender) and must be ignored.
+func acceptSequenced(senderID int32, sm *pb.SequencedMessage) bool {
+	receivedLock.Lock()
+	defer receivedLock.Unlock()
+
+	r, ok := received[senderID]
+	if !ok || sm.Incarnation > r.incarnation {
+		r = &receivedSeqNrs{
+			incarnation: sm.Incarnation,
+			ahead:       make(map[uint64]bool),
+		}
+		received[senderID] = r
+	} else if sm.Incarnation < r.incarnation {
+		return false
+	}
+
+	// Messages below FirstUnacked have been acknowledged (possibly by a previous incarnation of this node,
+	// or dropped from the sender's retransmission buffer) and will never be retransmitted. Stop waiting for them.
+	if sm.FirstUnacked > r.delivered+1 {
+		r.delivered = sm.FirstUnacked - 1
+		for seqNr := range r.ahead {
+			if seqNr <= r.delivered {
+				delete(r.ahead, seqNr)
+			}
+		}
+	}
+
+	if sm.SeqNr <= r.delivered || r.ahead[sm.SeqNr] {
+		return false
+	}
+
+	r.ahead[sm.SeqNr] = true
+	for r.ahead[r.delivered+1] {
+		delete(r.ahead, r.delivered+1)
+		r.delivered++
+	}
+	return true
+}
+
+// Handles an acknowledgment received from a peer.
+func handleAck(senderID int32, ack *pb.MessageAck) {
+	// Ignore acknowledgments of messages sent by a previous incarnation of this node.
+	if ack.Incarnation != incarnation {
+		return
+	}
+
+	supervisorsLock.Lock()
+	sc, ok := supervisors[senderID]
+	supervisorsLock.Unlock()
+
+	if ok {
+		sc.acknowledge(ack.SeqNr)
+	}
+}
+
+// Periodically acknowledges the sequenced messages received from each peer.
+// Meant to be run as a separate goroutine.
+func acknowledgeMessages() {
+	for range time.Tick(time.Duration(cfg.RetransmitAckPeriod) * time.Millisecond) {
+
+		// Collect acknowledgments to send.
+		acks := make(map[int32]*pb.MessageAck)
+		receivedLock.Lock()
+		for senderID, r := range received {
+			if r.delivered > r.acked {
+				r.acked = r.delivered
+				acks[senderID] = &pb.MessageAck{Incarnation: r.incarnation, SeqNr: r.delivered}
+			}
+		}
+		receivedLock.Unlock()
+
+		for senderID, ack := range acks {
+			EnqueuePriorityMsg(&pb.ProtocolMessage{
+				SenderId: membership.OwnID,
+				Sn:       -1,
+				Msg:      &pb.ProtocolMessage_Ack{Ack: ack},
+			}, senderID)
+		}
+	}
+}
@@ -15,19 +15,30 @@
 package messenger
 
 import (
+	"bytes"
+	"context"
+	cstd "crypto"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
 	"io/ioutil"
+	"math/big"
+	"time"
 
+	"github.com/Hanzheng2021/Orthrus/crypto"
+	"github.com/Hanzheng2021/Orthrus/membership"
 	logger "github.com/rs/zerolog/log"
-	"github.com/Hanzheng2021/Orthrus/config"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
 )
 
 // Configures a TLS connection.
 // This function is used for both the client and the server part of the connection.
+// All certificates are verified against the certificate of the CA in caCertFile.
 // Returns a TLS configuration to be used when creating a network connection (direct or through gRPC).
-func ConfigureTLS(certFile string, keyFile string) *tls.Config {
+func ConfigureTLS(certFile string, keyFile string, caCertFile string) *tls.Config {
 
 	// Load key pair / certificate of this node.
 	// This is the certificate this node will be presenting to the other side of the connection.
@@ -58,7 +69,7 @@ func ConfigureTLS(certFile string, keyFile string) *tls.Config {
 	// The CA signs all other certificates used in this code.
 	// All certificates are verified against this.
 	certpool := x509.NewCertPool()
-	pem, err := ioutil.ReadFile(config.Config.CACertFile)
+	pem, err := ioutil.ReadFile(caCertFile)
 	if err != nil {
 		logger.Fatal().
 			Err(err).
@@ -82,3 +93,127 @@ func ConfigureTLS(certFile string, keyFile string) *tls.Config {
 		//InsecureSkipVerify: true,                   // Uncomment this to skip verification of certificate against the CA.
 	}
 }
+
+// Configures a TLS connection between peers with per-node authentication.
+// Like ConfigureTLS, but when dialing another peer, this node presents a self-signed certificate for its own identity
+// key (generated by the discovery server at registration, see membership.OwnPrivKey) instead of the shared
+// certificate. When accepting connections, the node accepts both certificates signed by the CA (used by clients) and
+// identity certificates of known nodes. Incoming streams can then be bound to a node using AuthenticatedNodeID.
+func ConfigurePeerTLS(certFile string, keyFile string, caCertFile string) *tls.Config {
+	tlsConfig := ConfigureTLS(certFile, keyFile, caCertFile)
+
+	identityCert, err := identityCertificate()
+	if err != nil {
+		logger.Fatal().Err(err).Int32("ownID", membership.OwnID).Msg("Failed to create node identity certificate.")
+	}
+
+	// Client side of the TLS connection: present the identity certificate.
+	tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return identityCert, nil
+	}
+
+	// Server side of the TLS connection: identity certificates are self-signed and thus cannot be verified
+	// against the CA. We request any certificate and verify it ourselves.
+	caPool := tlsConfig.ClientCAs
+	tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return verifyCertificate(rawCerts, caPool)
+	}
+
+	return tlsConfig
+}
+
+// Returns the ID of the node that authenticated the connection over which the gRPC stream with the given context
+// was opened. Returns false if the connection is not using TLS or the other side did not present the identity
+// certificate of a known node.
+func AuthenticatedNodeID(ctx context.Context) (int32, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return -1, false
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return -1, false
+	}
+	return certificateNodeID(tlsInfo.State.PeerCertificates[0])
+}
+
+// Creates a self-signed certificate for the own identity key of this node.
+func identityCertificate() (*tls.Certificate, error) {
+	sk, err := crypto.PrivateKeyFromBytes(membership.OwnPrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse own private key: %s", err)
+	}
+	signer, ok := sk.(cstd.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type: %T", sk)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(membership.OwnID) + 1),
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("peer-%d", membership.OwnID)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		return nil, fmt.Errorf("could not create certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse certificate: %s", err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  sk,
+		Leaf:        leaf,
+	}, nil
+}
+
+// Accepts a certificate chain if its leaf is the identity certificate of a known node
+// or if it can be verified against the CA.
+func verifyCertificate(rawCerts [][]byte, caPool *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no certificate presented")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("could not parse certificate: %s", err)
+		}
+		certs[i] = cert
+	}
+
+	if _, ok := certificateNodeID(certs[0]); ok {
+		return nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         caPool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// Returns the ID of the node whose identity public key is certified by the given certificate.
+func certificateNodeID(cert *x509.Certificate) (int32, bool) {
+	pkBytes, err := crypto.PublicKeyToBytes(cert.PublicKey)
+	if err != nil {
+		return -1, false
+	}
+	for _, nodeID := range membership.AllNodeIDs() {
+		if identity := membership.NodeIdentity(nodeID); identity != nil && bytes.Equal(identity.PubKey, pkBytes) {
+			return nodeID, true
+		}
+	}
+	return -1, false
+}
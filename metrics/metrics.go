@@ -0,0 +1,369 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The metrics package exposes live counters, gauges and histograms of a peer or a client over HTTP,
+// in the Prometheus text exposition format.
+// As opposed to the event traces (see the tracing package), which are only analyzed after an experiment,
+// the metrics can be observed (and scraped) while the system is running.
+//
+// Updating a metric is cheap (at most an atomic operation or an uncontended lock) and metrics can be updated
+// whether or not the endpoint has been started. Metrics whose computation is expensive by itself
+// (e.g. the sizes of the messages sent) should only be updated if Enabled() returns true.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	logger "github.com/rs/zerolog/log"
+)
+
+// Path of the HTTP endpoint serving the metrics.
+const Path = "/metrics"
+
+// Set to 1 when the endpoint is started. Accessed atomically.
+var enabled int32
+
+// All the metrics, in the order they are written to the endpoint.
+var registry = make([]metric, 0)
+var registryLock sync.Mutex
+
+// A metric writes itself in the Prometheus text exposition format.
+type metric interface {
+	write(w io.Writer)
+}
+
+func register(m metric) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry = append(registry, m)
+}
+
+// Returns true if the metrics endpoint has been started.
+func Enabled() bool {
+	return atomic.LoadInt32(&enabled) == 1
+}
+
+// Starts serving the metrics at addr (host:port) under Path.
+// Returns an error if the listening socket cannot be created. Serving itself happens in a separate goroutine.
+func Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(Path, handle)
+	atomic.StoreInt32(&enabled, 1)
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			logger.Error().Err(err).Str("addr", addr).Msg("Metrics endpoint stopped.")
+		}
+	}()
+	logger.Info().Str("addr", listener.Addr().String()).Str("path", Path).Msg("Serving metrics.")
+	return nil
+}
+
+func handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	Write(w)
+}
+
+// Writes all metrics in the Prometheus text exposition format.
+func Write(w io.Writer) {
+	registryLock.Lock()
+	metrics := registry
+	registryLock.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func writeHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(help), name, metricType)
+}
+
+// Escaping of help texts and label values, as defined by the text exposition format.
+// (Go's %q escapes more characters, which Prometheus does not accept.)
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// Formats a label pair (without braces).
+func formatLabel(label string, value string) string {
+	return label + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+//============================================================
+// Counter and Gauge
+//============================================================
+
+// A single integer value. A counter only increases, a gauge can be set to any value.
+type Counter struct {
+	name       string
+	help       string
+	metricType string
+	value      int64
+}
+
+type Gauge = Counter
+
+func NewCounter(name string, help string) *Counter {
+	c := &Counter{name: name, help: help, metricType: "counter"}
+	register(c)
+	return c
+}
+
+func NewGauge(name string, help string) *Gauge {
+	g := &Gauge{name: name, help: help, metricType: "gauge"}
+	register(g)
+	return g
+}
+
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.value, 1)
+}
+
+func (c *Counter) Add(n int) {
+	atomic.AddInt64(&c.value, int64(n))
+}
+
+// Only meaningful for gauges.
+func (c *Counter) Set(v int64) {
+	atomic.StoreInt64(&c.value, v)
+}
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, c.metricType)
+	fmt.Fprintf(w, "%s %d\n", c.name, atomic.LoadInt64(&c.value))
+}
+
+//============================================================
+// CounterVec and GaugeVec
+//============================================================
+
+// A set of integer values, distinguished by the value of a single label (e.g. the peer ID).
+// A value only appears in the output once it has been updated.
+type CounterVec struct {
+	name       string
+	help       string
+	metricType string
+	label      string
+	values     sync.Map // map[string]*int64
+}
+
+type GaugeVec = CounterVec
+
+func NewCounterVec(name string, help string, label string) *CounterVec {
+	cv := &CounterVec{name: name, help: help, metricType: "counter", label: label}
+	register(cv)
+	return cv
+}
+
+func NewGaugeVec(name string, help string, label string) *GaugeVec {
+	gv := &GaugeVec{name: name, help: help, metricType: "gauge", label: label}
+	register(gv)
+	return gv
+}
+
+func (cv *CounterVec) value(labelValue string) *int64 {
+	if v, ok := cv.values.Load(labelValue); ok {
+		return v.(*int64)
+	}
+	v, _ := cv.values.LoadOrStore(labelValue, new(int64))
+	return v.(*int64)
+}
+
+func (cv *CounterVec) Inc(labelValue string) {
+	atomic.AddInt64(cv.value(labelValue), 1)
+}
+
+func (cv *CounterVec) Add(labelValue string, n int) {
+	atomic.AddInt64(cv.value(labelValue), int64(n))
+}
+
+// Only meaningful for gauges.
+func (cv *CounterVec) Set(labelValue string, v int64) {
+	atomic.StoreInt64(cv.value(labelValue), v)
+}
+
+func (cv *CounterVec) write(w io.Writer) {
+	writeHeader(w, cv.name, cv.help, cv.metricType)
+	for _, labelValue := range sortedKeys(&cv.values) {
+		fmt.Fprintf(w, "%s{%s} %d\n", cv.name, formatLabel(cv.label, labelValue), atomic.LoadInt64(cv.value(labelValue)))
+	}
+}
+
+//============================================================
+// GaugeVecFunc
+//============================================================
+
+// A set of integer values, distinguished by the value of a single label, that are computed when the metrics are
+// written. Suited for values that are cheaper to compute on demand than to keep up to date (e.g. sizes of
+// data structures that change with every request).
+type GaugeVecFunc struct {
+	name  string
+	help  string
+	label string
+	f     atomic.Value // func() map[string]int64
+}
+
+func NewGaugeVecFunc(name string, help string, label string) *GaugeVecFunc {
+	gf := &GaugeVecFunc{name: name, help: help, label: label}
+	register(gf)
+	return gf
+}
+
+// Sets the function computing the values, indexed by label value. Until it is set, the metric has no values.
+// The function is called concurrently with the rest of the program and must do its own synchronization.
+func (gf *GaugeVecFunc) SetFunc(f func() map[string]int64) {
+	gf.f.Store(f)
+}
+
+func (gf *GaugeVecFunc) write(w io.Writer) {
+	writeHeader(w, gf.name, gf.help, "gauge")
+	f, ok := gf.f.Load().(func() map[string]int64)
+	if !ok {
+		return
+	}
+	values := f()
+	labelValues := make([]string, 0, len(values))
+	for labelValue := range values {
+		labelValues = append(labelValues, labelValue)
+	}
+	for _, labelValue := range sortLabelValues(labelValues) {
+		fmt.Fprintf(w, "%s{%s} %d\n", gf.name, formatLabel(gf.label, labelValue), values[labelValue])
+	}
+}
+
+//============================================================
+// Histogram
+//============================================================
+
+// Distribution of observed values, optionally distinguished by the value of a single label.
+type Histogram struct {
+	name    string
+	help    string
+	label   string    // Empty if the histogram has no label.
+	buckets []float64 // Upper bounds of the buckets, in increasing order. The +Inf bucket is implicit.
+	series  sync.Map  // map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	sync.Mutex
+	counts []uint64 // Non-cumulative count of each bucket, the last one being the +Inf bucket.
+	sum    float64
+	count  uint64
+}
+
+// Creates a new histogram with the given bucket upper bounds. label can be empty.
+func NewHistogram(name string, help string, label string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, label: label, buckets: buckets}
+	register(h)
+	return h
+}
+
+// Records an observed value. labelValue is ignored if the histogram has no label.
+func (h *Histogram) Observe(labelValue string, v float64) {
+	s, ok := h.series.Load(labelValue)
+	if !ok {
+		s, _ = h.series.LoadOrStore(labelValue, &histogramSeries{counts: make([]uint64, len(h.buckets)+1)})
+	}
+	series := s.(*histogramSeries)
+
+	i := sort.SearchFloat64s(h.buckets, v)
+	series.Lock()
+	series.counts[i]++
+	series.sum += v
+	series.count++
+	series.Unlock()
+}
+
+func (h *Histogram) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, labelValue := range sortedKeys(&h.series) {
+		s, _ := h.series.Load(labelValue)
+		series := s.(*histogramSeries)
+
+		labels := ""
+		if h.label != "" {
+			labels = formatLabel(h.label, labelValue) + ","
+		}
+
+		series.Lock()
+		cumulative := uint64(0)
+		for i, count := range series.counts {
+			cumulative += count
+			upperBound := math.Inf(1)
+			if i < len(h.buckets) {
+				upperBound = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, labels, formatValue(upperBound), cumulative)
+		}
+		labels = ""
+		if h.label != "" {
+			labels = "{" + formatLabel(h.label, labelValue) + "}"
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, series.count)
+		series.Unlock()
+	}
+}
+
+// Returns the keys of a map of label values, in increasing numerical order if they all are numbers
+// (e.g. peer IDs), and in lexicographic order otherwise.
+func sortedKeys(m *sync.Map) []string {
+	keys := make([]string, 0)
+	m.Range(func(key, value interface{}) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	return sortLabelValues(keys)
+}
+
+// Sorts label values in place, in increasing numerical order if they all are numbers, and in lexicographic order
+// otherwise. Returns the sorted slice.
+func sortLabelValues(keys []string) []string {
+	sort.Slice(keys, func(i, j int) bool {
+		a, errA := strconv.Atoi(keys[i])
+		b, errB := strconv.Atoi(keys[j])
+		if errA == nil && errB == nil {
+			return a < b
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
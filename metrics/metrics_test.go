@@ -0,0 +1,103 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Returns the output of a single metric.
+func output(m metric) string {
+	var buf bytes.Buffer
+	m.write(&buf)
+	return buf.String()
+}
+
+func TestHistogram(t *testing.T) {
+	h := &Histogram{name: "test_latency_seconds", help: "Latency.", label: "path", buckets: []float64{1, 2, 5}}
+	for _, v := range []float64{0.5, 1, 1.5, 3, 10} {
+		h.Observe("fast", v)
+	}
+	h.Observe("slow", 2)
+
+	// Bucket counts are cumulative, the upper bounds are inclusive and the last bucket is +Inf.
+	want := `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{path="fast",le="1"} 2
+test_latency_seconds_bucket{path="fast",le="2"} 3
+test_latency_seconds_bucket{path="fast",le="5"} 4
+test_latency_seconds_bucket{path="fast",le="+Inf"} 5
+test_latency_seconds_sum{path="fast"} 16
+test_latency_seconds_count{path="fast"} 5
+test_latency_seconds_bucket{path="slow",le="1"} 0
+test_latency_seconds_bucket{path="slow",le="2"} 1
+test_latency_seconds_bucket{path="slow",le="5"} 1
+test_latency_seconds_bucket{path="slow",le="+Inf"} 1
+test_latency_seconds_sum{path="slow"} 2
+test_latency_seconds_count{path="slow"} 1
+`
+	if got := output(h); got != want {
+		t.Errorf("histogram output:\n%s\nexpected:\n%s", got, want)
+	}
+
+	unlabeled := &Histogram{name: "test_size", help: "Size.", buckets: []float64{0.25}}
+	unlabeled.Observe("", 0.1)
+	want = `# HELP test_size Size.
+# TYPE test_size histogram
+test_size_bucket{le="0.25"} 1
+test_size_bucket{le="+Inf"} 1
+test_size_sum 0.1
+test_size_count 1
+`
+	if got := output(unlabeled); got != want {
+		t.Errorf("histogram output without label:\n%s\nexpected:\n%s", got, want)
+	}
+}
+
+func TestLabelQuoting(t *testing.T) {
+	cv := &CounterVec{name: "test_total", help: "Backslash \\ and\nnewline.", metricType: "counter", label: "peer"}
+	cv.Add("a\"b\\c\nd", 2)
+	cv.Inc("é\t")
+
+	// Only backslashes, double quotes and newlines are escaped. Other characters appear as they are.
+	want := "# HELP test_total Backslash \\\\ and\\nnewline.\n" +
+		"# TYPE test_total counter\n" +
+		"test_total{peer=\"a\\\"b\\\\c\\nd\"} 2\n" +
+		"test_total{peer=\"é\t\"} 1\n"
+	if got := output(cv); got != want {
+		t.Errorf("counter output:\n%s\nexpected:\n%s", got, want)
+	}
+}
+
+func TestGaugeVecFunc(t *testing.T) {
+	gf := &GaugeVecFunc{name: "test_size", help: "Size.", label: "bucket"}
+	want := "# HELP test_size Size.\n# TYPE test_size gauge\n"
+	if got := output(gf); got != want {
+		t.Errorf("output without function:\n%s\nexpected:\n%s", got, want)
+	}
+
+	size := int64(3)
+	gf.SetFunc(func() map[string]int64 {
+		return map[string]int64{"10": size, "2": 1, "0": 0}
+	})
+	size = 4
+
+	// Values are computed when written and sorted numerically.
+	want += "test_size{bucket=\"0\"} 0\ntest_size{bucket=\"2\"} 1\ntest_size{bucket=\"10\"} 4\n"
+	if got := output(gf); got != want {
+		t.Errorf("output:\n%s\nexpected:\n%s", got, want)
+	}
+}
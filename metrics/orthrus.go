@@ -0,0 +1,70 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+// Values of the path label.
+// Payments take the fast path (the response is sent as soon as the request is committed, in any order),
+// contracts take the slow path (the response is sent when the request is delivered in sequence number order).
+const (
+	PathFast = "fast"
+	PathSlow = "slow"
+)
+
+// Returns the path taken by a request, given the IsContract field of the ClientRequest.
+func RequestPath(isContract int32) string {
+	if isContract == 1 {
+		return PathSlow
+	}
+	return PathFast
+}
+
+// Upper bounds (in seconds) of the latency histogram buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics of the peers.
+var (
+	RequestsReceived = NewCounter("orthrus_requests_received_total",
+		"Client requests received by the peer.")
+	RequestsProposed = NewCounter("orthrus_requests_proposed_total",
+		"Requests in the batches proposed by the peer.")
+	RequestsCommitted = NewCounter("orthrus_requests_committed_total",
+		"Requests in the batches committed to the log (in any order).")
+	RequestsDelivered = NewCounter("orthrus_requests_delivered_total",
+		"Requests in the batches delivered in sequence number order.")
+	ResponsesSent = NewCounterVec("orthrus_responses_sent_total",
+		"Responses sent to clients, by path (fast: payments, slow: contracts).", "path")
+	BucketSize = NewGaugeVecFunc("orthrus_bucket_size",
+		"Number of requests in each bucket.", "bucket")
+	ViewChanges = NewCounter("orthrus_view_changes_total",
+		"View changes (new views, terms or rounds) of the orderer instances.")
+	Epoch = NewGauge("orthrus_epoch",
+		"Current epoch.")
+	Htn = NewGauge("orthrus_htn",
+		"Highest timestamp number proposed or accepted by the peer.")
+	MessengerBytesSent = NewCounterVec("orthrus_messenger_sent_bytes_total",
+		"Bytes of protocol messages sent to each peer.", "peer")
+	MessengerBytesReceived = NewCounterVec("orthrus_messenger_received_bytes_total",
+		"Bytes of protocol messages received from each peer.", "peer")
+)
+
+// Metrics of the clients. A client process reports the sum over all its clients.
+var (
+	ClientRequestsSubmitted = NewCounter("orthrus_client_requests_submitted_total",
+		"Requests submitted by the clients.")
+	ClientRequestsFinished = NewCounterVec("orthrus_client_requests_finished_total",
+		"Requests for which the clients received enough responses, by path.", "path")
+	ClientResponseLatency = NewHistogram("orthrus_client_response_latency_seconds",
+		"Time from submitting a request until receiving enough responses, by path.", "path", latencyBuckets)
+)
@@ -15,7 +15,9 @@
 package orderer
 
 import (
+	"fmt"
 	"sync/atomic"
+	"time"
 
 	logger "github.com/rs/zerolog/log"
 	"github.com/Hanzheng2021/Orthrus/manager"
@@ -200,3 +202,16 @@ func min(a, b int32) int32 {
 func segmentLeader(seg manager.Segment, view int32) int32 {
 	return seg.Leaders()[view%int32(len(seg.Leaders()))]
 }
+
+// Checks that the proposal timestamp of a fresh batch deviates from the local time by at most tolerance milliseconds.
+// The timestamps are agreed upon as part of the batches and the REPUTATION leader policy scores the leaders by them.
+// Bounding them at the followers prevents a leader from hiding its lag (or the lag of others) by more than tolerance.
+func checkProposalTs(batch *pb.Batch, tolerance int) error {
+	now := time.Now().UnixNano()
+	bound := int64(tolerance) * int64(time.Millisecond)
+	if batch.ProposalTs < now-bound || batch.ProposalTs > now+bound {
+		return fmt.Errorf("proposal timestamp %d deviates from local time %d by more than %d ms",
+			batch.ProposalTs, now, tolerance)
+	}
+	return nil
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/Hanzheng2021/Orthrus/manager"
 	"github.com/Hanzheng2021/Orthrus/membership"
 	"github.com/Hanzheng2021/Orthrus/messenger"
+	"github.com/Hanzheng2021/Orthrus/metrics"
 	pb "github.com/Hanzheng2021/Orthrus/protobufs"
 	"github.com/Hanzheng2021/Orthrus/request"
 	"github.com/Hanzheng2021/Orthrus/tracing"
@@ -39,6 +40,9 @@ type DummyOrderer struct {
 
 	// Channel to which the Manager pushes new Segments.
 	segmentChan chan manager.Segment
+
+	// Configuration of the orderer.
+	cfg *config.Configuration
 }
 
 // This function is called by the messenger each time an Orderer-issued message is received over the network.
@@ -102,8 +106,17 @@ func (do *DummyOrderer) HandleEntry(entry *log.Entry) {
 	panic("DummyOrderer does not yet implement HandleEntry().")
 }
 
+// Creates a new DummyOrderer with the given configuration.
+// The configuration is mandatory: Init panics on an orderer created without one (e.g. &DummyOrderer{}).
+func NewDummyOrderer(cfg *config.Configuration) *DummyOrderer {
+	return &DummyOrderer{cfg: cfg}
+}
+
 // Initializes the DummyOrderer by subscribing to new segments issued by the Manager.
 func (do *DummyOrderer) Init(mngr manager.Manager) {
+	if do.cfg == nil {
+		panic("DummyOrderer initialized without a configuration.")
+	}
 	do.segmentChan = mngr.SubscribeOrderer()
 	// TODO initialize a backlog to store messages that arrive before the orderer starts
 }
@@ -166,7 +179,8 @@ func (do *DummyOrderer) proposeSN(segment manager.Segment, sn int32) {
 	logger.Trace().Int32("sn", sn).Msg("Creating proposal.")
 
 	// Create request batch and mark it as "in flight"
-	batch := segment.Buckets().CutBatch(config.Config.BatchSize, config.Config.BatchTimeout)
+	batch := segment.Buckets().CutBatch(do.cfg.BatchSize, do.cfg.BatchTimeout)
+	batch.DropExpired(sn)
 
 	// Create message
 	orderMsg := &pb.ProtocolMessage{
@@ -178,6 +192,7 @@ func (do *DummyOrderer) proposeSN(segment manager.Segment, sn int32) {
 		Type: "ProtocolMessage_Dummy",
 	}
 	tracing.MainTrace.Event(tracing.PROPOSE, int64(sn), 0)
+	metrics.RequestsProposed.Add(len(batch.Requests))
 	logger.Debug().
 		Int32("sn", sn).
 		Int("nReq", len(orderMsg.
@@ -22,11 +22,12 @@ import (
 
 	"github.com/golang/protobuf/proto"
 	"github.com/Hanzheng2021/Orthrus/announcer"
-	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/evidence"
 	"github.com/Hanzheng2021/Orthrus/log"
 	"github.com/Hanzheng2021/Orthrus/manager"
 	"github.com/Hanzheng2021/Orthrus/membership"
 	"github.com/Hanzheng2021/Orthrus/messenger"
+	"github.com/Hanzheng2021/Orthrus/metrics"
 	pb "github.com/Hanzheng2021/Orthrus/protobufs"
 	"github.com/Hanzheng2021/Orthrus/request"
 	"github.com/Hanzheng2021/Orthrus/tracing"
@@ -57,6 +58,7 @@ type hotStuffInstance struct {
 	backlog           *hotStuffBacklog                        // Backlog for future segment seq nos
 	serializer        *ordererChannel                         // Channel of messages that must be handled sequentially
 	newViewVotes      map[int32]map[int32]*pb.HotStuffNewView // Structure to count the new view votes (height -> senderID -> vote)
+	proposalTsValid   map[int32]bool                          // Heights whose proposal timestamp has been checked on reception
 
 	stopProp sync.Once
 	newBatch chan *request.Batch //
@@ -106,13 +108,14 @@ func (hi *hotStuffInstance) init(seg manager.Segment, orderer *HotStuffOrderer)
 	hi.backlog = newHotStuffBacklog(hi)
 
 	// Initialize view change timeout duration
-	hi.viewChangeTimeout = config.Config.ViewChangeTimeout
+	hi.viewChangeTimeout = hi.orderer.cfg.ViewChangeTimeout
 
 	// Initialise nodes
 	hi.nodes = make([]*hotStuffNode, 0, 0)
 
 	// Initialize new view  vote counting structure
 	hi.newViewVotes = make(map[int32]map[int32]*pb.HotStuffNewView)
+	hi.proposalTsValid = make(map[int32]bool)
 
 	// Initialise the root node
 	node := &pb.HotStuffNode{
@@ -165,7 +168,7 @@ func (hi *hotStuffInstance) start() {
 
 		// Schedule a batch for the first sn in the segment
 		go func() {
-			hi.newBatch <- hi.segment.Buckets().CutBatch(config.Config.BatchSize, config.Config.BatchTimeout)
+			hi.newBatch <- hi.segment.Buckets().CutBatch(hi.orderer.cfg.BatchSize, hi.orderer.cfg.BatchTimeout)
 		}()
 
 		// Send a proposal for the *fist* sn in the segment
@@ -189,7 +192,9 @@ func (hi *hotStuffInstance) proposeSN(sn int32) {
 	var batch *request.Batch
 	if hi.view == 0 && !hi.segmentProposed {
 		// Wait for a new batch
+		// The batch has been cut before sn was known, so the requests expiring before sn are only dropped now.
 		batch = <-hi.newBatch
+		batch.DropExpired(sn)
 
 		logger.Info().Int32("sn", sn).
 			Int("segment", hi.segment.SegID()).
@@ -208,19 +213,19 @@ func (hi *hotStuffInstance) proposeSN(sn int32) {
 		// If the segment is not proposed yet schedule a new batch
 		if !hi.segmentProposed {
 			go func() {
-				if int32(hi.segment.SegID())%int32(membership.NumNodes()) == 0 && config.Config.CrashTiming == "Straggler" {
+				if int32(hi.segment.SegID())%int32(membership.NumNodes()) == 0 && hi.orderer.cfg.CrashTiming == "Straggler" {
 					logger.Debug().
 						Int("segment", hi.segment.SegID()).
 						Msg("Straggler. Start wait for requests.")
-					timeout := time.Duration(int(0.16666667*float64(config.Config.ViewChangeTimeoutMs))) * time.Millisecond
+					timeout := time.Duration(int(0.16666667*float64(hi.orderer.cfg.ViewChangeTimeoutMs))) * time.Millisecond
 					hi.segment.Buckets().WaitForRequests(100000000000, timeout)
 					logger.Debug().
 						Int("segment", hi.segment.SegID()).
 						Msg("Straggler. Finish wait for requests.")
 				} else {
-					hi.segment.Buckets().WaitForRequests(config.Config.BatchSize, config.Config.BatchTimeout)
+					hi.segment.Buckets().WaitForRequests(hi.orderer.cfg.BatchSize, hi.orderer.cfg.BatchTimeout)
 				}
-				hi.newBatch <- hi.segment.Buckets().CutBatch(config.Config.BatchSize, 0)
+				hi.newBatch <- hi.segment.Buckets().CutBatch(hi.orderer.cfg.BatchSize, 0)
 			}()
 		}
 
@@ -239,16 +244,28 @@ func (hi *hotStuffInstance) proposeSN(sn int32) {
 		new.node.Aborted = true
 	}
 
+	// Piggyback evidence of misbehavior that has not yet been committed and set the proposal timestamp.
+	new.node.Batch.Evidence = evidence.Pending()
+	new.node.Batch.ProposalTs = time.Now().UnixNano()
+	new.digest = hotStuffDigest(new.node)
+
 	hi.leaf = new
 
+	// Sign the proposal header
+	sig, err := evidence.SignProposal(new.node.View, sn, new.height, new.digest)
+	if err != nil {
+		logger.Error().Err(err).Int32("sn", sn).Msg("Failed to sign PROPOSAL.")
+	}
+
 	// Create message
 	msg := &pb.ProtocolMessage{
 		SenderId: membership.OwnID,
 		Sn:       sn,
 		Msg: &pb.ProtocolMessage_Proposal{
 			Proposal: &pb.HotStuffProposal{
-				Leader: membership.OwnID,
-				Node:   new.node,
+				Leader:    membership.OwnID,
+				Node:      new.node,
+				Signature: sig,
 			},
 		},
 	}
@@ -262,6 +279,8 @@ func (hi *hotStuffInstance) proposeSN(sn int32) {
 		Msg("Sending PROPOSAL.")
 
 	tracing.MainTrace.Event(tracing.PROPOSE, int64(sn), int64(len(batch.Requests)))
+	tracing.BatchStage(new.node.Batch.Requests, tracing.StagePropose, sn)
+	metrics.RequestsProposed.Add(len(batch.Requests))
 
 	// Handle own proposal as follower to make sure state for this node is created before votes are received
 	hi.handleProposal(msg.GetProposal(), msg)
@@ -300,6 +319,41 @@ func (hi *hotStuffInstance) handleProposal(proposal *pb.HotStuffProposal, msg *p
 		return fmt.Errorf("malformed message: sender %d does not match leader %d", senderID, proposal.Leader)
 	}
 
+	// Check the leader's signature on the proposal and whether the leader already made a conflicting proposal
+	// for the same height.
+	signedProposal := &pb.SignedProposal{
+		Leader:    proposal.Leader,
+		View:      proposal.Node.View,
+		Sn:        sn,
+		Height:    proposal.Node.Height,
+		Digest:    hotStuffDigest(proposal.Node),
+		Signature: proposal.Signature,
+	}
+	if err := evidence.CheckProposal(signedProposal); err != nil {
+		hi.sendNewView()
+		return fmt.Errorf("invalid proposal from %d: %s", senderID, err.Error())
+	}
+	if ev := evidence.Observe(signedProposal); ev != nil {
+		hi.sendNewView()
+		return fmt.Errorf("leader %d equivocated for sn %d", senderID, sn)
+	}
+	for _, ev := range proposal.Node.Batch.Evidence {
+		if err := evidence.Verify(ev); err != nil {
+			hi.sendNewView()
+			return fmt.Errorf("proposal from %d contains invalid evidence: %s", senderID, err.Error())
+		}
+	}
+
+	// Check the proposal timestamp on first reception, as the proposal might be backlogged and handled again later.
+	// Each node is created (and timestamped) by the leader when proposing it.
+	if !hi.proposalTsValid[proposal.Node.Height] {
+		if err := checkProposalTs(proposal.Node.Batch, hi.orderer.cfg.ProposalTsTolerance); err != nil {
+			hi.sendNewView()
+			return fmt.Errorf("invalid proposal from %d: %s", senderID, err.Error())
+		}
+		hi.proposalTsValid[proposal.Node.Height] = true
+	}
+
 	// TODO can a Byzantine leader make you get stuck in a future view?
 	// Update your view if necessary
 	if proposal.Node.View > hi.view {
@@ -368,9 +422,17 @@ func (hi *hotStuffInstance) handleProposal(proposal *pb.HotStuffProposal, msg *p
 		return fmt.Errorf("proposal from %d contains in requests from invalid bucket: %s", senderID, err.Error())
 	}
 
+	// Check that proposal does not contain requests that must not be committed at this sequence number
+	if err := batch.CheckExpired(sn); err != nil {
+		return fmt.Errorf("proposal %d from %d contains expired requests: %s", sn, senderID, err.Error())
+	}
+
 	hi.vheight = proposal.Node.Height
 
 	new := hi.newNode(hi.nodes[proposal.Node.Certificate.Height], batch, proposal.Node.Certificate, sn, proposal.Node.Height, senderID)
+	new.node.Batch.Evidence = proposal.Node.Batch.Evidence
+	new.node.Batch.ProposalTs = proposal.Node.Batch.ProposalTs
+	new.digest = hotStuffDigest(new.node)
 	batch.MarkInFlight()
 
 	// Update to own log
@@ -404,7 +466,7 @@ func (hi *hotStuffInstance) handleProposal(proposal *pb.HotStuffProposal, msg *p
 
 	decided := new.parent.parent.parent
 	if !decided.announced {
-		hi.announce(decided, hi.height2sn[decided.height], decided.batch.Message(), decided.digest, decided.node.Aborted)
+		hi.announce(decided, hi.height2sn[decided.height], decided.node.Batch, decided.digest, decided.node.Aborted)
 	}
 
 	// Return to serializer the proposal with the next height to be voted.
@@ -956,6 +1018,7 @@ func (hi *hotStuffInstance) startView(view int32) {
 	}
 
 	tracing.MainTrace.Event(tracing.VIEW_CHANGE, int64(hi.segment.SegID()), int64(hi.view))
+	metrics.ViewChanges.Inc()
 
 	hi.view = view
 
@@ -21,6 +21,7 @@ import (
     "github.com/Hanzheng2021/Orthrus/membership"
 	logger "github.com/rs/zerolog/log"
 	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/evidence"
 	"github.com/Hanzheng2021/Orthrus/log"
 	"github.com/Hanzheng2021/Orthrus/manager"
 	pb "github.com/Hanzheng2021/Orthrus/protobufs"
@@ -34,6 +35,7 @@ type HotStuffOrderer struct {
 	backlog           backlog                   // map[int32]chan*ordererMsg
 	last              int32                     // Some sequence number we can ignore backlogMsgs above
 	lock              sync.Mutex
+	cfg               *config.Configuration // Configuration of the orderer.
 }
 
 type hotStuffDispatcher struct {
@@ -108,7 +110,16 @@ func (ho *HotStuffOrderer) HandleEntry(entry *log.Entry) {
 	})
 }
 
+// Creates a new HotStuffOrderer with the given configuration.
+// The configuration is mandatory: Init panics on an orderer created without one (e.g. &HotStuffOrderer{}).
+func NewHotStuffOrderer(cfg *config.Configuration) *HotStuffOrderer {
+	return &HotStuffOrderer{cfg: cfg}
+}
+
 func (ho *HotStuffOrderer) Init(mngr manager.Manager) {
+	if ho.cfg == nil {
+		panic("HotStuffOrderer initialized without a configuration.")
+	}
 	ho.segmentChan = mngr.SubscribeOrderer()
 	ho.backlog = newBacklog()
 	ho.lock = sync.Mutex{}
@@ -171,9 +182,10 @@ func (ho *HotStuffOrderer) killSegment(seg manager.Segment) {
 	}
 	ho.lock.Unlock()
 
-	epochLength := int32(config.Config.EpochLength)
+	epochLength := int32(ho.cfg.EpochLength)
 	if seg.LastSN()%epochLength == epochLength-1 {
 		ho.backlog.gc <- seg.LastSN()
+		evidence.Prune(seg.LastSN())
 	}
 
 	// We just need any entry from this segment
@@ -19,15 +19,18 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Hanzheng2021/Orthrus/announcer"
-	"github.com/Hanzheng2021/Orthrus/config"
 	"github.com/Hanzheng2021/Orthrus/crypto"
+	"github.com/Hanzheng2021/Orthrus/dissemination"
+	"github.com/Hanzheng2021/Orthrus/evidence"
 	"github.com/Hanzheng2021/Orthrus/log"
 	"github.com/Hanzheng2021/Orthrus/manager"
 	"github.com/Hanzheng2021/Orthrus/membership"
 	"github.com/Hanzheng2021/Orthrus/messenger"
+	"github.com/Hanzheng2021/Orthrus/metrics"
 	pb "github.com/Hanzheng2021/Orthrus/protobufs"
 	"github.com/Hanzheng2021/Orthrus/request"
 	"github.com/Hanzheng2021/Orthrus/statetransfer"
@@ -44,8 +47,6 @@ const (
 var (
 	// Store the htn msg from all instances
 	lock sync.Mutex
-	// The byzantine delay time
-	byzantineDelay = -1
 )
 
 // TODO: Consolidate the segment-internal and the global checkpoints.
@@ -69,6 +70,7 @@ type pbftInstance struct {
 	priority          *ordererChannel                // Channel of priority messages
 	cutBatch          chan struct{}                  // Channel for synchronizing batch cutting
 	stopProp          sync.Once
+	disseminator      *dissemination.Disseminator // Disseminates batches ahead of proposing them. Nil if not leading or disabled.
 	//	next              int // The index  of the next to be proposed SN
 	// Ladon
 	startTs              int64 // Timestamp of the start of the instance. Used for estimating duration of segment.
@@ -95,6 +97,7 @@ type pbftBatch struct {
 	preprepared     bool        // Is true if proposal (preprepare) received
 	prepared        bool        // Is true if 2f unique prepare messages and a matching proposal received
 	committed       bool        // Is true if 2f+1 unique commit messages and a matching proposal received
+	proposalTsValid bool        // Is true if the proposal timestamp has been checked on reception of the preprepare
 	viewChangeTimer *time.Timer // Timer to start a view change
 }
 
@@ -223,6 +226,24 @@ func (pi *pbftInstance) init(seg manager.Segment, orderer *PbftOrderer) {
 	pi.height = 0
 }
 
+// Returns a snapshot of the state of the instance, for introspection.
+// Can be called concurrently with the running instance.
+func (pi *pbftInstance) status() *pb.InstanceStatus {
+	firstUncommitSn := make(map[int32]int32)
+	lock.Lock()
+	for leader, sn := range pi.firstUncommitSn {
+		firstUncommitSn[leader] = sn
+	}
+	lock.Unlock()
+
+	return &pb.InstanceStatus{
+		SegId:           int32(pi.segment.SegID()),
+		View:            atomic.LoadInt32(&pi.view),
+		LastProposeSn:   atomic.LoadInt32(&pi.lastProposeSn),
+		FirstUncommitSn: firstUncommitSn,
+	}
+}
+
 func (pi *pbftInstance) lead() {
 
 	logger.Info().
@@ -234,16 +255,11 @@ func (pi *pbftInstance) lead() {
 	batchSize := pi.segment.BatchSize()
 
 	// Simulate a straggler.
-	if membership.SimulatedStraggler[membership.OwnID] == 1 && (config.Config.CrashTiming == "Straggler" || config.Config.CrashTiming == "ByzantineStraggler") {
-		if byzantineDelay == -1 {
-			byzantineDelay = 10 * config.Config.BatchTimeoutMs
-		}
-		config.Config.BatchTimeoutMs = byzantineDelay
-		config.Config.BatchTimeout = time.Duration(config.Config.BatchTimeoutMs) * time.Millisecond
-		logger.Info().Str("byzantine", config.Config.CrashTiming).Int("batchTimeout", config.Config.BatchTimeoutMs).Msg("byzantine effected !")
+	// The orderer's batch timeout is already prolonged for a simulated straggler (see PbftOrderer.Init).
+	if membership.SimulatedStraggler[membership.OwnID] == 1 && (pi.orderer.cfg.CrashTiming == "Straggler" || pi.orderer.cfg.CrashTiming == "ByzantineStraggler") {
 		// we set the batchsize to an infinate practically size, so that we always wait for the timeout
 		batchSize = 1000000000
-		logger.Info().Str("crashTiming", config.Config.CrashTiming).Int("batchTimeout", config.Config.BatchTimeoutMs).Msg("Simulating Straggler.")
+		logger.Info().Str("crashTiming", pi.orderer.cfg.CrashTiming).Int64("batchTimeout", pi.orderer.batchTimeout.Milliseconds()).Msg("Simulating Straggler.")
 	}
 
 	// Send a proposal for each sequence number in the Segment.
@@ -263,9 +279,14 @@ func (pi *pbftInstance) lead() {
 		// However, as we know that the batch is ready (by having waited here), we will set the timeout of the actual
 		// batch cutting to 0. The signatures still need to be verified though, but the configuration option of early
 		// request verification should alleviate this problem.
+		// With batch dissemination, the batches have already been cut and we wait for them to be certified.
 		start := time.Now()
 		logger.Debug().Int("batchSize", pi.segment.BatchSize()).Msg("Waiting for batch.")
-		pi.segment.Buckets().WaitForRequests(batchSize, config.Config.BatchTimeout)
+		if pi.disseminator != nil {
+			pi.disseminator.WaitForCertified(pi.orderer.batchTimeout)
+		} else {
+			pi.segment.Buckets().WaitForRequests(batchSize, pi.orderer.batchTimeout)
+		}
 		logger.Debug().Int("batchSize", pi.segment.BatchSize()).Msg("Batch ready.")
 		waitTime := time.Since(start)
 		logger.Info().Int32("sn", sn).Int64("waitTime", waitTime.Milliseconds()).Msg("Finish waiting, batch ready.")
@@ -324,7 +345,7 @@ func (pi *pbftInstance) lead() {
 
 		//Ladon
 		//replcace its own htn before propose, make htn possibly higher
-		if config.Config.CrashTiming != "ByzantineStraggler" {
+		if pi.orderer.cfg.CrashTiming != "ByzantineStraggler" {
 			lock.Lock()
 			pi.htnLog[membership.OwnID] = membership.GetHtn()
 			lock.Unlock()
@@ -341,7 +362,7 @@ func (pi *pbftInstance) lead() {
 
 		//Ladon
 
-		if membership.SimulatedStraggler[membership.OwnID] == 1 && (config.Config.CrashTiming == "ByzantineStraggler") && len(newSeqMsg.Tnlog) > membership.Quorum() {
+		if membership.SimulatedStraggler[membership.OwnID] == 1 && (pi.orderer.cfg.CrashTiming == "ByzantineStraggler") && len(newSeqMsg.Tnlog) > membership.Quorum() {
 			// drop some high ranks(tn)
 			//sort.Ints(newSeqMsg.Tnlog)
 			//logger.Info().Msg("drop some high ranks")
@@ -392,7 +413,8 @@ func (pi *pbftInstance) lead() {
 		}
 
 		// Update related information for next proposal
-		pi.lastProposeSn = msg.Sn
+		// (Stored atomically, as it is also read by status().)
+		atomic.StoreInt32(&pi.lastProposeSn, msg.Sn)
 		// lock.Lock()
 		// for key, _ := range pi.htnLog {
 		// 	pi.htnLog[key] = -1
@@ -418,20 +440,20 @@ func (pi *pbftInstance) proposeSN(preprepare *pb.PbftPreprepare, sn int32) {
 		logger.Info().
 			Int32("pi.segment.FirstSN()", pi.segment.FirstSN()).
 			Int32("pi.segment.LastSN()", pi.segment.LastSN()).
-			Int("EpochLength", config.Config.EpochLength).
+			Int("EpochLength", pi.orderer.cfg.EpochLength).
 			Int32("membership.OwnID", membership.OwnID).
 			Int32("sn", sn).
 			Msg("Info display.")
-		if pi.segment.FirstSN() >= int32(config.Config.EpochLength) && pi.segment.LastSN() < int32(config.Config.EpochLength)*2 {
+		if pi.segment.FirstSN() >= int32(pi.orderer.cfg.EpochLength) && pi.segment.LastSN() < int32(pi.orderer.cfg.EpochLength)*2 {
 			// if pi.segment.FirstSN() < int32(membership.NumNodes()) {
 
-			if (config.Config.CrashTiming == "EpochStart" && sn%int32(membership.NumNodes()) == int32(pi.segment.SegID()%membership.NumNodes()) && !messenger.Crashed) ||
-				(config.Config.CrashTiming == "EpochEnd" && sn == pi.segment.LastSN()) {
+			if (pi.orderer.cfg.CrashTiming == "EpochStart" && sn%int32(membership.NumNodes()) == int32(pi.segment.SegID()%membership.NumNodes()) && !messenger.Crashed) ||
+				(pi.orderer.cfg.CrashTiming == "EpochEnd" && sn == pi.segment.LastSN()) {
 
-				logger.Info().Str("crashTiming", config.Config.CrashTiming).Msg("Simulating node crash.")
+				logger.Info().Str("crashTiming", pi.orderer.cfg.CrashTiming).Msg("Simulating node crash.")
 				messenger.Crashed = true
 				go func() {
-					time.Sleep(time.Duration(0.9*float64(config.Config.ViewChangeTimeoutMs)) * time.Millisecond)
+					time.Sleep(time.Duration(0.9*float64(pi.orderer.cfg.ViewChangeTimeoutMs)) * time.Millisecond)
 					messenger.Crashed = false
 				}()
 			}
@@ -442,11 +464,11 @@ func (pi *pbftInstance) proposeSN(preprepare *pb.PbftPreprepare, sn int32) {
 
 	// Simulate Equivocation
 	if membership.SimulatedEquivocation[membership.OwnID] == 1 &&
-		config.Config.CrashTiming == "Equivocation" &&
+		pi.orderer.cfg.CrashTiming == "Equivocation" &&
 		//pi.lastProposeSn > pi.segment.FirstSN() &&
 		pi.height == 1 &&
-		pi.segment.FirstSN() >= int32(config.Config.EpochLength) &&
-		pi.segment.LastSN() < int32(config.Config.EpochLength)*2 {
+		pi.segment.FirstSN() >= int32(pi.orderer.cfg.EpochLength) &&
+		pi.segment.LastSN() < int32(pi.orderer.cfg.EpochLength)*2 {
 		logger.Info().
 			Int32("membership.OwnID", membership.OwnID).
 			Int32("lastProposeSn", pi.lastProposeSn).
@@ -462,18 +484,28 @@ func (pi *pbftInstance) proposeSN(preprepare *pb.PbftPreprepare, sn int32) {
 
 	// Simulate a straggler.
 	batchSize := pi.segment.BatchSize()
-	if membership.SimulatedCrashes[membership.OwnID] != nil && (config.Config.CrashTiming == "Straggler" || config.Config.CrashTiming == "ByzantineStraggler") {
+	if membership.SimulatedCrashes[membership.OwnID] != nil && (pi.orderer.cfg.CrashTiming == "Straggler" || pi.orderer.cfg.CrashTiming == "ByzantineStraggler") {
 		// we cut an empty batch to maximize damage
 		batchSize = 4096
 	}
 
 	// Create the actual request batch. The timeout is 0, since the we already waited for the batch in pi.lead().
-	batch := pi.segment.Buckets().CutBatch(batchSize, 0)
+	// With batch dissemination, the batch consists of the certified batches disseminated so far.
+	var batch *request.Batch
+	var certs []*pb.AvailabilityCertificate
+	// Never propose requests that expire before sn, as the followers would reject the proposal.
+	if pi.disseminator != nil {
+		batch, certs = pi.disseminator.CutCertified(sn)
+	} else {
+		batch = pi.segment.Buckets().CutBatch(batchSize, 0)
+		batch.DropExpired(sn)
+	}
 
 	// Notify batch cutting goroutine that it can start waiting for the next batch.
 	pi.cutBatch <- struct{}{}
 
-	if config.Config.SignRequests {
+	// The Disseminator verifies the signatures when cutting the batches.
+	if pi.orderer.cfg.SignRequests && pi.disseminator == nil {
 		// TODO: Do something useful with the result of signature verification
 		if err := batch.CheckSignatures(); err != nil {
 			logger.Error().Msg("Signature verification of request in freshly cut batch failed.")
@@ -481,6 +513,11 @@ func (pi *pbftInstance) proposeSN(preprepare *pb.PbftPreprepare, sn int32) {
 	}
 	batch.MarkInFlight()
 	preprepare.Batch = batch.Message()
+	preprepare.Batch.Certificates = certs
+
+	// Piggyback evidence of misbehavior that has not yet been committed and set the proposal timestamp.
+	preprepare.Batch.Evidence = evidence.Pending()
+	preprepare.Batch.ProposalTs = time.Now().UnixNano()
 
 	// This is technically not necessary, as new batches are only proposed in view 0
 	preprepare.View = pi.view
@@ -497,6 +534,11 @@ func (pi *pbftInstance) proposeSN(preprepare *pb.PbftPreprepare, sn int32) {
 	// Add message to own log
 	pi.height++
 	digest := pbftDigest(preprepare)
+	sig, err := evidence.SignProposal(preprepare.View, sn, 0, digest)
+	if err != nil {
+		logger.Error().Err(err).Int32("sn", sn).Msg("Failed to sign PREPREPARE.")
+	}
+	preprepare.Signature = sig
 	pi.batches[pi.view][sn].digest = digest
 	pi.batches[pi.view][sn].preprepareMsg = preprepare
 	pi.batches[pi.view][sn].batch = batch
@@ -507,17 +549,20 @@ func (pi *pbftInstance) proposeSN(preprepare *pb.PbftPreprepare, sn int32) {
 	// The timestamp is not part of the digest.
 	preprepare.Ts = time.Now().UnixNano()
 
+	// The leader keeps the requests in its own copy of the preprepare, but only sends the certificates.
 	msg := &pb.ProtocolMessage{
 		SenderId: membership.OwnID,
 		Sn:       sn,
 		Msg: &pb.ProtocolMessage_Preprepare{
-			Preprepare: preprepare,
+			Preprepare: withoutDisseminatedRequests(preprepare),
 		},
 	}
 	for _, req := range batch.Requests {
 		logger.Debug().Int32("clientId", req.Msg.RequestId.ClientId).Int32("clientSn", req.Msg.RequestId.ClientSn).Int32("sn", sn).Msg("propose a transaction.")
 	}
 	tracing.MainTrace.Event(tracing.PROPOSE, int64(sn), int64(len(batch.Requests)))
+	tracing.BatchStage(preprepare.Batch.Requests, tracing.StagePropose, sn)
+	metrics.RequestsProposed.Add(len(batch.Requests))
 	// trace request id.
 	if len(batch.Requests) > 0 {
 		go func() {
@@ -527,14 +572,52 @@ func (pi *pbftInstance) proposeSN(preprepare *pb.PbftPreprepare, sn int32) {
 		}()
 	}
 
+	// A simulated equivocating leader sends a conflicting (empty) proposal to every other follower.
+	equivocationMsg := msg
+	if preprepare.EquFlag {
+		equivocationMsg = pi.conflictingPreprepare(preprepare)
+	}
+
 	// Enqueue the message for all followers
-	for _, nodeID := range pi.segment.Followers() {
+	for i, nodeID := range pi.segment.Followers() {
 		if nodeID != membership.OwnID {
-			messenger.EnqueuePriorityMsg(msg, nodeID)
+			if i%2 == 1 {
+				messenger.EnqueuePriorityMsg(equivocationMsg, nodeID)
+			} else {
+				messenger.EnqueuePriorityMsg(msg, nodeID)
+			}
 		}
 	}
 }
 
+// Creates a validly signed preprepare message with an empty batch that conflicts with the given preprepare.
+// Only used to simulate an equivocating leader.
+func (pi *pbftInstance) conflictingPreprepare(preprepare *pb.PbftPreprepare) *pb.ProtocolMessage {
+	conflicting := &pb.PbftPreprepare{
+		Sn:      preprepare.Sn,
+		View:    preprepare.View,
+		Leader:  preprepare.Leader,
+		Batch:   &pb.Batch{Requests: []*pb.ClientRequest{}},
+		Ts:      preprepare.Ts,
+		Tn:      preprepare.Tn,
+		Tnlog:   preprepare.Tnlog,
+		EquFlag: true,
+	}
+	sig, err := evidence.SignProposal(conflicting.View, conflicting.Sn, 0, pbftDigest(conflicting))
+	if err != nil {
+		logger.Error().Err(err).Int32("sn", conflicting.Sn).Msg("Failed to sign conflicting PREPREPARE.")
+	}
+	conflicting.Signature = sig
+
+	return &pb.ProtocolMessage{
+		SenderId: membership.OwnID,
+		Sn:       conflicting.Sn,
+		Msg: &pb.ProtocolMessage_Preprepare{
+			Preprepare: conflicting,
+		},
+	}
+}
+
 func (pi *pbftInstance) handlePreprepare(preprepare *pb.PbftPreprepare, msg *pb.ProtocolMessage) error {
 	// start := time.Now()
 
@@ -587,18 +670,75 @@ func (pi *pbftInstance) handlePreprepare(preprepare *pb.PbftPreprepare, msg *pb.
 		logger.Error().Msg("Ignoring PREPREPARE message. Batch already committed.")
 		return nil
 	}
+
+	// Check the leader's signature on the proposal and whether the proposal conflicts with another proposal
+	// of the same leader observed for the same sequence number and view (either directly or through a prepare message).
+	digest := pbftDigest(preprepare)
+	signedProposal := &pb.SignedProposal{
+		Leader:    preprepare.Leader,
+		View:      preprepare.View,
+		Sn:        sn,
+		Digest:    digest,
+		Signature: preprepare.Signature,
+	}
+	if err := evidence.CheckProposal(signedProposal); err != nil {
+		pi.sendViewChange()
+		return fmt.Errorf("invalid proposal from %d: %s", senderID, err.Error())
+	}
+	if ev := evidence.Observe(signedProposal); ev != nil {
+		pi.sendViewChange()
+		return fmt.Errorf("leader %d equivocated for sn %d", senderID, sn)
+	}
+	// Check that the evidence of misbehavior attached to the proposal is valid
+	for _, ev := range preprepare.Batch.Evidence {
+		if err := evidence.Verify(ev); err != nil {
+			pi.sendViewChange()
+			return fmt.Errorf("proposal from %d contains invalid evidence: %s", senderID, err.Error())
+		}
+	}
+
 	// Check that no other batch is preprepared for the same sequence number in this view
 	if batch.preprepareMsg != nil {
 		pi.sendViewChange()
 		return fmt.Errorf("duplicate preprepare from %d for sn %d", senderID, sn)
 	}
 
+	// Check the timestamp of fresh proposals (only made in view 0) on first reception.
+	// A preprepare handled again after fetching missing batch bodies is not checked again.
+	if preprepare.View == 0 && !batch.proposalTsValid {
+		if err := checkProposalTs(preprepare.Batch, pi.orderer.cfg.ProposalTsTolerance); err != nil {
+			pi.sendViewChange()
+			return fmt.Errorf("invalid proposal from %d: %s", senderID, err.Error())
+		}
+		batch.proposalTsValid = true
+	}
+
 	// logger.Info().
 	// 	Int32("sn", sn).
 	// 	Int64("costTime", time.Since(start).Milliseconds()).
 	// 	Msg("handlepreprepare 1")
 	// start = time.Now()
 
+	// If the leader only proposed certificates of disseminated batches, fill in the requests from the batch bodies.
+	// If some bodies are missing, they are fetched and the preprepare is handled again once they arrive.
+	if len(preprepare.Batch.Certificates) > 0 {
+		for _, cert := range preprepare.Batch.Certificates {
+			if err := dissemination.VerifyCertificate(cert); err != nil {
+				pi.sendViewChange()
+				return fmt.Errorf("proposal from %d contains invalid certificate: %s", senderID, err.Error())
+			}
+		}
+		requests, ok := dissemination.Resolve(preprepare.Batch.Certificates, func() { pi.serializer.serialize(msg) })
+		if !ok {
+			logger.Info().Int32("sn", sn).
+				Int32("senderID", senderID).
+				Int("nCerts", len(preprepare.Batch.Certificates)).
+				Msg("Waiting for disseminated batch bodies.")
+			return nil
+		}
+		preprepare.Batch.Requests = requests
+	}
+
 	// Check that proposal requests are valid
 	batch.batch = request.NewBatch(preprepare.Batch)
 
@@ -608,12 +748,6 @@ func (pi *pbftInstance) handlePreprepare(preprepare *pb.PbftPreprepare, msg *pb.
 	// 	Msg("handlepreprepare 2")
 	// start = time.Now()
 
-	if config.Config.CrashTiming == "Equivocation" && membership.SimulatedEquivocation[senderID] == 1 && preprepare.EquFlag && sn >= int32(config.Config.EpochLength) && sn < int32(config.Config.EpochLength)*2 { //Equivocation
-		pi.sendViewChange()
-		logger.Info().Msg("Detect Equivocation...")
-		return fmt.Errorf("malformed message: leader %d Equivocation", senderID)
-	}
-
 	if batch.batch == nil {
 		logger.Error().Int32("peerId", senderID).Int32("sn", sn).Msg("Invalid requests in proposal.")
 		pi.sendViewChange()
@@ -627,6 +761,10 @@ func (pi *pbftInstance) handlePreprepare(preprepare *pb.PbftPreprepare, msg *pb.
 	if err := batch.batch.CheckBucket(pi.segment.Buckets().GetBucketIDs()); err != nil {
 		return fmt.Errorf("proposal from %d contains in requests from invalid bucket: %s", senderID, err.Error())
 	}
+	// Check that proposal does not contain requests that must not be committed at this sequence number
+	if err := batch.batch.CheckExpired(sn); err != nil {
+		return fmt.Errorf("proposal from %d contains expired requests: %s", senderID, err.Error())
+	}
 	// Mark requests as preprepared
 	batch.batch.MarkInFlight()
 
@@ -637,10 +775,10 @@ func (pi *pbftInstance) handlePreprepare(preprepare *pb.PbftPreprepare, msg *pb.
 	// start = time.Now()
 
 	// Create new batch
-	digest := pbftDigest(preprepare)
 	batch.digest = digest
 	batch.preprepareMsg = preprepare
 	batch.preprepared = true
+	tracing.BatchStage(preprepare.Batch.Requests, tracing.StagePreprepare, sn)
 
 	// logger.Info().
 	// 	Int32("sn", sn).
@@ -658,6 +796,7 @@ func (pi *pbftInstance) handlePreprepare(preprepare *pb.PbftPreprepare, msg *pb.
 
 	if !batch.prepared && isPrepared(batch) {
 		batch.prepared = true
+		tracing.BatchStage(batch.preprepareMsg.Batch.Requests, tracing.StagePrepare, batch.preprepareMsg.Sn)
 		// Ladon
 		pi.sendHtnMsg(batch.preprepareMsg.Sn, batch.preprepareMsg.Tn, batch.preprepareMsg.Leader)
 		// Ladon
@@ -708,9 +847,10 @@ func (pi *pbftInstance) sendPrepare(batch *pbftBatch) {
 
 	// Create message
 	prepare := &pb.PbftPrepare{
-		Sn:     batch.preprepareMsg.Sn,
-		View:   pi.view,
-		Digest: batch.digest,
+		Sn:        batch.preprepareMsg.Sn,
+		View:      pi.view,
+		Digest:    batch.digest,
+		LeaderSig: batch.preprepareMsg.Signature,
 	}
 
 	msg := &pb.ProtocolMessage{
@@ -727,7 +867,7 @@ func (pi *pbftInstance) sendPrepare(batch *pbftBatch) {
 	// Simulate a straggler.
 	// if membership.SimulatedStraggler[membership.OwnID] == 1 {
 	if membership.SimulatedStraggler[membership.OwnID] == 1 &&
-		config.Config.CrashTiming == "SilentStraggler" {
+		pi.orderer.cfg.CrashTiming == "SilentStraggler" {
 		logger.Debug().Msg("Skipping sendPrepare...")
 		return
 	}
@@ -769,13 +909,13 @@ func (pi *pbftInstance) handlePrepare(prepare *pb.PbftPrepare, msg *pb.ProtocolM
 
 	batch := pi.batches[pi.view][sn]
 
-	// if config.Config.CrashTiming == "Equivocation" && senderID == 1 && len(batch.prepareMsgs) > membership.Faults() { //Equivocation
+	// if pi.orderer.cfg.CrashTiming == "Equivocation" && senderID == 1 && len(batch.prepareMsgs) > membership.Faults() { //Equivocation
 	// 	pi.sendViewChange()
 	// 	logger.Info().Msg("Detect Equivocation...")
 	// 	return fmt.Errorf("malformed message: leader %d Equivocation", senderID)
 	// }
 
-	// if config.Config.CrashTiming == "Equivocation" && membership.SimulatedEquivocation[batch.preprepareMsg.Leader] == 1 && sn >= int32(config.Config.EpochLength) && sn < int32(config.Config.EpochLength)*2 { //Equivocation
+	// if pi.orderer.cfg.CrashTiming == "Equivocation" && membership.SimulatedEquivocation[batch.preprepareMsg.Leader] == 1 && sn >= int32(pi.orderer.cfg.EpochLength) && sn < int32(pi.orderer.cfg.EpochLength)*2 { //Equivocation
 	// 	if len(batch.prepareMsgs) == membership.Faults() + 1 {
 	// 		pi.sendViewChange()
 	// 		logger.Info().Msg("Detect Equivocation...")
@@ -786,6 +926,23 @@ func (pi *pbftInstance) handlePrepare(prepare *pb.PbftPrepare, msg *pb.ProtocolM
 	// 	}
 	// }
 
+	// The leader's signature echoed in the prepare message allows detecting a leader that sent
+	// different proposals to different followers.
+	if len(prepare.LeaderSig) > 0 {
+		leader := segmentLeader(pi.segment, prepare.View)
+		ev := evidence.Observe(&pb.SignedProposal{
+			Leader:    leader,
+			View:      prepare.View,
+			Sn:        sn,
+			Digest:    prepare.Digest,
+			Signature: prepare.LeaderSig,
+		})
+		if ev != nil {
+			pi.sendViewChange()
+			return fmt.Errorf("leader %d equivocated for sn %d", leader, sn)
+		}
+	}
+
 	if _, ok := batch.prepareMsgs[senderID]; ok {
 		return fmt.Errorf("duplicate prepare message from %d", senderID)
 	}
@@ -801,6 +958,7 @@ func (pi *pbftInstance) handlePrepare(prepare *pb.PbftPrepare, msg *pb.ProtocolM
 
 	if !batch.prepared && isPrepared(batch) {
 		batch.prepared = true
+		tracing.BatchStage(batch.preprepareMsg.Batch.Requests, tracing.StagePrepare, batch.preprepareMsg.Sn)
 		// TODO: does this order matter ?
 		// Ladon
 		pi.sendHtnMsg(batch.preprepareMsg.Sn, batch.preprepareMsg.Tn, batch.preprepareMsg.Leader)
@@ -863,7 +1021,7 @@ func (pi *pbftInstance) sendCommit(batch *pbftBatch) {
 	// Simulate a straggler.
 	// if membership.SimulatedStraggler[membership.OwnID] == 1 {
 	if membership.SimulatedStraggler[membership.OwnID] == 1 &&
-		config.Config.CrashTiming == "SilentStraggler" {
+		pi.orderer.cfg.CrashTiming == "SilentStraggler" {
 		logger.Debug().Msg("Skipping sendCommit...")
 		return
 	}
@@ -1188,6 +1346,7 @@ func (pi *pbftInstance) announce(batch *pbftBatch, sn int32, reqBatch *pb.Batch,
 	}
 	// Announce decision.
 	announcer.Announce(logEntry)
+	dissemination.Forget(reqBatch.GetCertificates())
 
 	// logger.Info().
 	// 	Int32("sn", sn).
@@ -1368,7 +1527,7 @@ func (pi *pbftInstance) catchUp() {
 }
 
 func (pi *pbftInstance) sendViewChange() {
-	if config.Config.DisabledViewChange {
+	if pi.orderer.cfg.DisabledViewChange {
 		tracing.MainTrace.Stop()
 		logger.Fatal().Int("segID", pi.segment.SegID()).Msg("VIEWCHANGE disabled, peer exits.")
 	}
@@ -2430,6 +2589,30 @@ func (pi *pbftInstance) handleMessage(msg *pb.ProtocolMessage) {
 
 }
 
+// Returns a copy of a preprepare that contains the certificates of disseminated batches, but not their requests.
+// Returns the preprepare itself if it does not contain certificates.
+func withoutDisseminatedRequests(preprepare *pb.PbftPreprepare) *pb.PbftPreprepare {
+	if len(preprepare.Batch.Certificates) == 0 {
+		return preprepare
+	}
+	return &pb.PbftPreprepare{
+		Sn:     preprepare.Sn,
+		View:   preprepare.View,
+		Leader: preprepare.Leader,
+		Batch: &pb.Batch{
+			Evidence:     preprepare.Batch.Evidence,
+			ProposalTs:   preprepare.Batch.ProposalTs,
+			Certificates: preprepare.Batch.Certificates,
+		},
+		Aborted:   preprepare.Aborted,
+		Ts:        preprepare.Ts,
+		Tn:        preprepare.Tn,
+		Tnlog:     preprepare.Tnlog,
+		EquFlag:   preprepare.EquFlag,
+		Signature: preprepare.Signature,
+	}
+}
+
 func pbftDigest(preprepare *pb.PbftPreprepare) []byte {
 	// TODO: Add the "aborted" and potentially other flags to the digest.
 
@@ -2568,13 +2751,13 @@ func (pi *pbftInstance) startView(view int32) {
 	}
 
 	lastView := pi.view
-	pi.view = view
+	atomic.StoreInt32(&pi.view, view) // Also read by status().
 
 	// Set the viewchange timeout for this view.
 	// (1<<pi.view) = 2 to the power of pi.view (2^pi.view).
 	// I.e, in view one, the timeout will be double ViewchangeTimeout*(2^1),
 	// in view two, it will be ViewChangeTimeout*(2^2), etc.
-	pi.viewChangeTimeout = config.Config.ViewChangeTimeout * (1 << uint(pi.view))
+	pi.viewChangeTimeout = pi.orderer.cfg.ViewChangeTimeout * (1 << uint(pi.view))
 
 	logger.Info().
 		Int32("view", pi.view).
@@ -2584,6 +2767,7 @@ func (pi *pbftInstance) startView(view int32) {
 
 	// In ISS, we only propose fresh batches in view 0
 	if view > 0 {
+		metrics.ViewChanges.Inc()
 		pi.stopProposing()
 	}
 
@@ -2601,8 +2785,8 @@ func (pi *pbftInstance) startView(view int32) {
 			// If we have a median commitTime from previous epochs
 			// Set an adaptive timeout for each batch
 			if pi.orderer.commitTime != 0 {
-				pi.setViewChangeTimer(sn, time.Duration(i)*config.Config.BatchTimeout+pi.orderer.commitTime)
-				logger.Info().Int64("initial", int64(config.Config.BatchTimeout)).Int64("advanced", int64(time.Duration(i)*config.Config.BatchTimeout+pi.orderer.commitTime)).Msg("Advanced timeout")
+				pi.setViewChangeTimer(sn, time.Duration(i)*pi.orderer.batchTimeout+pi.orderer.commitTime)
+				logger.Info().Int64("initial", int64(pi.orderer.batchTimeout)).Int64("advanced", int64(time.Duration(i)*pi.orderer.batchTimeout+pi.orderer.commitTime)).Msg("Advanced timeout")
 			}
 
 			// Except for at initialization, carry over state from the previous view.
@@ -2648,5 +2832,8 @@ func (pi *pbftInstance) startView(view int32) {
 func (pi *pbftInstance) stopProposing() {
 	pi.stopProp.Do(func() {
 		close(pi.cutBatch)
+		if pi.disseminator != nil {
+			pi.disseminator.Stop()
+		}
 	})
 }
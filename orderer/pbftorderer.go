@@ -20,6 +20,9 @@ import (
 	"time"
 
 	logger "github.com/rs/zerolog/log"
+	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/dissemination"
+	"github.com/Hanzheng2021/Orthrus/evidence"
 	"github.com/Hanzheng2021/Orthrus/log"
 	"github.com/Hanzheng2021/Orthrus/manager"
 	"github.com/Hanzheng2021/Orthrus/membership"
@@ -29,12 +32,14 @@ import (
 
 // Represents a PBFT Orderer implementation.
 type PbftOrderer struct {
-	segmentChan chan manager.Segment // Channel to which the Manager pushes new Segments.
-	dispatcher  pbftDispatcher       // map[int32]*pbftInstance
-	backlog     backlog              // map[int32]chan*ordererMsg
-	last        int32                // Some sequence number we can ignere messages above
-	commitTime  time.Duration		 // Median commit duration
-	lock        sync.Mutex
+	segmentChan  chan manager.Segment // Channel to which the Manager pushes new Segments.
+	dispatcher   pbftDispatcher       // map[int32]*pbftInstance
+	backlog      backlog              // map[int32]chan*ordererMsg
+	last         int32                // Some sequence number we can ignere messages above
+	commitTime   time.Duration        // Median commit duration
+	lock         sync.Mutex
+	cfg          *config.Configuration // Configuration of the orderer.
+	batchTimeout time.Duration         // Batch timeout used when leading. Longer than configured for simulated stragglers.
 }
 
 type pbftDispatcher struct {
@@ -56,6 +61,20 @@ func (d *pbftDispatcher) delete(key int32) {
 	d.mm.Delete(key)
 }
 
+// Returns all the instances, each once, even though an instance is stored under all sequence numbers of its segment.
+func (d *pbftDispatcher) instances() []*pbftInstance {
+	seen := make(map[*pbftInstance]bool)
+	instances := make([]*pbftInstance, 0)
+	d.mm.Range(func(key, value interface{}) bool {
+		if pi := value.(*pbftInstance); !seen[pi] {
+			seen[pi] = true
+			instances = append(instances, pi)
+		}
+		return true
+	})
+	return instances
+}
+
 // HandleMessage is called by the messenger each time an Orderer-issued message is received over the network.
 func (po *PbftOrderer) HandleMessage(msg *pb.ProtocolMessage) {
 	//logger.Trace().
@@ -139,12 +158,28 @@ func (po *PbftOrderer) HandleEntry(entry *log.Entry) {
 	})
 }
 
+// Creates a new PbftOrderer with the given configuration.
+// The configuration is mandatory: Init panics on an orderer created without one (e.g. &PbftOrderer{}).
+func NewPbftOrderer(cfg *config.Configuration) *PbftOrderer {
+	return &PbftOrderer{cfg: cfg}
+}
+
 // Initializes the PbftOrderer.
 // Subscribes to new segments issued by the Manager and allocates internal buffers and data structures.
 func (po *PbftOrderer) Init(mngr manager.Manager) {
+	if po.cfg == nil {
+		panic("PbftOrderer initialized without a configuration.")
+	}
 	po.segmentChan = mngr.SubscribeOrderer()
 	po.backlog = newBacklog()
 	po.last = -1
+
+	// A simulated straggler delays its proposals by waiting 10 times longer for its batches.
+	po.batchTimeout = po.cfg.BatchTimeout
+	if membership.SimulatedStraggler[membership.OwnID] == 1 &&
+		(po.cfg.CrashTiming == "Straggler" || po.cfg.CrashTiming == "ByzantineStraggler") {
+		po.batchTimeout = 10 * po.cfg.BatchTimeout
+	}
 }
 
 // Starts the PbftOrderer. Listens on the channel where the Manager issues new Segemnts and starts a goroutine to
@@ -194,6 +229,10 @@ func (po *PbftOrderer) runSegment(seg manager.Segment) {
 	pi.subscribeToBacklog()
 
 	if isLeading(seg, membership.OwnID, pi.view) {
+		if po.cfg.Dissemination {
+			pi.disseminator = dissemination.NewDisseminator(seg.Buckets(), seg.BatchSize(), seg.Followers(), po.cfg)
+			go pi.disseminator.Run()
+		}
 		go pi.lead()
 	}
 	go pi.processSerializedMessages()
@@ -221,6 +260,7 @@ func (po *PbftOrderer) killSegment(seg manager.Segment) {
 	// This is only possible because of the existence of the stable checkpoint.
 	// Otherwise other segments could be affected, as the sequence numbers interleave.
 	po.backlog.gc <- seg.LastSN()
+	evidence.Prune(seg.LastSN())
 
 	// We just need any entry from this segment
 	pi, ok := po.dispatcher.load(seg.LastSN())
@@ -247,6 +287,19 @@ func (po *PbftOrderer) killSegment(seg manager.Segment) {
 	}
 }
 
+// Returns the state of all running instances, ordered by segment ID.
+func (po *PbftOrderer) InstanceStatus() []*pb.InstanceStatus {
+	instances := po.dispatcher.instances()
+	status := make([]*pb.InstanceStatus, len(instances))
+	for i, pi := range instances {
+		status[i] = pi.status()
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].SegId < status[j].SegId
+	})
+	return status
+}
+
 func (po *PbftOrderer) Sign(data []byte) ([]byte, error) {
 	// TODO
 	return nil, nil
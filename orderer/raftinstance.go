@@ -22,11 +22,11 @@ import (
 	"math/rand"
 
 	"github.com/Hanzheng2021/Orthrus/announcer"
-	"github.com/Hanzheng2021/Orthrus/config"
 	"github.com/Hanzheng2021/Orthrus/log"
 	"github.com/Hanzheng2021/Orthrus/manager"
 	"github.com/Hanzheng2021/Orthrus/membership"
 	"github.com/Hanzheng2021/Orthrus/messenger"
+	"github.com/Hanzheng2021/Orthrus/metrics"
 	"github.com/Hanzheng2021/Orthrus/profiling"
 	pb "github.com/Hanzheng2021/Orthrus/protobufs"
 	"github.com/Hanzheng2021/Orthrus/request"
@@ -153,7 +153,7 @@ func (ri *raftInstance) init(seg manager.Segment, orderer *RaftOrderer) {
 		ri.matchIndex[id] = -1
 	}
 
-	ri.minElectionTimeout = config.Config.ViewChangeTimeout
+	ri.minElectionTimeout = ri.orderer.cfg.ViewChangeTimeout
 
 	ri.sn2index = make(map[int32]int32)
 	ri.announced = make(map[int32]bool)
@@ -190,7 +190,7 @@ func (ri *raftInstance) heartbeat() {
 			return
 		}
 		logger.Debug().Msg("Waiting for heartbeat timeout.")
-		time.Sleep(config.Config.BatchTimeout)
+		time.Sleep(ri.orderer.cfg.BatchTimeout)
 		logger.Debug().Msg("Heartbeat timeout expired.")
 		select {
 		case <-ri.stepDown:
@@ -218,13 +218,14 @@ func (ri *raftInstance) heartbeat() {
 				msg.Sn = sn
 
 				// Cut immediately a batch
-				batch := ri.segment.Buckets().CutBatch(config.Config.BatchSize, 0)
+				batch := ri.segment.Buckets().CutBatch(ri.orderer.cfg.BatchSize, 0)
+				batch.DropExpired(sn)
 				logger.Info().
 					Int32("sn", sn).
 					Int("segment", ri.segment.SegID()).
 					Int("requests", len(batch.Requests)).
 					Msg("Cutting new batch")
-				if config.Config.SignRequests {
+				if ri.orderer.cfg.SignRequests {
 					// TODO: Do something useful with the result of signature verification
 					if err := batch.CheckSignatures(); err != nil {
 						logger.Fatal().Msg("Signature verification of freshly cat Batch failed.")
@@ -449,7 +450,7 @@ func (ri *raftInstance) HandleVoteResponse(resp *pb.RaftVoteResponse, sn, sender
 
 	// Make sure you don't double count
 	if _, ok := ri.votes[senderID]; ok {
-		return fmt.Errorf("vote from %")
+		return fmt.Errorf("duplicate vote from %d", senderID)
 	}
 
 	// Record vote
@@ -507,6 +508,8 @@ func (ri *raftInstance) SendAppendEntryRequest(req *pb.RaftAppendEntryRequest, s
 			Msg("Updated leader state")
 
 		tracing.MainTrace.Event(tracing.PROPOSE, int64(sn), int64(len(req.Batch.Requests)))
+		tracing.BatchStage(req.Batch.Requests, tracing.StagePropose, sn)
+		metrics.RequestsProposed.Add(len(req.Batch.Requests))
 	}
 
 	// Enqueue new log entry and potentially uncommitted entries to each follower
@@ -854,13 +857,14 @@ func (ri *raftInstance) maybeAnnounce() {
 }
 
 func (ri *raftInstance) newTerm() {
-	if config.Config.DisabledViewChange {
+	if ri.orderer.cfg.DisabledViewChange {
 		profiling.StopProfiler()
 		tracing.MainTrace.Stop()
 		tracing.Trace2.Stop()
 		logger.Fatal().Int("segID", ri.segment.SegID()).Msg("VIEWCHANGE disabled, peer exits.")
 	}
 	tracing.MainTrace.Event(tracing.VIEW_CHANGE, int64(ri.segment.SegID()), int64(ri.term))
+	metrics.ViewChanges.Inc()
 
 	// Advance term (view) and reset vote counting
 	ri.status = candidate
@@ -32,6 +32,7 @@ type RaftOrderer struct {
 	backlog     backlog              // map[int32]chan*ordererMsg
 	last        int32                // Some sequence number we can ignore backlogMsgs above
 	lock        sync.Mutex
+	cfg         *config.Configuration // Configuration of the orderer.
 }
 
 type raftDispatcher struct {
@@ -109,10 +110,19 @@ func (ro *RaftOrderer) HandleEntry(entry *log.Entry) {
 	})
 }
 
+// Creates a new RaftOrderer with the given configuration.
+// The configuration is mandatory: Init panics on an orderer created without one (e.g. &RaftOrderer{}).
+func NewRaftOrderer(cfg *config.Configuration) *RaftOrderer {
+	return &RaftOrderer{cfg: cfg}
+}
+
 // Init initializes the Raft orderer.
 // Subscribes to new segments issued by the Manager and allocates internal buffers and data structures.
 func (ro *RaftOrderer) Init(mngr manager.Manager) {
-	if config.Config.SignRequests {
+	if ro.cfg == nil {
+		panic("RaftOrderer initialized without a configuration.")
+	}
+	if ro.cfg.SignRequests {
 		logger.Warn().Msg("Signature verification should be disabled")
 	}
 	ro.segmentChan = mngr.SubscribeOrderer()
@@ -0,0 +1,1043 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orderer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/crypto"
+	"github.com/Hanzheng2021/Orthrus/evidence"
+	"github.com/Hanzheng2021/Orthrus/log"
+	"github.com/Hanzheng2021/Orthrus/manager"
+	"github.com/Hanzheng2021/Orthrus/membership"
+	"github.com/Hanzheng2021/Orthrus/metrics"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	"github.com/Hanzheng2021/Orthrus/request"
+	"github.com/Hanzheng2021/Orthrus/tracing"
+	logger "github.com/rs/zerolog/log"
+)
+
+// Steps of a Tendermint round.
+type tendermintStep int
+
+const (
+	stepPropose tendermintStep = iota
+	stepPrevote
+	stepPrecommit
+)
+
+// Represents a Tendermint instance implementation.
+// A Tendermint instance is responsible for ordering the sequence numbers of a single segment.
+// Each sequence number corresponds to a Tendermint height and is agreed upon independently,
+// in rounds consisting of a propose, a prevote and a precommit step.
+// The proposer of round r is the r-th leader of the segment. Only the proposer of round 0 proposes fresh batches.
+// Proposers of later rounds re-propose the value prevoted by a quorum in an earlier round, if any,
+// and an aborted empty batch otherwise.
+// As in the PBFT instance, the leader orders its batches using ranks (rank-based fast ordering):
+// before each proposal, it collects the highest ranks known to a quorum of followers and proposes the next rank,
+// possibly skipping sequence numbers of the segment. The number of skipped sequence numbers is part of the proposed
+// value, so every peer deciding the value commits the same skipped sequence numbers as empty batches.
+// A skipped sequence number must not be decided otherwise. Therefore, a follower only prevotes for a value if it has
+// not voted for any sequence number the value skips, and it withholds its votes for these sequence numbers
+// until the sequence number of the value is decided (see reserved()).
+// The leader stops skipping sequence numbers as soon as any sequence number enters a round other than 0.
+type tendermintInstance struct {
+	segment    manager.Segment             // The segment of the instance
+	orderer    *TendermintOrderer          // The tendermint orderer
+	heights    map[int32]*tendermintHeight // Protocol state per sequence number
+	serializer *ordererChannel             // Channel of all messages
+	proposed   chan struct{}               // Channel for synchronizing batch cutting
+	stop       chan struct{}               // Closed when the instance stops proposing
+	stopProp   sync.Once
+	startTs    int64 // Timestamp of the start of the instance.
+
+	// Rank-based fast ordering
+	rankLock       sync.Mutex
+	rankLog        map[int32]int32 // Highest rank reported by each peer. Guarded by rankLock.
+	rankRecv       map[int32]int   // Number of rank messages received per sequence number. Guarded by rankLock.
+	readyToPropose chan struct{}   // Signals that a quorum of ranks has been collected for the last proposal.
+	lastProposeSn  int32           // Last sequence number proposed by the leader. Only accessed by lead().
+	nextFreshIdx   int             // Index (in the segment's SNs) following the last fresh proposal of the leader.
+	rankOrdering   int32           // 1 until any sequence number enters a round other than 0. Accessed atomically.
+}
+
+// A value proposed for a sequence number.
+type tendermintValue struct {
+	proposal *pb.TendermintProposal // The proposal (of the round) containing the value.
+	batch    *request.Batch         // The batch of the proposal. Nil if the proposal is invalid.
+	digest   []byte
+}
+
+// Protocol state of a single sequence number.
+type tendermintHeight struct {
+	sn                  int32
+	round               int32
+	step                tendermintStep
+	lockedRound         int32
+	lockedValue         *tendermintValue
+	validRound          int32
+	validValue          *tendermintValue
+	proposals           map[int32]*tendermintValue  // Values proposed by the proposer of each round
+	values              map[string]*tendermintValue // Valid values proposed in any round, indexed by digest
+	prevotes            map[int32]map[int32]string  // Digests prevoted per round per sender (empty string for nil)
+	precommits          map[int32]map[int32]string  // Digests precommitted per round per sender (empty string for nil)
+	prevoteTimeoutSet   map[int32]bool              // Rounds in which the prevote timeout has been scheduled
+	precommitTimeoutSet map[int32]bool              // Rounds in which the precommit timeout has been scheduled
+	validatedInRound    map[int32]bool              // Rounds in which a quorum prevoted the proposed value
+	active              bool                        // Is true if timeouts are running for this sequence number
+	timer               *time.Timer                 // Timer of the current step
+	decided             bool                        // Is true if the value for this sequence number has been committed
+	decidedDigest       string                      // Digest of the committed value
+	withheld            bool                        // Is true if an own vote has been withheld (see reserved())
+}
+
+func newTendermintHeight(sn int32) *tendermintHeight {
+	return &tendermintHeight{
+		sn:                  sn,
+		round:               0,
+		step:                stepPropose,
+		lockedRound:         -1,
+		validRound:          -1,
+		proposals:           make(map[int32]*tendermintValue),
+		values:              make(map[string]*tendermintValue),
+		prevotes:            make(map[int32]map[int32]string),
+		precommits:          make(map[int32]map[int32]string),
+		prevoteTimeoutSet:   make(map[int32]bool),
+		precommitTimeoutSet: make(map[int32]bool),
+		validatedInRound:    make(map[int32]bool),
+	}
+}
+
+// Returns true if the node has voted for this sequence number in any round.
+func (h *tendermintHeight) hasVoted(nodeID int32) bool {
+	for _, votes := range h.prevotes {
+		if _, ok := votes[nodeID]; ok {
+			return true
+		}
+	}
+	for _, votes := range h.precommits {
+		if _, ok := votes[nodeID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Initializes the Tendermint instance.
+func (ti *tendermintInstance) init(seg manager.Segment, orderer *TendermintOrderer) {
+	ti.segment = seg
+	ti.orderer = orderer
+
+	ti.heights = make(map[int32]*tendermintHeight)
+	for _, sn := range seg.SNs() {
+		ti.heights[sn] = newTendermintHeight(sn)
+	}
+
+	// Initalize channels (Needs to happen before starting any timer.)
+	ti.serializer = newOrdererChannel(channelSize)
+	ti.proposed = make(chan struct{})
+	ti.stop = make(chan struct{})
+
+	ti.startTs = time.Now().UnixNano()
+
+	// Initialize rank-based fast ordering.
+	ti.rankLog = make(map[int32]int32)
+	ti.rankRecv = make(map[int32]int)
+	for i := 0; i < membership.NumNodes(); i++ {
+		ti.rankLog[int32(i)] = ((seg.FirstSN() - int32(seg.SegID()%membership.NumNodes())) / int32(membership.NumNodes())) - 1
+	}
+	ti.readyToPropose = make(chan struct{})
+	ti.lastProposeSn = -1
+	ti.nextFreshIdx = 0
+	ti.rankOrdering = 1
+
+	// Start the timer for the first sequence number in the segment
+	ti.activate(ti.heights[seg.FirstSN()])
+}
+
+func (ti *tendermintInstance) lead() {
+	logger.Info().
+		Int32("OwnID", ti.orderer.ownID).
+		Int("segID", ti.segment.SegID()).
+		Msg("Leading segment.")
+
+	// Send a proposal for each sequence number in the Segment (unless skipped due to rank-based ordering).
+	for _, sn := range ti.segment.SNs() {
+		if sn <= ti.lastProposeSn {
+			continue
+		}
+
+		// Wait for a batch to be ready.
+		// As in the PBFT instance, the actual batch cutting happens when handling the serialized placeholder message.
+		ti.segment.Buckets().WaitForRequests(ti.segment.BatchSize(), ti.orderer.cfg.BatchTimeout)
+
+		// Wait until a quorum of followers has reported their ranks after the previous proposal.
+		// The first sequence number is proposed directly.
+		if ti.lastProposeSn != -1 {
+			select {
+			case <-ti.readyToPropose:
+			case <-ti.stop:
+				return
+			}
+		}
+
+		rank, ranks := ti.nextRank()
+		proposeSn := sn
+		if atomic.LoadInt32(&ti.rankOrdering) == 1 {
+			proposeSn = ti.rankToSn(sn, rank)
+		}
+		ti.lastProposeSn = proposeSn
+
+		logger.Debug().
+			Int32("sn", sn).
+			Int32("rank", rank).
+			Int32("proposeSn", proposeSn).
+			Msg("Ready to propose.")
+
+		ti.serializer.serialize(&pb.ProtocolMessage{
+			SenderId: ti.orderer.ownID,
+			Sn:       proposeSn,
+			Msg: &pb.ProtocolMessage_TendermintNewseqno{TendermintNewseqno: &pb.TendermintProposal{
+				Sn:    proposeSn,
+				Tn:    rank,
+				Tnlog: ranks,
+			}},
+		})
+
+		// Wait until the batch is actually cut.
+		select {
+		case <-ti.proposed:
+		case <-ti.stop:
+			return
+		}
+	}
+}
+
+// Computes the rank of the next proposal as the successor of the highest rank reported by the followers.
+// Returns the rank and the reported ranks it is based on.
+func (ti *tendermintInstance) nextRank() (int32, []int32) {
+	ti.rankLock.Lock()
+	ti.rankLog[ti.orderer.ownID] = membership.GetHtn()
+	ranks := make([]int32, 0, len(ti.rankLog))
+	for _, r := range ti.rankLog {
+		ranks = append(ranks, r)
+	}
+	ti.rankLock.Unlock()
+
+	highest := ranks[0]
+	for _, r := range ranks {
+		if r > highest {
+			highest = r
+		}
+	}
+	membership.SetHtn(highest + 1)
+	return highest + 1, ranks
+}
+
+// Returns the sequence number of the segment corresponding to a rank,
+// but never a sequence number lower than sn or higher than the last one of the segment.
+func (ti *tendermintInstance) rankToSn(sn int32, rank int32) int32 {
+	rankSn := rank*int32(membership.NumNodes()) + int32(ti.segment.SegID()%membership.NumNodes())
+	if rankSn >= ti.segment.LastSN() {
+		return ti.segment.LastSN()
+	}
+	if _, ok := ti.heights[rankSn]; !ok || rankSn < sn {
+		return sn
+	}
+	return rankSn
+}
+
+// Returns the index of a sequence number in the segment, or -1 if the segment does not contain it.
+func (ti *tendermintInstance) snIndex(sn int32) int {
+	for i, s := range ti.segment.SNs() {
+		if s == sn {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the sequence numbers of the segment skipped by a proposal.
+func (ti *tendermintInstance) skippedSNs(proposal *pb.TendermintProposal) []int32 {
+	idx := ti.snIndex(proposal.Sn)
+	if proposal.Skipped <= 0 || idx < int(proposal.Skipped) {
+		return nil
+	}
+	return ti.segment.SNs()[idx-int(proposal.Skipped) : idx]
+}
+
+// Cuts a fresh batch and proposes it in round 0 of the sequence number of the placeholder message.
+func (ti *tendermintInstance) handleNewSeqNo(placeholder *pb.TendermintProposal) {
+	defer func() {
+		select {
+		case ti.proposed <- struct{}{}:
+		case <-ti.stop:
+		}
+	}()
+
+	// The sequence numbers between the previous fresh proposal and this one are skipped.
+	skipped := 0
+	if idx := ti.snIndex(placeholder.Sn); idx >= 0 {
+		if idx > ti.nextFreshIdx {
+			skipped = idx - ti.nextFreshIdx
+		}
+		ti.nextFreshIdx = idx + 1
+	}
+
+	h, ok := ti.heights[placeholder.Sn]
+	if !ok || h.decided || h.round != 0 || h.proposals[0] != nil {
+		logger.Warn().Int32("sn", placeholder.Sn).Msg("Not proposing. Sequence number already proposed or in later round.")
+		return
+	}
+
+	// Create the actual request batch. The timeout is 0, since the we already waited for the batch in ti.lead().
+	batch := ti.segment.Buckets().CutBatch(ti.segment.BatchSize(), 0)
+	batch.DropExpired(h.sn)
+	if ti.orderer.cfg.SignRequests {
+		if err := batch.CheckSignatures(); err != nil {
+			logger.Error().Msg("Signature verification of request in freshly cut batch failed.")
+		}
+	}
+	batch.MarkInFlight()
+
+	proposal := &pb.TendermintProposal{
+		Sn:         h.sn,
+		Round:      0,
+		ValidRound: -1,
+		Batch:      batch.Message(),
+		Tn:         placeholder.Tn,
+		Tnlog:      placeholder.Tnlog,
+		Skipped:    int32(skipped),
+	}
+	proposal.Batch.Evidence = evidence.Pending()
+	proposal.Batch.ProposalTs = time.Now().UnixNano()
+
+	logger.Info().Int32("sn", h.sn).
+		Int32("round", 0).
+		Int("nReq", len(batch.Requests)).
+		Int("skipped", skipped).
+		Msg("Sending PROPOSAL.")
+	tracing.MainTrace.Event(tracing.PROPOSE, int64(h.sn), int64(len(batch.Requests)))
+	tracing.BatchStage(proposal.Batch.Requests, tracing.StagePropose, h.sn)
+	metrics.RequestsProposed.Add(len(batch.Requests))
+
+	ti.sendProposal(h, &tendermintValue{proposal: proposal, batch: batch, digest: tendermintDigest(proposal)})
+}
+
+// Proposes the valid value, or an aborted empty batch if there is none, in the current round (other than 0).
+func (ti *tendermintInstance) proposeInRound(h *tendermintHeight) {
+	proposal := &pb.TendermintProposal{
+		Sn:         h.sn,
+		Round:      h.round,
+		ValidRound: h.validRound,
+	}
+	var batch *request.Batch
+	if h.validValue != nil {
+		proposal.Batch = h.validValue.proposal.Batch
+		proposal.Aborted = h.validValue.proposal.Aborted
+		proposal.Tn = h.validValue.proposal.Tn
+		proposal.Skipped = h.validValue.proposal.Skipped
+		batch = h.validValue.batch
+	} else {
+		batch = &request.Batch{Requests: make([]*request.Request, 0, 0)}
+		proposal.Batch = batch.Message()
+		proposal.Aborted = true
+	}
+
+	logger.Info().Int32("sn", h.sn).
+		Int32("round", h.round).
+		Int32("validRound", h.validRound).
+		Bool("aborted", proposal.Aborted).
+		Msg("Sending PROPOSAL.")
+
+	ti.sendProposal(h, &tendermintValue{proposal: proposal, batch: batch, digest: tendermintDigest(proposal)})
+}
+
+// Sends an own proposal to all followers and processes it locally.
+func (ti *tendermintInstance) sendProposal(h *tendermintHeight, value *tendermintValue) {
+	// This value will be overwritten by receivers.
+	// Setting it here, as this counts as local "reception" of the proposal.
+	// The timestamp is not part of the digest.
+	value.proposal.Ts = time.Now().UnixNano()
+
+	msg := &pb.ProtocolMessage{
+		SenderId: ti.orderer.ownID,
+		Sn:       h.sn,
+		Msg:      &pb.ProtocolMessage_TendermintProposal{TendermintProposal: value.proposal},
+	}
+	for _, nodeID := range ti.segment.Followers() {
+		if nodeID != ti.orderer.ownID {
+			ti.orderer.send(msg, nodeID)
+		}
+	}
+
+	ti.receiveProposal(h, value)
+}
+
+func (ti *tendermintInstance) handleProposal(proposal *pb.TendermintProposal, msg *pb.ProtocolMessage) error {
+	// Convenience variables
+	sn := msg.Sn
+	senderID := msg.SenderId
+
+	if sn != proposal.Sn {
+		return fmt.Errorf("malformed message from %d: header sequence number doesn't match", senderID)
+	}
+	h, ok := ti.heights[sn]
+	if !ok {
+		return fmt.Errorf("instance %d does not handle sequence number %d", ti.segment.SegID(), sn)
+	}
+	if senderID != segmentLeader(ti.segment, proposal.Round) {
+		return fmt.Errorf("proposal from %d, which is not the proposer of round %d", senderID, proposal.Round)
+	}
+	if h.decided {
+		return nil
+	}
+	if _, ok := h.proposals[proposal.Round]; ok {
+		return fmt.Errorf("duplicate proposal from %d for round %d", senderID, proposal.Round)
+	}
+
+	value := &tendermintValue{proposal: proposal, digest: tendermintDigest(proposal)}
+
+	// A value proposed again in a later round has already been validated and its requests are in flight.
+	if existing, ok := h.values[string(value.digest)]; ok {
+		value.batch = existing.batch
+	} else if err := ti.validate(proposal); err != nil {
+		// Invalid proposals are still recorded, so the follower prevotes nil.
+		logger.Warn().Err(err).Int32("sn", sn).Int32("senderID", senderID).Msg("Invalid proposal.")
+	} else {
+		value.batch = request.NewBatch(proposal.Batch)
+		value.batch.MarkInFlight()
+	}
+
+	ti.receiveProposal(h, value)
+	return nil
+}
+
+// Checks that the requests in a proposal are valid and can be proposed at the proposal's sequence number.
+func (ti *tendermintInstance) validate(proposal *pb.TendermintProposal) error {
+	if proposal.Batch == nil {
+		return fmt.Errorf("missing batch")
+	}
+	if len(proposal.Batch.Certificates) > 0 {
+		return fmt.Errorf("batch dissemination not supported")
+	}
+	if proposal.Skipped < 0 || int(proposal.Skipped) > ti.snIndex(proposal.Sn) {
+		return fmt.Errorf("invalid number of skipped sequence numbers: %d", proposal.Skipped)
+	}
+	// Fresh values are only proposed in round 0. Values proposed again in later rounds keep their old timestamp.
+	if proposal.ValidRound == -1 && !proposal.Aborted {
+		if err := checkProposalTs(proposal.Batch, ti.orderer.cfg.ProposalTsTolerance); err != nil {
+			return err
+		}
+	}
+	batch := request.NewBatch(proposal.Batch)
+	if batch == nil {
+		return fmt.Errorf("proposal contains invalid requests")
+	}
+	if err := batch.CheckInFlight(); err != nil {
+		return fmt.Errorf("proposal contains in flight requests: %s", err.Error())
+	}
+	if err := batch.CheckBucket(ti.segment.Buckets().GetBucketIDs()); err != nil {
+		return fmt.Errorf("proposal contains requests from invalid bucket: %s", err.Error())
+	}
+	if err := batch.CheckExpired(proposal.Sn); err != nil {
+		return fmt.Errorf("proposal contains expired requests: %s", err.Error())
+	}
+	return nil
+}
+
+// Records a proposal and advances the protocol state accordingly.
+func (ti *tendermintInstance) receiveProposal(h *tendermintHeight, value *tendermintValue) {
+	h.proposals[value.proposal.Round] = value
+	if _, ok := h.values[string(value.digest)]; !ok && value.batch != nil {
+		h.values[string(value.digest)] = value
+	}
+	ti.update(h)
+}
+
+func (ti *tendermintInstance) handleVote(vote *pb.TendermintVote, msg *pb.ProtocolMessage) error {
+	// Convenience variables
+	sn := msg.Sn
+	senderID := msg.SenderId
+
+	if sn != vote.Sn {
+		return fmt.Errorf("malformed message from %d: header sequence number doesn't match", senderID)
+	}
+	h, ok := ti.heights[sn]
+	if !ok {
+		return fmt.Errorf("instance %d does not handle sequence number %d", ti.segment.SegID(), sn)
+	}
+	if h.decided {
+		return nil
+	}
+
+	votes := h.prevotes
+	if vote.Type == pb.TendermintVote_PRECOMMIT {
+		votes = h.precommits
+	}
+	if votes[vote.Round] == nil {
+		votes[vote.Round] = make(map[int32]string)
+	}
+	if _, ok := votes[vote.Round][senderID]; ok {
+		return fmt.Errorf("duplicate %s from %d for round %d", vote.Type.String(), senderID, vote.Round)
+	}
+	votes[vote.Round][senderID] = string(vote.Digest)
+
+	// Votes of other peers show that the sequence number is being agreed upon, even if this peer has not received
+	// the proposal or is still waiting for lower sequence numbers. Without the timeouts, the sequence number might
+	// never be decided if this peer's vote is needed.
+	ti.activate(h)
+
+	// Skip to a higher round if at least one correct peer is already there.
+	if vote.Round > h.round && ti.roundParticipants(h, vote.Round) > membership.Faults() {
+		ti.startRound(h, vote.Round)
+	}
+
+	ti.update(h)
+	return nil
+}
+
+// Returns the number of distinct peers that sent a vote for round r.
+func (ti *tendermintInstance) roundParticipants(h *tendermintHeight, r int32) int {
+	participants := make(map[int32]bool)
+	for senderID := range h.prevotes[r] {
+		participants[senderID] = true
+	}
+	for senderID := range h.precommits[r] {
+		participants[senderID] = true
+	}
+	return len(participants)
+}
+
+// Returns the number of votes for a digest (the empty string standing for nil).
+func countVotes(votes map[int32]string, digest string) int {
+	n := 0
+	for _, d := range votes {
+		if d == digest {
+			n++
+		}
+	}
+	return n
+}
+
+// Applies the rules of the Tendermint protocol to the current state of a sequence number.
+func (ti *tendermintInstance) update(h *tendermintHeight) {
+	if h.decided {
+		return
+	}
+
+	// Decide on a value precommitted by a quorum in any round.
+	for r, value := range h.proposals {
+		if value.batch != nil && countVotes(h.precommits[r], string(value.digest)) >= membership.Quorum() {
+			ti.decide(h, value)
+			return
+		}
+	}
+
+	if ti.withhold(h) {
+		return
+	}
+
+	p := h.proposals[h.round]
+
+	// Prevote for the proposal of the current round, if it is valid and compatible with the lock.
+	if h.step == stepPropose && p != nil {
+		vr := p.proposal.ValidRound
+		if vr == -1 {
+			if p.batch != nil && ti.canSkip(p) && (h.lockedRound == -1 || sameValue(h.lockedValue, p)) {
+				ti.prevote(h, p)
+			} else {
+				ti.prevote(h, nil)
+			}
+			return
+		} else if vr < h.round && countVotes(h.prevotes[vr], string(p.digest)) >= membership.Quorum() {
+			if p.batch != nil && ti.canSkip(p) && (h.lockedRound <= vr || sameValue(h.lockedValue, p)) {
+				ti.prevote(h, p)
+			} else {
+				ti.prevote(h, nil)
+			}
+			return
+		}
+	}
+
+	if h.step == stepPrevote && len(h.prevotes[h.round]) >= membership.Quorum() && !h.prevoteTimeoutSet[h.round] {
+		h.prevoteTimeoutSet[h.round] = true
+		ti.setTimer(h, pb.TendermintTimeout_PREVOTE, ti.orderer.cfg.TendermintVoteTimeout*time.Duration(h.round+1))
+	}
+
+	// Lock and precommit the proposed value if a quorum prevoted it.
+	if h.step >= stepPrevote && p != nil && p.batch != nil && !h.validatedInRound[h.round] &&
+		countVotes(h.prevotes[h.round], string(p.digest)) >= membership.Quorum() {
+
+		h.validatedInRound[h.round] = true
+		h.validValue = p
+		h.validRound = h.round
+		if h.step == stepPrevote {
+			h.lockedValue = p
+			h.lockedRound = h.round
+			ti.precommit(h, p)
+			return
+		}
+	}
+
+	if h.step == stepPrevote && countVotes(h.prevotes[h.round], "") >= membership.Quorum() {
+		ti.precommit(h, nil)
+		return
+	}
+
+	if len(h.precommits[h.round]) >= membership.Quorum() && !h.precommitTimeoutSet[h.round] {
+		h.precommitTimeoutSet[h.round] = true
+		ti.setTimer(h, pb.TendermintTimeout_PRECOMMIT, ti.orderer.cfg.TendermintVoteTimeout*time.Duration(h.round+1))
+	}
+}
+
+func sameValue(a *tendermintValue, b *tendermintValue) bool {
+	return a != nil && b != nil && string(a.digest) == string(b.digest)
+}
+
+// Returns true if none of the sequence numbers skipped by a value has been decided or voted for by this peer.
+// Only then the peer may prevote for the value.
+func (ti *tendermintInstance) canSkip(value *tendermintValue) bool {
+	for _, sn := range ti.skippedSNs(value.proposal) {
+		if skipped := ti.heights[sn]; skipped.decided || skipped.hasVoted(ti.orderer.ownID) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if this peer prevoted for a value skipping h at a higher sequence number
+// that has not been decided (or has been decided with that value, but h has not been committed yet).
+// The peer must not vote for a reserved sequence number, since the value skipping it might be decided.
+// Together with canSkip(), this makes sure that a sequence number cannot be both skipped and decided otherwise:
+// the quorums deciding either would intersect in a correct peer that voted for both.
+func (ti *tendermintInstance) reserved(h *tendermintHeight) bool {
+	for _, sn := range ti.segment.SNs() {
+		if sn <= h.sn {
+			continue
+		}
+		higher := ti.heights[sn]
+		for _, votes := range higher.prevotes {
+			digest, ok := votes[ti.orderer.ownID]
+			if !ok || digest == "" || (higher.decided && higher.decidedDigest != digest) {
+				continue
+			}
+			if value, ok := higher.values[digest]; ok {
+				for _, skipped := range ti.skippedSNs(value.proposal) {
+					if skipped == h.sn {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Returns true (and remembers it) if the votes of this peer for h must be withheld, as h is reserved.
+func (ti *tendermintInstance) withhold(h *tendermintHeight) bool {
+	if !ti.reserved(h) {
+		return false
+	}
+	if !h.withheld {
+		logger.Info().Int32("sn", h.sn).Int32("round", h.round).Msg("Withholding votes for reserved sequence number.")
+	}
+	h.withheld = true
+	return true
+}
+
+// Applies the protocol rules to a sequence number whose votes have been withheld and is not reserved any more.
+// Restarts the timeout of the current step, which might have expired while the votes were withheld.
+func (ti *tendermintInstance) resume(h *tendermintHeight) {
+	logger.Info().Int32("sn", h.sn).Int32("round", h.round).Msg("Resuming votes for sequence number.")
+	h.withheld = false
+	if h.step == stepPropose && h.active {
+		ti.setProposeTimer(h)
+	} else if h.step == stepPrevote && h.prevoteTimeoutSet[h.round] {
+		ti.setTimer(h, pb.TendermintTimeout_PREVOTE, ti.orderer.cfg.TendermintVoteTimeout*time.Duration(h.round+1))
+	}
+	ti.update(h)
+}
+
+func (ti *tendermintInstance) prevote(h *tendermintHeight, value *tendermintValue) {
+	if ti.withhold(h) {
+		return
+	}
+	h.step = stepPrevote
+	ti.sendVote(h, pb.TendermintVote_PREVOTE, value)
+	ti.update(h)
+}
+
+func (ti *tendermintInstance) precommit(h *tendermintHeight, value *tendermintValue) {
+	if ti.withhold(h) {
+		return
+	}
+	h.step = stepPrecommit
+	if value != nil {
+		ti.sendRank(h, value)
+	}
+	ti.sendVote(h, pb.TendermintVote_PRECOMMIT, value)
+	ti.update(h)
+}
+
+// Records an own vote and sends it to all other followers.
+func (ti *tendermintInstance) sendVote(h *tendermintHeight, voteType pb.TendermintVote_Type, value *tendermintValue) {
+	vote := &pb.TendermintVote{
+		Type:  voteType,
+		Sn:    h.sn,
+		Round: h.round,
+	}
+	if value != nil {
+		vote.Digest = value.digest
+	}
+
+	logger.Debug().Int32("sn", h.sn).
+		Int32("round", h.round).
+		Bool("nil", value == nil).
+		Msgf("Sending %s.", voteType.String())
+
+	// Add vote to own log
+	votes := h.prevotes
+	if voteType == pb.TendermintVote_PRECOMMIT {
+		votes = h.precommits
+	}
+	if votes[h.round] == nil {
+		votes[h.round] = make(map[int32]string)
+	}
+	votes[h.round][ti.orderer.ownID] = string(vote.Digest)
+
+	msg := &pb.ProtocolMessage{
+		SenderId: ti.orderer.ownID,
+		Sn:       h.sn,
+		Msg:      &pb.ProtocolMessage_TendermintVote{TendermintVote: vote},
+	}
+	for _, nodeID := range ti.segment.Followers() {
+		if nodeID != ti.orderer.ownID {
+			ti.orderer.send(msg, nodeID)
+		}
+	}
+}
+
+// Enters a new round for a sequence number.
+func (ti *tendermintInstance) startRound(h *tendermintHeight, round int32) {
+	logger.Info().Int32("sn", h.sn).
+		Int("segID", ti.segment.SegID()).
+		Int32("round", round).
+		Msg("Starting new round.")
+
+	h.round = round
+	h.step = stepPropose
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+
+	// In ISS, fresh batches are only proposed in round 0.
+	// Once a sequence number needs more rounds, sequence numbers are not skipped any more.
+	if round > 0 {
+		metrics.ViewChanges.Inc()
+		atomic.StoreInt32(&ti.rankOrdering, 0)
+		h.active = true
+	}
+
+	if segmentLeader(ti.segment, round) == ti.orderer.ownID {
+		if round > 0 {
+			ti.proposeInRound(h)
+		}
+	} else if h.active {
+		ti.setProposeTimer(h)
+	}
+
+	ti.update(h)
+}
+
+// Starts the timeouts for a sequence number, if not yet started.
+func (ti *tendermintInstance) activate(h *tendermintHeight) {
+	if h.active || h.decided {
+		return
+	}
+	h.active = true
+	if h.step == stepPropose {
+		ti.setProposeTimer(h)
+	}
+}
+
+// The propose timeout of round r is ViewChangeTimeout*(2^r).
+func (ti *tendermintInstance) setProposeTimer(h *tendermintHeight) {
+	ti.setTimer(h, pb.TendermintTimeout_PROPOSE, ti.orderer.cfg.ViewChangeTimeout*(1<<uint(h.round)))
+}
+
+func (ti *tendermintInstance) setTimer(h *tendermintHeight, step pb.TendermintTimeout_Step, after time.Duration) {
+	msg := &pb.ProtocolMessage{
+		SenderId: ti.orderer.ownID,
+		Sn:       h.sn,
+		Msg: &pb.ProtocolMessage_TendermintTimeout{TendermintTimeout: &pb.TendermintTimeout{
+			Sn:    h.sn,
+			Round: h.round,
+			Step:  step,
+		}},
+	}
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	h.timer = time.AfterFunc(after, func() { ti.serializer.serialize(msg) })
+}
+
+func (ti *tendermintInstance) handleTimeout(timeout *pb.TendermintTimeout) {
+	h, ok := ti.heights[timeout.Sn]
+	if !ok || h.decided || timeout.Round != h.round {
+		logger.Debug().
+			Int32("sn", timeout.Sn).
+			Int32("timeoutRound", timeout.Round).
+			Msg("Ignoring outdated timeout.")
+		return
+	}
+
+	logger.Warn().Int32("sn", h.sn).
+		Int("segId", ti.segment.SegID()).
+		Int32("round", h.round).
+		Str("step", timeout.Step.String()).
+		Msg("Timeout")
+
+	switch timeout.Step {
+	case pb.TendermintTimeout_PROPOSE:
+		if h.step == stepPropose {
+			ti.prevote(h, nil)
+		}
+	case pb.TendermintTimeout_PREVOTE:
+		if h.step == stepPrevote {
+			ti.precommit(h, nil)
+		}
+	case pb.TendermintTimeout_PRECOMMIT:
+		ti.startRound(h, h.round+1)
+	}
+}
+
+// Commits the decided value of a sequence number.
+// The sequence numbers skipped by the value (see rank-based fast ordering) are committed as empty batches first.
+// All correct peers decide the same value and thus commit the same skipped sequence numbers.
+func (ti *tendermintInstance) decide(h *tendermintHeight, value *tendermintValue) {
+	for _, sn := range ti.skippedSNs(value.proposal) {
+		if skipped := ti.heights[sn]; !skipped.decided {
+			ti.commitEmpty(skipped, value.proposal.Ts)
+		}
+	}
+
+	ti.announce(h, value)
+}
+
+// Commits an empty batch for a sequence number skipped by the leader.
+func (ti *tendermintInstance) commitEmpty(h *tendermintHeight, proposeTs int64) {
+	logger.Info().Int32("sn", h.sn).Msg("Commit the empty block.")
+	emptyBatch := &request.Batch{Requests: make([]*request.Request, 0, 0)}
+	ti.announce(h, &tendermintValue{
+		proposal: &pb.TendermintProposal{Sn: h.sn, Batch: emptyBatch.Message(), Ts: proposeTs},
+		batch:    emptyBatch,
+	})
+}
+
+func (ti *tendermintInstance) announce(h *tendermintHeight, value *tendermintValue) {
+	h.decided = true
+	h.decidedDigest = string(value.digest)
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+
+	// Return the requests of all other proposed values to their buckets and remove the decided ones.
+	for digest, other := range h.values {
+		if digest != string(value.digest) {
+			other.batch.Resurrect()
+		}
+	}
+	request.RemoveBatch(value.batch)
+
+	logEntry := &log.Entry{
+		Sn:        h.sn,
+		Batch:     value.proposal.Batch,
+		ProposeTs: value.proposal.Ts,
+		CommitTs:  time.Now().UnixNano(),
+		Aborted:   value.proposal.Aborted,
+		Digest:    value.digest,
+	}
+	// If the batch was aborted suspect the first leader of the segment
+	if logEntry.Aborted {
+		logEntry.Suspect = segmentLeader(ti.segment, 0)
+	}
+	ti.orderer.commit(logEntry)
+
+	// Send the votes withheld for sequence numbers that are not reserved by a prevoted value any more.
+	for _, sn := range ti.segment.SNs() {
+		if w := ti.heights[sn]; w.withheld && !w.decided && !ti.reserved(w) {
+			ti.resume(w)
+		}
+	}
+
+	// Start the timeouts for the first undecided sequence number in the segment.
+	for _, sn := range ti.segment.SNs() {
+		if !ti.heights[sn].decided {
+			ti.activate(ti.heights[sn])
+			break
+		}
+	}
+}
+
+func (ti *tendermintInstance) handleMissingEntry(msg *pb.MissingEntry) {
+	logger.Info().
+		Int32("sn", msg.Sn).
+		Int("segID", ti.segment.SegID()).
+		Msg("Handling MissingEntry.")
+
+	h, ok := ti.heights[msg.Sn]
+	if !ok || h.decided {
+		return
+	}
+
+	// TODO: Properly verify the incoming entry.
+	batch := request.NewBatch(msg.Batch)
+	if batch == nil {
+		logger.Error().Int32("sn", msg.Sn).Msg("Invalid requests in missing entry.")
+		return
+	}
+	batch.MarkInFlight()
+
+	ti.announce(h, &tendermintValue{
+		proposal: &pb.TendermintProposal{Sn: msg.Sn, Batch: msg.Batch, Aborted: msg.Aborted, Ts: ti.startTs},
+		batch:    batch,
+		digest:   msg.Digest,
+	})
+}
+
+// Reports the own highest rank to the leader of the segment after precommitting a value.
+func (ti *tendermintInstance) sendRank(h *tendermintHeight, value *tendermintValue) {
+	if value.proposal.Tn > membership.GetHtn() {
+		membership.SetHtn(value.proposal.Tn)
+	}
+
+	rankMsg := &pb.HtnMsg{
+		Sn:   h.sn,
+		Tn:   value.proposal.Tn,
+		View: h.round,
+		Htn:  membership.GetHtn(),
+	}
+	msg := &pb.ProtocolMessage{
+		SenderId: ti.orderer.ownID,
+		Sn:       h.sn,
+		Msg:      &pb.ProtocolMessage_HtnMsg{HtnMsg: rankMsg},
+	}
+
+	if leader := segmentLeader(ti.segment, 0); leader == ti.orderer.ownID {
+		ti.handleRank(rankMsg, msg)
+	} else {
+		ti.orderer.send(msg, leader)
+	}
+}
+
+// Records the rank reported by a follower and, once a quorum of followers has reported their ranks
+// for a sequence number, lets the leader propose the next one.
+func (ti *tendermintInstance) handleRank(rankMsg *pb.HtnMsg, msg *pb.ProtocolMessage) {
+	if rankMsg.Htn > membership.GetHtn() {
+		membership.SetHtn(rankMsg.Htn)
+	}
+
+	ti.rankLock.Lock()
+	ti.rankLog[msg.SenderId] = rankMsg.Htn
+	ti.rankRecv[msg.Sn]++
+	ready := ti.rankRecv[msg.Sn] == membership.Quorum()
+	ti.rankLock.Unlock()
+
+	if ready {
+		go func() {
+			select {
+			case ti.readyToPropose <- struct{}{}:
+			case <-ti.stop:
+			}
+		}()
+	}
+}
+
+func (ti *tendermintInstance) processSerializedMessages() {
+	logger.Info().Int("segID", ti.segment.SegID()).Msg("Starting serialized message processing.")
+
+	for msg := range ti.serializer.channel {
+		if msg == nil {
+			return
+		}
+		ti.handleMessage(msg)
+	}
+}
+
+func (ti *tendermintInstance) handleMessage(msg *pb.ProtocolMessage) {
+	switch m := msg.Msg.(type) {
+	case *pb.ProtocolMessage_TendermintProposal:
+		if err := ti.handleProposal(m.TendermintProposal, msg); err != nil {
+			logger.Debug().
+				Err(err).
+				Int32("sn", msg.Sn).
+				Int32("senderID", msg.SenderId).
+				Msg("TendermintOrderer ignores proposal.")
+		}
+	case *pb.ProtocolMessage_TendermintVote:
+		if err := ti.handleVote(m.TendermintVote, msg); err != nil {
+			logger.Debug().
+				Err(err).
+				Int32("sn", msg.Sn).
+				Int32("senderID", msg.SenderId).
+				Msg("TendermintOrderer ignores vote.")
+		}
+	case *pb.ProtocolMessage_TendermintNewseqno:
+		ti.handleNewSeqNo(m.TendermintNewseqno)
+	case *pb.ProtocolMessage_TendermintTimeout:
+		ti.handleTimeout(m.TendermintTimeout)
+	case *pb.ProtocolMessage_HtnMsg:
+		ti.handleRank(m.HtnMsg, msg)
+	case *pb.ProtocolMessage_MissingEntry:
+		ti.handleMissingEntry(m.MissingEntry)
+	default:
+		logger.Error().
+			Str("msg", fmt.Sprint(m)).
+			Int32("sn", msg.Sn).
+			Int32("senderID", msg.SenderId).
+			Msg("TendermintOrderer cannot handle message. Unknown message type.")
+	}
+}
+
+func (ti *tendermintInstance) subscribeToBacklog() {
+	// Check for backloged messages for this segment
+	ti.orderer.backlog.subscribers <- backlogSubscriber{segment: ti.segment, serializer: ti.serializer}
+}
+
+func (ti *tendermintInstance) stopProposing() {
+	ti.stopProp.Do(func() {
+		close(ti.stop)
+	})
+}
+
+// Computes the digest identifying a proposed value. It does not depend on the round,
+// so a value proposed again in a later round has the same digest.
+// The rank and the number of skipped sequence numbers are part of the value.
+func tendermintDigest(proposal *pb.TendermintProposal) []byte {
+	metadata := make([]byte, 9)
+	if proposal.Aborted {
+		metadata[0] = 1
+	}
+	binary.LittleEndian.PutUint32(metadata[1:5], uint32(proposal.Tn))
+	binary.LittleEndian.PutUint32(metadata[5:9], uint32(proposal.Skipped))
+	return crypto.Hash(append(request.BatchDigest(proposal.Batch), metadata...))
+}
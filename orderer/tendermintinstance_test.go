@@ -0,0 +1,484 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orderer
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/log"
+	"github.com/Hanzheng2021/Orthrus/membership"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	"github.com/Hanzheng2021/Orthrus/request"
+)
+
+// Number of peers in the tests. Quorum is 3, at most 1 peer is faulty.
+const testNodes = 4
+
+// Proposal timestamp of all proposals in the tests. Proposals with the same batch and rank have the same digest.
+var testProposalTs = time.Now().UnixNano()
+
+func TestMain(m *testing.M) {
+	cfg := config.Default()
+	cfg.Failures = 0
+	cfg.StragglerCnt = 0
+	membership.Init(cfg)
+	identities := make([]*pb.NodeIdentity, testNodes)
+	for i := range identities {
+		identities[i] = &pb.NodeIdentity{NodeId: int32(i)}
+	}
+	membership.InitNodeIdentities(identities, cfg)
+	request.Init(cfg)
+	os.Exit(m.Run())
+}
+
+// Segment of the tests, led by peer 0 in round 0, peer 1 in round 1, etc.
+type testSegment struct {
+	sns []int32
+}
+
+func (s *testSegment) SegID() int                    { return 0 }
+func (s *testSegment) Leaders() []int32              { return []int32{0, 1, 2, 3} }
+func (s *testSegment) Followers() []int32            { return []int32{0, 1, 2, 3} }
+func (s *testSegment) SNs() []int32                  { return s.sns }
+func (s *testSegment) FirstSN() int32                { return s.sns[0] }
+func (s *testSegment) LastSN() int32                 { return s.sns[len(s.sns)-1] }
+func (s *testSegment) Len() int32                    { return int32(len(s.sns)) }
+func (s *testSegment) StartsAfter() int32            { return -1 }
+func (s *testSegment) Buckets() *request.BucketGroup { return &request.BucketGroup{} }
+func (s *testSegment) BatchSize() int                { return 1 }
+
+type testMessage struct {
+	msg  *pb.ProtocolMessage
+	dest int32
+}
+
+// In-memory transport connecting the Tendermint instances of all peers.
+// Sent messages are queued and only delivered by deliver(), in the order they have been sent.
+// Timers never fire on their own (the timeouts are set to an hour); tests trigger timeouts with timeout().
+type testNetwork struct {
+	t         *testing.T
+	instances []*tendermintInstance
+	queue     []testMessage
+	drop      func(msg *pb.ProtocolMessage, dest int32) bool // Messages for which drop returns true are discarded.
+	entries   []map[int32]*log.Entry                         // Committed log entries per peer, indexed by sequence number.
+}
+
+func newTestNetwork(t *testing.T, sns ...int32) *testNetwork {
+	net := &testNetwork{
+		t:         t,
+		instances: make([]*tendermintInstance, testNodes),
+		drop:      func(*pb.ProtocolMessage, int32) bool { return false },
+		entries:   make([]map[int32]*log.Entry, testNodes),
+	}
+
+	cfg := config.Default()
+	cfg.ViewChangeTimeout = time.Hour
+	cfg.TendermintVoteTimeout = time.Hour
+
+	seg := &testSegment{sns: sns}
+	for i := range net.instances {
+		nodeID := int32(i)
+		net.entries[i] = make(map[int32]*log.Entry)
+		orderer := &TendermintOrderer{
+			cfg:   cfg,
+			ownID: nodeID,
+			send: func(msg *pb.ProtocolMessage, dest int32) {
+				net.queue = append(net.queue, testMessage{msg: msg, dest: dest})
+			},
+			commit: func(entry *log.Entry) {
+				if _, ok := net.entries[nodeID][entry.Sn]; ok {
+					t.Errorf("peer %d committed sequence number %d twice", nodeID, entry.Sn)
+				}
+				net.entries[nodeID][entry.Sn] = entry
+			},
+		}
+		net.instances[i] = &tendermintInstance{}
+		net.instances[i].init(seg, orderer)
+	}
+
+	t.Cleanup(func() {
+		for _, ti := range net.instances {
+			ti.stopProposing()
+			for _, h := range ti.heights {
+				if h.timer != nil {
+					h.timer.Stop()
+				}
+			}
+		}
+	})
+	return net
+}
+
+// Delivers all queued messages (including the ones sent while delivering) that are not dropped.
+func (net *testNetwork) deliver() {
+	for len(net.queue) > 0 {
+		m := net.queue[0]
+		net.queue = net.queue[1:]
+		if !net.drop(m.msg, m.dest) {
+			net.instances[m.dest].handleMessage(m.msg)
+		}
+	}
+}
+
+// Makes peer 0, the leader of round 0, propose an empty batch with the given rank at sn.
+// The rank makes the proposed values of a test distinguishable.
+func (net *testNetwork) propose(sn int32, tn int32, skipped int32) *tendermintValue {
+	ti := net.instances[0]
+	batch := &request.Batch{Requests: make([]*request.Request, 0, 0)}
+	proposal := &pb.TendermintProposal{
+		Sn:         sn,
+		Round:      0,
+		ValidRound: -1,
+		Batch:      batch.Message(),
+		Tn:         tn,
+		Skipped:    skipped,
+	}
+	proposal.Batch.ProposalTs = testProposalTs
+	value := &tendermintValue{proposal: proposal, batch: batch, digest: tendermintDigest(proposal)}
+	ti.sendProposal(ti.heights[sn], value)
+	return value
+}
+
+// Makes the timeout of the current round and the given step expire at the given peers.
+func (net *testNetwork) timeout(sn int32, step pb.TendermintTimeout_Step, nodeIDs ...int32) {
+	for _, nodeID := range nodeIDs {
+		ti := net.instances[nodeID]
+		ti.handleTimeout(&pb.TendermintTimeout{Sn: sn, Round: ti.heights[sn].round, Step: step})
+	}
+}
+
+// Returns the vote of a peer in a round and whether the peer voted at all.
+func (net *testNetwork) vote(nodeID int32, sn int32, round int32, voteType pb.TendermintVote_Type) (string, bool) {
+	h := net.instances[nodeID].heights[sn]
+	votes := h.prevotes
+	if voteType == pb.TendermintVote_PRECOMMIT {
+		votes = h.precommits
+	}
+	digest, ok := votes[round][nodeID]
+	return digest, ok
+}
+
+// Fails the test if not all peers committed sn or if their entries differ.
+// Returns the entry of peer 0.
+func (net *testNetwork) committed(sn int32) *log.Entry {
+	net.t.Helper()
+	first, ok := net.entries[0][sn]
+	if !ok {
+		net.t.Fatalf("peer 0 did not commit sequence number %d", sn)
+	}
+	for nodeID := 1; nodeID < testNodes; nodeID++ {
+		entry, ok := net.entries[nodeID][sn]
+		if !ok {
+			net.t.Fatalf("peer %d did not commit sequence number %d", nodeID, sn)
+		}
+		if entry.Aborted != first.Aborted || entry.Suspect != first.Suspect ||
+			string(entry.Digest) != string(first.Digest) || len(entry.Batch.Requests) != len(first.Batch.Requests) {
+			net.t.Fatalf("peers 0 and %d committed different entries at sequence number %d", nodeID, sn)
+		}
+	}
+	return first
+}
+
+// Injects a vote of another peer at a single instance.
+func injectVote(ti *tendermintInstance, from int32, sn int32, round int32, voteType pb.TendermintVote_Type, value *tendermintValue) {
+	vote := &pb.TendermintVote{Type: voteType, Sn: sn, Round: round}
+	if value != nil {
+		vote.Digest = value.digest
+	}
+	ti.handleMessage(&pb.ProtocolMessage{
+		SenderId: from,
+		Sn:       sn,
+		Msg:      &pb.ProtocolMessage_TendermintVote{TendermintVote: vote},
+	})
+}
+
+// Injects a proposal of the proposer of the given round at a single instance.
+func injectProposal(ti *tendermintInstance, sn int32, round int32, validRound int32, tn int32) *tendermintValue {
+	batch := &request.Batch{Requests: make([]*request.Request, 0, 0)}
+	proposal := &pb.TendermintProposal{
+		Sn:         sn,
+		Round:      round,
+		ValidRound: validRound,
+		Batch:      batch.Message(),
+		Tn:         tn,
+	}
+	proposal.Batch.ProposalTs = testProposalTs
+	ti.handleMessage(&pb.ProtocolMessage{
+		SenderId: segmentLeader(ti.segment, round),
+		Sn:       sn,
+		Msg:      &pb.ProtocolMessage_TendermintProposal{TendermintProposal: proposal},
+	})
+	return &tendermintValue{proposal: proposal, batch: batch, digest: tendermintDigest(proposal)}
+}
+
+// Locks peer 2 on a value proposed in round 0 and moves it to round 1, where nothing has been proposed yet.
+func lockInRoundZero(t *testing.T, net *testNetwork) (*tendermintInstance, *tendermintValue) {
+	t.Helper()
+	ti := net.instances[2]
+	h := ti.heights[0]
+
+	p := injectProposal(ti, 0, 0, -1, 1)
+	injectVote(ti, 0, 0, 0, pb.TendermintVote_PREVOTE, p)
+	injectVote(ti, 1, 0, 0, pb.TendermintVote_PREVOTE, p)
+	if h.lockedRound != 0 || !sameValue(h.lockedValue, p) {
+		t.Fatalf("peer not locked on the value prevoted by a quorum: locked round %d", h.lockedRound)
+	}
+	if digest, _ := net.vote(2, 0, 0, pb.TendermintVote_PRECOMMIT); digest != string(p.digest) {
+		t.Fatalf("peer did not precommit the locked value")
+	}
+
+	injectVote(ti, 0, 0, 0, pb.TendermintVote_PRECOMMIT, nil)
+	injectVote(ti, 1, 0, 0, pb.TendermintVote_PRECOMMIT, nil)
+	net.timeout(0, pb.TendermintTimeout_PRECOMMIT, 2)
+	if h.round != 1 || h.step != stepPropose {
+		t.Fatalf("peer in round %d and step %d after the precommit timeout, expected round 1 and propose", h.round, h.step)
+	}
+	return ti, p
+}
+
+func TestTendermint_Decide(t *testing.T) {
+	net := newTestNetwork(t, 0, 1, 2, 3)
+
+	p := net.propose(0, 1, 0)
+	net.deliver()
+
+	entry := net.committed(0)
+	if entry.Aborted || string(entry.Digest) != string(p.digest) {
+		t.Fatalf("committed entry does not contain the proposed value")
+	}
+	if len(net.entries[0]) != 1 {
+		t.Fatalf("committed %d entries, expected 1", len(net.entries[0]))
+	}
+}
+
+func TestTendermint_LockedPeerPrevotesNilForOtherValue(t *testing.T) {
+	net := newTestNetwork(t, 0)
+	ti, _ := lockInRoundZero(t, net)
+
+	// The proposer of round 1 (peer 1) proposes a different fresh value.
+	injectProposal(ti, 0, 1, -1, 2)
+	if digest, ok := net.vote(2, 0, 1, pb.TendermintVote_PREVOTE); !ok || digest != "" {
+		t.Fatalf("locked peer did not prevote nil for a different value (voted: %v)", ok)
+	}
+}
+
+func TestTendermint_LockedPeerPrevotesLockedValue(t *testing.T) {
+	net := newTestNetwork(t, 0)
+	ti, p := lockInRoundZero(t, net)
+
+	// The proposer of round 1 proposes the locked value again, referring to the polka of round 0.
+	injectProposal(ti, 0, 1, 0, 1)
+	if digest, _ := net.vote(2, 0, 1, pb.TendermintVote_PREVOTE); digest != string(p.digest) {
+		t.Fatalf("locked peer did not prevote for the re-proposed locked value")
+	}
+}
+
+func TestTendermint_PolkaInHigherRoundChangesLock(t *testing.T) {
+	net := newTestNetwork(t, 0)
+	ti, p := lockInRoundZero(t, net)
+	h := ti.heights[0]
+
+	// The locked peer prevotes nil for a different value, but the other peers prevote for it.
+	q := injectProposal(ti, 0, 1, -1, 2)
+	injectVote(ti, 0, 0, 1, pb.TendermintVote_PREVOTE, q)
+	injectVote(ti, 1, 0, 1, pb.TendermintVote_PREVOTE, q)
+	if h.lockedRound != 0 || !sameValue(h.lockedValue, p) {
+		t.Fatalf("peer changed its lock without a polka")
+	}
+
+	// A polka in a round higher than the locked round replaces the lock.
+	injectVote(ti, 3, 0, 1, pb.TendermintVote_PREVOTE, q)
+	if h.lockedRound != 1 || !sameValue(h.lockedValue, q) || h.validRound != 1 || !sameValue(h.validValue, q) {
+		t.Fatalf("polka of round 1 did not change the lock: locked round %d", h.lockedRound)
+	}
+	if digest, _ := net.vote(2, 0, 1, pb.TendermintVote_PRECOMMIT); digest != string(q.digest) {
+		t.Fatalf("peer did not precommit the value of the polka")
+	}
+}
+
+func TestTendermint_ReproposalWaitsForPolka(t *testing.T) {
+	net := newTestNetwork(t, 0)
+	ti := net.instances[2]
+	h := ti.heights[0]
+
+	// Nothing is proposed in round 0 and the peer moves to round 1 with the other peers.
+	injectVote(ti, 0, 0, 1, pb.TendermintVote_PREVOTE, nil)
+	injectVote(ti, 1, 0, 1, pb.TendermintVote_PREVOTE, nil)
+	if h.round != 1 {
+		t.Fatalf("peer in round %d, expected 1", h.round)
+	}
+
+	// The proposer of round 1 claims that its value was prevoted by a quorum in round 0.
+	r := injectProposal(ti, 0, 1, 0, 3)
+	if _, ok := net.vote(2, 0, 1, pb.TendermintVote_PREVOTE); ok {
+		t.Fatalf("peer prevoted a re-proposed value without a polka in its valid round")
+	}
+
+	// The prevotes of round 0 arrive late.
+	injectVote(ti, 0, 0, 0, pb.TendermintVote_PREVOTE, r)
+	injectVote(ti, 1, 0, 0, pb.TendermintVote_PREVOTE, r)
+	if _, ok := net.vote(2, 0, 1, pb.TendermintVote_PREVOTE); ok {
+		t.Fatalf("peer prevoted a re-proposed value without a quorum of prevotes in its valid round")
+	}
+	injectVote(ti, 3, 0, 0, pb.TendermintVote_PREVOTE, r)
+	if digest, _ := net.vote(2, 0, 1, pb.TendermintVote_PREVOTE); digest != string(r.digest) {
+		t.Fatalf("peer did not prevote a re-proposed value after the polka in its valid round")
+	}
+}
+
+func TestTendermint_RoundSkip(t *testing.T) {
+	net := newTestNetwork(t, 0)
+	ti := net.instances[2]
+	h := ti.heights[0]
+
+	// A single peer in a higher round might be faulty.
+	injectVote(ti, 0, 0, 3, pb.TendermintVote_PREVOTE, nil)
+	if h.round != 0 {
+		t.Fatalf("peer skipped to round %d after a vote of a single peer", h.round)
+	}
+	injectVote(ti, 0, 0, 3, pb.TendermintVote_PRECOMMIT, nil)
+	if h.round != 0 {
+		t.Fatalf("peer skipped to round %d after two votes of a single peer", h.round)
+	}
+
+	// With votes from f+1 peers, at least one correct peer is in the higher round.
+	injectVote(ti, 1, 0, 3, pb.TendermintVote_PRECOMMIT, nil)
+	if h.round != 3 || h.step != stepPropose {
+		t.Fatalf("peer in round %d and step %d, expected round 3 and propose", h.round, h.step)
+	}
+	if ti.rankOrdering != 0 {
+		t.Fatalf("rank-based ordering still enabled after a round change")
+	}
+
+	// Votes of lower rounds do not move the peer back.
+	injectVote(ti, 3, 0, 1, pb.TendermintVote_PREVOTE, nil)
+	injectVote(ti, 1, 0, 1, pb.TendermintVote_PREVOTE, nil)
+	if h.round != 3 {
+		t.Fatalf("peer moved to round %d after votes of a lower round", h.round)
+	}
+}
+
+// A peer that voted on a sequence number before receiving a proposal skipping it must not prevote the proposal.
+// Nevertheless, all peers commit the same entries, derived from the decided value only.
+func TestTendermint_SkippedSequenceNumbersFollowDecidedValue(t *testing.T) {
+	net := newTestNetwork(t, 0, 1, 2, 3)
+
+	// Peer 3 times out waiting for a proposal for sequence number 0 before receiving the proposal for 2.
+	net.timeout(0, pb.TendermintTimeout_PROPOSE, 3)
+	p := net.propose(2, 1, 2)
+	net.deliver()
+
+	if digest, ok := net.vote(3, 2, 0, pb.TendermintVote_PREVOTE); !ok || digest != "" {
+		t.Fatalf("peer prevoted a value skipping a sequence number it voted on")
+	}
+	for nodeID := int32(0); nodeID < 3; nodeID++ {
+		if digest, _ := net.vote(nodeID, 2, 0, pb.TendermintVote_PREVOTE); digest != string(p.digest) {
+			t.Fatalf("peer %d did not prevote the proposal", nodeID)
+		}
+	}
+
+	for _, sn := range []int32{0, 1} {
+		if entry := net.committed(sn); entry.Aborted || entry.Digest != nil || len(entry.Batch.Requests) != 0 {
+			t.Fatalf("skipped sequence number %d not committed as an empty batch", sn)
+		}
+	}
+	if entry := net.committed(2); string(entry.Digest) != string(p.digest) {
+		t.Fatalf("sequence number 2 not committed with the proposed value")
+	}
+	if len(net.entries[3]) != 3 {
+		t.Fatalf("peer 3 committed %d entries, expected 3", len(net.entries[3]))
+	}
+}
+
+// A peer that prevoted a value skipping a sequence number withholds its votes for it
+// until the value cannot be decided any more.
+func TestTendermint_WithholdVotesForReservedSequenceNumber(t *testing.T) {
+	net := newTestNetwork(t, 0, 1, 2, 3)
+
+	// Only peer 1 receives the proposal skipping sequence numbers 0 and 1.
+	net.drop = func(msg *pb.ProtocolMessage, dest int32) bool {
+		_, ok := msg.Msg.(*pb.ProtocolMessage_TendermintProposal)
+		return ok && dest != 1
+	}
+	p := net.propose(2, 1, 2)
+	net.deliver()
+	net.drop = func(*pb.ProtocolMessage, int32) bool { return false }
+	if digest, _ := net.vote(1, 2, 0, pb.TendermintVote_PREVOTE); digest != string(p.digest) {
+		t.Fatalf("peer 1 did not prevote the proposal")
+	}
+
+	// Peer 1 must not vote on sequence number 0 while the proposal skipping it might be decided.
+	net.timeout(0, pb.TendermintTimeout_PROPOSE, 1)
+	net.deliver()
+	if net.instances[1].heights[0].hasVoted(1) {
+		t.Fatalf("peer voted for a sequence number skipped by a value it prevoted")
+	}
+	if !net.instances[1].heights[0].withheld {
+		t.Fatalf("vote for reserved sequence number not withheld")
+	}
+
+	// The peers that did not receive the proposal prevote nil. The prevotes of peers 0 and 1 alone are no polka,
+	// so all peers precommit nil, and peer 1 aborts sequence number 2 in round 1.
+	net.timeout(2, pb.TendermintTimeout_PROPOSE, 2, 3)
+	net.deliver()
+	net.timeout(2, pb.TendermintTimeout_PREVOTE, 0, 1, 2, 3)
+	net.deliver()
+	net.timeout(2, pb.TendermintTimeout_PRECOMMIT, 0, 1, 2, 3)
+	net.deliver()
+
+	entry := net.committed(2)
+	if !entry.Aborted || entry.Suspect != 0 {
+		t.Fatalf("sequence number 2 not aborted")
+	}
+	for _, sn := range []int32{0, 1} {
+		for nodeID := range net.entries {
+			if _, ok := net.entries[nodeID][sn]; ok {
+				t.Fatalf("peer %d committed sequence number %d, which the decided value did not skip", nodeID, sn)
+			}
+		}
+	}
+
+	// With the proposal not decided, peer 1 sends the withheld vote.
+	h := net.instances[1].heights[0]
+	if h.withheld {
+		t.Fatalf("vote still withheld after the reserving sequence number has been aborted")
+	}
+	net.timeout(0, pb.TendermintTimeout_PROPOSE, 1)
+	if digest, ok := net.vote(1, 0, 0, pb.TendermintVote_PREVOTE); !ok || digest != "" {
+		t.Fatalf("peer did not prevote nil after its propose timeout")
+	}
+}
+
+func TestTendermint_ProposalTimestampOutOfBounds(t *testing.T) {
+	net := newTestNetwork(t, 0)
+	ti := net.instances[2]
+	tolerance := int64(ti.orderer.cfg.ProposalTsTolerance) * int64(time.Millisecond)
+
+	// A leader must not backdate its proposal to hide its lag.
+	batch := &request.Batch{Requests: make([]*request.Request, 0, 0)}
+	proposal := &pb.TendermintProposal{Sn: 0, Round: 0, ValidRound: -1, Batch: batch.Message(), Tn: 1}
+	proposal.Batch.ProposalTs = time.Now().UnixNano() - 2*tolerance
+	ti.handleMessage(&pb.ProtocolMessage{
+		SenderId: 0,
+		Sn:       0,
+		Msg:      &pb.ProtocolMessage_TendermintProposal{TendermintProposal: proposal},
+	})
+	if digest, ok := net.vote(2, 0, 0, pb.TendermintVote_PREVOTE); !ok || digest != "" {
+		t.Fatalf("peer did not prevote nil for a proposal with a timestamp out of bounds")
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orderer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/announcer"
+	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/evidence"
+	"github.com/Hanzheng2021/Orthrus/log"
+	"github.com/Hanzheng2021/Orthrus/manager"
+	"github.com/Hanzheng2021/Orthrus/membership"
+	"github.com/Hanzheng2021/Orthrus/messenger"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	logger "github.com/rs/zerolog/log"
+)
+
+// Represents a Tendermint Orderer implementation.
+type TendermintOrderer struct {
+	segmentChan chan manager.Segment // Channel to which the Manager pushes new Segments.
+	dispatcher  tendermintDispatcher // map[int32]*tendermintInstance
+	backlog     backlog              // map[int32]chan*ordererMsg
+	last        int32                // Some sequence number we can ignore messages above
+	lock        sync.Mutex
+	cfg         *config.Configuration // Configuration of the orderer.
+
+	// Own ID and the functions for sending messages and committing log entries.
+	// Set by Init() to membership.OwnID, messenger.EnqueueMsg and announcer.Announce. Replaced in tests.
+	ownID  int32
+	send   func(msg *pb.ProtocolMessage, destNodeID int32)
+	commit func(entry *log.Entry)
+}
+
+type tendermintDispatcher struct {
+	mm sync.Map
+}
+
+func (d *tendermintDispatcher) load(key int32) (*tendermintInstance, bool) {
+	if v, ok := d.mm.Load(key); ok {
+		return v.(*tendermintInstance), ok
+	}
+	return nil, false
+}
+
+func (d *tendermintDispatcher) store(key int32, value *tendermintInstance) {
+	d.mm.Store(key, value)
+}
+
+func (d *tendermintDispatcher) delete(key int32) {
+	d.mm.Delete(key)
+}
+
+// HandleMessage is called by the messenger each time an Orderer-issued message is received over the network.
+func (to *TendermintOrderer) HandleMessage(msg *pb.ProtocolMessage) {
+	sn := msg.Sn
+
+	// Check if message is from an old segment and needs to be discarded
+	last := atomic.LoadInt32(&to.last)
+	if sn <= last {
+		logger.Debug().
+			Int32("sn", sn).
+			Int32("senderID", msg.SenderId).
+			Msg("TendermintOrderer discards message. Message belongs to an old segment.")
+		return
+	}
+
+	// Set reception timestamp for proposals.
+	if m, ok := msg.Msg.(*pb.ProtocolMessage_TendermintProposal); ok {
+		m.TendermintProposal.Ts = time.Now().UnixNano()
+	}
+
+	// Check if the message is for a future message and needs to be backlogged
+	ti, ok := to.dispatcher.load(sn)
+	if !ok {
+		to.backlog.add(msg)
+		return
+	}
+
+	ti.serializer.serialize(msg)
+}
+
+// Handles entries produced externally.
+func (to *TendermintOrderer) HandleEntry(entry *log.Entry) {
+	// Treat the log entry as a MissingEntry message
+	// and process it using the instance according to its sequence number.
+	to.HandleMessage(&pb.ProtocolMessage{
+		SenderId: -1,
+		Sn:       entry.Sn,
+		Msg: &pb.ProtocolMessage_MissingEntry{
+			MissingEntry: &pb.MissingEntry{
+				Sn:      entry.Sn,
+				Batch:   entry.Batch,
+				Digest:  entry.Digest,
+				Aborted: entry.Aborted,
+				Suspect: entry.Suspect,
+				Proof:   "Dummy Proof.",
+			},
+		},
+	})
+}
+
+// Creates a new TendermintOrderer with the given configuration.
+// The configuration is mandatory: Init panics on an orderer created without one (e.g. &TendermintOrderer{}).
+func NewTendermintOrderer(cfg *config.Configuration) *TendermintOrderer {
+	return &TendermintOrderer{cfg: cfg}
+}
+
+// Initializes the TendermintOrderer.
+// Subscribes to new segments issued by the Manager and allocates internal buffers and data structures.
+func (to *TendermintOrderer) Init(mngr manager.Manager) {
+	if to.cfg == nil {
+		panic("TendermintOrderer initialized without a configuration.")
+	}
+	to.ownID = membership.OwnID
+	to.send = messenger.EnqueueMsg
+	to.commit = announcer.Announce
+	to.segmentChan = mngr.SubscribeOrderer()
+	to.backlog = newBacklog()
+	to.last = -1
+}
+
+// Starts the TendermintOrderer. Listens on the channel where the Manager issues new Segemnts and starts a goroutine to
+// handle each of them.
+// Meant to be run as a separate goroutine.
+// Decrements the provided wait group when done.
+func (to *TendermintOrderer) Start(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for s, ok := <-to.segmentChan; ok; s, ok = <-to.segmentChan {
+
+		logger.Info().
+			Int("segId", s.SegID()).
+			Int32("length", s.Len()).
+			Int32("firstSN", s.FirstSN()).
+			Int32("lastSN", s.LastSN()).
+			Int32("first leader", s.Leaders()[0]).
+			Msgf("TendermintOrderer received a new segment: %+v", s.SNs())
+
+		to.runSegment(s)
+		go to.killSegment(s)
+	}
+}
+
+// Runs the Tendermint ordering algorithm for a Segment.
+func (to *TendermintOrderer) runSegment(seg manager.Segment) {
+	ti := &tendermintInstance{}
+	ti.init(seg, to)
+	for _, sn := range seg.SNs() {
+		to.dispatcher.store(sn, ti)
+	}
+	logger.Info().Int("segID", seg.SegID()).
+		Int32("first", seg.FirstSN()).
+		Int32("last", seg.LastSN()).
+		Msg("Starting Tendermint instance.")
+
+	ti.subscribeToBacklog()
+
+	if isLeading(seg, to.ownID, 0) {
+		go ti.lead()
+	}
+	go ti.processSerializedMessages()
+}
+
+func (to *TendermintOrderer) killSegment(seg manager.Segment) {
+	// Wait until this segment is part of a stable checkpoint, AND all the sequence numbers are committed.
+	// It might happen that we obtain a stable checkpoint before committing all sequence numbers, if others are faster.
+	// It is important to subscribe before getting the current checkpoint, in case of a concurrent checkpoint update.
+	checkpoints := log.Checkpoints()
+	currentCheckpoint := log.GetCheckpoint()
+	for currentCheckpoint == nil || currentCheckpoint.Sn < seg.LastSN() {
+		currentCheckpoint = <-checkpoints
+	}
+	log.WaitForEntry(seg.LastSN())
+
+	// Update the last sequence number the orderer accepts messages for
+	to.lock.Lock()
+	if seg.LastSN() > to.last {
+		atomic.StoreInt32(&to.last, seg.LastSN())
+	}
+	to.lock.Unlock()
+
+	// This is only possible because of the existence of the stable checkpoint.
+	// Otherwise other segments could be affected, as the sequence numbers interleave.
+	to.backlog.gc <- seg.LastSN()
+	evidence.Prune(seg.LastSN())
+
+	// We just need any entry from this segment
+	ti, ok := to.dispatcher.load(seg.LastSN())
+	if !ok {
+		logger.Error().
+			Int("segId", seg.SegID()).
+			Msg("No instance available.")
+		return
+	}
+
+	// Close the message channel for the segment
+	logger.Info().Int("segID", seg.SegID()).Msg("Closing message serializers.")
+
+	ti.serializer.stop()
+	ti.stopProposing()
+
+	// Delete the tendermintInstance for the segment
+	for _, sn := range seg.SNs() {
+		to.dispatcher.delete(sn)
+	}
+}
+
+func (to *TendermintOrderer) Sign(data []byte) ([]byte, error) {
+	// TODO
+	return nil, nil
+}
+
+func (to *TendermintOrderer) CheckSig(data []byte, senderID int32, signature []byte) error {
+	// TODO
+	return nil
+}
@@ -36,11 +36,20 @@ func StartCPUTracing(trace tracing.Trace, interval time.Duration) {
 // Measures average CPU usage in the given time window and returns it as a floating point number between 0 and 1.
 // ATTENTION: Blocks for the duration of the time window!
 func GetCPUUsage(fields []string, window time.Duration) []float32 {
+	usage, err := readCPUUsage(fields, window)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Could not read statistics.")
+	}
+	return usage
+}
+
+// Like GetCPUUsage, but returns an error instead of exiting if the CPU statistics cannot be read.
+func readCPUUsage(fields []string, window time.Duration) ([]float32, error) {
 
 	// Get initial CPU stats
 	stat, err := linuxproc.ReadStat("/proc/stat")
 	if err != nil {
-		logger.Fatal().Err(err).Msg("Could not read statistics.")
+		return nil, err
 	}
 	oldCPUStat := stat.CPUStatAll
 
@@ -50,7 +59,7 @@ func GetCPUUsage(fields []string, window time.Duration) []float32 {
 	// Get new CPU stats
 	stat, err = linuxproc.ReadStat("/proc/stat")
 	if err != nil {
-		logger.Fatal().Err(err).Msg("Could not read statistics.")
+		return nil, err
 	}
 	newCPUStat := stat.CPUStatAll
 
@@ -102,7 +111,7 @@ func GetCPUUsage(fields []string, window time.Duration) []float32 {
 		}
 	}
 
-	return result
+	return result, nil
 }
 
 func sumCPUStat(stat linuxproc.CPUStat) uint64 {
@@ -0,0 +1,117 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiling
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rpprof "runtime/pprof"
+	"time"
+
+	logger "github.com/rs/zerolog/log"
+)
+
+// As opposed to the profilers started by StartProfiler(), which write their data to files when the process stops,
+// the debug server provides profiles of a running process on demand, over HTTP:
+// - /debug/pprof/          The net/http/pprof profiles, e.g. go tool pprof http://host:port/debug/pprof/profile?seconds=30
+// - /debug/goroutines      Stack traces of all goroutines, as text.
+// - /debug/cpu?window=1s   Machine CPU usage (see GetCPUUsage) over the given window, as JSON.
+// Only one CPU profile can be taken at a time. While StartProfiler("cpu", ...) is running, /debug/pprof/profile fails.
+
+// Default and maximal window of a CPU usage snapshot.
+const (
+	defaultCPUWindow = time.Second
+	maxCPUWindow     = time.Minute
+)
+
+// Fields of a CPU usage snapshot, in the order reported.
+var cpuFields = []string{"Load", "User", "Nice", "System", "Idle", "IOWait", "IRQ", "SoftIRQ", "Steal", "Guest", "GuestNice"}
+
+// Starts the debug server at addr (host:port). If the host is empty, the server binds to the loopback interface only.
+// If profileRate is positive, the block and mutex profilers are enabled with this rate / fraction
+// (see runtime.SetBlockProfileRate and runtime.SetMutexProfileFraction), otherwise their profiles stay empty.
+// Returns an error if the listening socket cannot be created. Serving itself happens in a separate goroutine.
+func StartDebugServer(addr string, profileRate int) error {
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	if profileRate > 0 {
+		runtime.SetBlockProfileRate(profileRate)
+		runtime.SetMutexProfileFraction(profileRate)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/goroutines", handleGoroutines)
+	mux.HandleFunc("/debug/cpu", handleCPUUsage)
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			logger.Error().Err(err).Str("addr", addr).Msg("Debug server stopped.")
+		}
+	}()
+	logger.Info().Str("addr", listener.Addr().String()).Int("profileRate", profileRate).Msg("Serving debug endpoints.")
+	return nil
+}
+
+func handleGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := rpprof.Lookup("goroutine").WriteTo(w, 2); err != nil {
+		logger.Error().Err(err).Msg("Could not write goroutine dump.")
+	}
+}
+
+func handleCPUUsage(w http.ResponseWriter, r *http.Request) {
+	window := defaultCPUWindow
+	if ws := r.URL.Query().Get("window"); ws != "" {
+		var err error
+		if window, err = time.ParseDuration(ws); err != nil || window <= 0 || window > maxCPUWindow {
+			http.Error(w, "window must be a positive duration of at most "+maxCPUWindow.String(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	usage, err := readCPUUsage(cpuFields, window)
+	if err != nil {
+		http.Error(w, "could not read CPU statistics: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	snapshot := struct {
+		Time   time.Time          `json:"time"`
+		Window string             `json:"window"`
+		Usage  map[string]float32 `json:"usage"` // Fraction of CPU time (between 0 and 1) per field.
+	}{Time: time.Now(), Window: window.String(), Usage: make(map[string]float32)}
+	for i, field := range cpuFields {
+		snapshot.Usage[field] = usage[i]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&snapshot); err != nil {
+		logger.Error().Err(err).Msg("Could not write CPU usage.")
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package request
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/messenger"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	"github.com/golang/protobuf/proto"
+	logger "github.com/rs/zerolog/log"
+)
+
+// Admission control of requests received from clients.
+// Before a request received from a client is added to its Buffer and Bucket, it must pass
+// the rate limit of its client, the global rate limit, and the limit on the total size of the requests in the buckets.
+// If the buckets are full, the request can still be admitted by evicting requests with lower fees.
+// Rejected and evicted requests are reported to their clients with a corresponding ClientResponse status.
+// Requests received in proposals of other peers are not subject to admission control,
+// as they must be accepted for the ordering protocol to make progress.
+
+var (
+	// Global rate limit on requests received from clients. Nil if not configured.
+	globalRateLimit *tokenBucket
+
+	// Total size (in bytes) of all requests currently in the buckets.
+	// Accessed atomically.
+	bucketBytes int64
+)
+
+// Token bucket rate limiter. Allows rate operations per second on average, with bursts of up to burst operations.
+type tokenBucket struct {
+	lock       sync.Mutex
+	rate       float64
+	burst      float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+// Creates a new (full) token bucket. Returns nil if rate is not positive, which stands for no limit.
+func newTokenBucket(rate int, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = rate
+	}
+	return &tokenBucket{
+		rate:       float64(rate),
+		burst:      float64(burst),
+		tokens:     float64(burst),
+		lastRefill: time.Now(),
+	}
+}
+
+// Refills the token bucket and takes one token from it, if available.
+// A nil token bucket never runs out of tokens.
+func (tb *tokenBucket) take() bool {
+	if tb == nil {
+		return true
+	}
+
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+
+	now := time.Now()
+	tb.tokens += now.Sub(tb.lastRefill).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.lastRefill = now
+
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// Initializes the global admission control data structures.
+func initAdmission(cfg *config.Configuration) {
+	globalRateLimit = newTokenBucket(cfg.AdmissionGlobalRate, cfg.AdmissionGlobalBurst)
+}
+
+// Decides whether a request received from a client can be added to the buckets.
+// If the buckets are full, tries to make room for the request by evicting requests with lower fees.
+// Returns pb.ClientResponse_COMMITTED if the request is admitted (it is not committed yet, of course,
+// but no rejection status applies), and the reason of the rejection otherwise.
+func admit(req *Request) pb.ClientResponse_Status {
+	if !req.Buffer.rateLimit.take() || !globalRateLimit.take() {
+		return pb.ClientResponse_RATE_LIMITED
+	}
+
+	cfg := req.Bucket.cfg
+	maxBytes := int64(cfg.AdmissionMaxBucketBytes)
+	if maxBytes <= 0 || atomic.LoadInt64(&bucketBytes)+int64(req.Size) <= maxBytes {
+		return pb.ClientResponse_COMMITTED
+	}
+
+	// Duplicates and requests outside their client's watermark window do not take space in the buckets
+	// (Add ignores or backlogs them), so other requests must not be evicted for them.
+	if !req.Buffer.inWindow(req.Msg.RequestId.ClientSn) || req.Bucket.indexed(req) {
+		return pb.ClientResponse_COMMITTED
+	}
+	if !cfg.AdmissionFeeEviction {
+		return pb.ClientResponse_MEMPOOL_FULL
+	}
+
+	// Evict requests with the lowest fees until the new request fits.
+	for atomic.LoadInt64(&bucketBytes)+int64(req.Size) > maxBytes {
+		victim := lowestFeeRequest(req.Fee)
+		if victim == nil {
+			return pb.ClientResponse_MEMPOOL_FULL
+		}
+		if victim.Bucket.evict(victim) {
+			logger.Debug().
+				Int32("clId", victim.Msg.RequestId.ClientId).
+				Int32("clSn", victim.Msg.RequestId.ClientSn).
+				Float64("fee", victim.Fee).
+				Float64("newFee", req.Fee).
+				Msg("Evicted request.")
+			reject(victim.Msg, pb.ClientResponse_EVICTED)
+		}
+	}
+	return pb.ClientResponse_COMMITTED
+}
+
+// Returns the request with the lowest fee (strictly lower than maxFee) in all the buckets
+// that is not in flight, or nil if there is none.
+func lowestFeeRequest(maxFee float64) *Request {
+	var lowest *Request
+	for _, b := range Buckets {
+		b.Lock()
+		for req := b.FirstRequest; req != nil; req = req.Next {
+			if !req.InFlight && req.Fee < maxFee && (lowest == nil || req.Fee < lowest.Fee) {
+				lowest = req
+			}
+		}
+		b.Unlock()
+	}
+	return lowest
+}
+
+// Reports the rejection of a request to its client.
+func reject(reqMsg *pb.ClientRequest, status pb.ClientResponse_Status) {
+	messenger.RespondToClient(reqMsg.RequestId.ClientId, &pb.ClientResponse{
+		ClientSn: reqMsg.RequestId.ClientSn,
+		OrderSn:  -1,
+		Status:   status,
+	})
+}
+
+// Returns the fee offered by the transaction contained in a request, or 0 if the payload is not a transaction.
+func requestFee(reqMsg *pb.ClientRequest) float64 {
+	tx := &pb.Transaction{}
+	if err := proto.Unmarshal(reqMsg.Payload, tx); err != nil {
+		return 0
+	}
+	return tx.Fee
+}
@@ -0,0 +1,243 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package request
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+)
+
+// Sets up two empty buckets with a configuration admitting up to maxBytes bytes of requests
+// and returns the configuration.
+func setupAdmission(t *testing.T, maxBytes int, feeEviction bool) *config.Configuration {
+	t.Cleanup(func() {
+		Buckets = nil
+		globalRateLimit = nil
+		atomic.StoreInt64(&bucketBytes, 0)
+	})
+
+	cfg := &config.Configuration{
+		NumBuckets:                2,
+		ClientWatermarkWindowSize: 10,
+		AdmissionMaxBucketBytes:   maxBytes,
+		AdmissionFeeEviction:      feeEviction,
+	}
+	Buckets = []*Bucket{NewBucket(0, cfg), NewBucket(1, cfg)}
+	globalRateLimit = nil
+	atomic.StoreInt64(&bucketBytes, 0)
+	return cfg
+}
+
+// Creates a request of 10 bytes with the given fee, in the bucket given by its client sequence number.
+func testRequest(buf *Buffer, clSn int32, fee float64) *Request {
+	return &Request{
+		Msg:      &pb.ClientRequest{RequestId: &pb.RequestID{ClientId: buf.ClientID, ClientSn: clSn}},
+		Digest:   []byte{byte(clSn)},
+		Buffer:   buf,
+		Bucket:   Buckets[int(clSn)%len(Buckets)],
+		Verified: true,
+		Size:     10,
+		Fee:      fee,
+	}
+}
+
+// Adds requests with the given fees to the buckets and returns them.
+func fillBuckets(t *testing.T, buf *Buffer, fees ...float64) []*Request {
+	reqs := make([]*Request, len(fees))
+	for i, fee := range fees {
+		reqs[i] = testRequest(buf, int32(i), fee)
+		if added, _ := reqs[i].Bucket.AddRequest(reqs[i]); added != reqs[i] {
+			t.Fatalf("could not add request %d", i)
+		}
+	}
+	return reqs
+}
+
+func TestTokenBucket(t *testing.T) {
+	if tb := newTokenBucket(0, 5); tb != nil || !tb.take() {
+		t.Fatalf("token bucket without rate limits")
+	}
+
+	tb := newTokenBucket(10, 3)
+	for i := 0; i < 3; i++ {
+		if !tb.take() {
+			t.Fatalf("token %d of the burst not available", i)
+		}
+	}
+	if tb.take() {
+		t.Fatalf("token available after the burst")
+	}
+
+	// After one second, the bucket is refilled up to the burst, not the rate.
+	tb.lastRefill = tb.lastRefill.Add(-time.Second)
+	for i := 0; i < 3; i++ {
+		if !tb.take() {
+			t.Fatalf("token %d not refilled", i)
+		}
+	}
+	if tb.take() {
+		t.Fatalf("token bucket refilled beyond its burst")
+	}
+
+	// The burst defaults to the rate.
+	if tb := newTokenBucket(7, 0); tb.burst != 7 || tb.tokens != 7 {
+		t.Fatalf("burst %f with %f tokens, expected 7", tb.burst, tb.tokens)
+	}
+}
+
+func TestLowestFeeRequest(t *testing.T) {
+	buf := NewBuffer(1, setupAdmission(t, 0, true))
+	reqs := fillBuckets(t, buf, 5, 3, 4, 1)
+
+	if got := lowestFeeRequest(10); got != reqs[3] {
+		t.Fatalf("lowest fee request is %v, expected request 3", got.Msg.RequestId)
+	}
+	if got := lowestFeeRequest(1); got != nil {
+		t.Fatalf("request with fee %f returned, expected none lower than 1", got.Fee)
+	}
+
+	// Requests in flight cannot be evicted.
+	reqs[3].InFlight = true
+	if got := lowestFeeRequest(10); got != reqs[1] {
+		t.Fatalf("lowest fee request is %v, expected request 1", got.Msg.RequestId)
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxBytes    int
+		feeEviction bool
+		fees        []float64 // Fees of the requests in the buckets (10 bytes each).
+		lowWM       int32     // Low watermark of the client.
+		clSn        int32     // Client sequence number of the new request.
+		fee         float64   // Fee of the new request.
+		want        pb.ClientResponse_Status
+		wantEvicted []int // Indices of the evicted requests.
+	}{
+		{
+			name: "unlimited",
+			fees: []float64{1, 2, 3},
+			clSn: 3,
+			fee:  1,
+			want: pb.ClientResponse_COMMITTED,
+		},
+		{
+			name:     "fits",
+			maxBytes: 40,
+			fees:     []float64{1, 2, 3},
+			clSn:     3,
+			fee:      1,
+			want:     pb.ClientResponse_COMMITTED,
+		},
+		{
+			name:     "full without eviction",
+			maxBytes: 30,
+			fees:     []float64{1, 2, 3},
+			clSn:     3,
+			fee:      5,
+			want:     pb.ClientResponse_MEMPOOL_FULL,
+		},
+		{
+			name:        "evicts lowest fee",
+			maxBytes:    30,
+			feeEviction: true,
+			fees:        []float64{2, 1, 3},
+			clSn:        3,
+			fee:         5,
+			want:        pb.ClientResponse_COMMITTED,
+			wantEvicted: []int{1},
+		},
+		{
+			name:        "evicts until the request fits",
+			maxBytes:    25,
+			feeEviction: true,
+			fees:        []float64{2, 1, 3},
+			clSn:        3,
+			fee:         5,
+			want:        pb.ClientResponse_COMMITTED,
+			wantEvicted: []int{0, 1},
+		},
+		{
+			name:        "no request with lower fee",
+			maxBytes:    30,
+			feeEviction: true,
+			fees:        []float64{2, 1, 3},
+			clSn:        3,
+			fee:         1,
+			want:        pb.ClientResponse_MEMPOOL_FULL,
+		},
+		{
+			name:        "duplicate does not evict",
+			maxBytes:    30,
+			feeEviction: true,
+			fees:        []float64{2, 1, 3},
+			clSn:        2,
+			fee:         5,
+			want:        pb.ClientResponse_COMMITTED,
+		},
+		{
+			name:        "request ahead of the watermark window does not evict",
+			maxBytes:    30,
+			feeEviction: true,
+			fees:        []float64{2, 1, 3},
+			clSn:        10,
+			fee:         5,
+			want:        pb.ClientResponse_COMMITTED,
+		},
+		{
+			name:        "request below the watermark window does not evict",
+			maxBytes:    30,
+			feeEviction: true,
+			fees:        []float64{2, 1, 3},
+			lowWM:       5,
+			clSn:        4,
+			fee:         5,
+			want:        pb.ClientResponse_COMMITTED,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := NewBuffer(1, setupAdmission(t, tc.maxBytes, tc.feeEviction))
+			reqs := fillBuckets(t, buf, tc.fees...)
+			buf.LowWatermark = tc.lowWM
+
+			req := testRequest(buf, tc.clSn, tc.fee)
+			if got := admit(req); got != tc.want {
+				t.Fatalf("admission status %s, expected %s", got, tc.want)
+			}
+
+			evicted := make(map[int]bool)
+			for _, i := range tc.wantEvicted {
+				evicted[i] = true
+			}
+			for i, r := range reqs {
+				inBucket := r.Prev != nil || r.Next != nil || r.Bucket.FirstRequest == r
+				if inBucket == evicted[i] || r.Bucket.indexed(r) == evicted[i] {
+					t.Errorf("request %d: in bucket %v, indexed %v, expected evicted %v",
+						i, inBucket, r.Bucket.indexed(r), evicted[i])
+				}
+			}
+			if want := int64(10 * (len(reqs) - len(tc.wantEvicted))); atomic.LoadInt64(&bucketBytes) != want {
+				t.Errorf("%d bytes in buckets, expected %d", atomic.LoadInt64(&bucketBytes), want)
+			}
+		})
+	}
+}
@@ -15,12 +15,12 @@
 package request
 
 import (
+	"encoding/binary"
 	"fmt"
 	"sync"
 	"sync/atomic"
 
 	logger "github.com/rs/zerolog/log"
-	"github.com/Hanzheng2021/Orthrus/config"
 	"github.com/Hanzheng2021/Orthrus/crypto"
 	"github.com/Hanzheng2021/Orthrus/membership"
 	pb "github.com/Hanzheng2021/Orthrus/protobufs"
@@ -100,12 +100,11 @@ func NewBatch(msg *pb.Batch) *Batch {
 	}
 
 	// Check signatures of the requests in the new batch.
-	if config.Config.SignRequests {
-		if err := newBatch.CheckSignatures(); err != nil {
-			logger.Fatal().Err(err).Msg("Invalid signature in new batch.")
-			// TODO: Instead of crashing, just return nil.
-			return nil
-		}
+	// If requests are not signed (SignRequests), the batch verifier accepts all batches.
+	if err := newBatch.CheckSignatures(); err != nil {
+		logger.Fatal().Err(err).Msg("Invalid signature in new batch.")
+		// TODO: Instead of crashing, just return nil.
+		return nil
 	}
 
 	return newBatch
@@ -222,6 +221,24 @@ func checkSignaturesExternal(b *Batch) bool {
 
 func BatchDigest(batch *pb.Batch) []byte {
 	metadata := make([]byte, 0, 0)
+
+	// If the requests have been disseminated separately, the certificates stand for them.
+	// This way, the digest is the same before and after the requests are filled in from the batch bodies.
+	if len(batch.Certificates) > 0 {
+		certDigests := make([][]byte, len(batch.Certificates), len(batch.Certificates))
+		for i, cert := range batch.Certificates {
+			certDigests[i] = cert.Digest
+		}
+		for _, ev := range batch.Evidence {
+			metadata = append(metadata, ev.GetFirst().GetSignature()...)
+			metadata = append(metadata, ev.GetSecond().GetSignature()...)
+		}
+		ts := make([]byte, 8)
+		binary.LittleEndian.PutUint64(ts, uint64(batch.ProposalTs))
+		metadata = append(metadata, ts...)
+		return crypto.ParallelDataArrayHash(append(certDigests, crypto.Hash(metadata)))
+	}
+
 	reqDigests := make([][]byte, len(batch.Requests), len(batch.Requests))
 	for i, req := range batch.Requests {
 		// Request id in bytes
@@ -232,5 +249,14 @@ func BatchDigest(batch *pb.Batch) []byte {
 		// Digest of the request
 		reqDigests[i] = Digest(req)
 	}
+	// Evidence of misbehavior attached to the batch (the signatures cover all the other evidence fields).
+	for _, ev := range batch.Evidence {
+		metadata = append(metadata, ev.GetFirst().GetSignature()...)
+		metadata = append(metadata, ev.GetSecond().GetSignature()...)
+	}
+	// Proposal timestamp
+	ts := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ts, uint64(batch.ProposalTs))
+	metadata = append(metadata, ts...)
 	return crypto.ParallelDataArrayHash(append(reqDigests, crypto.Hash(metadata)))
 }
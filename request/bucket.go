@@ -17,7 +17,10 @@ package request
 import (
 	"bytes"
 	"fmt"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Hanzheng2021/Orthrus/account"
 	"github.com/Hanzheng2021/Orthrus/config"
@@ -40,6 +43,9 @@ type Bucket struct {
 	// Currently only used for printing debug messages.
 	id int
 
+	// Configuration the bucket has been created with.
+	cfg *config.Configuration
+
 	// BucketGroup waiting to cut a batch of requests (also) from this Bucket.
 	// If no BucketGroup is waiting for this Bucket, group nil.
 	// Used for notifying the BucketGroup waiting to cut a batch about request additions.
@@ -63,11 +69,16 @@ type Bucket struct {
 	// Pointer to the end necessary for using the list as a FIFO queue.
 	// If set to nil, no requests are in the bucket (and FirstRequest also must be nil).
 	LastRequest *Request
+
+	// Index of the requests in the doubly linked list, ordered by decreasing fee.
+	// Only maintained in fee priority mode (FeePriority).
+	byFee feeIndex
 }
 
-func NewBucket(id int) *Bucket {
+func NewBucket(id int, cfg *config.Configuration) *Bucket {
 	return &Bucket{
 		id:       id,
+		cfg:      cfg,
 		reqIndex: make(map[int64]*Request),
 	}
 }
@@ -158,7 +169,7 @@ func (b *Bucket) addNoLock(newReq *Request) (*Request, bool) {
 		// If a verified request with a different digest is present in a bucket, ignore the new request.
 		// If the already present request was not verified, it might have been submitted by a faulty client,
 		// and the new request might be the correct one (that's why we need the other branches too).
-	} else if ok && (oldReq.Verified || !config.Config.SignRequests) {
+	} else if ok && (oldReq.Verified || !b.cfg.SignRequests) {
 		return nil, false
 
 		// The request already present has not yet been verified (and verification is enabled).
@@ -198,7 +209,7 @@ func (b *Bucket) addNoLock(newReq *Request) (*Request, bool) {
 	} else {
 
 		// Request retrial if only verified requests are allowed to go in the bucket and request is not verified.
-		if config.Config.SignRequests && config.Config.VerifyRequestsEarly && !newReq.Verified {
+		if b.cfg.SignRequests && b.cfg.VerifyRequestsEarly && !newReq.Verified {
 			return nil, true
 
 			// If request is either already verified or no verification is required to add reqeusts to the backet,
@@ -247,6 +258,8 @@ func (b *Bucket) append(r *Request) {
 	}
 	b.LastRequest = r
 	b.numRequests++
+	atomic.AddInt64(&bucketBytes, int64(r.Size))
+	b.indexFee(r)
 }
 
 func (b *Bucket) Prepend(req *Request) {
@@ -273,6 +286,8 @@ func (b *Bucket) Prepend(req *Request) {
 
 		// Update the bucket's request counter.
 		b.numRequests++
+		atomic.AddInt64(&bucketBytes, int64(req.Size))
+		b.indexFee(req)
 
 		// Notify bucket group if a batch is being cut.
 		if b.Group != nil {
@@ -316,6 +331,12 @@ func (b *Bucket) PrependMultiple(reqs []*Request) {
 
 	// Update the bucket's request counter.
 	b.numRequests += len(reqs)
+	size := 0
+	for _, req := range reqs {
+		size += req.Size
+		b.indexFee(req)
+	}
+	atomic.AddInt64(&bucketBytes, int64(size))
 }
 
 // Removes the first up to n Requests from the Bucket and appends them to dest.
@@ -362,6 +383,39 @@ func (b *Bucket) RemoveFirst(n int, dest []*Request) []*Request {
 	return dest
 }
 
+// Removes up to n Requests with the highest fees from the Bucket and appends them to dest.
+// To prevent starvation of requests with low fees, requests waiting in the Bucket for longer than
+// FeePriorityMaxAge are taken first (in FIFO order), regardless of their fees.
+// Returns the resulting slice obtained by appending the Requests to dest.
+// Must only be used in fee priority mode (FeePriority).
+// ATTENTION: Bucket must be LOCKED when calling this method.
+func (b *Bucket) RemoveHighestFee(n int, dest []*Request) []*Request {
+	pendingRequests := make([]*Request, 0, 0)
+	maxAge := time.Duration(b.cfg.FeePriorityMaxAge) * time.Millisecond
+
+	// take moves a request to dest if it is valid and sets it aside otherwise (like RemoveFirst()).
+	take := func(req *Request) {
+		b.removeNoLock(req)
+		if account.RequestIsValid(req.Msg) {
+			dest = append(dest, req)
+			n--
+		} else {
+			pendingRequests = append(pendingRequests, req)
+		}
+	}
+
+	// The list is ordered by reception time, except for resurrected requests, which are prepended (and are old anyway).
+	for n > 0 && b.FirstRequest != nil && time.Since(b.FirstRequest.Received) > maxAge {
+		take(b.FirstRequest)
+	}
+	for n > 0 && len(b.byFee) > 0 {
+		take(b.byFee[0])
+	}
+
+	b.PrependMultiple(pendingRequests)
+	return dest
+}
+
 // Removes each Request in req from the Bucket if it is present, but NOT from the index (see removeNoLock()).
 func (b *Bucket) Remove(reqs []*Request) {
 	b.Lock()
@@ -423,9 +477,44 @@ func (b *Bucket) removeNoLock(req *Request) {
 	// Mark request as not in a bucket.
 	req.Prev = nil
 	req.Next = nil
+	b.unindexFee(req)
 
 	// Decrement number of requests in batch.
 	b.numRequests--
+	atomic.AddInt64(&bucketBytes, -int64(req.Size))
+}
+
+// Removes a request that is not in flight from the bucket and from the index, making room for other requests.
+// As opposed to removeNoLock(), the request is also removed from the index, so the client can submit it again.
+// Returns false if the request is not in the bucket (any more) or is in flight.
+func (b *Bucket) evict(req *Request) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if req.InFlight || (req.Next == nil && req.Prev == nil && b.FirstRequest != req) {
+		return false
+	}
+	b.removeNoLock(req)
+	b.unindexNoLock(req)
+	return true
+}
+
+// Returns true if a request with the same request ID is present in the Bucket's request index.
+func (b *Bucket) indexed(req *Request) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	_, ok := b.reqIndex[int64(req.Msg.RequestId.ClientId)<<32+int64(req.Msg.RequestId.ClientSn)]
+	return ok
+}
+
+// Removes the index entry of a request (if it is still indexed), such that an identical request can be added again.
+// ATTENTION: Bucket must be LOCKED when calling this method.
+func (b *Bucket) unindexNoLock(req *Request) {
+	reqID := int64(req.Msg.RequestId.ClientId)<<32 + int64(req.Msg.RequestId.ClientSn)
+	if b.reqIndex[reqID] == req {
+		delete(b.reqIndex, reqID)
+	}
 }
 
 // Removes the index entry for all the requests present in the given Log entries.
@@ -445,7 +534,7 @@ func (b *Bucket) PruneIndex(watermarks *sync.Map) { // expected map type of wate
 			if b.reqIndex[reqID] == nil {
 				continue
 			}
-			if GetBucketNr(clID.(int32), clSN, b.reqIndex[reqID].Msg.RequestId.SenderId) == b.id {
+			if GetBucketNr(clID.(int32), clSN, b.reqIndex[reqID].Msg.RequestId.SenderId, b.cfg.NumBuckets) == b.id {
 
 				delete(b.reqIndex, reqID)
 			}
@@ -457,6 +546,18 @@ func (b *Bucket) PruneIndex(watermarks *sync.Map) { // expected map type of wate
 	logger.Debug().Int("bucketId", b.id).Int("reqLeft", b.Len()).Msg("Pruned Bucket index.")
 }
 
+// Returns the number of requests in each bucket, indexed by bucket ID.
+// Called when the metrics are scraped (see metrics.BucketSize).
+func bucketSizes() map[string]int64 {
+	sizes := make(map[string]int64, len(Buckets))
+	for _, b := range Buckets {
+		b.Lock()
+		sizes[strconv.Itoa(b.id)] = int64(b.numRequests)
+		b.Unlock()
+	}
+	return sizes
+}
+
 // TODO: Remove these debug functions.
 
 func (b *Bucket) print() {
@@ -54,13 +54,17 @@ type BucketGroup struct {
 	// It is useful to limit the rate at which data is put on the wire, decreasing the likelihood of view changes
 	// when too much data is sent out concurrently.
 	nextBatchTimestamp int64
+
+	// Configuration the bucket group has been created with.
+	cfg *config.Configuration
 }
 
 // Creates a new BucketGroup and returns a pointer to it.
 // The buckets parameter is a list of bucket IDs. NewBucketGroup() sorts this list!
 // Sorting by bucket ID is important to prevent deadlocks, as buckets are always locked in the order of this list.
 // NOTE: Currently there is always only one bucket group, so these deadlocks cannot occur, but this might change.
-func NewBucketGroup(bucketIDs []int) *BucketGroup {
+// The cfg parameter determines the batch cutting policy (FeePriority, ThroughputCap, FixBatchRate).
+func NewBucketGroup(bucketIDs []int, cfg *config.Configuration) *BucketGroup {
 
 	// Sort bucket IDs.
 	sort.Ints(bucketIDs)
@@ -78,6 +82,7 @@ func NewBucketGroup(bucketIDs []int) *BucketGroup {
 		timer:              nil,
 		batchTrigger:       make(chan struct{}),
 		nextBatchTimestamp: 0,
+		cfg:                cfg,
 	}
 }
 
@@ -112,13 +117,19 @@ func (bg *BucketGroup) CutBatch(size int, timeout time.Duration) *Batch {
 		initCut = int(bg.totalRequests) / len(bg.buckets)
 	}
 
+	// In fee priority mode, prefer requests with higher fees over older requests.
+	remove := (*Bucket).RemoveFirst
+	if bg.cfg.FeePriority {
+		remove = (*Bucket).RemoveHighestFee
+	}
+
 	logger.Debug().
 		Int("nBuckets", len(bg.buckets)).
 		Msg("bd.buckets length")
 	// Add initial requests to the batch.
 	for _, b := range bg.buckets {
 		// logger.Debug().Int("bg.buckets", i).Msg("i th buckets")
-		newBatch.Requests = b.RemoveFirst(initCut, newBatch.Requests)
+		newBatch.Requests = remove(b, initCut, newBatch.Requests)
 	}
 
 	// Fill rest of the batch with any requests, iterating over all buckets.
@@ -127,7 +138,7 @@ func (bg *BucketGroup) CutBatch(size int, timeout time.Duration) *Batch {
 		// If we are still missing some requests
 		if len(newBatch.Requests) < size {
 			// Add up to the missing number of requests (size - len(newBatch.Requests)).
-			newBatch.Requests = b.RemoveFirst(size-len(newBatch.Requests), newBatch.Requests)
+			newBatch.Requests = remove(b, size-len(newBatch.Requests), newBatch.Requests)
 
 			// Stop iterating over buckets if enough requests were collected.
 		} else {
@@ -143,10 +154,10 @@ func (bg *BucketGroup) CutBatch(size int, timeout time.Duration) *Batch {
 	// If, for some reason, too many batches are sent concurrently (e.g. when the bucket is very full),
 	// all of them will be slow, increasing the likelihood of timeouts.
 	totalReq := len(newBatch.Requests) * membership.NumNodes()
-	if config.Config.LeaderPolicy == "Single" {
+	if bg.cfg.LeaderPolicy == "Single" {
 		totalReq /= membership.NumNodes() // For Single leader policy, use the raw throughput cap, not adjusted to system size.
 	}
-	waitingTime := 1000000000 * int64(totalReq/config.Config.ThroughputCap) // In nanoseconds
+	waitingTime := 1000000000 * int64(totalReq/bg.cfg.ThroughputCap) // In nanoseconds
 	// waitingTime := int64(1000000000) // In nanoseconds
 	atomic.StoreInt64(&bg.nextBatchTimestamp, time.Now().UnixNano()+waitingTime)
 
@@ -182,7 +193,7 @@ func (bg *BucketGroup) waitForRequestsLocked(numRequests int, timeout time.Durat
 
 	// If FixBatchRate, wait until timeout.
 	// Otherwise, if there are enough requests in the bucket, return immediately.
-	if (config.Config.FixBatchRate && (int(bg.totalRequests) >= numRequests && timeout == 0)) || (!config.Config.FixBatchRate && (int(bg.totalRequests) >= numRequests || timeout == 0)) {
+	if (bg.cfg.FixBatchRate && (int(bg.totalRequests) >= numRequests && timeout == 0)) || (!bg.cfg.FixBatchRate && (int(bg.totalRequests) >= numRequests || timeout == 0)) {
 		return
 	}
 
@@ -38,12 +38,15 @@ type Buffer struct {
 	// ID of the client this buffer is associated to.
 	ClientID int32
 
+	// Configuration the buffer has been created with.
+	cfg *config.Configuration
+
 	// Start of the client watermark window (as seen locally by the replica).
 	// All ClientRequests with SNs lower than LowWatermark were present in the past,
 	// but are now removed from the buffer.
 	// Only requests with sequence numbers between LowWatermark
-	// and (LowWatermark + config.Config.ClientWatermarkWindowSize) can be added to the buffer.
-	// Additionaly, up to config.Config.ClientRequestBacklogSize requests will be stored in the buffer's backlog
+	// and (LowWatermark + ClientWatermarkWindowSize) can be added to the buffer.
+	// Additionaly, up to ClientRequestBacklogSize requests will be stored in the buffer's backlog
 	// and added automatically when LowWatermark increases in Buffer.AdvanceWatermarks()
 	LowWatermark int32
 
@@ -56,15 +59,20 @@ type Buffer struct {
 	// when the client watermarks advance.
 	backlog *util.ChannelBuffer
 	//backlog []*pb.ClientRequest
+
+	// Limits the rate at which the client can submit requests. Nil if no limit is configured.
+	rateLimit *tokenBucket
 }
 
 // Allocates and returns a new Buffer.
-func NewBuffer(clientID int32) *Buffer {
+func NewBuffer(clientID int32, cfg *config.Configuration) *Buffer {
 	return &Buffer{
 		ClientID:          clientID,
+		cfg:               cfg,
 		LowWatermark:      0,
 		requestsCommitted: make(map[int32]bool),
-		backlog:           util.NewChannelBuffer(config.Config.ClientRequestBacklogSize),
+		backlog:           util.NewChannelBuffer(cfg.ClientRequestBacklogSize),
+		rateLimit:         newTokenBucket(cfg.AdmissionClientRate, cfg.AdmissionClientBurst),
 	}
 }
 
@@ -83,7 +91,7 @@ func (b *Buffer) Add(req *Request) bool {
 
 	// Convenience variables
 	clientSN := req.Msg.RequestId.ClientSn
-	clientWatermarkWindowSize := int32(config.Config.ClientWatermarkWindowSize)
+	clientWatermarkWindowSize := int32(b.cfg.ClientWatermarkWindowSize)
 
 	// Request is ahead of the client watermark window.
 	// Try backlogging it, if backlogging fails, ignore it.
@@ -125,6 +133,14 @@ func (b *Buffer) Add(req *Request) bool {
 	}
 }
 
+// Returns true if the client sequence number is within the current client watermark window.
+func (b *Buffer) inWindow(clientSN int32) bool {
+	b.RLock()
+	defer b.RUnlock()
+
+	return clientSN >= b.LowWatermark && clientSN < b.LowWatermark+int32(b.cfg.ClientWatermarkWindowSize)
+}
+
 // Processes log entries for advancing the client watermark.
 // Tries to add requests from the backlog back to the buffer
 // (since some of them might be now in the watermark window).
@@ -164,7 +180,8 @@ func (b *Buffer) AdvanceWatermarks(entries []interface{}) watermarkRange { // ex
 	// we avoid holding on to the lock during verification.
 	// b.backlog.Get() is called before starting the goroutine (i.e. while the buffer is still locked)
 	// to prevent unnecessary handling of concurrently backlogged requests.
-	go b.processBacklog(b.backlog.Get())
+	// Expired requests are discarded right away, so that all of them are gone when the watermarks have advanced.
+	go b.processBacklog(dropExpiredBacklog(b.backlog.Get()))
 
 	logger.Debug().
 		Int32("clientId", b.ClientID).
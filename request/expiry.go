@@ -0,0 +1,148 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package request
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/Hanzheng2021/Orthrus/log"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	logger "github.com/rs/zerolog/log"
+)
+
+// Expiry of client requests.
+// A client can limit the validity of a request by setting its ValidUntilSn field.
+// Such a request must not be committed at a sequence number greater than ValidUntilSn.
+// Leaders drop expired requests from their batches before proposing them and followers reject proposals
+// containing requests that are expired at the proposal's sequence number.
+// Requests that cannot be committed any more are garbage-collected from the Buckets and the Buffers' backlogs
+// whenever the client watermarks advance (i.e., at the end of an epoch).
+// As all peers have committed the same entries at that point, all of them drop the same requests.
+
+// Highest sequence number of the entries processed by the last advancement of the client watermarks.
+// Requests expired at the next sequence number can never be committed any more.
+// Accessed atomically.
+var committedSn int32 = -1
+
+// Returns true if the request must not be committed at sequence number sn.
+func Expired(reqMsg *pb.ClientRequest, sn int32) bool {
+	return reqMsg.ValidUntilSn != 0 && sn > reqMsg.ValidUntilSn
+}
+
+// Returns true if the request cannot be committed any more, as it expires before the next uncommitted sequence number.
+func expiredAtCommitted(reqMsg *pb.ClientRequest) bool {
+	return Expired(reqMsg, atomic.LoadInt32(&committedSn)+1)
+}
+
+// Checks if the batch contains requests that must not be committed at sequence number sn.
+// If the batch has expired requests the method returns an error.
+func (b *Batch) CheckExpired(sn int32) error {
+	for _, req := range b.Requests {
+		if Expired(req.Msg, sn) {
+			return fmt.Errorf("request %d from %d expired at %d", req.Msg.RequestId.ClientSn, req.Msg.RequestId.ClientId, req.Msg.ValidUntilSn)
+		}
+	}
+	return nil
+}
+
+// Removes the requests that must not be committed at sequence number sn from a freshly cut batch and discards them.
+// Called by the leader before proposing the batch for sn.
+// The requests in the batch must not be in flight yet.
+func (b *Batch) DropExpired(sn int32) {
+	valid := b.Requests[:0]
+	for _, req := range b.Requests {
+		if Expired(req.Msg, sn) {
+			req.Bucket.Lock()
+			req.Bucket.unindexNoLock(req)
+			req.Bucket.Unlock()
+			logExpired(req, sn)
+			reject(req.Msg, pb.ClientResponse_EXPIRED)
+		} else {
+			valid = append(valid, req)
+		}
+	}
+	b.Requests = valid
+}
+
+// Records the highest sequence number of the given log entries as committed.
+// Called when the client watermarks advance, before the Buffers re-add their backlogged requests,
+// so that requests expired at the end of the entries are dropped from the backlogs.
+func advanceCommittedSn(entries []interface{}) { // expected type of entries: []*log.Entry
+	sn := atomic.LoadInt32(&committedSn)
+	for _, entry := range entries {
+		if entry.(*log.Entry).Sn > sn {
+			sn = entry.(*log.Entry).Sn
+		}
+	}
+	atomic.StoreInt32(&committedSn, sn)
+}
+
+// Removes all requests that cannot be committed any more after the committed entries from the Buckets.
+// Called when the client watermarks advance, after advanceCommittedSn.
+func collectExpired() {
+	sn := atomic.LoadInt32(&committedSn)
+	for _, b := range Buckets {
+		for _, req := range b.removeExpired(sn + 1) {
+			logExpired(req, sn+1)
+			reject(req.Msg, pb.ClientResponse_EXPIRED)
+		}
+	}
+}
+
+// Discards the requests that cannot be committed any more from the requests taken from a Buffer's backlog
+// and returns the remaining ones.
+func dropExpiredBacklog(requests []interface{}) []interface{} { // expected type of requests: []*Request
+	sn := atomic.LoadInt32(&committedSn) + 1
+	valid := requests[:0]
+	for _, r := range requests {
+		req := r.(*Request)
+		if Expired(req.Msg, sn) {
+			logExpired(req, sn)
+			reject(req.Msg, pb.ClientResponse_EXPIRED)
+		} else {
+			valid = append(valid, r)
+		}
+	}
+	return valid
+}
+
+// Removes all requests that are not in flight and must not be committed at sequence number sn from the Bucket
+// and its index. Returns the removed requests.
+func (b *Bucket) removeExpired(sn int32) []*Request {
+	b.Lock()
+	defer b.Unlock()
+
+	expired := make([]*Request, 0)
+	for req := b.FirstRequest; req != nil; {
+		next := req.Next
+		if !req.InFlight && Expired(req.Msg, sn) {
+			b.removeNoLock(req)
+			b.unindexNoLock(req)
+			expired = append(expired, req)
+		}
+		req = next
+	}
+	return expired
+}
+
+func logExpired(req *Request, sn int32) {
+	logger.Debug().
+		Int32("clId", req.Msg.RequestId.ClientId).
+		Int32("clSn", req.Msg.RequestId.ClientSn).
+		Int32("validUntil", req.Msg.ValidUntilSn).
+		Int32("sn", sn).
+		Msg("Dropping expired request.")
+}
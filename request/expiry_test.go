@@ -0,0 +1,49 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package request
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/Hanzheng2021/Orthrus/log"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+)
+
+func TestDropExpiredBacklog(t *testing.T) {
+	defer atomic.StoreInt32(&committedSn, -1)
+	atomic.StoreInt32(&committedSn, -1)
+	advanceCommittedSn([]interface{}{&log.Entry{Sn: 9}, &log.Entry{Sn: 7}})
+
+	backlog := make([]interface{}, 0)
+	for clSn, validUntil := range []int32{0, 5, 9, 10, 20} {
+		backlog = append(backlog, &Request{Msg: &pb.ClientRequest{
+			RequestId:    &pb.RequestID{ClientId: 1, ClientSn: int32(clSn)},
+			ValidUntilSn: validUntil,
+		}})
+	}
+
+	// Sequence numbers up to 9 are committed, so only requests valid at 10 can still be committed.
+	valid := dropExpiredBacklog(backlog)
+	want := []int32{0, 3, 4}
+	if len(valid) != len(want) {
+		t.Fatalf("%d requests left in backlog, expected %d", len(valid), len(want))
+	}
+	for i, r := range valid {
+		if clSn := r.(*Request).Msg.RequestId.ClientSn; clSn != want[i] {
+			t.Errorf("request %d left in backlog, expected %d", clSn, want[i])
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package request
+
+import "container/heap"
+
+// Max-heap of requests ordered by fee. Requests with equal fees are ordered by reception time.
+// Implements heap.Interface. Each request stores its position in the heap (see Request.feePos),
+// so it can be removed from the heap in logarithmic time when it is removed from its bucket.
+type feeIndex []*Request
+
+func (fi feeIndex) Len() int {
+	return len(fi)
+}
+
+func (fi feeIndex) Less(i, j int) bool {
+	if fi[i].Fee != fi[j].Fee {
+		return fi[i].Fee > fi[j].Fee
+	}
+	return fi[i].Received.Before(fi[j].Received)
+}
+
+func (fi feeIndex) Swap(i, j int) {
+	fi[i], fi[j] = fi[j], fi[i]
+	fi[i].feePos = i + 1
+	fi[j].feePos = j + 1
+}
+
+func (fi *feeIndex) Push(x interface{}) {
+	req := x.(*Request)
+	*fi = append(*fi, req)
+	req.feePos = len(*fi)
+}
+
+func (fi *feeIndex) Pop() interface{} {
+	old := *fi
+	req := old[len(old)-1]
+	old[len(old)-1] = nil
+	*fi = old[:len(old)-1]
+	req.feePos = 0
+	return req
+}
+
+// Adds a request that has just been inserted in the bucket to the fee index.
+// Does nothing if not in fee priority mode.
+// ATTENTION: Bucket must be LOCKED when calling this method.
+func (b *Bucket) indexFee(req *Request) {
+	if b.cfg.FeePriority && req.feePos == 0 {
+		heap.Push(&b.byFee, req)
+	}
+}
+
+// Removes a request that has just been removed from the bucket from the fee index.
+// ATTENTION: Bucket must be LOCKED when calling this method.
+func (b *Bucket) unindexFee(req *Request) {
+	if req.feePos > 0 {
+		heap.Remove(&b.byFee, req.feePos-1)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package request
+
+import (
+	"container/heap"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+)
+
+// Sets up fee priority mode and returns an empty bucket.
+func setupFeePriority(t *testing.T) *Bucket {
+	t.Cleanup(func() {
+		atomic.StoreInt64(&bucketBytes, 0)
+	})
+
+	return NewBucket(0, &config.Configuration{FeePriority: true, FeePriorityMaxAge: 1000})
+}
+
+// Adds requests with the given fees to the bucket, the i-th one received age[i] ago (if present),
+// and returns them.
+func addFeeRequests(t *testing.T, b *Bucket, fees []float64, ages []time.Duration) []*Request {
+	now := time.Now()
+	reqs := make([]*Request, len(fees))
+	for i, fee := range fees {
+		received := now.Add(time.Duration(i) * time.Microsecond)
+		if i < len(ages) {
+			received = now.Add(-ages[i])
+		}
+		reqs[i] = &Request{
+			Msg:      &pb.ClientRequest{RequestId: &pb.RequestID{ClientId: 1, ClientSn: int32(i)}},
+			Digest:   []byte{byte(i)},
+			Bucket:   b,
+			Verified: true,
+			Fee:      fee,
+			Received: received,
+		}
+		if added, _ := b.AddRequest(reqs[i]); added != reqs[i] {
+			t.Fatalf("could not add request %d", i)
+		}
+	}
+	return reqs
+}
+
+// Returns the client sequence numbers of the requests.
+func clientSNs(reqs []*Request) []int32 {
+	sns := make([]int32, len(reqs))
+	for i, req := range reqs {
+		sns[i] = req.Msg.RequestId.ClientSn
+	}
+	return sns
+}
+
+func equalSNs(a []int32, b []int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks that the fee index contains exactly the requests in the bucket and that their positions are consistent.
+func checkFeeIndex(t *testing.T, b *Bucket) {
+	t.Helper()
+	if b.byFee.Len() != b.Len() {
+		t.Fatalf("%d requests in fee index, %d in bucket", b.byFee.Len(), b.Len())
+	}
+	for req := b.FirstRequest; req != nil; req = req.Next {
+		if req.feePos < 1 || req.feePos > len(b.byFee) || b.byFee[req.feePos-1] != req {
+			t.Fatalf("request %d at wrong position %d of fee index", req.Msg.RequestId.ClientSn, req.feePos)
+		}
+	}
+}
+
+func TestFeeIndex(t *testing.T) {
+	b := setupFeePriority(t)
+	reqs := addFeeRequests(t, b, []float64{3, 5, 1, 5, 2}, nil)
+	checkFeeIndex(t, b)
+
+	// Removing a request from the bucket removes it from the index.
+	b.Lock()
+	b.removeNoLock(reqs[0])
+	b.Unlock()
+	if reqs[0].feePos != 0 {
+		t.Fatalf("removed request still indexed at %d", reqs[0].feePos)
+	}
+	checkFeeIndex(t, b)
+
+	// Highest fees first, equal fees in order of reception.
+	popped := make([]*Request, 0)
+	for b.byFee.Len() > 0 {
+		popped = append(popped, heap.Pop(&b.byFee).(*Request))
+	}
+	if got, want := clientSNs(popped), []int32{1, 3, 4, 2}; !equalSNs(got, want) {
+		t.Fatalf("fee order %v, expected %v", got, want)
+	}
+}
+
+func TestBucket_RemoveHighestFee(t *testing.T) {
+	tests := []struct {
+		name     string
+		fees     []float64
+		ages     []time.Duration // Time since the reception of the first requests. Later requests are fresh.
+		n        int
+		want     []int32 // Client sequence numbers of the removed requests, in order.
+		wantLeft []int32 // Client sequence numbers of the requests left in the bucket, in order.
+	}{
+		{
+			name:     "highest fees first",
+			fees:     []float64{1, 4, 2, 3},
+			n:        2,
+			want:     []int32{1, 3},
+			wantLeft: []int32{0, 2},
+		},
+		{
+			name:     "equal fees in order of reception",
+			fees:     []float64{2, 2, 2},
+			n:        2,
+			want:     []int32{0, 1},
+			wantLeft: []int32{2},
+		},
+		{
+			name:     "aged requests bypass fees",
+			fees:     []float64{1, 2, 10, 9},
+			ages:     []time.Duration{3 * time.Second, 2 * time.Second},
+			n:        3,
+			want:     []int32{0, 1, 2},
+			wantLeft: []int32{3},
+		},
+		{
+			name:     "aged requests limited by n",
+			fees:     []float64{1, 2, 10},
+			ages:     []time.Duration{3 * time.Second, 2 * time.Second},
+			n:        1,
+			want:     []int32{0},
+			wantLeft: []int32{1, 2},
+		},
+		{
+			name:     "fewer requests than n",
+			fees:     []float64{1, 3, 2},
+			n:        5,
+			want:     []int32{1, 2, 0},
+			wantLeft: []int32{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := setupFeePriority(t)
+			addFeeRequests(t, b, tc.fees, tc.ages)
+
+			b.Lock()
+			removed := b.RemoveHighestFee(tc.n, make([]*Request, 0))
+			b.Unlock()
+
+			if got := clientSNs(removed); !equalSNs(got, tc.want) {
+				t.Errorf("removed %v, expected %v", got, tc.want)
+			}
+			left := make([]*Request, 0)
+			for req := b.FirstRequest; req != nil; req = req.Next {
+				left = append(left, req)
+			}
+			if got := clientSNs(left); !equalSNs(got, tc.wantLeft) {
+				t.Errorf("left %v in bucket, expected %v", got, tc.wantLeft)
+			}
+			checkFeeIndex(t, b)
+		})
+	}
+}
+
+func TestBucket_RemoveHighestFeeResurrect(t *testing.T) {
+	b := setupFeePriority(t)
+	addFeeRequests(t, b, []float64{1, 4, 2, 3}, nil)
+
+	b.Lock()
+	batch := &Batch{Requests: b.RemoveHighestFee(2, make([]*Request, 0))}
+	b.Unlock()
+	batch.MarkInFlight()
+	checkFeeIndex(t, b)
+
+	// Resurrected requests are re-indexed by fee and are taken again before requests with lower fees.
+	batch.Resurrect()
+	checkFeeIndex(t, b)
+	if b.Len() != 4 {
+		t.Fatalf("%d requests in bucket after resurrection, expected 4", b.Len())
+	}
+	b.Lock()
+	removed := b.RemoveHighestFee(3, make([]*Request, 0))
+	b.Unlock()
+	if got, want := clientSNs(removed), []int32{1, 3, 2}; !equalSNs(got, want) {
+		t.Fatalf("removed %v after resurrection, expected %v", got, want)
+	}
+	checkFeeIndex(t, b)
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package request
+
+import (
+	"sync"
+
+	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/membership"
+	"github.com/Hanzheng2021/Orthrus/messenger"
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	logger "github.com/rs/zerolog/log"
+)
+
+// Forwarding of client requests to the current leader of their bucket.
+// A client may send its requests to any single peer. If that peer does not lead the request's bucket,
+// it still stores the request, but also forwards it to the leader, so the request is proposed without waiting
+// for the client to find the leader (or for the bucket to be assigned to this peer).
+// Forwarded requests are never forwarded again.
+
+// Identifies a forwarded request together with the peer it has been forwarded to.
+// A request is forwarded again if its bucket is assigned to a different leader (e.g. after an epoch change).
+type forwardKey struct {
+	clientID int32
+	clientSN int32
+	leader   int32
+}
+
+var (
+	// Whether requests received from clients are forwarded (ForwardRequests).
+	forwardRequests bool
+
+	// Maximal number of forwarded requests remembered (RequestForwardDedupSize).
+	forwardDedupSize int
+
+	// Recently forwarded requests, used for not forwarding the same request (e.g. resubmitted by its client) twice.
+	// The keys are also stored in the order of forwarding, so the oldest can be evicted
+	// when more than forwardDedupSize requests are remembered.
+	forwarded      = make(map[forwardKey]bool)
+	forwardedOrder = make([]forwardKey, 0)
+
+	// Guards the above variables.
+	forwardLock sync.Mutex
+
+	// Limits the rate of forwarded requests to RequestForwardRate (with a burst of the same size).
+	forwardBudget *tokenBucket
+)
+
+// Initializes request forwarding with the given configuration.
+func initForwarding(cfg *config.Configuration) {
+	forwardRequests = cfg.ForwardRequests
+	forwardDedupSize = cfg.RequestForwardDedupSize
+	forwardBudget = newTokenBucket(cfg.RequestForwardRate, cfg.RequestForwardRate)
+}
+
+// Adds a request received from a client, unless it is rejected by admission control,
+// and, if configured, forwards it to the leader of its bucket.
+func handleClientRequest(reqMsg *pb.ClientRequest) {
+	req := newRequest(reqMsg)
+	if status := admit(req); status != pb.ClientResponse_COMMITTED {
+		logger.Debug().
+			Int32("clId", reqMsg.RequestId.ClientId).
+			Int32("clSn", reqMsg.RequestId.ClientSn).
+			Str("status", status.String()).
+			Msg("Rejected request.")
+		reject(reqMsg, status)
+		return
+	}
+	if Add(req) != nil && forwardRequests {
+		forward(reqMsg)
+	}
+}
+
+// This function is used by the messenger as the handler function for requests forwarded by other peers.
+// Adds the request to the corresponding request buffer (but does not forward it further).
+// As the number of forwarded requests is limited by the forwarding budget of the other peers,
+// they are added directly, without going through the request handler threads.
+func HandleForwardedRequest(req *pb.ClientRequest, senderID int32) {
+	logger.Trace().
+		Int32("clId", req.RequestId.ClientId).
+		Int32("clSn", req.RequestId.ClientSn).
+		Int32("senderID", senderID).
+		Msg("Received forwarded request.")
+
+	AddReqMsg(req)
+}
+
+// Sends a request to the current leader of its bucket, unless this peer is the leader,
+// the request has already been forwarded to the leader, or the forwarding budget is exhausted.
+func forward(req *pb.ClientRequest) {
+	leader, ok := messenger.BucketLeader(getBucket(req).GetId())
+	if !ok || leader == membership.OwnID {
+		return
+	}
+
+	key := forwardKey{clientID: req.RequestId.ClientId, clientSN: req.RequestId.ClientSn, leader: leader}
+
+	forwardLock.Lock()
+	if forwarded[key] {
+		forwardLock.Unlock()
+		return
+	}
+	if !forwardBudget.take() {
+		forwardLock.Unlock()
+		logger.Debug().
+			Int32("clId", key.clientID).
+			Int32("clSn", key.clientSN).
+			Msg("Forwarding budget exhausted. Not forwarding request.")
+		return
+	}
+	forwarded[key] = true
+	forwardedOrder = append(forwardedOrder, key)
+	if len(forwardedOrder) > forwardDedupSize {
+		delete(forwarded, forwardedOrder[0])
+		forwardedOrder = forwardedOrder[1:]
+	}
+	forwardLock.Unlock()
+
+	messenger.EnqueueMsg(&pb.ProtocolMessage{
+		SenderId: membership.OwnID,
+		Sn:       -1,
+		Msg:      &pb.ProtocolMessage_ForwardedRequest{ForwardedRequest: req},
+	}, leader)
+}
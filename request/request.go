@@ -17,11 +17,14 @@ package request
 import (
 	"encoding/binary"
 	"sync"
+	"time"
 
 	"github.com/Hanzheng2021/Orthrus/config"
 	"github.com/Hanzheng2021/Orthrus/crypto"
 	"github.com/Hanzheng2021/Orthrus/membership"
+	"github.com/Hanzheng2021/Orthrus/metrics"
 	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	"github.com/golang/protobuf/proto"
 	logger "github.com/rs/zerolog/log"
 )
 
@@ -29,7 +32,7 @@ var (
 	// Uncommitted requests received from clients, organized in buffers indexed by client ID.
 	// For each known client, this map (indexed by client ID) contains a buffer of requests from that client.
 	// This data structure is necessary to filter out ClientRequests that are outside of the client watermark window.
-	// It buffers up to config.Config.ClientRequestBacklogSize client requests ahead of the watermark window.
+	// It buffers up to ClientRequestBacklogSize client requests ahead of the watermark window.
 	buffers = make(map[int32]*Buffer)
 
 	// Lock to guard the map of request Buffers.
@@ -46,7 +49,7 @@ var (
 	Buckets []*Bucket
 
 	// Channels to which gRPC threads are writing incoming requests.
-	// A configurable number of threads (config.Config.RequestHandlerThreads) reads these channels and puts the requests
+	// A configurable number of threads (RequestHandlerThreads) reads these channels and puts the requests
 	// in corresponding Buffers. This indirection is required to avoid cache contention on the Buffer locks when there
 	// are many clients (more than the number of physical cores of the machine).
 	requestInputChannels []chan *pb.ClientRequest
@@ -63,48 +66,59 @@ type watermarkRange struct {
 	newWM int32
 }
 
-// Initialize the request package.
+// Initialize the request package with the given configuration.
+// The buckets, the buffers and the request handling goroutines are created with (and keep) this configuration.
 // Cannot be part of the init() function, as the configuration file is not yet loaded when init() is executed.
-func Init() {
+func Init(cfg *config.Configuration) {
 
 	// Initializes the Buckets.
-	Buckets = make([]*Bucket, config.Config.NumBuckets)
+	Buckets = make([]*Bucket, cfg.NumBuckets)
 	for i := range Buckets {
-		Buckets[i] = NewBucket(i)
+		Buckets[i] = NewBucket(i, cfg)
 	}
 
+	// Report the sizes of the buckets when the metrics are scraped.
+	metrics.BucketSize.SetFunc(bucketSizes)
+
+	// Initialize admission control and the request forwarding budget.
+	initAdmission(cfg)
+	initForwarding(cfg)
+
 	// Initialize request handler goroutines.
 	// These threads are reading incoming requests from (buffered) input channels and putting them in Buffers / Buckets.
 	// The gRPC threads (one per client) are writing these requests to the channels.
 	// The number of request handler threads is limited on purpose to avoid cache contention when accessing the Buffers.
 	// If the gRPC threads were to do this directly, cache contention could occur in deployments with many clients.
-	requestInputChannels = make([]chan *pb.ClientRequest, config.Config.RequestHandlerThreads, config.Config.RequestHandlerThreads)
-	for i := 0; i < config.Config.RequestHandlerThreads; i++ {
+	requestInputChannels = make([]chan *pb.ClientRequest, cfg.RequestHandlerThreads, cfg.RequestHandlerThreads)
+	for i := 0; i < cfg.RequestHandlerThreads; i++ {
 
 		// Create new request input channel and a thread that reads that reads requests from the channel
 		// and adds those requests to the corresponding Buffers
 		// TODO: Implement graceful shutdown!
-		requestInputChannels[i] = make(chan *pb.ClientRequest, config.Config.RequestInputChannelBuffer)
+		requestInputChannels[i] = make(chan *pb.ClientRequest, cfg.RequestInputChannelBuffer)
 		go func(i int) {
 			for req := range requestInputChannels[i] {
-				AddReqMsg(req)
+				handleClientRequest(req)
 			}
 		}(i)
 	}
 
-	if config.Config.BatchVerifier == "sequential" {
+	if !cfg.SignRequests {
+		// Requests are not signed. Accept all batches.
+		batchVerifierFunc = func(*Batch) bool { return true }
+	} else if cfg.BatchVerifier == "sequential" {
 		batchVerifierFunc = checkSignaturesSequential
-	} else if config.Config.BatchVerifier == "parallel" {
+	} else if cfg.BatchVerifier == "parallel" {
 		batchVerifierFunc = checkSignaturesParallel
-	} else if config.Config.BatchVerifier == "external" {
+	} else if cfg.BatchVerifier == "external" {
 		batchVerifierFunc = checkSignaturesExternal
 
 		// Initialize request verifier goroutines.
 		// These are a fixed number of threads only verifying request signatures.
 		// The capacity of the verifier channel buffer is chosen such that one full batch for each verifier fits inside.
 		// To stop the goroutines, close the verifier channel.
-		verifierChan = make(chan *Request, config.Config.BatchSize*config.Config.RequestHandlerThreads)
-		for i := 0; i < config.Config.RequestHandlerThreads; i++ {
+		verifierChan = make(chan *Request, cfg.BatchSize*cfg.RequestHandlerThreads)
+		for i := 0; i < cfg.RequestHandlerThreads; i++ {
 			go func() {
 
 				// Reads requests from the verifier channel,
@@ -121,7 +135,7 @@ func Init() {
 			}()
 		}
 	} else {
-		logger.Fatal().Str("name", config.Config.BatchVerifier).Msg("Unknown batch verifier.")
+		logger.Fatal().Str("name", cfg.BatchVerifier).Msg("Unknown batch verifier.")
 	}
 
 }
@@ -147,6 +161,18 @@ type Request struct {
 	// Flag indicating whether the request signature has been verified.
 	Verified bool
 
+	// Size of the request message in bytes. Counted towards the size limit of the buckets.
+	Size int
+
+	// Fee offered by the transaction in the request. Only set if fee-based eviction or fee priority is enabled.
+	Fee float64
+
+	// Time the request has been received. Used for bounding the time a request waits in fee priority mode.
+	Received time.Time
+
+	// Position of the request in the fee index of its bucket, plus one. 0 if the request is not in the fee index.
+	feePos int
+
 	// Request is "in flight", i.e., has been added to or observed in some (protocol-specific) proposal message.
 	// This flag tracks duplication.
 	// A request should be marked as in flight upon being either added to or upon encountered in a proposal message.
@@ -170,22 +196,40 @@ type Request struct {
 
 // Allocates a new Request object from a client request message and adds it by calling Add().
 func AddReqMsg(reqMsg *pb.ClientRequest) *Request {
+	return Add(newRequest(reqMsg))
+}
 
-	return Add(&Request{
+// Allocates a new Request object from a client request message.
+func newRequest(reqMsg *pb.ClientRequest) *Request {
+	bucket := getBucket(reqMsg)
+	req := &Request{
 		Msg:      reqMsg,
 		Digest:   Digest(reqMsg),
-		Buffer:   getBuffer(reqMsg.RequestId.ClientId),
-		Bucket:   getBucket(reqMsg),
+		Buffer:   getBuffer(reqMsg.RequestId.ClientId, bucket.cfg),
+		Bucket:   bucket,
 		Verified: true,  // signature has not yet been verified
 		InFlight: false, // request has not yet been proposed (an identical one might have been, though, in which case we discard this request object)
 		Next:     nil,   // This request object is not part of a bucket list.
 		Prev:     nil,
-	})
+		Size:     proto.Size(reqMsg),
+		Received: time.Now(),
+	}
+	if bucket.cfg.AdmissionFeeEviction || bucket.cfg.FeePriority {
+		req.Fee = requestFee(reqMsg)
+	}
+	return req
 }
 
 // Adds a request received as a protobuf message to the appropriate buffer and bucket.
 func Add(req *Request) *Request {
 
+	// Drop requests that can never be committed any more.
+	// This also garbage-collects expired requests from the Buffers' backlogs when re-adding them.
+	if expiredAtCommitted(req.Msg) {
+		reject(req.Msg, pb.ClientResponse_EXPIRED)
+		return nil
+	}
+
 	// The buffer needs to be Rlocked not only while checking watermarks, but also while adding the request to the Bucket!
 	req.Buffer.RLock()
 	defer req.Buffer.RUnlock()
@@ -273,6 +317,9 @@ func AdvanceWatermarks(entries []interface{}) { //expected type is []*log.Entry
 	buffersLock.RLock()
 	defer buffersLock.RUnlock()
 
+	// Requests expired at the end of the entries are dropped from the backlogs while the watermarks advance.
+	advanceCommittedSn(entries)
+
 	// This map stores, for each client, its old and its new watermark.
 	watermarks := &sync.Map{}
 
@@ -300,26 +347,29 @@ func AdvanceWatermarks(entries []interface{}) { //expected type is []*log.Entry
 		}(bucket)
 	}
 	wg.Wait()
+
+	// Garbage-collect the requests that expired before the end of the committed entries.
+	collectExpired()
 }
 
 // Returns a bucket to which the request message belongs.
 func getBucket(req *pb.ClientRequest) *Bucket {
-	// if config.Config.PrecomputeRequests {
+	// if cfg.PrecomputeRequests {
 	// 	return GetBucketByHashing(req)
 	// }
-	return Buckets[GetBucketNr(req.RequestId.ClientId, req.RequestId.ClientSn, req.RequestId.SenderId)]
+	return Buckets[GetBucketNr(req.RequestId.ClientId, req.RequestId.ClientSn, req.RequestId.SenderId, len(Buckets))]
 }
 
-// This is the hash function that computes the bucket number of a request.
+// This is the hash function that computes the bucket number of a request, given the total number of buckets.
 // This implementation assigns requests from the same client to buckets in a round-robin way.
-func GetBucketNr(clID int32, clSN int32, senderId int32) int {
-	// return int((clID + clSN) % int32(config.Config.NumBuckets))
-	return int(senderId % int32(config.Config.NumBuckets))
+func GetBucketNr(clID int32, clSN int32, senderId int32, numBuckets int) int {
+	// return int((clID + clSN) % int32(numBuckets))
+	return int(senderId % int32(numBuckets))
 }
 
 // Returns the request buffer associated with a client ID.
-// If the request buffer does not exist, allocates a new one.
-func getBuffer(clientID int32) *Buffer {
+// If the request buffer does not exist, allocates a new one with the given configuration.
+func getBuffer(clientID int32, cfg *config.Configuration) *Buffer {
 
 	// First, check if buffer is present only using a read lock.
 	// This check only fails for the very first request from a client (unless we implement client GC later).
@@ -341,7 +391,7 @@ func getBuffer(clientID int32) *Buffer {
 	if buf, ok := buffers[clientID]; ok {
 		return buf
 	} else {
-		newBuf := NewBuffer(clientID)
+		newBuf := NewBuffer(clientID, cfg)
 		buffers[clientID] = newBuf
 		return newBuf
 	}
@@ -365,6 +415,12 @@ func Digest(req *pb.ClientRequest) []byte {
 	buffer = append(buffer, id...)
 	buffer = append(buffer, req.Payload...)
 	buffer = append(buffer, req.Pubkey...)
+	// The expiry is only included if set, so digests of requests that never expire stay unchanged.
+	if req.ValidUntilSn != 0 {
+		validUntil := make([]byte, 4)
+		binary.LittleEndian.PutUint32(validUntil, uint32(req.ValidUntilSn))
+		buffer = append(buffer, validUntil...)
+	}
 	return crypto.Hash(buffer)
 }
 
@@ -21,7 +21,7 @@ import (
 	"strconv"
 
 	"github.com/golang/protobuf/proto"
-	"github.com/Hanzheng2021/Orthrus/config"
+	"github.com/Hanzheng2021/Orthrus/metrics"
 	"github.com/Hanzheng2021/Orthrus/tracing"
 
 	// "github.com/Hanzheng2021/Orthrus/crypto"
@@ -47,15 +47,17 @@ import (
 func HandleRequest(req *pb.ClientRequest) {
 
 	tracing.Trace2.EventForClientInPeer(tracing.REQ_RECEIVE, int64(req.RequestId.ClientSn), req.RequestId.ClientId)
+	tracing.RequestStage(req, tracing.StageReceive, -1)
+	metrics.RequestsReceived.Inc()
 
-	if config.Config.RequestHandlerThreads > 0 {
+	if threads := len(requestInputChannels); threads > 0 {
 		// Write request to the corresponding input channel for further processing by a request handler thread.
 		// There is a fixed number of request handler threads (should be at most as many as there are physical cores)
 		// to avoid cache contention on the request Buffers. To avoid this contention, it is also crucial that requests from
 		// the same client (there is a separate Buffer per client) are handled by the same request handler thread.
-		requestInputChannels[int(req.RequestId.ClientId)%config.Config.RequestHandlerThreads] <- req
+		requestInputChannels[int(req.RequestId.ClientId)%threads] <- req
 	} else {
-		AddReqMsg(req)
+		handleClientRequest(req)
 	}
 }
 
@@ -73,7 +75,7 @@ func GetBucketByHashing(req *pb.ClientRequest) *Bucket {
 	}
 
 	// fmt.Printf("bucket index i is %d\n", i)
-	b := Buckets[SID%config.Config.NumBuckets]
+	b := Buckets[SID%len(Buckets)]
 
 	return b
 }
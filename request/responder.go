@@ -19,6 +19,7 @@ import (
 
 	"github.com/Hanzheng2021/Orthrus/log"
 	"github.com/Hanzheng2021/Orthrus/messenger"
+	"github.com/Hanzheng2021/Orthrus/metrics"
 	pb "github.com/Hanzheng2021/Orthrus/protobufs"
 	"github.com/Hanzheng2021/Orthrus/tracing"
 	logger "github.com/rs/zerolog/log"
@@ -66,6 +67,8 @@ func (r *Responder) Start(wg *sync.WaitGroup) {
 				logger.Debug().Msg("commit a contract transaction.")
 				// Respond to the corresponding client.
 				tracing.Trace2.EventForClientInPeer(tracing.RESP_SEND, int64(req.RequestId.ClientSn), req.RequestId.ClientId)
+				tracing.RequestStage(req, tracing.StageRespond, e.Sn)
+				metrics.ResponsesSent.Inc(metrics.PathSlow)
 
 				messenger.RespondToClient(req.RequestId.ClientId, &pb.ClientResponse{
 					OrderSn:  e.Sn,
@@ -94,6 +97,8 @@ func (r *Responder) StartOutOfOrder(wg *sync.WaitGroup) {
 				logger.Debug().Msg("commit a payment transaction.")
 				// Respond to the corresponding client.
 				tracing.Trace2.EventForClientInPeer(tracing.RESP_SEND, int64(req.RequestId.ClientSn), req.RequestId.ClientId)
+				tracing.RequestStage(req, tracing.StageRespond, e.Sn)
+				metrics.ResponsesSent.Inc(metrics.PathFast)
 
 				messenger.RespondToClient(req.RequestId.ClientId, &pb.ClientResponse{
 					OrderSn:  e.Sn,
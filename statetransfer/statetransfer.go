@@ -67,7 +67,7 @@ func CatchUp(checkpoint *pb.StableCheckpoint) {
 	}
 
 	// Ask for each missing entry in parallel.
-	for _, sn := range log.Missing(checkpoint.Sn) {
+	for _, sn := range log.Missing(checkpoint.Sn, -1) {
 		go FetchMissingEntry(sn, sources)
 	}
 }
@@ -20,7 +20,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/Hanzheng2021/Orthrus/config"
 	"github.com/rs/zerolog"
 	logger "github.com/rs/zerolog/log"
 )
@@ -94,7 +93,7 @@ func (bt *BufferedTrace) Event(e EventType, sampledVal int64, val0 int64) {
 	if int(index) >= bt.BufferCapacity {
 		logger.Error().
 			Int32("index", index).
-			Int("capacity", config.Config.EventBufferSize).
+			Int("capacity", bt.BufferCapacity).
 			Msg("Trace event index exceeds capacity.")
 	}
 
@@ -133,7 +132,7 @@ func (bt *BufferedTrace) EventForClientInPeer(e EventType, sampledVal int64, cli
 	if int(index) >= bt.BufferCapacity {
 		logger.Error().
 			Int32("index", index).
-			Int("capacity", config.Config.EventBufferSize).
+			Int("capacity", bt.BufferCapacity).
 			Msg("Trace event index exceeds capacity.")
 	}
 
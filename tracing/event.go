@@ -41,6 +41,14 @@ const (
 	VIEW_CHANGE
 )
 
+// Values of val0 of REQ_SEND events, telling the kind of the submitted request.
+// Traces written before the kind of requests was recorded contain ReqKindUnknown.
+const (
+	ReqKindUnknown  int64 = 0
+	ReqKindPayment  int64 = 1 // Fast path.
+	ReqKindContract int64 = 2 // Slow path.
+)
+
 func (et EventType) String() string {
 	return [...]string{
 		"PROPOSE",
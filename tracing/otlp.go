@@ -0,0 +1,246 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	logger "github.com/rs/zerolog/log"
+)
+
+// Spans are exported in the JSON encoding of the OpenTelemetry protocol (OTLP),
+// i.e., as ExportTraceServiceRequest messages, which both OTLP/HTTP collectors and the OTLP file format accept.
+
+const (
+	// Maximal number of spans in one export.
+	spanBatchSize = 512
+
+	// Maximal time a span waits before being exported.
+	spanFlushPeriod = time.Second
+
+	// Capacity of the buffer of spans waiting to be exported.
+	// Spans recorded while the buffer is full are dropped rather than slowing down the caller.
+	spanBufferSize = 16384
+
+	// Timeout of a request to the collector.
+	collectorTimeout = 5 * time.Second
+)
+
+// OTLP span kinds.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// In OTLP JSON, 64-bit integers are encoded as decimal strings.
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue,omitempty"`
+	IntValue    string `json:"intValue,omitempty"`
+	BoolValue   bool   `json:"boolValue,omitempty"`
+}
+
+func stringAttr(key string, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}}
+}
+
+func intAttr(key string, value int64) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: strconv.FormatInt(value, 10)}}
+}
+
+func boolAttr(key string, value bool) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{BoolValue: value}}
+}
+
+func newOtlpSpan(traceID []byte, spanID []byte, parentSpanID []byte, name string, kind int, start int64, end int64) *otlpSpan {
+	return &otlpSpan{
+		TraceID:           hex.EncodeToString(traceID),
+		SpanID:            hex.EncodeToString(spanID),
+		ParentSpanID:      hex.EncodeToString(parentSpanID),
+		Name:              name,
+		Kind:              kind,
+		StartTimeUnixNano: strconv.FormatInt(start, 10),
+		EndTimeUnixNano:   strconv.FormatInt(end, 10),
+	}
+}
+
+// Collects spans and exports them in batches to a file and/or an OTLP/HTTP collector.
+type spanExporter struct {
+	resource  otlpResource
+	spans     chan *otlpSpan
+	done      chan struct{}
+	file      *os.File
+	collector string
+	client    *http.Client
+	dropped   int64 // Accessed atomically.
+
+	// Called before each flush, from the exporting goroutine.
+	onFlush func()
+}
+
+func newSpanExporter(resource otlpResource, fileName string, collector string) (*spanExporter, error) {
+	se := &spanExporter{
+		resource:  resource,
+		spans:     make(chan *otlpSpan, spanBufferSize),
+		done:      make(chan struct{}),
+		collector: collector,
+		client:    &http.Client{Timeout: collectorTimeout},
+	}
+	if fileName != "" {
+		var err error
+		if se.file, err = os.Create(fileName); err != nil {
+			return nil, err
+		}
+	}
+	go se.run()
+	return se, nil
+}
+
+// Enqueues a span for export. Never blocks.
+func (se *spanExporter) export(span *otlpSpan) {
+	select {
+	case se.spans <- span:
+	default:
+		atomic.AddInt64(&se.dropped, 1)
+	}
+}
+
+// Exports the remaining spans and closes the output file.
+// No span must be exported after stop has been called.
+func (se *spanExporter) stop() {
+	close(se.spans)
+	<-se.done
+	if dropped := atomic.LoadInt64(&se.dropped); dropped > 0 {
+		logger.Warn().Int64("spans", dropped).Msg("Dropped request spans, as the export buffer was full.")
+	}
+	if se.file != nil {
+		if err := se.file.Close(); err != nil {
+			logger.Error().Err(err).Msg("Could not close request span file.")
+		}
+	}
+}
+
+func (se *spanExporter) run() {
+	defer close(se.done)
+
+	ticker := time.NewTicker(spanFlushPeriod)
+	defer ticker.Stop()
+
+	batch := make([]*otlpSpan, 0, spanBatchSize)
+	for {
+		select {
+		case span, ok := <-se.spans:
+			if !ok {
+				se.flush(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) == spanBatchSize {
+				se.flush(batch)
+				batch = make([]*otlpSpan, 0, spanBatchSize)
+			}
+		case <-ticker.C:
+			if se.onFlush != nil {
+				se.onFlush()
+			}
+			se.flush(batch)
+			batch = make([]*otlpSpan, 0, spanBatchSize)
+		}
+	}
+}
+
+func (se *spanExporter) flush(batch []*otlpSpan) {
+	if len(batch) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(&otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource:   se.resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "orthrus"}, Spans: batch}},
+	}}})
+	if err != nil {
+		logger.Error().Err(err).Msg("Could not encode request spans.")
+		return
+	}
+
+	if se.file != nil {
+		if _, err := se.file.Write(append(data, '\n')); err != nil {
+			logger.Error().Err(err).Msg("Could not write request spans.")
+		}
+	}
+	if se.collector != "" {
+		resp, err := se.client.Post(se.collector, "application/json", bytes.NewReader(data))
+		if err != nil {
+			logger.Error().Err(err).Str("collector", se.collector).Msg("Could not send request spans.")
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			logger.Error().Int("status", resp.StatusCode).Str("collector", se.collector).Msg("Collector rejected request spans.")
+		}
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2022 IBM Corp. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/Hanzheng2021/Orthrus/protobufs"
+	logger "github.com/rs/zerolog/log"
+)
+
+// Request tracing follows single requests across the client and all peers.
+// As opposed to the event traces (MainTrace, Trace2), which record isolated events,
+// the spans of a traced request share a trace context that the client attaches to the request (ClientRequest.Trace).
+// - The client records a span for the whole request, from submission until it received enough responses,
+//   with an event for each response.
+// - Each peer records a span for its processing of the request, as a child of the client's span,
+//   with a child span for each stage of the processing (see Stage).
+// All spans are exported in the OTLP JSON format (see otlp.go).
+
+// A stage of the processing of a request at a peer.
+// The span of a stage covers the time from the end of the preceding stage until the end of this stage.
+// For example, the StagePrepare span covers the time from receiving the proposal to preparing the batch.
+// Stages are only recorded if they occur at the peer: e.g., only the leader proposes a batch,
+// only a PBFT orderer records the preprepare and prepare stages,
+// and a request the peer only learns about from the proposal has no receive stage.
+type Stage int
+
+const (
+	StageReceive    Stage = iota // The peer received the request from the client.
+	StagePropose                 // The peer proposed a batch containing the request.
+	StagePreprepare              // The peer accepted the proposal (PBFT preprepare) containing the request.
+	StagePrepare                 // The batch containing the request is prepared (PBFT).
+	StageCommit                  // The batch containing the request is committed (out of order).
+	StageDeliver                 // The batch containing the request is delivered (in sequence number order).
+	StageRespond                 // The peer sent the response to the client.
+	numStages
+)
+
+func (s Stage) String() string {
+	return [...]string{
+		"receive",
+		"propose",
+		"preprepare",
+		"prepare",
+		"commit",
+		"deliver",
+		"respond",
+	}[s]
+}
+
+// Time after which the stages of a request that never completed (i.e., was not delivered and responded to)
+// are exported anyway (marked as incomplete) and forgotten.
+const requestTraceTimeout = time.Minute
+
+// Set when request tracing is started. Requests are only traced at this node if exporter is not nil.
+var exporter *spanExporter
+
+// Attributes of the spans of this node.
+var ownNodeAttr otlpKeyValue
+
+// The stages recorded so far of each traced request, indexed by request ID.
+var requestStages = make(map[requestID]*stages)
+var requestStagesLock sync.Mutex
+
+type requestID struct {
+	clientID int32
+	clientSn int32
+}
+
+type stages struct {
+	trace      *pb.TraceContext
+	isContract int32
+	sn         int32
+	times      [numStages]int64 // Unix ns, 0 if the stage has not been recorded.
+	first      int64
+}
+
+// Starts exporting the spans of traced requests to the file fileName and/or to the OTLP/HTTP collector
+// at the URL collector (each only if not empty).
+// If fileName contains %d, it is replaced by nodeID.
+// service is the name of the exporting service (e.g. "orthrus-peer") and nodeID the ID of the peer or client.
+// Must be called before any other request tracing function. Does nothing if both fileName and collector are empty.
+func StartRequestTracing(service string, nodeID int32, fileName string, collector string) error {
+	if fileName == "" && collector == "" {
+		return nil
+	}
+	if strings.Contains(fileName, "%d") {
+		fileName = fmt.Sprintf(fileName, nodeID)
+	}
+
+	ownNodeAttr = intAttr("orthrus.node", int64(nodeID))
+	resource := otlpResource{Attributes: []otlpKeyValue{stringAttr("service.name", service), ownNodeAttr}}
+	se, err := newSpanExporter(resource, fileName, collector)
+	if err != nil {
+		return err
+	}
+	se.onFlush = pruneStages
+	exporter = se
+
+	logger.Info().
+		Str("file", fileName).
+		Str("collector", collector).
+		Msg("Exporting request spans.")
+	return nil
+}
+
+// Exports the spans not yet exported and stops request tracing.
+func StopRequestTracing() {
+	if exporter == nil {
+		return
+	}
+	exporter.stop()
+}
+
+// Returns true if spans of traced requests are being exported.
+func RequestTracingEnabled() bool {
+	return exporter != nil
+}
+
+// Returns a new trace context for a request to be traced.
+func NewTraceContext() *pb.TraceContext {
+	traceID := make([]byte, 16)
+	spanID := make([]byte, 8)
+	rand.Read(traceID)
+	rand.Read(spanID)
+	return &pb.TraceContext{TraceId: traceID, SpanId: spanID}
+}
+
+func newSpanID() []byte {
+	spanID := make([]byte, 8)
+	rand.Read(spanID)
+	return spanID
+}
+
+// The span of a traced request at the client. Not safe for concurrent use.
+type RequestSpan struct {
+	span *otlpSpan
+}
+
+// Starts the client span of a request carrying a trace context. Returns nil if the request is not traced.
+// All methods of RequestSpan can be called on nil.
+func StartRequestSpan(req *pb.ClientRequest) *RequestSpan {
+	if exporter == nil || req.Trace == nil {
+		return nil
+	}
+
+	now := time.Now().UnixNano()
+	span := newOtlpSpan(req.Trace.TraceId, req.Trace.SpanId, nil, "orthrus.request", spanKindClient, now, now)
+	span.Attributes = requestAttrs(req)
+	return &RequestSpan{span: span}
+}
+
+// Records the reception of a response from a peer.
+func (rs *RequestSpan) Response(peerID int32) {
+	if rs == nil {
+		return
+	}
+	rs.span.Events = append(rs.span.Events, otlpEvent{
+		TimeUnixNano: fmt.Sprint(time.Now().UnixNano()),
+		Name:         "response",
+		Attributes:   []otlpKeyValue{intAttr("orthrus.peer", int64(peerID))},
+	})
+}
+
+// Ends the span (when enough responses have been received) and exports it.
+func (rs *RequestSpan) End() {
+	if rs == nil {
+		return
+	}
+	rs.span.EndTimeUnixNano = fmt.Sprint(time.Now().UnixNano())
+	exporter.export(rs.span)
+}
+
+// Records that the request reached the given processing stage at this peer (see Stage).
+// sn is the sequence number the request is (being) committed at, or -1 if not known yet.
+// Once the request has been both delivered and responded to, the spans of the request at this peer are exported.
+// Does nothing if the request is not traced.
+func RequestStage(req *pb.ClientRequest, stage Stage, sn int32) {
+	if exporter == nil || req.Trace == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	id := requestID{clientID: req.RequestId.ClientId, clientSn: req.RequestId.ClientSn}
+
+	requestStagesLock.Lock()
+	s, ok := requestStages[id]
+	if !ok {
+		s = &stages{trace: req.Trace, isContract: req.IsContract, sn: -1, first: now}
+		requestStages[id] = s
+	}
+	if s.times[stage] == 0 {
+		s.times[stage] = now
+	}
+	if sn >= 0 {
+		s.sn = sn
+	}
+	complete := s.times[StageDeliver] != 0 && s.times[StageRespond] != 0
+	if complete {
+		delete(requestStages, id)
+	}
+	requestStagesLock.Unlock()
+
+	if complete {
+		exportStages(req, s, false)
+	}
+}
+
+// Records the same stage for all requests in a batch.
+func BatchStage(requests []*pb.ClientRequest, stage Stage, sn int32) {
+	if exporter == nil {
+		return
+	}
+	for _, req := range requests {
+		RequestStage(req, stage, sn)
+	}
+}
+
+// Exports and forgets the stages of requests that have not completed within requestTraceTimeout.
+func pruneStages() {
+	deadline := time.Now().Add(-requestTraceTimeout).UnixNano()
+	incomplete := make(map[requestID]*stages)
+
+	requestStagesLock.Lock()
+	for id, s := range requestStages {
+		if s.first < deadline {
+			incomplete[id] = s
+			delete(requestStages, id)
+		}
+	}
+	requestStagesLock.Unlock()
+
+	for id, s := range incomplete {
+		exportStages(&pb.ClientRequest{
+			RequestId:  &pb.RequestID{ClientId: id.clientID, ClientSn: id.clientSn},
+			IsContract: s.isContract,
+		}, s, true)
+	}
+}
+
+// Exports the span of the request at this peer and one child span for each recorded stage.
+func exportStages(req *pb.ClientRequest, s *stages, incomplete bool) {
+	start, end := int64(0), int64(0)
+	for _, t := range s.times {
+		if t != 0 && (start == 0 || t < start) {
+			start = t
+		}
+		if t > end {
+			end = t
+		}
+	}
+
+	peerSpanID := newSpanID()
+	peerSpan := newOtlpSpan(s.trace.TraceId, peerSpanID, s.trace.SpanId, "orthrus.peer", spanKindServer, start, end)
+	peerSpan.Attributes = append(requestAttrs(req), ownNodeAttr)
+	if s.sn >= 0 {
+		peerSpan.Attributes = append(peerSpan.Attributes, intAttr("orthrus.sn", int64(s.sn)))
+	}
+	if incomplete {
+		peerSpan.Attributes = append(peerSpan.Attributes, boolAttr("orthrus.incomplete", true))
+	}
+	exporter.export(peerSpan)
+
+	for stage := StageReceive; stage < numStages; stage++ {
+		if s.times[stage] == 0 {
+			continue
+		}
+		// The stage starts at the latest preceding stage that was recorded before it.
+		// E.g., the response to a payment is sent at commit, before delivery.
+		stageStart := int64(0)
+		for prev := StageReceive; prev < stage; prev++ {
+			if s.times[prev] != 0 && s.times[prev] <= s.times[stage] && s.times[prev] > stageStart {
+				stageStart = s.times[prev]
+			}
+		}
+		if stageStart == 0 {
+			// Nothing to measure for the first stage recorded.
+			continue
+		}
+		exporter.export(newOtlpSpan(s.trace.TraceId, newSpanID(), peerSpanID,
+			"orthrus."+stage.String(), spanKindInternal, stageStart, s.times[stage]))
+	}
+}
+
+func requestAttrs(req *pb.ClientRequest) []otlpKeyValue {
+	path := "fast"
+	if req.IsContract == 1 {
+		path = "slow"
+	}
+	return []otlpKeyValue{
+		intAttr("orthrus.client", int64(req.RequestId.ClientId)),
+		intAttr("orthrus.client_sn", int64(req.RequestId.ClientSn)),
+		stringAttr("orthrus.path", path),
+	}
+}
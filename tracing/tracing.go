@@ -25,22 +25,22 @@ var (
 	Trace2    Trace
 )
 
-// Initializes the main trace.
+// Initializes the main trace with the given configuration.
 // Cannot be part of the init() function, as the configuration file is not yet loaded when init() is executed.
-func Init() {
+func Init(c *config.Configuration) {
 	MainTrace = &BufferedTrace{
-		Sampling:       config.Config.TraceSampling,
-		BufferCapacity: config.Config.EventBufferSize,
-		//ProtocolEventCapacity: config.Config.EventBufferSize,
-		//RequestEventCapacity:  config.Config.EventBufferSize,
+		Sampling:       c.TraceSampling,
+		BufferCapacity: c.EventBufferSize,
+		//ProtocolEventCapacity: c.EventBufferSize,
+		//RequestEventCapacity:  c.EventBufferSize,
 		EthereumEventCapacity: 1024,
 	}
 
 	Trace2 = &BufferedTrace{
-		Sampling:              config.Config.ClientTraceSampling,
-		BufferCapacity:        config.Config.EventBufferSize,
-		ProtocolEventCapacity: config.Config.EventBufferSize,
-		RequestEventCapacity:  config.Config.EventBufferSize,
+		Sampling:              c.ClientTraceSampling,
+		BufferCapacity:        c.EventBufferSize,
+		ProtocolEventCapacity: c.EventBufferSize,
+		RequestEventCapacity:  c.EventBufferSize,
 		EthereumEventCapacity: 1024,
 	}
 }